@@ -0,0 +1,498 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+	"golang.org/x/crypto/bcrypt"
+)
+
+// Account deletion is retried automatically this many times, then waits for an admin
+const maxDeletionAttempts = 5
+
+// Longest accepted first or last name
+const maxNameLength = 100
+
+// deletionQueue delivers account deletion IDs to the deletion worker
+var deletionQueue = make(chan primitive.ObjectID, 64)
+
+// accountBlocked returns why the user may not sign in, or "" when they may
+func accountBlocked(user *User) string {
+	switch {
+	case user.DeletionRequestedAt != nil:
+		return "Account is being deleted"
+	case user.SuspendedAt != nil:
+		return "Account is suspended"
+	}
+	return ""
+}
+
+// handleUpdateProfile changes the user's first and last name
+func handleUpdateProfile(w http.ResponseWriter, r *http.Request) {
+	auth := authFromContext(r)
+	var body struct {
+		FirstName *string `json:"firstName"`
+		LastName  *string `json:"lastName"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+		JSONError(w, http.StatusBadRequest, "Invalid request body")
+		return
+	}
+	set := bson.M{}
+	for _, f := range []struct {
+		value *string
+		field string
+		label string
+	}{
+		{body.FirstName, "firstname", "First name"},
+		{body.LastName, "lastname", "Last name"},
+	} {
+		if f.value == nil {
+			continue
+		}
+		v := strings.TrimSpace(*f.value)
+		if v == "" || len([]rune(v)) > maxNameLength {
+			JSONError(w, http.StatusBadRequest, f.label+" must be 1-"+strconv.Itoa(maxNameLength)+" characters")
+			return
+		}
+		set[f.field] = v
+	}
+
+	// Only the changed fields are written, so a concurrent suspend or role change
+	// made by an admin is not overwritten with what we read
+	ctx, cancel := context.WithTimeout(r.Context(), 5*time.Second)
+	defer cancel()
+	var user User
+	filter := bson.M{"id": auth.UserID.Hex()}
+	var err error
+	if len(set) == 0 {
+		err = database.Collection("users").FindOne(ctx, filter).Decode(&user)
+	} else {
+		err = database.Collection("users").FindOneAndUpdate(ctx, filter, bson.M{"$set": set},
+			options.FindOneAndUpdate().SetReturnDocument(options.After)).Decode(&user)
+	}
+	if errors.Is(err, mongo.ErrNoDocuments) {
+		JSONError(w, http.StatusNotFound, "User not found")
+		return
+	}
+	if err != nil {
+		log.Printf("[account] profile update error for user=%s: %v", auth.UserID.Hex(), err)
+		JSONError(w, http.StatusInternalServerError, "Failed to update profile")
+		return
+	}
+	user.HasPassword = user.Password != ""
+	JSONResponse(w, http.StatusOK, map[string]interface{}{
+		"success": true,
+		"message": "Profile updated",
+		"user":    user,
+	})
+}
+
+// handleChangePassword sets a new password after checking the current one and signs
+// out every other session. Accounts without a password (Google, OIDC) set one via reset.
+func handleChangePassword(w http.ResponseWriter, r *http.Request) {
+	auth := authFromContext(r)
+	var body struct {
+		CurrentPassword string `json:"currentPassword"`
+		NewPassword     string `json:"newPassword"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+		JSONError(w, http.StatusBadRequest, "Invalid request body")
+		return
+	}
+	if len(body.NewPassword) < minPasswordLength {
+		JSONError(w, http.StatusBadRequest, "Password must be at least "+strconv.Itoa(minPasswordLength)+" characters")
+		return
+	}
+	user, err := GetUserByID(auth.UserID.Hex())
+	if err != nil {
+		JSONError(w, http.StatusNotFound, "User not found")
+		return
+	}
+	if user.Password == "" {
+		JSONError(w, http.StatusBadRequest, "Account has no password; use password reset to set one")
+		return
+	}
+	if bcrypt.CompareHashAndPassword([]byte(user.Password), []byte(body.CurrentPassword)) != nil {
+		JSONError(w, http.StatusForbidden, "Current password is incorrect")
+		return
+	}
+	hashed, err := bcrypt.GenerateFromPassword([]byte(body.NewPassword), bcrypt.DefaultCost)
+	if err != nil {
+		log.Printf("[account] hashing error: %v", err)
+		JSONError(w, http.StatusInternalServerError, "Internal server error")
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(r.Context(), 5*time.Second)
+	defer cancel()
+	if _, err := database.Collection("users").UpdateOne(ctx,
+		bson.M{"id": user.ID},
+		bson.M{"$set": bson.M{"password": string(hashed)}},
+	); err != nil {
+		log.Printf("[account] password update error for user=%s: %v", user.ID, err)
+		JSONError(w, http.StatusInternalServerError, "Failed to change password")
+		return
+	}
+	revoked, err := revokeSessions(bson.M{"user_id": auth.UserID, "_id": bson.M{"$ne": auth.SessionID}}, "password_changed")
+	if err != nil {
+		log.Printf("[account] failed to revoke sessions of user=%s: %v", user.ID, err)
+	}
+	JSONResponse(w, http.StatusOK, map[string]interface{}{
+		"success": true,
+		"message": "Password changed",
+		"revoked": revoked,
+	})
+}
+
+// handleDeleteAccount schedules deletion of the account and everything it owns.
+// Password accounts confirm with "password", the others with their "email".
+// The user is signed out at once; the data is removed by the deletion worker.
+func handleDeleteAccount(w http.ResponseWriter, r *http.Request) {
+	auth := authFromContext(r)
+	var body struct {
+		Password string `json:"password"`
+		Email    string `json:"email"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+		JSONError(w, http.StatusBadRequest, "Invalid request body")
+		return
+	}
+	user, err := GetUserByID(auth.UserID.Hex())
+	if err != nil {
+		JSONError(w, http.StatusNotFound, "User not found")
+		return
+	}
+	if user.Password != "" {
+		if bcrypt.CompareHashAndPassword([]byte(user.Password), []byte(body.Password)) != nil {
+			JSONError(w, http.StatusForbidden, "Password is incorrect")
+			return
+		}
+	} else if !strings.EqualFold(strings.TrimSpace(body.Email), user.Email) {
+		JSONError(w, http.StatusForbidden, "Type your email to confirm")
+		return
+	}
+
+	del, err := requestAccountDeletion(user)
+	if err != nil {
+		log.Printf("[account] deletion request error for user=%s: %v", user.ID, err)
+		JSONError(w, http.StatusInternalServerError, "Failed to delete account")
+		return
+	}
+	JSONResponse(w, http.StatusAccepted, map[string]interface{}{
+		"success":     true,
+		"message":     "Account scheduled for deletion",
+		"deletion_id": del.ID.Hex(),
+	})
+}
+
+// requestAccountDeletion blocks sign-in, revokes all sessions and queues the deletion.
+// Repeated requests return the deletion already in progress.
+func requestAccountDeletion(user *User) (*AccountDeletion, error) {
+	userID, err := primitive.ObjectIDFromHex(user.ID)
+	if err != nil {
+		return nil, err
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	now := time.Now()
+	if _, err := database.Collection("users").UpdateOne(ctx,
+		bson.M{"id": user.ID, "deletionrequestedat": nil},
+		bson.M{"$set": bson.M{"deletionrequestedat": now}},
+	); err != nil {
+		return nil, err
+	}
+	if _, err := revokeUserSessions(userID, "user_deleted"); err != nil {
+		return nil, err
+	}
+
+	// One deletion per user: upsert keyed on user_id, only inserting fields for a new one
+	var del AccountDeletion
+	err = database.Collection("account_deletions").FindOneAndUpdate(ctx,
+		bson.M{"user_id": userID, "status": bson.M{"$ne": DeletionDone}},
+		bson.M{"$setOnInsert": bson.M{
+			"_id":        primitive.NewObjectID(),
+			"status":     DeletionPending,
+			"attempts":   0,
+			"created_at": now,
+			"updated_at": now,
+		}},
+		options.FindOneAndUpdate().SetUpsert(true).SetReturnDocument(options.After),
+	).Decode(&del)
+	if err != nil {
+		return nil, err
+	}
+	if del.Status == DeletionPending {
+		enqueueDeletion(del.ID)
+	}
+	return &del, nil
+}
+
+// enqueueDeletion hands the deletion to the worker without blocking the caller
+func enqueueDeletion(id primitive.ObjectID) {
+	select {
+	case deletionQueue <- id:
+	default:
+		go func() { deletionQueue <- id }()
+	}
+}
+
+// startDeletionWorker processes deletionQueue and resumes deletions interrupted by a restart
+func startDeletionWorker() {
+	go func() {
+		for id := range deletionQueue {
+			runAccountDeletion(id)
+		}
+	}()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	coll := database.Collection("account_deletions")
+	if _, err := coll.UpdateMany(ctx,
+		bson.M{"status": DeletionRunning},
+		bson.M{"$set": bson.M{"status": DeletionPending, "updated_at": time.Now()}},
+	); err != nil {
+		log.Printf("[account] failed to reset running deletions: %v", err)
+		return
+	}
+	ids, err := coll.Distinct(ctx, "_id", bson.M{"status": DeletionPending})
+	if err != nil {
+		log.Printf("[account] failed to load pending deletions: %v", err)
+		return
+	}
+	for _, id := range ids {
+		if oid, ok := id.(primitive.ObjectID); ok {
+			enqueueDeletion(oid)
+		}
+	}
+	if len(ids) > 0 {
+		log.Printf("[account] resumed %d pending deletions", len(ids))
+	}
+}
+
+// runAccountDeletion claims a pending deletion and removes the account's data. Failures
+// are retried with backoff up to maxDeletionAttempts; after that the deletion stays
+// failed until an admin retries it.
+func runAccountDeletion(id primitive.ObjectID) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	var del AccountDeletion
+	err := database.Collection("account_deletions").FindOneAndUpdate(ctx,
+		bson.M{"_id": id, "status": DeletionPending},
+		bson.M{
+			"$set": bson.M{"status": DeletionRunning, "updated_at": time.Now()},
+			"$inc": bson.M{"attempts": 1},
+		},
+		options.FindOneAndUpdate().SetReturnDocument(options.After),
+	).Decode(&del)
+	cancel()
+	if err != nil {
+		if !errors.Is(err, mongo.ErrNoDocuments) {
+			log.Printf("[account] claim deletion %s failed: %v", id.Hex(), err)
+		}
+		return
+	}
+
+	removed, err := deleteAccountData(del.UserID)
+	set := bson.M{"removed": removed, "updated_at": time.Now()}
+	if err == nil {
+		set["status"] = DeletionDone
+		set["error"] = ""
+		set["finished_at"] = time.Now()
+		log.Printf("[account] deleted user=%s (attempt %d)", del.UserID.Hex(), del.Attempts)
+	} else {
+		set["error"] = err.Error()
+		if del.Attempts < maxDeletionAttempts {
+			set["status"] = DeletionPending
+			delay := time.Duration(1<<del.Attempts) * 30 * time.Second
+			time.AfterFunc(delay, func() { enqueueDeletion(id) })
+			log.Printf("[account] deletion of user=%s failed (attempt %d), retrying in %s: %v", del.UserID.Hex(), del.Attempts, delay, err)
+		} else {
+			set["status"] = DeletionFailed
+			log.Printf("[account] deletion of user=%s failed after %d attempts: %v", del.UserID.Hex(), del.Attempts, err)
+		}
+	}
+
+	ctx, cancel = context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if _, err := database.Collection("account_deletions").UpdateOne(ctx, bson.M{"_id": id}, bson.M{"$set": set}); err != nil {
+		log.Printf("[account] failed to record deletion %s: %v", id.Hex(), err)
+	}
+}
+
+// deleteAccountData removes everything the user owns, then the user. Every step is
+// idempotent, so a retry continues where a failed attempt stopped. Subscriptions are
+// kept for accounting but canceled; the user's name in the audit log is dropped.
+func deleteAccountData(userID primitive.ObjectID) (map[string]int64, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Minute)
+	defer cancel()
+	removed := map[string]int64{}
+	byUser := bson.M{"user_id": userID}
+
+	// Job work directories are on disk, collect them before the documents go
+	jobIDs, err := database.Collection("jobs").Distinct(ctx, "_id", byUser)
+	if err != nil {
+		return removed, fmt.Errorf("jobs: %w", err)
+	}
+	for _, id := range jobIDs {
+		if oid, ok := id.(primitive.ObjectID); ok {
+			os.RemoveAll(jobWorkDir(oid))
+		}
+	}
+	inputKeys, err := database.Collection("jobs").Distinct(ctx, "input_key", byUser)
+	if err != nil {
+		return removed, fmt.Errorf("jobs: %w", err)
+	}
+	for _, key := range inputKeys {
+		if k, ok := key.(string); ok {
+			if err := blobStore.Delete(ctx, k); err != nil {
+				return removed, fmt.Errorf("job input %s: %w", k, err)
+			}
+		}
+	}
+	exportIDs, err := database.Collection("data_exports").Distinct(ctx, "_id", byUser)
+	if err != nil {
+		return removed, fmt.Errorf("data_exports: %w", err)
+	}
+	for _, id := range exportIDs {
+		if oid, ok := id.(primitive.ObjectID); ok {
+			if err := blobStore.Delete(ctx, exportKey(userID, oid)); err != nil {
+				return removed, fmt.Errorf("export %s: %w", oid.Hex(), err)
+			}
+		}
+	}
+	partKeys, err := database.Collection("uploads").Distinct(ctx, "parts.key", byUser)
+	if err != nil {
+		return removed, fmt.Errorf("uploads: %w", err)
+	}
+	for _, key := range partKeys {
+		if k, ok := key.(string); ok {
+			if err := blobStore.Delete(ctx, k); err != nil {
+				return removed, fmt.Errorf("upload part %s: %w", k, err)
+			}
+		}
+	}
+	audioKeys, err := database.Collection("transcripts").Distinct(ctx, "audio.key", byUser)
+	if err != nil {
+		return removed, fmt.Errorf("transcripts: %w", err)
+	}
+	for _, key := range audioKeys {
+		if k, ok := key.(string); ok {
+			if err := blobStore.Delete(ctx, k); err != nil {
+				return removed, fmt.Errorf("audio %s: %w", k, err)
+			}
+		}
+	}
+
+	steps := []struct {
+		coll   string
+		filter bson.M
+	}{
+		{"sessions", byUser},
+		{"jobs", byUser},
+		{"data_exports", byUser},
+		{"uploads", byUser},
+		{"notes", byUser},
+		{"materials", byUser},
+		{"transcripts", byUser},
+		{"usage", byUser},
+		{"email_tokens", byUser},
+		{"login_challenges", byUser},
+		{"identities", byUser},
+		{"api_keys", byUser},
+		{"two_factor", bson.M{"_id": userID}},
+		{"oidc_states", bson.M{"link_user_id": userID}},
+	}
+	for _, s := range steps {
+		res, err := database.Collection(s.coll).DeleteMany(ctx, s.filter)
+		if err != nil {
+			return removed, fmt.Errorf("%s: %w", s.coll, err)
+		}
+		removed[s.coll] += res.DeletedCount
+	}
+
+	res, err := database.Collection("subscriptions").UpdateMany(ctx,
+		bson.M{"user_id": userID, "status": bson.M{"$in": []string{SubscriptionPending, SubscriptionActive}}},
+		bson.M{"$set": bson.M{"status": SubscriptionCanceled, "updated_at": time.Now()}},
+	)
+	if err != nil {
+		return removed, fmt.Errorf("subscriptions: %w", err)
+	}
+	removed["subscriptions_canceled"] = res.ModifiedCount
+	if _, err := database.Collection("audit_log").UpdateMany(ctx,
+		bson.M{"actor_id": userID},
+		bson.M{"$set": bson.M{"actor_email": ""}},
+	); err != nil {
+		return removed, fmt.Errorf("audit_log: %w", err)
+	}
+
+	if err := DeleteUser(userID); err != nil {
+		return removed, fmt.Errorf("users: %w", err)
+	}
+	return removed, nil
+}
+
+// handleAdminListDeletions lists account deletions, newest first. Query: status, page, limit.
+func handleAdminListDeletions(w http.ResponseWriter, r *http.Request) {
+	filter := bson.M{}
+	if status := r.URL.Query().Get("status"); status != "" {
+		filter["status"] = status
+	}
+	page, limit := pagination(r)
+	ctx, cancel := context.WithTimeout(r.Context(), 10*time.Second)
+	defer cancel()
+	deletions := []AccountDeletion{}
+	total, err := findPage(ctx, database.Collection("account_deletions"), filter, bson.D{{Key: "created_at", Value: -1}}, page, limit, &deletions)
+	if err != nil {
+		log.Printf("[admin] list deletions error: %v", err)
+		JSONError(w, http.StatusInternalServerError, "Failed to load deletions")
+		return
+	}
+	JSONSuccess(w, map[string]interface{}{
+		"deletions": deletions,
+		"total":     total,
+		"page":      page,
+		"limit":     limit,
+	})
+}
+
+// handleAdminRetryDeletion re-queues a failed account deletion with a fresh attempt budget
+func handleAdminRetryDeletion(w http.ResponseWriter, r *http.Request) {
+	id, err := primitive.ObjectIDFromHex(mux.Vars(r)["id"])
+	if err != nil {
+		JSONError(w, http.StatusBadRequest, "Invalid ID format")
+		return
+	}
+	ctx, cancel := context.WithTimeout(r.Context(), 5*time.Second)
+	defer cancel()
+	var del AccountDeletion
+	err = database.Collection("account_deletions").FindOneAndUpdate(ctx,
+		bson.M{"_id": id, "status": DeletionFailed},
+		bson.M{"$set": bson.M{"status": DeletionPending, "attempts": 0, "updated_at": time.Now()}},
+		options.FindOneAndUpdate().SetReturnDocument(options.After),
+	).Decode(&del)
+	if errors.Is(err, mongo.ErrNoDocuments) {
+		JSONError(w, http.StatusConflict, "Only failed deletions can be retried")
+		return
+	}
+	if err != nil {
+		JSONError(w, http.StatusInternalServerError, "Failed to retry deletion")
+		return
+	}
+	enqueueDeletion(del.ID)
+	auditLog(r, AuditDeletionRetry, del.UserID.Hex(), map[string]interface{}{"deletion_id": del.ID.Hex(), "error": del.Error})
+	JSONSuccess(w, map[string]interface{}{"deletion": del})
+}
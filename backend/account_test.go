@@ -0,0 +1,61 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// withAuth returns r as requireAuth would pass it on for the user
+func withAuth(r *http.Request, userID primitive.ObjectID) *http.Request {
+	return r.WithContext(context.WithValue(r.Context(), authContextKey{}, &AuthResult{UserID: userID, Role: RoleUser}))
+}
+
+func TestUpdateProfileWritesOnlyNames(t *testing.T) {
+	useTestDatabase(t)
+	ctx := t.Context()
+
+	userID := primitive.NewObjectID()
+	suspended := time.Now().Truncate(time.Millisecond)
+	if _, err := database.Collection("users").InsertOne(ctx, User{
+		ID: userID.Hex(), FirstName: "Ada", LastName: "Byron", Email: "ada@example.com",
+		Role: RoleTeacher, SuspendedAt: &suspended, SuspendReason: "chargeback",
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		body     string
+		code     int
+		wantLast string
+	}{
+		{`{"lastName": "  Lovelace "}`, http.StatusOK, "Lovelace"},
+		{`{}`, http.StatusOK, "Lovelace"},
+		{`{"lastName": "   "}`, http.StatusBadRequest, "Lovelace"},
+		{`{"lastName": "` + strings.Repeat("x", maxNameLength+1) + `"}`, http.StatusBadRequest, "Lovelace"},
+	}
+	for _, tt := range tests {
+		r := withAuth(httptest.NewRequest(http.MethodPut, "/api/user", strings.NewReader(tt.body)), userID)
+		w := httptest.NewRecorder()
+		handleUpdateProfile(w, r)
+		if w.Code != tt.code {
+			t.Fatalf("%s: status = %d, want %d (%s)", tt.body, w.Code, tt.code, w.Body)
+		}
+		user, err := GetUserByID(userID.Hex())
+		if err != nil {
+			t.Fatal(err)
+		}
+		if user.FirstName != "Ada" || user.LastName != tt.wantLast {
+			t.Fatalf("%s: name = %q %q", tt.body, user.FirstName, user.LastName)
+		}
+		// Fields the profile endpoint does not own are left as an admin set them
+		if user.Role != RoleTeacher || user.SuspendedAt == nil || user.SuspendReason != "chargeback" || user.Email != "ada@example.com" {
+			t.Fatalf("%s: other fields changed: %+v", tt.body, user)
+		}
+	}
+}
@@ -0,0 +1,410 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"log"
+	"net/http"
+	"regexp"
+	"strconv"
+	"time"
+
+	"github.com/gorilla/mux"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// impersonationTTL is the lifetime of a support session; it cannot be refreshed
+const impersonationTTL = 30 * time.Minute
+
+// Audit actions
+const (
+	AuditUserSuspend     = "user.suspend"
+	AuditUserUnsuspend   = "user.unsuspend"
+	AuditUserRole        = "user.role"
+	AuditUserQuotaReset  = "user.quota_reset"
+	AuditUserImpersonate = "user.impersonate"
+	AuditDeletionRetry   = "account_deletion.retry"
+)
+
+// auditLog records an admin action. A failed write is logged, not returned: the action
+// has already happened by then.
+func auditLog(r *http.Request, action, targetID string, details map[string]interface{}) {
+	auth := authFromContext(r)
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	entry := AuditEntry{
+		ID:         primitive.NewObjectID(),
+		ActorID:    auth.UserID,
+		ActorEmail: auth.Email,
+		Action:     action,
+		TargetID:   targetID,
+		Details:    details,
+		IP:         clientIP(r),
+		CreatedAt:  time.Now(),
+	}
+	if _, err := database.Collection("audit_log").InsertOne(ctx, entry); err != nil {
+		log.Printf("[audit] failed to record %s by %s on %s: %v", action, auth.Email, targetID, err)
+	}
+}
+
+// pagination reads page (from 1) and limit (default 20, at most 100) from the query
+func pagination(r *http.Request) (page, limit int) {
+	page, _ = strconv.Atoi(r.URL.Query().Get("page"))
+	limit, _ = strconv.Atoi(r.URL.Query().Get("limit"))
+	if page < 1 {
+		page = 1
+	}
+	if limit < 1 {
+		limit = 20
+	}
+	if limit > 100 {
+		limit = 100
+	}
+	return page, limit
+}
+
+// findPage runs a paginated query and decodes the documents into out
+func findPage(ctx context.Context, coll *mongo.Collection, filter bson.M, sort bson.D, page, limit int, out interface{}) (int64, error) {
+	total, err := coll.CountDocuments(ctx, filter)
+	if err != nil {
+		return 0, err
+	}
+	cursor, err := coll.Find(ctx, filter, options.Find().
+		SetSort(sort).
+		SetSkip(int64((page-1)*limit)).
+		SetLimit(int64(limit)))
+	if err != nil {
+		return 0, err
+	}
+	defer cursor.Close(ctx)
+	return total, cursor.All(ctx, out)
+}
+
+// adminTargetUser loads the user from the {id} route variable, writing 404 when missing
+func adminTargetUser(w http.ResponseWriter, r *http.Request) (*User, primitive.ObjectID, bool) {
+	id := mux.Vars(r)["id"]
+	userID, err := primitive.ObjectIDFromHex(id)
+	if err != nil {
+		JSONError(w, http.StatusBadRequest, "Invalid ID format")
+		return nil, primitive.NilObjectID, false
+	}
+	user, err := GetUserByID(id)
+	if err != nil {
+		JSONError(w, http.StatusNotFound, "User not found")
+		return nil, primitive.NilObjectID, false
+	}
+	return user, userID, true
+}
+
+// handleAdminListUsers lists users, newest first.
+// Query: q (email or name substring), role, status (active|suspended), page, limit.
+func handleAdminListUsers(w http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query()
+	filter := bson.M{}
+	if s := q.Get("q"); s != "" {
+		re := primitive.Regex{Pattern: regexp.QuoteMeta(s), Options: "i"}
+		filter["$or"] = []bson.M{{"email": re}, {"firstname": re}, {"lastname": re}}
+	}
+	switch role := q.Get("role"); role {
+	case "":
+	case RoleUser:
+		// Accounts created before roles have no role field
+		filter["role"] = bson.M{"$in": []interface{}{RoleUser, "", nil}}
+	default:
+		filter["role"] = role
+	}
+	switch q.Get("status") {
+	case "suspended":
+		filter["suspendedat"] = bson.M{"$ne": nil}
+	case "active":
+		filter["suspendedat"] = nil
+	}
+
+	page, limit := pagination(r)
+	ctx, cancel := context.WithTimeout(r.Context(), 10*time.Second)
+	defer cancel()
+	users := []User{}
+	total, err := findPage(ctx, database.Collection("users"), filter, bson.D{{Key: "createdat", Value: -1}}, page, limit, &users)
+	if err != nil {
+		log.Printf("[admin] list users error: %v", err)
+		JSONError(w, http.StatusInternalServerError, "Failed to load users")
+		return
+	}
+	for i := range users {
+		users[i].Role = normalizeRole(users[i].Role)
+	}
+	JSONSuccess(w, map[string]interface{}{
+		"users": users,
+		"total": total,
+		"page":  page,
+		"limit": limit,
+	})
+}
+
+// handleAdminGetUser returns a user with their plan, quota usage and recent monthly usage
+func handleAdminGetUser(w http.ResponseWriter, r *http.Request) {
+	user, userID, ok := adminTargetUser(w, r)
+	if !ok {
+		return
+	}
+	user.Role = normalizeRole(user.Role)
+	quota, err := quotaStatus(userID)
+	if err != nil {
+		log.Printf("[admin] quota status error for user=%s: %v", user.ID, err)
+		JSONError(w, http.StatusInternalServerError, "Failed to load usage")
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(r.Context(), 5*time.Second)
+	defer cancel()
+	history := []UsageRecord{}
+	cursor, err := database.Collection("usage").Find(ctx,
+		bson.M{"user_id": userID, "period": "month"},
+		options.Find().SetSort(bson.M{"key": -1}).SetLimit(12),
+	)
+	if err == nil {
+		err = cursor.All(ctx, &history)
+	}
+	if err != nil {
+		log.Printf("[admin] usage history error for user=%s: %v", user.ID, err)
+	}
+
+	plan, err := userPlan(userID)
+	if err != nil {
+		log.Printf("[admin] plan lookup error for user=%s: %v", user.ID, err)
+	}
+
+	JSONSuccess(w, map[string]interface{}{
+		"user":          user,
+		"plan":          plan,
+		"quota":         quota,
+		"usage_history": history,
+	})
+}
+
+// handleAdminSuspendUser blocks sign-in and signs the user out everywhere
+func handleAdminSuspendUser(w http.ResponseWriter, r *http.Request) {
+	user, userID, ok := adminTargetUser(w, r)
+	if !ok {
+		return
+	}
+	var body struct {
+		Reason string `json:"reason"`
+	}
+	json.NewDecoder(r.Body).Decode(&body)
+	if userID == authFromContext(r).UserID {
+		JSONError(w, http.StatusBadRequest, "You cannot suspend yourself")
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(r.Context(), 5*time.Second)
+	defer cancel()
+	now := time.Now()
+	if _, err := database.Collection("users").UpdateOne(ctx, bson.M{"id": user.ID},
+		bson.M{"$set": bson.M{"suspendedat": now, "suspendreason": body.Reason}},
+	); err != nil {
+		JSONError(w, http.StatusInternalServerError, "Failed to suspend user")
+		return
+	}
+	revoked, err := revokeUserSessions(userID, "user_suspended")
+	if err != nil {
+		log.Printf("[admin] failed to revoke sessions of user=%s: %v", user.ID, err)
+	}
+	auditLog(r, AuditUserSuspend, user.ID, map[string]interface{}{"reason": body.Reason, "sessions_revoked": revoked})
+	JSONResponse(w, http.StatusOK, map[string]interface{}{"success": true, "message": "User suspended"})
+}
+
+// handleAdminUnsuspendUser lets a suspended user sign in again
+func handleAdminUnsuspendUser(w http.ResponseWriter, r *http.Request) {
+	user, _, ok := adminTargetUser(w, r)
+	if !ok {
+		return
+	}
+	ctx, cancel := context.WithTimeout(r.Context(), 5*time.Second)
+	defer cancel()
+	if _, err := database.Collection("users").UpdateOne(ctx, bson.M{"id": user.ID},
+		bson.M{"$set": bson.M{"suspendedat": nil, "suspendreason": ""}},
+	); err != nil {
+		JSONError(w, http.StatusInternalServerError, "Failed to unsuspend user")
+		return
+	}
+	auditLog(r, AuditUserUnsuspend, user.ID, nil)
+	JSONResponse(w, http.StatusOK, map[string]interface{}{"success": true, "message": "User unsuspended"})
+}
+
+// handleAdminSetRole changes the user's role. The new role is in the user's tokens after
+// the next refresh; a demoted admin is signed out right away.
+func handleAdminSetRole(w http.ResponseWriter, r *http.Request) {
+	user, userID, ok := adminTargetUser(w, r)
+	if !ok {
+		return
+	}
+	var body struct {
+		Role string `json:"role"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&body); err != nil || !containsString(validRoles, body.Role) {
+		JSONError(w, http.StatusBadRequest, "role must be one of user, teacher, admin")
+		return
+	}
+	if userID == authFromContext(r).UserID && body.Role != RoleAdmin {
+		JSONError(w, http.StatusBadRequest, "You cannot remove your own admin role")
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(r.Context(), 5*time.Second)
+	defer cancel()
+	if _, err := database.Collection("users").UpdateOne(ctx, bson.M{"id": user.ID},
+		bson.M{"$set": bson.M{"role": body.Role}},
+	); err != nil {
+		JSONError(w, http.StatusInternalServerError, "Failed to update role")
+		return
+	}
+	previous := normalizeRole(user.Role)
+	if previous == RoleAdmin && body.Role != RoleAdmin {
+		revokeUserSessions(userID, "role_changed")
+	}
+	auditLog(r, AuditUserRole, user.ID, map[string]interface{}{"from": previous, "to": body.Role})
+	JSONResponse(w, http.StatusOK, map[string]interface{}{"success": true, "message": "Role updated", "role": body.Role})
+}
+
+// handleAdminResetQuota clears the user's usage counters for the current day, month or both
+func handleAdminResetQuota(w http.ResponseWriter, r *http.Request) {
+	user, userID, ok := adminTargetUser(w, r)
+	if !ok {
+		return
+	}
+	var body struct {
+		Period string `json:"period"` // daily|monthly|all (default)
+	}
+	json.NewDecoder(r.Body).Decode(&body)
+
+	day, month := usageKeys(time.Now())
+	var keys []bson.M
+	switch body.Period {
+	case PeriodDaily:
+		keys = []bson.M{{"period": "day", "key": day}}
+	case PeriodMonthly:
+		keys = []bson.M{{"period": "month", "key": month}}
+	case "", "all":
+		body.Period = "all"
+		keys = []bson.M{{"period": "day", "key": day}, {"period": "month", "key": month}}
+	default:
+		JSONError(w, http.StatusBadRequest, "period must be daily, monthly or all")
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(r.Context(), 5*time.Second)
+	defer cancel()
+	res, err := database.Collection("usage").DeleteMany(ctx, bson.M{"user_id": userID, "$or": keys})
+	if err != nil {
+		JSONError(w, http.StatusInternalServerError, "Failed to reset quota")
+		return
+	}
+	auditLog(r, AuditUserQuotaReset, user.ID, map[string]interface{}{"period": body.Period, "records": res.DeletedCount})
+	quota, _ := quotaStatus(userID)
+	JSONSuccess(w, map[string]interface{}{"quota": quota})
+}
+
+// handleAdminImpersonate issues a short support session acting as the user. It has no
+// refresh token, is marked in the JWT (claim "imp") and cannot reach the admin API or
+// the user's security settings.
+func handleAdminImpersonate(w http.ResponseWriter, r *http.Request) {
+	user, userID, ok := adminTargetUser(w, r)
+	if !ok {
+		return
+	}
+	var body struct {
+		Reason string `json:"reason"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&body); err != nil || body.Reason == "" {
+		JSONError(w, http.StatusBadRequest, "reason is required")
+		return
+	}
+	admin := authFromContext(r)
+	if userID == admin.UserID {
+		JSONError(w, http.StatusBadRequest, "You cannot impersonate yourself")
+		return
+	}
+	if user.SuspendedAt != nil {
+		JSONError(w, http.StatusConflict, "User is suspended")
+		return
+	}
+
+	unusable, err := randomToken(32)
+	if err != nil {
+		JSONError(w, http.StatusInternalServerError, "Internal server error")
+		return
+	}
+	now := time.Now()
+	s := Session{
+		ID:             primitive.NewObjectID(),
+		UserID:         userID,
+		RefreshHash:    hashToken(unusable),
+		UserAgent:      r.UserAgent(),
+		IP:             clientIP(r),
+		CreatedAt:      now,
+		LastUsedAt:     now,
+		ExpiresAt:      now.Add(impersonationTTL),
+		ImpersonatedBy: &admin.UserID,
+	}
+	ctx, cancel := context.WithTimeout(r.Context(), 5*time.Second)
+	defer cancel()
+	if _, err := database.Collection("sessions").InsertOne(ctx, s); err != nil {
+		JSONError(w, http.StatusInternalServerError, "Failed to start session")
+		return
+	}
+	token, err := signAccessToken(user, s.ID.Hex(), impersonationTTL, &admin.UserID)
+	if err != nil {
+		JSONError(w, http.StatusInternalServerError, "Failed to start session")
+		return
+	}
+	auditLog(r, AuditUserImpersonate, user.ID, map[string]interface{}{"reason": body.Reason, "session_id": s.ID.Hex()})
+	JSONSuccess(w, map[string]interface{}{
+		"token":      token,
+		"expires_in": int(impersonationTTL.Seconds()),
+		"session_id": s.ID.Hex(),
+		"user":       user,
+	})
+}
+
+// handleAdminAuditLog lists admin actions, newest first.
+// Query: actor (user id), target (user id), action, page, limit.
+func handleAdminAuditLog(w http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query()
+	filter := bson.M{}
+	if actor := q.Get("actor"); actor != "" {
+		id, err := primitive.ObjectIDFromHex(actor)
+		if err != nil {
+			JSONError(w, http.StatusBadRequest, "Invalid actor ID")
+			return
+		}
+		filter["actor_id"] = id
+	}
+	if target := q.Get("target"); target != "" {
+		filter["target_id"] = target
+	}
+	if action := q.Get("action"); action != "" {
+		filter["action"] = action
+	}
+
+	page, limit := pagination(r)
+	ctx, cancel := context.WithTimeout(r.Context(), 10*time.Second)
+	defer cancel()
+	entries := []AuditEntry{}
+	total, err := findPage(ctx, database.Collection("audit_log"), filter, bson.D{{Key: "created_at", Value: -1}}, page, limit, &entries)
+	if err != nil {
+		log.Printf("[admin] audit log error: %v", err)
+		JSONError(w, http.StatusInternalServerError, "Failed to load audit log")
+		return
+	}
+	JSONSuccess(w, map[string]interface{}{
+		"entries": entries,
+		"total":   total,
+		"page":    page,
+		"limit":   limit,
+	})
+}
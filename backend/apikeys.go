@@ -0,0 +1,246 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// API key scopes
+const (
+	ScopeTranscribe    = "transcribe"
+	ScopeGenerate      = "generate"
+	ScopeReadMaterials = "read-materials"
+)
+
+var validScopes = []string{ScopeTranscribe, ScopeGenerate, ScopeReadMaterials}
+
+// routeScopes declares which named routes accept API keys and the scope they need.
+// Every other route, account and admin settings included, is JWT-only.
+var routeScopes = map[string]string{
+	"transcribe":              ScopeTranscribe,
+	"transcribe-youtube":      ScopeTranscribe,
+	"job":                     ScopeTranscribe,
+	"upload-create":           ScopeTranscribe,
+	"upload":                  ScopeTranscribe,
+	"upload-patch":            ScopeTranscribe,
+	"upload-delete":           ScopeTranscribe,
+	"transcript-retranscribe": ScopeTranscribe,
+	"job-events":              ScopeTranscribe,
+	"job-export":              ScopeTranscribe,
+	"generate":                ScopeGenerate,
+	"generate-and-save":       ScopeGenerate,
+	"materials-list":          ScopeReadMaterials,
+	"material":                ScopeReadMaterials,
+	"notes-list":              ScopeReadMaterials,
+	"note":                    ScopeReadMaterials,
+	"transcripts-list":        ScopeReadMaterials,
+	"transcript":              ScopeReadMaterials,
+	"transcript-export":       ScopeReadMaterials,
+	"transcript-audio":        ScopeReadMaterials,
+	"transcript-audio-url":    ScopeReadMaterials,
+}
+
+// API keys look like spk_<8 prefix chars>_<secret>; the prefix stays visible in listings
+const (
+	apiKeyTag       = "spk_"
+	maxAPIKeys      = 20
+	apiKeyTouchStep = time.Minute // last_used_at is updated at most this often
+)
+
+// isAPIKey tells API keys apart from JWTs in the Authorization header
+func isAPIKey(token string) bool {
+	return strings.HasPrefix(token, apiKeyTag)
+}
+
+// apiKeyPrefix returns the visible part of a key ("spk_" and 8 characters)
+func apiKeyPrefix(key string) string {
+	if len(key) < len(apiKeyTag)+8 {
+		return ""
+	}
+	return key[:len(apiKeyTag)+8]
+}
+
+// authenticateAPIKey checks the key, its scope for the current route and the owner's
+// account, writing 401/403 on failure. The result carries the key's scopes.
+func authenticateAPIKey(w http.ResponseWriter, r *http.Request, key string) *AuthResult {
+	scope := ""
+	if route := mux.CurrentRoute(r); route != nil {
+		scope = routeScopes[route.GetName()]
+	}
+	if scope == "" {
+		JSONError(w, http.StatusForbidden, "API keys cannot access this endpoint")
+		return nil
+	}
+
+	ctx, cancel := context.WithTimeout(r.Context(), 5*time.Second)
+	defer cancel()
+	var k APIKey
+	now := time.Now()
+	err := database.Collection("api_keys").FindOne(ctx, bson.M{
+		"prefix":     apiKeyPrefix(key),
+		"hash":       hashToken(key),
+		"revoked_at": nil,
+	}).Decode(&k)
+	if err != nil || (k.ExpiresAt != nil && now.After(*k.ExpiresAt)) {
+		JSONError(w, http.StatusUnauthorized, "Invalid API key")
+		return nil
+	}
+	if !containsString(k.Scopes, scope) {
+		JSONError(w, http.StatusForbidden, "API key lacks the "+scope+" scope")
+		return nil
+	}
+	user, err := GetUserByID(k.UserID.Hex())
+	if err != nil || accountBlocked(user) != "" {
+		JSONError(w, http.StatusUnauthorized, "Invalid API key")
+		return nil
+	}
+
+	if k.LastUsedAt == nil || now.Sub(*k.LastUsedAt) > apiKeyTouchStep {
+		if _, err := database.Collection("api_keys").UpdateOne(ctx, bson.M{"_id": k.ID}, bson.M{"$set": bson.M{"last_used_at": now}}); err != nil {
+			log.Printf("[apikeys] failed to record use of key=%s: %v", k.ID.Hex(), err)
+		}
+	}
+	return &AuthResult{
+		UserID:   k.UserID,
+		Email:    user.Email,
+		Role:     normalizeRole(user.Role),
+		APIKeyID: &k.ID,
+		Scopes:   k.Scopes,
+	}
+}
+
+// handleListAPIKeys lists the user's keys, revoked ones included, newest first
+func handleListAPIKeys(w http.ResponseWriter, r *http.Request) {
+	auth := authFromContext(r)
+	ctx, cancel := context.WithTimeout(r.Context(), 5*time.Second)
+	defer cancel()
+	keys := []APIKey{}
+	cursor, err := database.Collection("api_keys").Find(ctx,
+		bson.M{"user_id": auth.UserID},
+		options.Find().SetSort(bson.M{"created_at": -1}),
+	)
+	if err == nil {
+		err = cursor.All(ctx, &keys)
+	}
+	if err != nil {
+		JSONError(w, http.StatusInternalServerError, "Failed to load API keys")
+		return
+	}
+	JSONSuccess(w, map[string]interface{}{"keys": keys, "scopes": validScopes})
+}
+
+// handleCreateAPIKey issues a key. The full key is returned only in this response.
+func handleCreateAPIKey(w http.ResponseWriter, r *http.Request) {
+	auth := authFromContext(r)
+	var body struct {
+		Name          string   `json:"name"`
+		Scopes        []string `json:"scopes"`
+		ExpiresInDays int      `json:"expiresInDays"` // 0 = no expiry
+	}
+	if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+		JSONError(w, http.StatusBadRequest, "Invalid request body")
+		return
+	}
+	body.Name = strings.TrimSpace(body.Name)
+	if body.Name == "" || len([]rune(body.Name)) > maxNameLength {
+		JSONError(w, http.StatusBadRequest, "Name must be 1-"+strconv.Itoa(maxNameLength)+" characters")
+		return
+	}
+	var scopes []string
+	for _, s := range body.Scopes {
+		if !containsString(validScopes, s) {
+			JSONError(w, http.StatusBadRequest, "Unknown scope "+strconv.Quote(s)+"; expected transcribe, generate or read-materials")
+			return
+		}
+		if !containsString(scopes, s) {
+			scopes = append(scopes, s)
+		}
+	}
+	if len(scopes) == 0 {
+		JSONError(w, http.StatusBadRequest, "At least one scope is required")
+		return
+	}
+	if body.ExpiresInDays < 0 {
+		JSONError(w, http.StatusBadRequest, "expiresInDays must not be negative")
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(r.Context(), 5*time.Second)
+	defer cancel()
+	active, err := database.Collection("api_keys").CountDocuments(ctx, bson.M{"user_id": auth.UserID, "revoked_at": nil})
+	if err != nil {
+		JSONError(w, http.StatusInternalServerError, "Failed to create API key")
+		return
+	}
+	if active >= maxAPIKeys {
+		JSONError(w, http.StatusConflict, "Too many API keys; revoke one first")
+		return
+	}
+
+	prefix, err := randomToken(6) // 8 characters
+	secret, err2 := randomToken(32)
+	if err != nil || err2 != nil {
+		JSONError(w, http.StatusInternalServerError, "Internal server error")
+		return
+	}
+	key := apiKeyTag + prefix + "_" + secret
+	now := time.Now()
+	k := APIKey{
+		ID:        primitive.NewObjectID(),
+		UserID:    auth.UserID,
+		Name:      body.Name,
+		Prefix:    apiKeyPrefix(key),
+		Hash:      hashToken(key),
+		Scopes:    scopes,
+		CreatedAt: now,
+	}
+	if body.ExpiresInDays > 0 {
+		exp := now.AddDate(0, 0, body.ExpiresInDays)
+		k.ExpiresAt = &exp
+	}
+	if _, err := database.Collection("api_keys").InsertOne(ctx, k); err != nil {
+		log.Printf("[apikeys] create error for user=%s: %v", auth.UserID.Hex(), err)
+		JSONError(w, http.StatusInternalServerError, "Failed to create API key")
+		return
+	}
+	JSONResponse(w, http.StatusCreated, map[string]interface{}{
+		"success": true,
+		"data":    k,
+		"key":     key,
+	})
+}
+
+// handleRevokeAPIKey revokes one of the user's keys; it stops working immediately
+func handleRevokeAPIKey(w http.ResponseWriter, r *http.Request) {
+	auth := authFromContext(r)
+	id, err := primitive.ObjectIDFromHex(mux.Vars(r)["id"])
+	if err != nil {
+		JSONError(w, http.StatusBadRequest, "Invalid ID format")
+		return
+	}
+	ctx, cancel := context.WithTimeout(r.Context(), 5*time.Second)
+	defer cancel()
+	res, err := database.Collection("api_keys").UpdateOne(ctx,
+		bson.M{"_id": id, "user_id": auth.UserID, "revoked_at": nil},
+		bson.M{"$set": bson.M{"revoked_at": time.Now()}},
+	)
+	if err != nil {
+		JSONError(w, http.StatusInternalServerError, "Failed to revoke API key")
+		return
+	}
+	if res.MatchedCount == 0 {
+		JSONError(w, http.StatusNotFound, "API key not found")
+		return
+	}
+	JSONResponse(w, http.StatusOK, map[string]interface{}{"success": true, "message": "API key revoked"})
+}
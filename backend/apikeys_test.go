@@ -0,0 +1,105 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/mux"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// apiKeyRouter serves a route of two scopes, a JWT-only named route and an unnamed
+// one behind requireAuth, like main does; the handlers answer with the caller's scopes
+func apiKeyRouter() *mux.Router {
+	scopes := func(w http.ResponseWriter, r *http.Request) {
+		JSONSuccess(w, map[string]interface{}{"scopes": authFromContext(r).Scopes})
+	}
+	r := mux.NewRouter()
+	r.HandleFunc("/api/transcribe", requireAuth(scopes)).Methods("POST").Name("transcribe")
+	r.HandleFunc("/api/notes", requireAuth(scopes)).Methods("GET").Name("notes-list")
+	r.HandleFunc("/api/user/api-keys", requireAuth(scopes)).Methods("GET").Name("api-keys")
+	r.HandleFunc("/api/user/profile", requireAuth(scopes)).Methods("GET")
+	return r
+}
+
+func withAPIKey(router http.Handler, method, path, key string) *httptest.ResponseRecorder {
+	r := httptest.NewRequest(method, path, nil)
+	r.Header.Set("Authorization", "Bearer "+key)
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, r)
+	return w
+}
+
+func TestAPIKeysRejectedOnUnscopedRoutes(t *testing.T) {
+	// Refused before the key is looked up, so no MongoDB is needed
+	router := apiKeyRouter()
+	for _, path := range []string{"/api/user/api-keys", "/api/user/profile"} {
+		w := withAPIKey(router, http.MethodGet, path, "spk_abcdefgh_secret")
+		if w.Code != http.StatusForbidden || !strings.Contains(w.Body.String(), "API keys cannot access this endpoint") {
+			t.Fatalf("%s = %d %s, want 403", path, w.Code, w.Body)
+		}
+	}
+	for route, scope := range routeScopes {
+		if !containsString(validScopes, scope) {
+			t.Errorf("route %s needs unknown scope %q", route, scope)
+		}
+	}
+}
+
+func TestAPIKeyScopes(t *testing.T) {
+	useTestDatabase(t)
+	ctx := t.Context()
+	userID := primitive.NewObjectID()
+	if _, err := database.Collection("users").InsertOne(ctx, User{ID: userID.Hex(), Email: "ada@example.com", EmailVerified: true, Role: RoleUser}); err != nil {
+		t.Fatal(err)
+	}
+
+	body := strings.NewReader(`{"name":"notes sync","scopes":["read-materials"]}`)
+	w := httptest.NewRecorder()
+	handleCreateAPIKey(w, withAuth(httptest.NewRequest(http.MethodPost, "/api/user/api-keys", body), userID))
+	if w.Code != http.StatusCreated {
+		t.Fatalf("create = %d %s", w.Code, w.Body)
+	}
+	var created struct {
+		Key  string `json:"key"`
+		Data APIKey `json:"data"`
+	}
+	json.Unmarshal(w.Body.Bytes(), &created)
+	router := apiKeyRouter()
+
+	w = withAPIKey(router, http.MethodGet, "/api/notes", created.Key)
+	if w.Code != http.StatusOK || !strings.Contains(w.Body.String(), `"read-materials"`) {
+		t.Fatalf("route in scope = %d %s, want 200 with the key's scopes", w.Code, w.Body)
+	}
+	w = withAPIKey(router, http.MethodPost, "/api/transcribe", created.Key)
+	if w.Code != http.StatusForbidden || !strings.Contains(w.Body.String(), "lacks the transcribe scope") {
+		t.Fatalf("route out of scope = %d %s, want 403", w.Code, w.Body)
+	}
+	if w := withAPIKey(router, http.MethodGet, "/api/user/api-keys", created.Key); w.Code != http.StatusForbidden {
+		t.Fatalf("JWT-only route = %d, want 403", w.Code)
+	}
+	forged := created.Data.Prefix + "_" + strings.Repeat("x", 43)
+	if w := withAPIKey(router, http.MethodGet, "/api/notes", forged); w.Code != http.StatusUnauthorized {
+		t.Fatalf("wrong secret = %d, want 401", w.Code)
+	}
+
+	// Expired and revoked keys stop working
+	past := time.Now().Add(-time.Minute)
+	database.Collection("api_keys").InsertOne(ctx, APIKey{ID: primitive.NewObjectID(), UserID: userID, Prefix: apiKeyPrefix("spk_expired0_old"), Hash: hashToken("spk_expired0_old"), Scopes: []string{ScopeReadMaterials}, ExpiresAt: &past})
+	if w := withAPIKey(router, http.MethodGet, "/api/notes", "spk_expired0_old"); w.Code != http.StatusUnauthorized {
+		t.Fatalf("expired key = %d, want 401", w.Code)
+	}
+	r := mux.SetURLVars(withAuth(httptest.NewRequest(http.MethodDelete, "/api/user/api-keys/"+created.Data.ID.Hex(), nil), userID), map[string]string{"id": created.Data.ID.Hex()})
+	w = httptest.NewRecorder()
+	handleRevokeAPIKey(w, r)
+	if w.Code != http.StatusOK {
+		t.Fatalf("revoke = %d %s", w.Code, w.Body)
+	}
+	if w := withAPIKey(router, http.MethodGet, "/api/notes", created.Key); w.Code != http.StatusUnauthorized {
+		t.Fatalf("revoked key = %d, want 401", w.Code)
+	}
+}
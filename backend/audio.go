@@ -0,0 +1,349 @@
+package main
+
+import (
+	"context"
+	"crypto/hmac"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"os/exec"
+	"path"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// Recordings are kept as mono 64 kbit/s AAC in MP4 with the index up front, which
+// every browser can seek in via range requests
+const (
+	audioContentType = "audio/mp4"
+	audioURLTTL      = 12 * time.Hour // long enough to listen through a lecture
+)
+
+// audioKey is where the recording of a transcript lives in the blob store
+func audioKey(userID, transcriptID primitive.ObjectID) string {
+	return "audio/" + userID.Hex() + "/" + transcriptID.Hex() + ".m4a"
+}
+
+// normalizeAudio re-encodes any input ffmpeg understands into the stored format
+func normalizeAudio(ctx context.Context, inputPath, outputPath string) error {
+	cmd := exec.CommandContext(ctx, "ffmpeg", "-y", "-i", inputPath, "-vn", "-ac", "1", "-c:a", "aac", "-b:a", "64k",
+		"-movflags", "+faststart", outputPath)
+	if out, err := cmd.CombinedOutput(); err != nil {
+		return fmt.Errorf("ffmpeg audio normalization failed: %w; output: %s", err, string(out))
+	}
+	return nil
+}
+
+// storeTranscriptAudio normalizes the job's input, uploads it and records it on the
+// transcript. Losing the recording does not lose the transcript, so callers only log errors.
+func storeTranscriptAudio(job *TranscriptionJob, workDir string) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 15*time.Minute)
+	defer cancel()
+
+	outPath := filepath.Join(workDir, "audio.m4a")
+	if err := normalizeAudio(ctx, job.InputPath, outPath); err != nil {
+		return err
+	}
+	defer os.Remove(outPath)
+	f, err := os.Open(outPath)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	info, err := f.Stat()
+	if err != nil {
+		return err
+	}
+
+	key := audioKey(job.UserID, job.TranscriptID)
+	if err := blobStore.Put(ctx, key, f, info.Size(), audioContentType); err != nil {
+		return err
+	}
+	audio := StoredAudio{Key: key, ContentType: audioContentType, Size: info.Size(), StoredAt: time.Now()}
+	res, err := database.Collection("transcripts").UpdateOne(ctx,
+		bson.M{"_id": job.TranscriptID},
+		bson.M{"$set": bson.M{"audio": audio}},
+	)
+	if err == nil && res.MatchedCount == 0 {
+		// The transcript was deleted while we were uploading
+		err = blobStore.Delete(ctx, key)
+	}
+	return err
+}
+
+// fetchStoredAudio downloads the job input from the blob store key to job.InputPath
+func fetchStoredAudio(job *TranscriptionJob, key, workDir string) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 15*time.Minute)
+	defer cancel()
+
+	if err := os.MkdirAll(workDir, 0o755); err != nil {
+		return err
+	}
+	body, err := blobStore.Open(ctx, key, 0, -1)
+	if err != nil {
+		if errors.Is(err, errBlobNotFound) {
+			return fmt.Errorf("stored audio is missing: %s", key)
+		}
+		return err
+	}
+	defer body.Close()
+
+	// Written under a temporary name so an interrupted download is fetched again
+	tmp := job.InputPath + ".part"
+	out, err := os.Create(tmp)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(out, body); err != nil {
+		out.Close()
+		os.Remove(tmp)
+		return err
+	}
+	if err := out.Close(); err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	return os.Rename(tmp, job.InputPath)
+}
+
+// deleteTranscriptAudio removes a stored recording; failures leave an orphaned blob only
+func deleteTranscriptAudio(ctx context.Context, audio *StoredAudio) {
+	if audio == nil || audio.Key == "" {
+		return
+	}
+	if err := blobStore.Delete(ctx, audio.Key); err != nil {
+		log.Printf("[audio] failed to delete %s: %v", audio.Key, err)
+	}
+}
+
+var errRangeUnsatisfiable = errors.New("range not satisfiable")
+
+// parseByteRange parses a single-range "bytes=" header against an object of size bytes.
+// ok is false when the header should be ignored (absent, malformed or multi-range);
+// errRangeUnsatisfiable means the range lies outside the object.
+func parseByteRange(header string, size int64) (start, length int64, ok bool, err error) {
+	spec, found := strings.CutPrefix(header, "bytes=")
+	if !found || strings.Contains(spec, ",") {
+		return 0, 0, false, nil
+	}
+	first, last, found := strings.Cut(strings.TrimSpace(spec), "-")
+	if !found {
+		return 0, 0, false, nil
+	}
+	if first == "" {
+		// Suffix range: the last n bytes
+		n, err := strconv.ParseInt(last, 10, 64)
+		if err != nil || n < 0 {
+			return 0, 0, false, nil
+		}
+		if n == 0 || size == 0 {
+			return 0, 0, false, errRangeUnsatisfiable
+		}
+		if n > size {
+			n = size
+		}
+		return size - n, n, true, nil
+	}
+	start, perr := strconv.ParseInt(first, 10, 64)
+	if perr != nil || start < 0 {
+		return 0, 0, false, nil
+	}
+	if start >= size {
+		return 0, 0, false, errRangeUnsatisfiable
+	}
+	end := size - 1
+	if last != "" {
+		e, perr := strconv.ParseInt(last, 10, 64)
+		if perr != nil || e < start {
+			return 0, 0, false, nil
+		}
+		if e < end {
+			end = e
+		}
+	}
+	return start, end - start + 1, true, nil
+}
+
+// handleTranscriptAudio streams the stored recording of a transcript, honouring Range.
+// It accepts either the owner's JWT / API key or a signed link from handleTranscriptAudioURL,
+// since <audio> elements cannot send an Authorization header.
+func handleTranscriptAudio(w http.ResponseWriter, r *http.Request) {
+	id, ok := transcriptIDFromRequest(w, r)
+	if !ok {
+		return
+	}
+	filter := bson.M{"_id": id}
+	if sig := r.URL.Query().Get("sig"); sig != "" {
+		expires, _ := strconv.ParseInt(r.URL.Query().Get("expires"), 10, 64)
+		if expires < time.Now().Unix() || !hmac.Equal([]byte(sig), []byte(urlSignature("audio", id, expires))) {
+			JSONError(w, http.StatusForbidden, "Audio link is invalid or expired")
+			return
+		}
+	} else {
+		auth := extractUserFromJWT(w, r)
+		if auth == nil {
+			return
+		}
+		filter["user_id"] = auth.UserID
+	}
+
+	ctx, cancel := context.WithTimeout(r.Context(), 5*time.Second)
+	var t Transcript
+	err := database.Collection("transcripts").FindOne(ctx, filter).Decode(&t)
+	cancel()
+	if err != nil {
+		JSONError(w, http.StatusNotFound, "Transcript not found")
+		return
+	}
+	if t.Audio == nil {
+		JSONError(w, http.StatusNotFound, "No audio stored for this transcript")
+		return
+	}
+
+	size := t.Audio.Size
+	start, length := int64(0), size
+	status := http.StatusOK
+	if rangeHeader := r.Header.Get("Range"); rangeHeader != "" {
+		s, l, ok, err := parseByteRange(rangeHeader, size)
+		if err != nil {
+			w.Header().Set("Content-Range", "bytes */"+strconv.FormatInt(size, 10))
+			JSONError(w, http.StatusRequestedRangeNotSatisfiable, "Requested range not satisfiable")
+			return
+		}
+		if ok {
+			start, length, status = s, l, http.StatusPartialContent
+			w.Header().Set("Content-Range", fmt.Sprintf("bytes %d-%d/%d", start, start+length-1, size))
+		}
+	}
+
+	w.Header().Set("Accept-Ranges", "bytes")
+	w.Header().Set("Content-Type", t.Audio.ContentType)
+	w.Header().Set("Content-Length", strconv.FormatInt(length, 10))
+	w.Header().Set("Cache-Control", "private, max-age=3600")
+	if r.Method == http.MethodHead {
+		w.WriteHeader(status)
+		return
+	}
+	body, err := blobStore.Open(r.Context(), t.Audio.Key, start, length)
+	if err != nil {
+		log.Printf("[audio] open %s: %v", t.Audio.Key, err)
+		w.Header().Del("Content-Range")
+		w.Header().Del("Content-Length")
+		JSONError(w, http.StatusNotFound, "Audio is not available")
+		return
+	}
+	defer body.Close()
+	w.WriteHeader(status)
+	if _, err := io.Copy(w, body); err != nil {
+		log.Printf("[audio] stream %s interrupted: %v", id.Hex(), err)
+	}
+}
+
+// handleRetranscribeTranscript queues a new transcription of the stored recording, e.g. in
+// another language; the result replaces the transcript's text once the job completes
+func handleRetranscribeTranscript(w http.ResponseWriter, r *http.Request) {
+	id, ok := transcriptIDFromRequest(w, r)
+	if !ok {
+		return
+	}
+	userID := authFromContext(r).UserID
+	if !requireQuota(w, userID, UsageAudio) {
+		return
+	}
+
+	// The body is optional: no language means auto-detection
+	var body struct {
+		Language string `json:"language"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&body); err != nil && !errors.Is(err, io.EOF) {
+		JSONError(w, http.StatusBadRequest, "Invalid request body")
+		return
+	}
+	if body.Language == "auto" {
+		body.Language = ""
+	}
+
+	t, err := GetTranscript(id, userID)
+	if err != nil {
+		JSONError(w, http.StatusNotFound, "Transcript not found")
+		return
+	}
+	if t.Audio == nil {
+		JSONError(w, http.StatusConflict, "No audio stored for this transcript")
+		return
+	}
+
+	job := &TranscriptionJob{
+		ID:           primitive.NewObjectID(),
+		UserID:       userID,
+		Source:       t.Source,
+		Filename:     path.Base(t.Audio.Key),
+		URL:          t.URL,
+		Size:         t.Audio.Size,
+		Duration:     t.Duration,
+		Language:     body.Language,
+		Mode:         "single",
+		TranscriptID: t.ID,
+		AudioKey:     t.Audio.Key,
+	}
+	if job.Size > longAudioThreshold {
+		job.Mode = "segmented"
+	}
+	// The recording is fetched by the worker, so any instance can pick the job up
+	job.InputPath = filepath.Join(jobWorkDir(job.ID), "input"+path.Ext(t.Audio.Key))
+	if err := CreateJob(job); err != nil {
+		log.Printf("Error creating re-transcription job: %v", err)
+		JSONError(w, http.StatusInternalServerError, "Failed to create transcription job")
+		return
+	}
+	enqueueJob(job.ID)
+
+	JSONResponse(w, http.StatusAccepted, map[string]interface{}{
+		"success":      true,
+		"jobId":        job.ID.Hex(),
+		"status":       job.Status,
+		"mode":         job.Mode,
+		"transcriptId": t.ID.Hex(),
+	})
+}
+
+// handleTranscriptAudioURL returns a signed, short-lived link to the recording for players
+func handleTranscriptAudioURL(w http.ResponseWriter, r *http.Request) {
+	id, ok := transcriptIDFromRequest(w, r)
+	if !ok {
+		return
+	}
+	auth := extractUserFromJWT(w, r)
+	if auth == nil {
+		return
+	}
+	t, err := GetTranscript(id, auth.UserID)
+	if err != nil {
+		JSONError(w, http.StatusNotFound, "Transcript not found")
+		return
+	}
+	if t.Audio == nil {
+		JSONError(w, http.StatusNotFound, "No audio stored for this transcript")
+		return
+	}
+	expires := time.Now().Add(audioURLTTL)
+	JSONSuccess(w, map[string]interface{}{
+		"url": "/api/transcripts/" + id.Hex() + "/audio?" + url.Values{
+			"expires": {strconv.FormatInt(expires.Unix(), 10)},
+			"sig":     {urlSignature("audio", id, expires.Unix())},
+		}.Encode(),
+		"expires_at":   expires,
+		"content_type": t.Audio.ContentType,
+		"size":         t.Audio.Size,
+	})
+}
@@ -0,0 +1,115 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/gorilla/mux"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+func TestParseByteRange(t *testing.T) {
+	tests := []struct {
+		header        string
+		start, length int64
+		ok            bool
+		err           error
+	}{
+		{"bytes=0-9", 0, 10, true, nil},
+		{"bytes=90-", 90, 10, true, nil},
+		{"bytes=95-200", 95, 5, true, nil}, // clamped to the object
+		{"bytes=-5", 95, 5, true, nil},
+		{"bytes=-500", 0, 100, true, nil},
+		{"bytes=100-", 0, 0, false, errRangeUnsatisfiable},
+		{"bytes=-0", 0, 0, false, errRangeUnsatisfiable},
+		{"bytes=0-1,5-6", 0, 0, false, nil}, // multi-range falls back to the whole object
+		{"bytes=9-3", 0, 0, false, nil},
+		{"items=0-9", 0, 0, false, nil},
+		{"", 0, 0, false, nil},
+	}
+	for _, tt := range tests {
+		start, length, ok, err := parseByteRange(tt.header, 100)
+		if start != tt.start || length != tt.length || ok != tt.ok || err != tt.err {
+			t.Errorf("parseByteRange(%q) = %d, %d, %v, %v; want %d, %d, %v, %v",
+				tt.header, start, length, ok, err, tt.start, tt.length, tt.ok, tt.err)
+		}
+	}
+}
+
+// retranscribe calls handleRetranscribeTranscript for transcript id as userID
+func retranscribe(t *testing.T, userID, id primitive.ObjectID, body string) (int, map[string]interface{}) {
+	t.Helper()
+	r := httptest.NewRequest(http.MethodPost, "/api/transcripts/"+id.Hex()+"/retranscribe", strings.NewReader(body))
+	r = mux.SetURLVars(withAuth(r, userID), map[string]string{"id": id.Hex()})
+	w := httptest.NewRecorder()
+	handleRetranscribeTranscript(w, r)
+	var resp map[string]interface{}
+	json.Unmarshal(w.Body.Bytes(), &resp)
+	return w.Code, resp
+}
+
+func TestRetranscribeFromStoredAudio(t *testing.T) {
+	useTestDatabase(t)
+	t.Setenv("JOBS_DIR", t.TempDir())
+	prevStore, prevTranscriber := blobStore, transcriber
+	blobStore = &LocalBlobStore{Dir: t.TempDir()}
+	transcriber = &FakeTranscriber{Text: "second pass"}
+	t.Cleanup(func() { blobStore, transcriber = prevStore, prevTranscriber })
+	ctx := t.Context()
+
+	userID := primitive.NewObjectID()
+	tr := &Transcript{ID: primitive.NewObjectID(), UserID: userID, Source: TranscriptSourceUpload, Title: "Lecture", Text: "first pass", Language: "ru"}
+	audio := []byte("stored recording")
+	tr.Audio = &StoredAudio{Key: audioKey(userID, tr.ID), ContentType: audioContentType, Size: int64(len(audio))}
+	if err := blobStore.Put(ctx, tr.Audio.Key, bytes.NewReader(audio), tr.Audio.Size, audioContentType); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := database.Collection("transcripts").InsertOne(ctx, tr); err != nil {
+		t.Fatal(err)
+	}
+
+	code, resp := retranscribe(t, userID, tr.ID, `{"language":"en"}`)
+	if code != http.StatusAccepted {
+		t.Fatalf("retranscribe = %d %v", code, resp)
+	}
+	jobID, _ := primitive.ObjectIDFromHex(resp["jobId"].(string))
+	job, err := GetJob(jobID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// The worker downloads the recording itself: nothing is on this instance's disk yet
+	if fileExists(job.InputPath) {
+		t.Fatal("the recording should be fetched by the worker")
+	}
+	if err := processTranscriptionJob(job); err != nil {
+		t.Fatal(err)
+	}
+
+	got, err := GetTranscript(tr.ID, userID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got.Text != "second pass" || got.Language != "en" || got.JobID != jobID {
+		t.Fatalf("transcript = %q (%s, job %s), want the new text in en", got.Text, got.Language, got.JobID.Hex())
+	}
+	if got.Title != "Lecture" || got.Audio == nil || got.Audio.Key != tr.Audio.Key {
+		t.Fatalf("title or audio changed: %+v", got)
+	}
+	if n, _ := database.Collection("transcripts").CountDocuments(ctx, bson.M{"user_id": userID}); n != 1 {
+		t.Fatalf("transcripts = %d, want the original one only", n)
+	}
+
+	// Another user's transcript and one without a recording are refused
+	if code, _ := retranscribe(t, primitive.NewObjectID(), tr.ID, ""); code != http.StatusNotFound {
+		t.Fatalf("someone else's transcript = %d, want 404", code)
+	}
+	database.Collection("transcripts").UpdateOne(ctx, bson.M{"_id": tr.ID}, bson.M{"$unset": bson.M{"audio": ""}})
+	if code, _ := retranscribe(t, userID, tr.ID, ""); code != http.StatusConflict {
+		t.Fatalf("transcript without audio = %d, want 409", code)
+	}
+}
@@ -1,6 +1,7 @@
 package main
 
 import (
+	"context"
 	"net/http"
 	"strings"
 
@@ -8,13 +9,21 @@ import (
 	"go.mongodb.org/mongo-driver/bson/primitive"
 )
 
-// AuthResult contains the result of JWT authentication
+// AuthResult contains the result of JWT or API key authentication
 type AuthResult struct {
-	UserID primitive.ObjectID
-	Email  string
+	UserID    primitive.ObjectID
+	Email     string
+	SessionID primitive.ObjectID // zero for API keys
+	Role      string
+	// ImpersonatorID is the admin acting as this user in a support session
+	ImpersonatorID *primitive.ObjectID
+	// APIKeyID and Scopes are set when the request used a personal API key
+	APIKeyID *primitive.ObjectID
+	Scopes   []string
 }
 
-// extractUserFromJWT extracts and validates JWT token from Authorization header
+// extractUserFromJWT extracts and validates the JWT or API key from the Authorization header.
+// API keys are accepted only on routes listed in routeScopes.
 // Returns user ID and email if valid, or writes error response and returns nil
 func extractUserFromJWT(w http.ResponseWriter, r *http.Request) *AuthResult {
 	authHeader := r.Header.Get("Authorization")
@@ -24,9 +33,12 @@ func extractUserFromJWT(w http.ResponseWriter, r *http.Request) *AuthResult {
 	}
 
 	tokenString := strings.TrimPrefix(authHeader, "Bearer ")
+	if isAPIKey(tokenString) {
+		return authenticateAPIKey(w, r, tokenString)
+	}
 	token, err := jwt.Parse(tokenString, func(token *jwt.Token) (interface{}, error) {
 		return jwtSecret, nil
-	})
+	}, jwt.WithValidMethods([]string{"HS256"}))
 
 	if err != nil || !token.Valid {
 		http.Error(w, "Invalid token", http.StatusUnauthorized)
@@ -53,8 +65,50 @@ func extractUserFromJWT(w http.ResponseWriter, r *http.Request) *AuthResult {
 		return nil
 	}
 
-	return &AuthResult{
-		UserID: userID,
-		Email:  email,
+	// Access tokens belong to a session that can be revoked (logout, device removal)
+	sidStr, _ := claims["sid"].(string)
+	sessionID, err := primitive.ObjectIDFromHex(sidStr)
+	if err != nil || !sessionActive(sessionID, userID) {
+		http.Error(w, "Session expired, please sign in again", http.StatusUnauthorized)
+		return nil
+	}
+
+	role, _ := claims["role"].(string)
+	auth := &AuthResult{
+		UserID:    userID,
+		Email:     email,
+		SessionID: sessionID,
+		Role:      normalizeRole(role),
+	}
+	if imp, ok := claims["imp"].(string); ok {
+		if adminID, err := primitive.ObjectIDFromHex(imp); err == nil {
+			auth.ImpersonatorID = &adminID
+		}
 	}
+	return auth
+}
+
+type authContextKey struct{}
+
+// requireAuth rejects requests without a valid JWT and passes the AuthResult
+// to the handler through the request context (see authFromContext)
+func requireAuth(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		// Already authenticated by entitlementMiddleware
+		if authFromContext(r) != nil {
+			next(w, r)
+			return
+		}
+		auth := extractUserFromJWT(w, r)
+		if auth == nil {
+			return
+		}
+		next(w, r.WithContext(context.WithValue(r.Context(), authContextKey{}, auth)))
+	}
+}
+
+// authFromContext returns the user authenticated by requireAuth
+func authFromContext(r *http.Request) *AuthResult {
+	auth, _ := r.Context().Value(authContextKey{}).(*AuthResult)
+	return auth
 }
@@ -0,0 +1,304 @@
+package main
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+var errBlobNotFound = errors.New("blob not found")
+
+// BlobStore keeps binary objects (recordings) under slash-separated keys.
+// Implementations must be safe for concurrent use.
+type BlobStore interface {
+	Name() string
+	// Put stores size bytes from r under key, replacing an existing object
+	Put(ctx context.Context, key string, r io.Reader, size int64, contentType string) error
+	// Open reads length bytes from offset; length < 0 reads to the end.
+	// Returns errBlobNotFound when the key does not exist.
+	Open(ctx context.Context, key string, offset, length int64) (io.ReadCloser, error)
+	// Delete removes the object; deleting a missing key is not an error
+	Delete(ctx context.Context, key string) error
+}
+
+// blobStore is the store selected at startup via BLOB_STORE
+var blobStore BlobStore
+
+// newBlobStoreFromEnv builds the store selected by BLOB_STORE (local|s3). There is no
+// default: recordings must outlive the instance, which a temp directory does not.
+// An unset BLOB_STORE with BLOB_DIR set means local.
+func newBlobStoreFromEnv() (BlobStore, error) {
+	switch kind := strings.ToLower(getEnvOrFile("BLOB_STORE")); kind {
+	case "", "local":
+		dir := getEnvOrFile("BLOB_DIR")
+		if dir == "" {
+			return nil, fmt.Errorf("blob store is not configured: set BLOB_DIR to a persistent directory or BLOB_STORE=s3")
+		}
+		return &LocalBlobStore{Dir: dir}, nil
+	case "s3":
+		s := &S3BlobStore{
+			Endpoint:  getEnvOrFile("S3_ENDPOINT"),
+			Region:    getEnvOrFile("S3_REGION"),
+			Bucket:    getEnvOrFile("S3_BUCKET"),
+			AccessKey: getEnvOrFile("S3_ACCESS_KEY_ID"),
+			SecretKey: getEnvOrFile("S3_SECRET_ACCESS_KEY"),
+			// Custom endpoints (MinIO and most S3-compatible services) use path-style URLs
+			PathStyle:  getEnvOrFile("S3_ENDPOINT") != "" && getEnvOrFile("S3_PATH_STYLE") != "false",
+			HTTPClient: &http.Client{Timeout: 10 * time.Minute},
+		}
+		if s.Region == "" {
+			s.Region = "us-east-1"
+		}
+		if s.Endpoint == "" {
+			s.Endpoint = "https://s3." + s.Region + ".amazonaws.com"
+		}
+		if s.Bucket == "" || s.AccessKey == "" || s.SecretKey == "" {
+			return nil, fmt.Errorf("BLOB_STORE=s3 requires S3_BUCKET, S3_ACCESS_KEY_ID and S3_SECRET_ACCESS_KEY")
+		}
+		return s, nil
+	default:
+		return nil, fmt.Errorf("unknown BLOB_STORE %q (expected local or s3)", kind)
+	}
+}
+
+// LocalBlobStore keeps objects as files under Dir
+type LocalBlobStore struct {
+	Dir string
+}
+
+func (s *LocalBlobStore) Name() string { return "local" }
+
+// path maps a key to a file under Dir, refusing keys that would escape it
+func (s *LocalBlobStore) path(key string) (string, error) {
+	p := filepath.Join(s.Dir, filepath.FromSlash(key))
+	if !strings.HasPrefix(p, filepath.Clean(s.Dir)+string(filepath.Separator)) {
+		return "", fmt.Errorf("invalid blob key %q", key)
+	}
+	return p, nil
+}
+
+func (s *LocalBlobStore) Put(ctx context.Context, key string, r io.Reader, size int64, contentType string) error {
+	p, err := s.path(key)
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(p), 0o700); err != nil {
+		return err
+	}
+	// Write to a temporary file first so readers never see a partial object
+	tmp, err := os.CreateTemp(filepath.Dir(p), ".upload-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := io.Copy(tmp, r); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), p)
+}
+
+func (s *LocalBlobStore) Open(ctx context.Context, key string, offset, length int64) (io.ReadCloser, error) {
+	p, err := s.path(key)
+	if err != nil {
+		return nil, err
+	}
+	f, err := os.Open(p)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, errBlobNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	if _, err := f.Seek(offset, io.SeekStart); err != nil {
+		f.Close()
+		return nil, err
+	}
+	if length < 0 {
+		return f, nil
+	}
+	return struct {
+		io.Reader
+		io.Closer
+	}{io.LimitReader(f, length), f}, nil
+}
+
+func (s *LocalBlobStore) Delete(ctx context.Context, key string) error {
+	p, err := s.path(key)
+	if err != nil {
+		return err
+	}
+	if err := os.Remove(p); err != nil && !errors.Is(err, os.ErrNotExist) {
+		return err
+	}
+	return nil
+}
+
+// S3BlobStore talks to S3 or an S3-compatible service (MinIO, R2, GCS interop) with
+// AWS Signature Version 4. Bodies are sent as UNSIGNED-PAYLOAD so uploads can stream.
+type S3BlobStore struct {
+	Endpoint   string // e.g. https://s3.eu-central-1.amazonaws.com or http://localhost:9000
+	Region     string
+	Bucket     string
+	AccessKey  string
+	SecretKey  string
+	PathStyle  bool // endpoint/bucket/key instead of bucket.endpoint/key
+	HTTPClient *http.Client
+}
+
+func (s *S3BlobStore) Name() string { return "s3" }
+
+// objectURL returns the URL of key in the bucket
+func (s *S3BlobStore) objectURL(key string) (*url.URL, error) {
+	u, err := url.Parse(s.Endpoint)
+	if err != nil {
+		return nil, err
+	}
+	path := "/" + key
+	if s.PathStyle {
+		path = "/" + s.Bucket + path
+	} else {
+		u.Host = s.Bucket + "." + u.Host
+	}
+	u.Path = path
+	u.RawPath = s3URIEncode(path)
+	return u, nil
+}
+
+// s3URIEncode percent-encodes everything but unreserved characters and slashes,
+// as SigV4 expects for S3 object paths
+func s3URIEncode(path string) string {
+	var b strings.Builder
+	for i := 0; i < len(path); i++ {
+		c := path[i]
+		if c == '/' || c == '-' || c == '_' || c == '.' || c == '~' ||
+			('a' <= c && c <= 'z') || ('A' <= c && c <= 'Z') || ('0' <= c && c <= '9') {
+			b.WriteByte(c)
+		} else {
+			fmt.Fprintf(&b, "%%%02X", c)
+		}
+	}
+	return b.String()
+}
+
+func hmacSHA256(key []byte, data string) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(data))
+	return mac.Sum(nil)
+}
+
+// sign adds SigV4 headers to req
+func (s *S3BlobStore) sign(req *http.Request, now time.Time) {
+	amzDate := now.UTC().Format("20060102T150405Z")
+	day := amzDate[:8]
+	req.Header.Set("x-amz-date", amzDate)
+	req.Header.Set("x-amz-content-sha256", "UNSIGNED-PAYLOAD")
+
+	signed := "host;x-amz-content-sha256;x-amz-date"
+	canonical := strings.Join([]string{
+		req.Method,
+		req.URL.EscapedPath(),
+		req.URL.Query().Encode(),
+		"host:" + req.URL.Host + "\n" +
+			"x-amz-content-sha256:UNSIGNED-PAYLOAD\n" +
+			"x-amz-date:" + amzDate + "\n",
+		signed,
+		"UNSIGNED-PAYLOAD",
+	}, "\n")
+	scope := day + "/" + s.Region + "/s3/aws4_request"
+	sum := sha256.Sum256([]byte(canonical))
+	toSign := "AWS4-HMAC-SHA256\n" + amzDate + "\n" + scope + "\n" + hex.EncodeToString(sum[:])
+
+	key := hmacSHA256([]byte("AWS4"+s.SecretKey), day)
+	key = hmacSHA256(key, s.Region)
+	key = hmacSHA256(key, "s3")
+	key = hmacSHA256(key, "aws4_request")
+	req.Header.Set("Authorization", fmt.Sprintf("AWS4-HMAC-SHA256 Credential=%s/%s, SignedHeaders=%s, Signature=%s",
+		s.AccessKey, scope, signed, hex.EncodeToString(hmacSHA256(key, toSign))))
+}
+
+// do signs and performs a request on key, turning error statuses into errors
+func (s *S3BlobStore) do(ctx context.Context, method, key string, body io.Reader, prepare func(*http.Request)) (*http.Response, error) {
+	u, err := s.objectURL(key)
+	if err != nil {
+		return nil, err
+	}
+	req, err := http.NewRequestWithContext(ctx, method, u.String(), body)
+	if err != nil {
+		return nil, err
+	}
+	if prepare != nil {
+		prepare(req)
+	}
+	s.sign(req, time.Now())
+	resp, err := s.HTTPClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode == http.StatusNotFound {
+		resp.Body.Close()
+		return nil, errBlobNotFound
+	}
+	if resp.StatusCode >= 300 {
+		msg, _ := io.ReadAll(io.LimitReader(resp.Body, 4096))
+		resp.Body.Close()
+		return nil, newHTTPStatusError(resp, msg)
+	}
+	return resp, nil
+}
+
+func (s *S3BlobStore) Put(ctx context.Context, key string, r io.Reader, size int64, contentType string) error {
+	resp, err := s.do(ctx, http.MethodPut, key, r, func(req *http.Request) {
+		req.ContentLength = size
+		req.Header.Set("Content-Type", contentType)
+	})
+	if err != nil {
+		return fmt.Errorf("s3 put %s: %w", key, err)
+	}
+	resp.Body.Close()
+	return nil
+}
+
+func (s *S3BlobStore) Open(ctx context.Context, key string, offset, length int64) (io.ReadCloser, error) {
+	resp, err := s.do(ctx, http.MethodGet, key, nil, func(req *http.Request) {
+		switch {
+		case length >= 0:
+			req.Header.Set("Range", "bytes="+strconv.FormatInt(offset, 10)+"-"+strconv.FormatInt(offset+length-1, 10))
+		case offset > 0:
+			req.Header.Set("Range", "bytes="+strconv.FormatInt(offset, 10)+"-")
+		}
+	})
+	if err != nil {
+		if errors.Is(err, errBlobNotFound) {
+			return nil, err
+		}
+		return nil, fmt.Errorf("s3 get %s: %w", key, err)
+	}
+	return resp.Body, nil
+}
+
+func (s *S3BlobStore) Delete(ctx context.Context, key string) error {
+	resp, err := s.do(ctx, http.MethodDelete, key, nil, nil)
+	if errors.Is(err, errBlobNotFound) {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("s3 delete %s: %w", key, err)
+	}
+	resp.Body.Close()
+	return nil
+}
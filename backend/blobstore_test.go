@@ -0,0 +1,311 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// testBlobStoreContract runs the behaviour every BlobStore must share against store,
+// with keys under prefix
+func testBlobStoreContract(t *testing.T, store BlobStore, prefix string) {
+	t.Helper()
+	ctx := context.Background()
+	key := prefix + "audio/user 1/rec+ü.m4a" // spaces and non-ASCII must survive the round trip
+	data := bytes.Repeat([]byte("0123456789"), 10)
+
+	read := func(offset, length int64) string {
+		t.Helper()
+		body, err := store.Open(ctx, key, offset, length)
+		if err != nil {
+			t.Fatalf("Open(%d, %d): %v", offset, length, err)
+		}
+		defer body.Close()
+		b, err := io.ReadAll(body)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return string(b)
+	}
+
+	if _, err := store.Open(ctx, key, 0, -1); !errors.Is(err, errBlobNotFound) {
+		t.Fatalf("Open of a missing key: err = %v, want errBlobNotFound", err)
+	}
+	if err := store.Put(ctx, key, bytes.NewReader(data), int64(len(data)), audioContentType); err != nil {
+		t.Fatal(err)
+	}
+	if got := read(0, -1); got != string(data) {
+		t.Fatalf("full read = %q", got)
+	}
+	if got := read(10, 5); got != "01234" {
+		t.Fatalf("ranged read = %q, want 01234", got)
+	}
+	if got := read(95, -1); got != "56789" {
+		t.Fatalf("read to the end = %q, want 56789", got)
+	}
+
+	if err := store.Put(ctx, key, strings.NewReader("v2"), 2, audioContentType); err != nil {
+		t.Fatal(err)
+	}
+	if got := read(0, -1); got != "v2" {
+		t.Fatalf("read after overwrite = %q, want v2", got)
+	}
+
+	if err := store.Delete(ctx, key); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := store.Open(ctx, key, 0, -1); !errors.Is(err, errBlobNotFound) {
+		t.Fatalf("Open after Delete: err = %v, want errBlobNotFound", err)
+	}
+	if err := store.Delete(ctx, key); err != nil {
+		t.Fatalf("Delete of a missing key: %v", err)
+	}
+}
+
+func TestLocalBlobStore(t *testing.T) {
+	store := &LocalBlobStore{Dir: t.TempDir()}
+	testBlobStoreContract(t, store, "")
+
+	for _, key := range []string{"../outside", "a/../../outside"} {
+		if err := store.Put(context.Background(), key, strings.NewReader("x"), 1, "text/plain"); err == nil {
+			t.Errorf("Put(%q) escaped the store directory", key)
+		}
+	}
+	if _, err := os.Stat(filepath.Join(filepath.Dir(store.Dir), "outside")); err == nil {
+		t.Fatal("a file was written outside the store directory")
+	}
+}
+
+// TestS3BlobStore runs against a real S3 API, e.g. MinIO:
+//
+//	S3_TEST_ENDPOINT=http://localhost:9000 S3_TEST_BUCKET=speakapper \
+//	S3_TEST_ACCESS_KEY_ID=minioadmin S3_TEST_SECRET_ACCESS_KEY=minioadmin go test -run BlobStore .
+func TestS3BlobStore(t *testing.T) {
+	endpoint := os.Getenv("S3_TEST_ENDPOINT")
+	if endpoint == "" {
+		t.Skip("S3_TEST_ENDPOINT is not set")
+	}
+	region := os.Getenv("S3_TEST_REGION")
+	if region == "" {
+		region = "us-east-1"
+	}
+	store := &S3BlobStore{
+		Endpoint:   endpoint,
+		Region:     region,
+		Bucket:     os.Getenv("S3_TEST_BUCKET"),
+		AccessKey:  os.Getenv("S3_TEST_ACCESS_KEY_ID"),
+		SecretKey:  os.Getenv("S3_TEST_SECRET_ACCESS_KEY"),
+		PathStyle:  true,
+		HTTPClient: &http.Client{Timeout: time.Minute},
+	}
+	testBlobStoreContract(t, store, fmt.Sprintf("test-%d/", time.Now().UnixNano()))
+}
+
+// fakeS3 is an in-memory, path-style S3 endpoint for one bucket that checks the
+// SigV4 signature of every request against what it actually received
+type fakeS3 struct {
+	*httptest.Server
+	bucket, region, accessKey, secretKey string
+
+	mu      sync.Mutex
+	objects map[string][]byte
+	ranges  []string // Range headers of GET requests
+}
+
+func newFakeS3(t *testing.T) *fakeS3 {
+	t.Helper()
+	f := &fakeS3{bucket: "speakapper", region: "eu-central-1", accessKey: "AKID", secretKey: "secret", objects: map[string][]byte{}}
+	f.Server = httptest.NewServer(http.HandlerFunc(f.serve))
+	t.Cleanup(f.Close)
+	return f
+}
+
+func (f *fakeS3) store() *S3BlobStore {
+	return &S3BlobStore{
+		Endpoint:   f.URL,
+		Region:     f.region,
+		Bucket:     f.bucket,
+		AccessKey:  f.accessKey,
+		SecretKey:  f.secretKey,
+		PathStyle:  true,
+		HTTPClient: f.Client(),
+	}
+}
+
+// signature recomputes the SigV4 signature of r from the server's side
+func (f *fakeS3) signature(r *http.Request) string {
+	amzDate := r.Header.Get("x-amz-date")
+	day := amzDate[:min(8, len(amzDate))]
+	canonical := strings.Join([]string{
+		r.Method,
+		r.URL.EscapedPath(),
+		r.URL.Query().Encode(),
+		"host:" + r.Host + "\nx-amz-content-sha256:" + r.Header.Get("x-amz-content-sha256") + "\nx-amz-date:" + amzDate + "\n",
+		"host;x-amz-content-sha256;x-amz-date",
+		r.Header.Get("x-amz-content-sha256"),
+	}, "\n")
+	sum := sha256.Sum256([]byte(canonical))
+	scope := day + "/" + f.region + "/s3/aws4_request"
+	key := hmacSHA256([]byte("AWS4"+f.secretKey), day)
+	for _, part := range []string{f.region, "s3", "aws4_request"} {
+		key = hmacSHA256(key, part)
+	}
+	sig := hmacSHA256(key, "AWS4-HMAC-SHA256\n"+amzDate+"\n"+scope+"\n"+hex.EncodeToString(sum[:]))
+	return "AWS4-HMAC-SHA256 Credential=" + f.accessKey + "/" + scope +
+		", SignedHeaders=host;x-amz-content-sha256;x-amz-date, Signature=" + hex.EncodeToString(sig)
+}
+
+func (f *fakeS3) serve(w http.ResponseWriter, r *http.Request) {
+	if r.Header.Get("Authorization") != f.signature(r) {
+		http.Error(w, "<Error><Code>SignatureDoesNotMatch</Code></Error>", http.StatusForbidden)
+		return
+	}
+	key, ok := strings.CutPrefix(r.URL.Path, "/"+f.bucket+"/")
+	if !ok {
+		http.Error(w, "<Error><Code>NoSuchBucket</Code></Error>", http.StatusNotFound)
+		return
+	}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	switch r.Method {
+	case http.MethodPut:
+		b, _ := io.ReadAll(r.Body)
+		f.objects[key] = b
+	case http.MethodGet:
+		obj, found := f.objects[key]
+		if !found {
+			http.Error(w, "<Error><Code>NoSuchKey</Code></Error>", http.StatusNotFound)
+			return
+		}
+		f.ranges = append(f.ranges, r.Header.Get("Range"))
+		if start, length, ok, _ := parseByteRange(r.Header.Get("Range"), int64(len(obj))); ok {
+			w.WriteHeader(http.StatusPartialContent)
+			w.Write(obj[start : start+length])
+			return
+		}
+		w.Write(obj)
+	case http.MethodDelete:
+		delete(f.objects, key)
+		w.WriteHeader(http.StatusNoContent)
+	}
+}
+
+func TestS3BlobStoreAgainstFake(t *testing.T) {
+	f := newFakeS3(t)
+	testBlobStoreContract(t, f.store(), "")
+
+	want := []string{"", "bytes=10-14", "bytes=95-", ""}
+	if strings.Join(f.ranges, ",") != strings.Join(want, ",") {
+		t.Fatalf("Range headers = %q, want %q", f.ranges, want)
+	}
+
+	// A wrong secret must be rejected, not mistaken for a missing object
+	s := f.store()
+	s.SecretKey = "wrong"
+	_, err := s.Open(context.Background(), "anything", 0, -1)
+	var statusErr *HTTPStatusError
+	if !errors.As(err, &statusErr) || statusErr.StatusCode != http.StatusForbidden {
+		t.Fatalf("Open with a wrong secret: err = %v, want a 403", err)
+	}
+}
+
+func TestS3ObjectURL(t *testing.T) {
+	tests := []struct {
+		endpoint  string
+		pathStyle bool
+		want      string
+	}{
+		{"http://localhost:9000", true, "http://localhost:9000/speakapper/audio/a%20b/%C3%BC%2B1.m4a"},
+		{"https://s3.eu-central-1.amazonaws.com", false, "https://speakapper.s3.eu-central-1.amazonaws.com/audio/a%20b/%C3%BC%2B1.m4a"},
+	}
+	for _, tt := range tests {
+		s := &S3BlobStore{Endpoint: tt.endpoint, Bucket: "speakapper", PathStyle: tt.pathStyle}
+		u, err := s.objectURL("audio/a b/ü+1.m4a")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := u.String(); got != tt.want {
+			t.Errorf("objectURL = %s, want %s", got, tt.want)
+		}
+	}
+}
+
+func TestNewBlobStoreFromEnv(t *testing.T) {
+	tests := []struct {
+		name     string
+		env      map[string]string
+		wantName string
+		wantErr  string
+	}{
+		{name: "nothing configured", wantErr: "not configured"},
+		{name: "local without a directory", env: map[string]string{"BLOB_STORE": "local"}, wantErr: "BLOB_DIR"},
+		{name: "directory implies local", env: map[string]string{"BLOB_DIR": "/var/lib/blobs"}, wantName: "local"},
+		{name: "explicit local", env: map[string]string{"BLOB_STORE": "LOCAL", "BLOB_DIR": "/var/lib/blobs"}, wantName: "local"},
+		{name: "s3", env: map[string]string{
+			"BLOB_STORE": "s3", "S3_BUCKET": "b", "S3_ACCESS_KEY_ID": "k", "S3_SECRET_ACCESS_KEY": "s",
+		}, wantName: "s3"},
+		{name: "s3 without credentials", env: map[string]string{"BLOB_STORE": "s3", "S3_BUCKET": "b"}, wantErr: "S3_ACCESS_KEY_ID"},
+		{name: "unknown", env: map[string]string{"BLOB_STORE": "gcs"}, wantErr: "unknown BLOB_STORE"},
+	}
+	vars := []string{"BLOB_STORE", "BLOB_DIR", "S3_ENDPOINT", "S3_REGION", "S3_BUCKET", "S3_ACCESS_KEY_ID", "S3_SECRET_ACCESS_KEY", "S3_PATH_STYLE"}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			for _, v := range vars {
+				t.Setenv(v, tt.env[v])
+				t.Setenv(v+"_FILE", "")
+			}
+			store, err := newBlobStoreFromEnv()
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Fatalf("error = %v, want it to contain %q", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if store.Name() != tt.wantName {
+				t.Fatalf("store = %s, want %s", store.Name(), tt.wantName)
+			}
+		})
+	}
+}
+
+func TestS3BlobStoreDefaults(t *testing.T) {
+	t.Setenv("BLOB_STORE", "s3")
+	t.Setenv("S3_BUCKET", "b")
+	t.Setenv("S3_ACCESS_KEY_ID", "k")
+	t.Setenv("S3_SECRET_ACCESS_KEY", "s")
+	t.Setenv("S3_ENDPOINT", "")
+	t.Setenv("S3_REGION", "")
+	store, err := newBlobStoreFromEnv()
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := store.(*S3BlobStore)
+	if s.Endpoint != "https://s3.us-east-1.amazonaws.com" || s.Region != "us-east-1" || s.PathStyle {
+		t.Fatalf("AWS defaults = %+v", s)
+	}
+
+	// A custom endpoint switches to path-style URLs unless told otherwise
+	t.Setenv("S3_ENDPOINT", "http://localhost:9000")
+	if store, _ = newBlobStoreFromEnv(); !store.(*S3BlobStore).PathStyle {
+		t.Fatal("custom endpoint should use path-style URLs")
+	}
+	t.Setenv("S3_PATH_STYLE", "false")
+	if store, _ = newBlobStoreFromEnv(); store.(*S3BlobStore).PathStyle {
+		t.Fatal("S3_PATH_STYLE=false should use virtual-hosted URLs")
+	}
+}
@@ -0,0 +1,368 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"html"
+	"io"
+	"log"
+	"net/http"
+	"os/exec"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+)
+
+// Captions policies: which YouTube subtitles may replace Whisper. Set per request
+// ("captions") or for all requests with YOUTUBE_CAPTIONS.
+const (
+	CaptionsOff    = "off"
+	CaptionsManual = "manual" // human-made subtitles only (default)
+	CaptionsAuto   = "auto"   // human-made, then YouTube's automatic captions
+)
+
+// Job modes of transcripts taken from YouTube instead of Whisper
+const (
+	ModeCaptions     = "captions"
+	ModeAutoCaptions = "auto-captions"
+)
+
+// Captions are good enough when they cover most of the video with actual text
+const (
+	minCaptionCoverage = 0.5
+	minCaptionWords    = 20
+	maxCaptionBytes    = 10 << 20
+)
+
+// Caption formats we can parse, in order of preference
+var captionFormats = []string{"vtt", "srv3", "srv2", "srv1"}
+
+var errNoCaptions = errors.New("no suitable captions")
+
+func validCaptionsPolicy(p string) bool {
+	return p == CaptionsOff || p == CaptionsManual || p == CaptionsAuto
+}
+
+// captionsPolicy resolves the policy of a job: its own, YOUTUBE_CAPTIONS, or manual
+func captionsPolicy(requested string) string {
+	if validCaptionsPolicy(requested) {
+		return requested
+	}
+	if p := strings.ToLower(getEnvOrFile("YOUTUBE_CAPTIONS")); validCaptionsPolicy(p) {
+		return p
+	}
+	return CaptionsManual
+}
+
+// captionTrack is one downloadable format of a subtitle track in yt-dlp's info JSON
+type captionTrack struct {
+	Ext  string `json:"ext"`
+	URL  string `json:"url"`
+	Name string `json:"name"`
+}
+
+// ytInfo is the part of `yt-dlp -J` output we use
+type ytInfo struct {
+	Title             string                    `json:"title"`
+	Duration          float64                   `json:"duration"`
+	Language          string                    `json:"language"` // original language, often empty
+	Subtitles         map[string][]captionTrack `json:"subtitles"`
+	AutomaticCaptions map[string][]captionTrack `json:"automatic_captions"`
+}
+
+// youtubeCaptions is a transcript built from existing subtitles
+type youtubeCaptions struct {
+	Mode     string // captions|auto-captions
+	Language string
+	Duration float64
+	Segments []TranscriptSegment
+}
+
+// fetchYouTubeCaptions returns the video's subtitles in language ("" = the video's own)
+// when policy allows them and they are good enough, errNoCaptions otherwise
+func fetchYouTubeCaptions(videoURL, language, policy string) (*youtubeCaptions, error) {
+	if err := checkYouTubeURL(videoURL); err != nil {
+		return nil, err
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Minute)
+	defer cancel()
+
+	info, err := fetchYouTubeInfo(ctx, videoURL)
+	if err != nil {
+		return nil, err
+	}
+	tracks, mode, lang := chooseCaptionTrack(info, language, policy)
+	if tracks == nil {
+		return nil, errNoCaptions
+	}
+	segments, err := downloadCaptionTrack(ctx, tracks)
+	if err != nil {
+		return nil, err
+	}
+	if !captionsUsable(segments, info.Duration) {
+		return nil, fmt.Errorf("%w: %s track %q covers too little of the video", errNoCaptions, mode, lang)
+	}
+	duration := info.Duration
+	if duration == 0 {
+		duration = segments[len(segments)-1].End
+	}
+	log.Printf("YouTube transcribe: using %s (%s), %d segments", mode, lang, len(segments))
+	return &youtubeCaptions{Mode: mode, Language: lang, Duration: duration, Segments: segments}, nil
+}
+
+// fetchYouTubeInfo reads the video's metadata, subtitle tracks included, without
+// downloading any media. "--" keeps the URL from being read as an option.
+func fetchYouTubeInfo(ctx context.Context, videoURL string) (*ytInfo, error) {
+	args := append([]string{"-J", "--skip-download", "--no-playlist", "--no-warnings"}, ytdlpCookieFileArgs()...)
+	args = append(args, "--", videoURL)
+	cmd := exec.CommandContext(ctx, ytdlpBin(), args...)
+	var stderr bytes.Buffer
+	cmd.Stderr = &stderr
+	out, err := cmd.Output()
+	if err != nil {
+		return nil, fmt.Errorf("yt-dlp -J failed: %w; output: %s", err, strings.TrimSpace(stderr.String()))
+	}
+	var info ytInfo
+	if err := json.Unmarshal(out, &info); err != nil {
+		return nil, fmt.Errorf("yt-dlp -J returned invalid JSON: %w", err)
+	}
+	return &info, nil
+}
+
+// baseLang reduces "en-US", "en_GB" or "en-orig" to "en"
+func baseLang(code string) string {
+	code = strings.ToLower(code)
+	if i := strings.IndexAny(code, "-_"); i >= 0 {
+		code = code[:i]
+	}
+	return code
+}
+
+// chooseCaptionTrack picks human-made subtitles in language, then, if policy allows,
+// YouTube's speech recognition in the video's original language. Automatic tracks in
+// other languages are machine translations and never used.
+func chooseCaptionTrack(info *ytInfo, language, policy string) (tracks []captionTrack, mode, lang string) {
+	lang = baseLang(language)
+	if lang == "" {
+		lang = baseLang(info.Language)
+	}
+
+	manual := make([]string, 0, len(info.Subtitles))
+	for key := range info.Subtitles {
+		if key != "live_chat" {
+			manual = append(manual, key)
+		}
+	}
+	sort.Strings(manual) // "en" before "en-GB"
+	for _, key := range manual {
+		if baseLang(key) == lang {
+			return info.Subtitles[key], ModeCaptions, lang
+		}
+	}
+	if lang == "" && len(manual) == 1 {
+		return info.Subtitles[manual[0]], ModeCaptions, baseLang(manual[0])
+	}
+
+	if policy != CaptionsAuto || lang == "" {
+		return nil, "", ""
+	}
+	if t, ok := info.AutomaticCaptions[lang+"-orig"]; ok {
+		return t, ModeAutoCaptions, lang
+	}
+	if t, ok := info.AutomaticCaptions[lang]; ok && baseLang(info.Language) == lang {
+		return t, ModeAutoCaptions, lang
+	}
+	return nil, "", ""
+}
+
+// downloadCaptionTrack fetches the best parseable format of a track
+func downloadCaptionTrack(ctx context.Context, tracks []captionTrack) ([]TranscriptSegment, error) {
+	for _, ext := range captionFormats {
+		for _, t := range tracks {
+			if t.Ext != ext || t.URL == "" {
+				continue
+			}
+			data, err := fetchCaption(ctx, t.URL)
+			if err != nil {
+				return nil, err
+			}
+			if ext == "vtt" {
+				return parseVTT(string(data)), nil
+			}
+			return parseSRV(data)
+		}
+	}
+	return nil, fmt.Errorf("%w: no vtt or srv format offered", errNoCaptions)
+}
+
+func fetchCaption(ctx context.Context, captionURL string) ([]byte, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, captionURL, nil)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("downloading captions: %w", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("downloading captions: status %d", resp.StatusCode)
+	}
+	return io.ReadAll(io.LimitReader(resp.Body, maxCaptionBytes))
+}
+
+// captionsUsable rejects empty, nearly empty and truncated tracks
+func captionsUsable(segments []TranscriptSegment, duration float64) bool {
+	if len(segments) == 0 {
+		return false
+	}
+	words := 0
+	for _, s := range segments {
+		words += len(strings.Fields(s.Text))
+	}
+	if words < minCaptionWords {
+		return false
+	}
+	return duration <= 0 || segments[len(segments)-1].End >= duration*minCaptionCoverage
+}
+
+var (
+	captionTagRe   = regexp.MustCompile(`<[^>]*>`)
+	vttTimestampRe = regexp.MustCompile(`^((?:\d+:)?\d{1,2}:\d{2}\.\d{3})\s+-->\s+((?:\d+:)?\d{1,2}:\d{2}\.\d{3})`)
+)
+
+// cleanCaptionText strips markup (<c>, inline timestamps, <font>) and entities
+func cleanCaptionText(s string) string {
+	s = html.UnescapeString(captionTagRe.ReplaceAllString(s, ""))
+	return strings.Join(strings.Fields(s), " ")
+}
+
+// parseVTTTime parses "01:02:03.456" or "02:03.456" into seconds
+func parseVTTTime(s string) float64 {
+	var secs float64
+	for _, part := range strings.Split(s, ":") {
+		v, _ := strconv.ParseFloat(part, 64)
+		secs = secs*60 + v
+	}
+	return secs
+}
+
+// parseVTT turns WebVTT cues into segments. YouTube's automatic captions repeat the
+// previous line at the top of every cue ("roll-up"), so repeated lines are dropped.
+func parseVTT(data string) []TranscriptSegment {
+	var segments []TranscriptSegment
+	lastLine := ""
+	blocks := strings.Split(strings.ReplaceAll(data, "\r\n", "\n"), "\n\n")
+	for _, block := range blocks {
+		lines := strings.Split(strings.TrimSpace(block), "\n")
+		timing := -1
+		for i, l := range lines {
+			if vttTimestampRe.MatchString(l) {
+				timing = i
+				break
+			}
+		}
+		if timing < 0 {
+			continue // header, NOTE, STYLE
+		}
+		m := vttTimestampRe.FindStringSubmatch(lines[timing])
+		var text []string
+		for _, l := range lines[timing+1:] {
+			l = cleanCaptionText(l)
+			if l == "" || l == lastLine {
+				continue
+			}
+			text = append(text, l)
+			lastLine = l
+		}
+		if len(text) == 0 {
+			continue
+		}
+		segments = append(segments, TranscriptSegment{
+			Start: parseVTTTime(m[1]),
+			End:   parseVTTTime(m[2]),
+			Text:  strings.Join(text, " "),
+		})
+	}
+	return segments
+}
+
+// srvCue is a cue of YouTube's timedtext XML: srv1 <text start dur> (seconds),
+// srv2 <text t d> and srv3 <p t d> (milliseconds)
+type srvCue struct {
+	Start string `xml:"start,attr"`
+	Dur   string `xml:"dur,attr"`
+	T     string `xml:"t,attr"`
+	D     string `xml:"d,attr"`
+	Inner string `xml:",innerxml"`
+}
+
+// parseSRV turns srv1/srv2/srv3 timedtext into segments
+func parseSRV(data []byte) ([]TranscriptSegment, error) {
+	var doc struct {
+		Texts []srvCue `xml:"text"`
+		Paras []srvCue `xml:"body>p"`
+	}
+	if err := xml.Unmarshal(data, &doc); err != nil {
+		return nil, fmt.Errorf("parsing timedtext: %w", err)
+	}
+	var segments []TranscriptSegment
+	for _, c := range append(doc.Texts, doc.Paras...) {
+		text := cleanCaptionText(c.Inner)
+		if text == "" {
+			continue
+		}
+		var start, dur float64
+		if c.T != "" {
+			t, _ := strconv.ParseFloat(c.T, 64)
+			d, _ := strconv.ParseFloat(c.D, 64)
+			start, dur = t/1000, d/1000
+		} else {
+			start, _ = strconv.ParseFloat(c.Start, 64)
+			dur, _ = strconv.ParseFloat(c.Dur, 64)
+			// srv1 escapes HTML inside the XML escaping ("&amp;#39;")
+			text = html.UnescapeString(text)
+		}
+		segments = append(segments, TranscriptSegment{Start: start, End: start + dur, Text: text})
+	}
+	return segments, nil
+}
+
+// finishWithCaptions completes a YouTube job from its subtitles without downloading
+// audio. Plans still cap the video length; no audio minutes are used.
+func finishWithCaptions(job *TranscriptionJob, caps *youtubeCaptions) error {
+	job.Duration = caps.Duration
+	if !job.UserID.IsZero() {
+		plan, err := userPlan(job.UserID)
+		if err != nil {
+			return err
+		}
+		if err := checkAudioLength(plan, entitlementsFor(plan), job.Duration); err != nil {
+			return err
+		}
+	}
+
+	texts := make([]string, len(caps.Segments))
+	for i, s := range caps.Segments {
+		texts[i] = s.Text
+	}
+	job.Mode = caps.Mode
+	job.Segments = caps.Segments
+	job.Transcript = strings.Join(texts, " ")
+	if err := UpdateJob(job.ID, bson.M{"duration": job.Duration}); err != nil {
+		return err
+	}
+	if err := completeJob(job, caps.Language); err != nil {
+		return err
+	}
+	cleanupJob(job)
+	return nil
+}
@@ -0,0 +1,242 @@
+package main
+
+import (
+	"math"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// captionFixture reads testdata/captions/<name>
+func captionFixture(t *testing.T, name string) []byte {
+	t.Helper()
+	b, err := os.ReadFile(filepath.Join("testdata", "captions", name))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return b
+}
+
+func sameSegments(got, want []TranscriptSegment) bool {
+	if len(got) != len(want) {
+		return false
+	}
+	for i := range got {
+		if got[i].Text != want[i].Text || math.Abs(got[i].Start-want[i].Start) > 1e-9 || math.Abs(got[i].End-want[i].End) > 1e-9 {
+			return false
+		}
+	}
+	return true
+}
+
+func TestParseVTT(t *testing.T) {
+	tests := []struct {
+		name string
+		data string
+		want []TranscriptSegment
+	}{
+		{
+			name: "manual subtitles",
+			data: string(captionFixture(t, "manual.vtt")),
+			want: []TranscriptSegment{
+				{Start: 1, End: 3.5, Text: "Hello & welcome"},
+				{Start: 3.5, End: 6, Text: "to the lecture on engines."},
+				{Start: 3723.456, End: 3725, Text: "Later on"},
+			},
+		},
+		{
+			name: "automatic captions roll up",
+			data: string(captionFixture(t, "auto.vtt")),
+			want: []TranscriptSegment{
+				{Start: 0, End: 2.31, Text: "so today we're"},
+				{Start: 2.32, End: 4.55, Text: "going to talk"},
+				{Start: 4.56, End: 6.8, Text: "about engines"},
+			},
+		},
+		{
+			name: "CRLF line endings",
+			data: "WEBVTT\r\n\r\n00:01.000 --> 00:02.500\r\nShort timestamps\r\n",
+			want: []TranscriptSegment{{Start: 1, End: 2.5, Text: "Short timestamps"}},
+		},
+		{
+			name: "no cues",
+			data: "WEBVTT\n\nNOTE nothing here\n",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := parseVTT(tt.data); !sameSegments(got, tt.want) {
+				t.Fatalf("segments = %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestParseSRV(t *testing.T) {
+	// srv1 counts in seconds, srv2 and srv3 in milliseconds; all three say the same
+	want := []TranscriptSegment{
+		{Start: 1, End: 3.5, Text: "Hello & welcome"},
+		{Start: 3.5, End: 6, Text: "it's the lecture"},
+	}
+	for _, name := range []string{"srv1.xml", "srv2.xml", "srv3.xml"} {
+		t.Run(name, func(t *testing.T) {
+			got, err := parseSRV(captionFixture(t, name))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !sameSegments(got, want) {
+				t.Fatalf("segments = %+v, want %+v", got, want)
+			}
+		})
+	}
+	if _, err := parseSRV([]byte("<timedtext><p t=")); err == nil {
+		t.Fatal("expected an error for broken XML")
+	}
+}
+
+func TestChooseCaptionTrack(t *testing.T) {
+	track := func(url string) []captionTrack { return []captionTrack{{Ext: "vtt", URL: url}} }
+	tests := []struct {
+		name     string
+		info     ytInfo
+		language string
+		policy   string
+		wantURL  string // empty: no track
+		wantMode string
+		wantLang string
+	}{
+		{
+			name:     "manual before auto",
+			info:     ytInfo{Language: "en", Subtitles: map[string][]captionTrack{"en": track("manual-en")}, AutomaticCaptions: map[string][]captionTrack{"en-orig": track("auto-en")}},
+			policy:   CaptionsAuto,
+			wantURL:  "manual-en",
+			wantMode: ModeCaptions, wantLang: "en",
+		},
+		{
+			name:     "requested language matches a regional track",
+			info:     ytInfo{Subtitles: map[string][]captionTrack{"de": track("manual-de"), "en-GB": track("manual-en-gb")}},
+			language: "en-US",
+			policy:   CaptionsManual,
+			wantURL:  "manual-en-gb",
+			wantMode: ModeCaptions, wantLang: "en",
+		},
+		{
+			name:     "plain language before regional",
+			info:     ytInfo{Language: "en", Subtitles: map[string][]captionTrack{"en-GB": track("manual-en-gb"), "en": track("manual-en")}},
+			policy:   CaptionsManual,
+			wantURL:  "manual-en",
+			wantMode: ModeCaptions, wantLang: "en",
+		},
+		{
+			name:     "the only manual track of a video of unknown language",
+			info:     ytInfo{Subtitles: map[string][]captionTrack{"fr": track("manual-fr"), "live_chat": track("chat")}},
+			policy:   CaptionsManual,
+			wantURL:  "manual-fr",
+			wantMode: ModeCaptions, wantLang: "fr",
+		},
+		{
+			name:   "several manual tracks of a video of unknown language",
+			info:   ytInfo{Subtitles: map[string][]captionTrack{"fr": track("manual-fr"), "de": track("manual-de")}},
+			policy: CaptionsAuto,
+		},
+		{
+			name:   "manual policy ignores automatic captions",
+			info:   ytInfo{Language: "en", AutomaticCaptions: map[string][]captionTrack{"en-orig": track("auto-en")}},
+			policy: CaptionsManual,
+		},
+		{
+			name:     "original speech recognition",
+			info:     ytInfo{Language: "en", AutomaticCaptions: map[string][]captionTrack{"en-orig": track("auto-en-orig"), "en": track("auto-en")}},
+			policy:   CaptionsAuto,
+			wantURL:  "auto-en-orig",
+			wantMode: ModeAutoCaptions, wantLang: "en",
+		},
+		{
+			name:     "speech recognition in the video's language",
+			info:     ytInfo{Language: "en", AutomaticCaptions: map[string][]captionTrack{"en": track("auto-en"), "de": track("auto-de")}},
+			policy:   CaptionsAuto,
+			wantURL:  "auto-en",
+			wantMode: ModeAutoCaptions, wantLang: "en",
+		},
+		{
+			name:     "machine translation is never used",
+			info:     ytInfo{Language: "en", AutomaticCaptions: map[string][]captionTrack{"en": track("auto-en"), "de": track("auto-de")}},
+			language: "de",
+			policy:   CaptionsAuto,
+		},
+		{
+			name:   "automatic captions of a video of unknown language",
+			info:   ytInfo{AutomaticCaptions: map[string][]captionTrack{"en": track("auto-en")}},
+			policy: CaptionsAuto,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tracks, mode, lang := chooseCaptionTrack(&tt.info, tt.language, tt.policy)
+			if tt.wantURL == "" {
+				if tracks != nil {
+					t.Fatalf("chose %v (%s, %s), want none", tracks, mode, lang)
+				}
+				return
+			}
+			if len(tracks) != 1 || tracks[0].URL != tt.wantURL || mode != tt.wantMode || lang != tt.wantLang {
+				t.Fatalf("chose %v (%s, %s), want %s (%s, %s)", tracks, mode, lang, tt.wantURL, tt.wantMode, tt.wantLang)
+			}
+		})
+	}
+}
+
+func TestCaptionsUsable(t *testing.T) {
+	// words returns segments with n words in total, the last one ending at end
+	words := func(n int, end float64) []TranscriptSegment {
+		var segments []TranscriptSegment
+		for i := 0; i < n; i++ {
+			segments = append(segments, TranscriptSegment{Start: end * float64(i) / float64(n), End: end * float64(i+1) / float64(n), Text: "word"})
+		}
+		return segments
+	}
+	tests := []struct {
+		name     string
+		segments []TranscriptSegment
+		duration float64
+		want     bool
+	}{
+		{"empty", nil, 100, false},
+		{"too few words", words(minCaptionWords-1, 100), 100, false},
+		{"covers the video", words(minCaptionWords, 100), 100, true},
+		{"covers half", words(minCaptionWords, 50), 100, true},
+		{"truncated", words(minCaptionWords*5, 30), 100, false},
+		{"unknown duration", words(minCaptionWords, 10), 0, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := captionsUsable(tt.segments, tt.duration); got != tt.want {
+				t.Fatalf("captionsUsable = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestDownloadCaptionTrackPrefersVTT(t *testing.T) {
+	srv := httptest.NewServer(http.FileServer(http.Dir(filepath.Join("testdata", "captions"))))
+	defer srv.Close()
+
+	tracks := []captionTrack{{Ext: "json3", URL: srv.URL + "/missing.json"}, {Ext: "srv3", URL: srv.URL + "/srv3.xml"}, {Ext: "vtt", URL: srv.URL + "/auto.vtt"}}
+	got, err := downloadCaptionTrack(t.Context(), tracks)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(got) != 3 || got[2].Text != "about engines" {
+		t.Fatalf("segments = %+v, want the vtt track", got)
+	}
+
+	got, err = downloadCaptionTrack(t.Context(), tracks[:2])
+	if err != nil || len(got) != 2 || got[1].Text != "it's the lecture" {
+		t.Fatalf("segments = %+v, %v, want the srv3 track", got, err)
+	}
+	if _, err := downloadCaptionTrack(t.Context(), tracks[:1]); err == nil {
+		t.Fatal("expected an error when no format can be parsed")
+	}
+}
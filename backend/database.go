@@ -2,12 +2,9 @@ package main
 
 import (
 	"context"
-	"encoding/json"
-	"fmt"
-	"io"
 	"log"
-	"net/http"
 	"os"
+	"strings"
 	"time"
 
 	"go.mongodb.org/mongo-driver/bson"
@@ -71,76 +68,28 @@ func DisconnectDB() error {
 	return nil
 }
 
-// ValidateGoogleToken валидирует Google токен и получает информацию о пользователе
-func ValidateGoogleToken(accessToken string) (*GoogleUserInfo, error) {
-	url := fmt.Sprintf("https://www.googleapis.com/oauth2/v2/userinfo?access_token=%s", accessToken)
-	httpClient := &http.Client{Timeout: 10 * time.Second}
-	resp, err := httpClient.Get(url)
-	if err != nil {
-		return nil, fmt.Errorf("ошибка при запросе к Google API: %v", err)
-	}
-	defer resp.Body.Close()
-
-	if resp.StatusCode != http.StatusOK {
-		return nil, fmt.Errorf("неверный статус ответа от Google API: %d", resp.StatusCode)
-	}
-
-	body, err := io.ReadAll(resp.Body)
-	if err != nil {
-		return nil, fmt.Errorf("ошибка при чтении ответа: %v", err)
-	}
-
-	var userInfo GoogleUserInfo
-	if err := json.Unmarshal(body, &userInfo); err != nil {
-		return nil, fmt.Errorf("ошибка при парсинге ответа: %v", err)
-	}
-
-	return &userInfo, nil
+// normalizeEmail приводит email к виду, в котором он хранится и сравнивается
+func normalizeEmail(email string) string {
+	return strings.ToLower(strings.TrimSpace(email))
 }
 
-// ValidateGoogleIDToken validates Google ID token and gets user information
-func ValidateGoogleIDToken(idToken string) (*GoogleUserInfo, error) {
-	url := fmt.Sprintf("https://oauth2.googleapis.com/tokeninfo?id_token=%s", idToken)
-	httpClient := &http.Client{Timeout: 10 * time.Second}
-	resp, err := httpClient.Get(url)
-	if err != nil {
-		return nil, fmt.Errorf("error requesting Google tokeninfo API: %v", err)
-	}
-	defer resp.Body.Close()
+// emailCollation сравнивает email без учёта регистра, чтобы находились и аккаунты,
+// созданные до нормализации адресов
+var emailCollation = &options.Collation{Locale: "en", Strength: 2}
 
-	if resp.StatusCode != http.StatusOK {
-		return nil, fmt.Errorf("invalid response status from Google tokeninfo API: %d", resp.StatusCode)
-	}
-
-	body, err := io.ReadAll(resp.Body)
+// ensureUserIndexes создаёт уникальный индекс по email без учёта регистра: он же
+// не даёт параллельным регистрациям создать два аккаунта на один адрес
+func ensureUserIndexes() {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	_, err := database.Collection("users").Indexes().CreateOne(ctx, mongo.IndexModel{
+		Keys:    bson.D{{Key: "email", Value: 1}},
+		Options: options.Index().SetName("email_ci").SetUnique(true).SetCollation(emailCollation),
+	})
 	if err != nil {
-		return nil, fmt.Errorf("error reading response: %v", err)
-	}
-
-	var tokenInfo struct {
-		Email         string `json:"email"`
-		Name          string `json:"name"`
-		Picture       string `json:"picture"`
-		EmailVerified string `json:"email_verified"`
-		Aud           string `json:"aud"`
+		// Например, уже есть аккаунты, отличающиеся только регистром email
+		log.Printf("⚠️  Не удалось создать уникальный индекс users.email: %v", err)
 	}
-
-	if err := json.Unmarshal(body, &tokenInfo); err != nil {
-		return nil, fmt.Errorf("error parsing response: %v", err)
-	}
-
-	// Verify email is verified
-	if tokenInfo.EmailVerified != "true" {
-		return nil, fmt.Errorf("email not verified")
-	}
-
-	userInfo := &GoogleUserInfo{
-		Email:   tokenInfo.Email,
-		Name:    tokenInfo.Name,
-		Picture: tokenInfo.Picture,
-	}
-
-	return userInfo, nil
 }
 
 // CreateUser создает нового пользователя в базе данных
@@ -150,7 +99,11 @@ func CreateUser(user *User) error {
 
 	// Генерируем ObjectID для MongoDB
 	user.ID = primitive.NewObjectID().Hex()
+	user.Email = normalizeEmail(user.Email)
 	user.CreatedAt = time.Now()
+	if user.Role == "" {
+		user.Role = RoleUser
+	}
 
 	collection := database.Collection("users")
 	_, err := collection.InsertOne(ctx, user)
@@ -165,7 +118,8 @@ func GetUserByEmail(email string) (*User, error) {
 	collection := database.Collection("users")
 
 	var user User
-	err := collection.FindOne(ctx, bson.M{"email": email}).Decode(&user)
+	err := collection.FindOne(ctx, bson.M{"email": normalizeEmail(email)},
+		options.FindOne().SetCollation(emailCollation)).Decode(&user)
 	if err != nil {
 		return nil, err
 	}
@@ -173,40 +127,36 @@ func GetUserByEmail(email string) (*User, error) {
 	return &user, nil
 }
 
-// UserExists проверяет, существует ли пользователь с данным email
-func UserExists(email string) (bool, error) {
+// GetUserByID получает пользователя по ID (hex-строка из JWT)
+func GetUserByID(id string) (*User, error) {
 	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
 	defer cancel()
 
 	collection := database.Collection("users")
 
-	count, err := collection.CountDocuments(ctx, bson.M{"email": email})
+	var user User
+	err := collection.FindOne(ctx, bson.M{"id": id}).Decode(&user)
 	if err != nil {
-		return false, err
+		return nil, err
 	}
 
-	return count > 0, nil
+	return &user, nil
 }
 
-// GetAllUsers получает всех пользователей (для админки)
-func GetAllUsers() ([]User, error) {
-	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+// UserExists проверяет, существует ли пользователь с данным email
+func UserExists(email string) (bool, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
 	defer cancel()
 
 	collection := database.Collection("users")
 
-	cursor, err := collection.Find(ctx, bson.M{})
+	count, err := collection.CountDocuments(ctx, bson.M{"email": normalizeEmail(email)},
+		options.Count().SetCollation(emailCollation))
 	if err != nil {
-		return nil, err
-	}
-	defer cursor.Close(ctx)
-
-	var users []User
-	if err = cursor.All(ctx, &users); err != nil {
-		return nil, err
+		return false, err
 	}
 
-	return users, nil
+	return count > 0, nil
 }
 
 // UpdateUser обновляет данные пользователя
@@ -224,13 +174,11 @@ func UpdateUser(user *User) error {
 	return err
 }
 
-// DeleteUser удаляет пользователя
-func DeleteUser(email string) error {
+// DeleteUser удаляет документ пользователя; его данные удаляет deleteAccountData
+func DeleteUser(userID primitive.ObjectID) error {
 	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
 	defer cancel()
 
-	collection := database.Collection("users")
-
-	_, err := collection.DeleteOne(ctx, bson.M{"email": email})
+	_, err := database.Collection("users").DeleteOne(ctx, bson.M{"id": userID.Hex()})
 	return err
 }
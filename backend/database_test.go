@@ -0,0 +1,87 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"testing"
+	"time"
+
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// useTestDatabase points the package at a throwaway database on MONGODB_TEST_URI,
+// dropped when the test ends. Tests that need MongoDB are skipped without it.
+func useTestDatabase(t *testing.T) {
+	t.Helper()
+	uri := os.Getenv("MONGODB_TEST_URI")
+	if uri == "" {
+		t.Skip("MONGODB_TEST_URI is not set")
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	c, err := mongo.Connect(ctx, options.Client().ApplyURI(uri))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := c.Ping(ctx, nil); err != nil {
+		t.Fatalf("MONGODB_TEST_URI is unreachable: %v", err)
+	}
+
+	prevClient, prevDatabase := client, database
+	client = c
+	database = c.Database(fmt.Sprintf("speakapper_test_%d", time.Now().UnixNano()))
+	t.Cleanup(func() {
+		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+		defer cancel()
+		database.Drop(ctx)
+		c.Disconnect(ctx)
+		client, database = prevClient, prevDatabase
+	})
+}
+
+func TestNormalizeEmail(t *testing.T) {
+	for in, want := range map[string]string{
+		"ada@example.com":       "ada@example.com",
+		"  Ada@Example.COM \n":  "ada@example.com",
+		"ADA.LOVELACE@MAIL.RU ": "ada.lovelace@mail.ru",
+		"":                      "",
+	} {
+		if got := normalizeEmail(in); got != want {
+			t.Errorf("normalizeEmail(%q) = %q, want %q", in, got, want)
+		}
+	}
+}
+
+func TestUserEmailIsCaseInsensitive(t *testing.T) {
+	useTestDatabase(t)
+	ensureUserIndexes()
+
+	// An account stored before emails were normalized
+	ctx := context.Background()
+	if _, err := database.Collection("users").InsertOne(ctx, User{ID: "legacy", Email: "Ada.Lovelace@Example.com"}); err != nil {
+		t.Fatal(err)
+	}
+	user, err := GetUserByEmail("ada.lovelace@example.COM")
+	if err != nil || user.ID != "legacy" {
+		t.Fatalf("GetUserByEmail: user = %+v, err = %v", user, err)
+	}
+	if exists, err := UserExists(" ADA.LOVELACE@example.com"); err != nil || !exists {
+		t.Fatalf("UserExists = %v, %v", exists, err)
+	}
+
+	// A second account for the same mailbox is rejected by the index
+	err = CreateUser(&User{Email: "ada.lovelace@example.com"})
+	if !mongo.IsDuplicateKeyError(err) {
+		t.Fatalf("CreateUser with a differently cased email: err = %v, want duplicate key", err)
+	}
+
+	created := &User{Email: " Grace@Example.com"}
+	if err := CreateUser(created); err != nil {
+		t.Fatal(err)
+	}
+	if created.Email != "grace@example.com" {
+		t.Fatalf("stored email = %q, want it normalized", created.Email)
+	}
+}
@@ -0,0 +1,237 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"net/http"
+	"time"
+
+	"github.com/gorilla/mux"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// FreePlanID is the plan of users without an active subscription
+const FreePlanID = "free"
+
+// Entitlements are the capabilities of a plan; 0 limits mean unlimited
+type Entitlements struct {
+	YouTube          bool `json:"youtube"`
+	MaxAudioMinutes  int  `json:"max_audio_minutes"`  // length of one upload/video
+	MaxMaterials     int  `json:"max_materials"`      // materials stored at once
+	MaxQuizQuestions int  `json:"max_quiz_questions"` // questions kept per generated material
+}
+
+// entitlementTable declares what every plan may do. Plans from SUBSCRIPTION_PLANS_FILE
+// may override their row with an "entitlements" object.
+var entitlementTable = map[string]Entitlements{
+	FreePlanID: {YouTube: false, MaxAudioMinutes: 30, MaxMaterials: 3, MaxQuizQuestions: 10},
+	"basic":    {YouTube: false, MaxAudioMinutes: 90, MaxMaterials: 10, MaxQuizQuestions: 20},
+	"premium":  {YouTube: true, MaxAudioMinutes: 240, MaxMaterials: 0, MaxQuizQuestions: 0},
+}
+
+// Features that routes can be gated by
+const (
+	FeatureYouTube       = "youtube"
+	FeatureAudioLength   = "audio_length"
+	FeatureMaterials     = "materials"
+	FeatureQuizQuestions = "quiz_questions"
+)
+
+// routeFeatures declares which features each named route is gated by.
+// entitlementMiddleware checks youtube and materials up front; audio length and
+// quiz size are only known inside the handler, which reads the entitlements
+// the middleware put in the request context.
+var routeFeatures = map[string][]string{
+	"transcribe":         {FeatureAudioLength},
+	"transcribe-youtube": {FeatureYouTube, FeatureAudioLength},
+	"generate-and-save":  {FeatureMaterials, FeatureQuizQuestions},
+	"materials-create":   {FeatureMaterials},
+}
+
+// entitlementsFor returns the capabilities of planID, falling back to the free plan
+func entitlementsFor(planID string) Entitlements {
+	if p, ok := findPlan(planID); ok && p.Entitlements != nil {
+		return *p.Entitlements
+	}
+	if e, ok := entitlementTable[planID]; ok {
+		return e
+	}
+	return entitlementTable[FreePlanID]
+}
+
+// userPlan returns the plan ID of the user's active subscription or "free"
+func userPlan(userID primitive.ObjectID) (string, error) {
+	sub, err := GetActiveSubscription(userID)
+	if err != nil {
+		return "", err
+	}
+	if sub == nil {
+		return FreePlanID, nil
+	}
+	return sub.PlanID, nil
+}
+
+// plansAllowing lists the paid plans on which check passes, for upgrade hints
+func plansAllowing(check func(Entitlements) bool) []string {
+	var out []string
+	for _, p := range plans {
+		if check(entitlementsFor(p.ID)) {
+			out = append(out, p.ID)
+		}
+	}
+	return out
+}
+
+// UpgradeRequiredError is returned when the user's plan does not include a feature
+type UpgradeRequiredError struct {
+	Feature      string   `json:"feature"`
+	Plan         string   `json:"plan"`
+	Limit        int      `json:"limit,omitempty"`
+	Requested    float64  `json:"requested,omitempty"`
+	UpgradePlans []string `json:"upgrade_plans"`
+	Message      string   `json:"-"`
+}
+
+func (e *UpgradeRequiredError) Error() string { return e.Message }
+
+// writeUpgradeRequired sends a 402 with details the frontend can render
+func writeUpgradeRequired(w http.ResponseWriter, e *UpgradeRequiredError) {
+	JSONErrorWithDetails(w, http.StatusPaymentRequired, e.Message, map[string]interface{}{
+		"code":          "upgrade_required",
+		"feature":       e.Feature,
+		"plan":          e.Plan,
+		"limit":         e.Limit,
+		"requested":     e.Requested,
+		"upgrade_plans": e.UpgradePlans,
+		"upgrade_url":   "/pricing",
+	})
+}
+
+// checkAudioLength rejects recordings longer than the plan allows
+func checkAudioLength(plan string, ent Entitlements, seconds float64) error {
+	if ent.MaxAudioMinutes <= 0 || seconds <= float64(ent.MaxAudioMinutes*60) {
+		return nil
+	}
+	minutes := seconds / 60
+	return &UpgradeRequiredError{
+		Feature:   FeatureAudioLength,
+		Plan:      plan,
+		Limit:     ent.MaxAudioMinutes,
+		Requested: float64(int(minutes*10)) / 10,
+		UpgradePlans: plansAllowing(func(e Entitlements) bool {
+			return e.MaxAudioMinutes <= 0 || minutes <= float64(e.MaxAudioMinutes)
+		}),
+		Message: fmt.Sprintf("Recording is %.0f minutes, your plan allows up to %d minutes", minutes, ent.MaxAudioMinutes),
+	}
+}
+
+// checkFeature evaluates one up-front feature gate for the user
+func checkFeature(ctx context.Context, feature string, userID primitive.ObjectID, plan string, ent Entitlements) error {
+	switch feature {
+	case FeatureYouTube:
+		if ent.YouTube {
+			return nil
+		}
+		return &UpgradeRequiredError{
+			Feature:      feature,
+			Plan:         plan,
+			UpgradePlans: plansAllowing(func(e Entitlements) bool { return e.YouTube }),
+			Message:      "YouTube transcription is not included in your plan",
+		}
+	case FeatureMaterials:
+		if ent.MaxMaterials <= 0 {
+			return nil
+		}
+		count, err := database.Collection("materials").CountDocuments(ctx, bson.M{"user_id": userID})
+		if err != nil {
+			return err
+		}
+		if count < int64(ent.MaxMaterials) {
+			return nil
+		}
+		return &UpgradeRequiredError{
+			Feature:   feature,
+			Plan:      plan,
+			Limit:     ent.MaxMaterials,
+			Requested: float64(count + 1),
+			UpgradePlans: plansAllowing(func(e Entitlements) bool {
+				return e.MaxMaterials <= 0 || count < int64(e.MaxMaterials)
+			}),
+			Message: fmt.Sprintf("Your plan stores up to %d materials, delete some or upgrade", ent.MaxMaterials),
+		}
+	}
+	return nil
+}
+
+type entitlementsContextKey struct{}
+
+// entitlementMiddleware authenticates requests to routes listed in routeFeatures,
+// checks their up-front gates and stores the user's entitlements in the context
+func entitlementMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		route := mux.CurrentRoute(r)
+		if route == nil {
+			next.ServeHTTP(w, r)
+			return
+		}
+		features, ok := routeFeatures[route.GetName()]
+		if !ok {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		auth := authFromContext(r)
+		if auth == nil {
+			if auth = extractUserFromJWT(w, r); auth == nil {
+				return
+			}
+		}
+		plan, err := userPlan(auth.UserID)
+		if err != nil {
+			log.Printf("[entitlements] plan lookup failed for user=%s: %v", auth.UserID.Hex(), err)
+			JSONError(w, http.StatusInternalServerError, "Failed to load subscription")
+			return
+		}
+		ent := entitlementsFor(plan)
+
+		ctx, cancel := context.WithTimeout(r.Context(), 5*time.Second)
+		defer cancel()
+		for _, f := range features {
+			if err := checkFeature(ctx, f, auth.UserID, plan, ent); err != nil {
+				if ue, ok := err.(*UpgradeRequiredError); ok {
+					writeUpgradeRequired(w, ue)
+					return
+				}
+				log.Printf("[entitlements] %s check failed: %v", f, err)
+				JSONError(w, http.StatusInternalServerError, "Failed to check plan limits")
+				return
+			}
+		}
+
+		ctx = context.WithValue(r.Context(), authContextKey{}, auth)
+		ctx = context.WithValue(ctx, entitlementsContextKey{}, planEntitlements{Plan: plan, Entitlements: ent})
+		next.ServeHTTP(w, r.WithContext(ctx))
+	})
+}
+
+// planEntitlements pairs the user's plan with its entitlements
+type planEntitlements struct {
+	Plan string
+	Entitlements
+}
+
+// entitlementsFromContext returns what entitlementMiddleware resolved for the request,
+// or looks the user's plan up when the route is not gated
+func entitlementsFromContext(r *http.Request, userID primitive.ObjectID) planEntitlements {
+	if pe, ok := r.Context().Value(entitlementsContextKey{}).(planEntitlements); ok {
+		return pe
+	}
+	plan, err := userPlan(userID)
+	if err != nil {
+		log.Printf("[entitlements] plan lookup failed for user=%s: %v", userID.Hex(), err)
+		plan = FreePlanID
+	}
+	return planEntitlements{Plan: plan, Entitlements: entitlementsFor(plan)}
+}
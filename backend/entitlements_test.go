@@ -0,0 +1,142 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/mux"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// useDefaultPlans makes the built-in catalog the active one for the test
+func useDefaultPlans(t *testing.T) {
+	t.Helper()
+	prev := plans
+	plans = defaultPlans
+	t.Cleanup(func() { plans = prev })
+}
+
+func TestCheckAudioLength(t *testing.T) {
+	useDefaultPlans(t)
+	tests := []struct {
+		name         string
+		plan         string
+		minutes      float64
+		wantUpgrades []string // nil: allowed
+	}{
+		{"within the free limit", FreePlanID, 30, nil},
+		{"over the free limit", FreePlanID, 31, []string{"basic", "premium"}},
+		{"only premium is long enough", FreePlanID, 120, []string{"premium"}},
+		{"longer than any plan", "basic", 300, []string{}},
+		{"unknown plan counts as free", "gold", 45, []string{"basic", "premium"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := checkAudioLength(tt.plan, entitlementsFor(tt.plan), tt.minutes*60)
+			if tt.wantUpgrades == nil {
+				if err != nil {
+					t.Fatalf("error = %v, want allowed", err)
+				}
+				return
+			}
+			var ue *UpgradeRequiredError
+			if !errors.As(err, &ue) {
+				t.Fatalf("error = %v, want *UpgradeRequiredError", err)
+			}
+			if ue.Feature != FeatureAudioLength || ue.Requested != tt.minutes || strings.Join(ue.UpgradePlans, ",") != strings.Join(tt.wantUpgrades, ",") {
+				t.Fatalf("error = %+v, want upgrades %v", ue, tt.wantUpgrades)
+			}
+		})
+	}
+	if err := checkAudioLength("premium", Entitlements{}, 24*3600); err != nil {
+		t.Fatalf("unlimited plan: %v", err)
+	}
+}
+
+func TestWriteUpgradeRequired(t *testing.T) {
+	w := httptest.NewRecorder()
+	writeUpgradeRequired(w, &UpgradeRequiredError{Feature: FeatureYouTube, Plan: FreePlanID, UpgradePlans: []string{"premium"}, Message: "YouTube transcription is not included in your plan"})
+	var resp struct {
+		Success bool                   `json:"success"`
+		Message string                 `json:"message"`
+		Details map[string]interface{} `json:"details"`
+	}
+	json.Unmarshal(w.Body.Bytes(), &resp)
+	if w.Code != http.StatusPaymentRequired || resp.Success || resp.Message == "" {
+		t.Fatalf("response = %d %s", w.Code, w.Body)
+	}
+	if resp.Details["code"] != "upgrade_required" || resp.Details["feature"] != FeatureYouTube || resp.Details["upgrade_url"] != "/pricing" {
+		t.Fatalf("details = %v", resp.Details)
+	}
+}
+
+// entitlementRouter gates a youtube and a materials route like main does; the handler
+// answers with the plan the middleware resolved
+func entitlementRouter() *mux.Router {
+	plan := func(w http.ResponseWriter, r *http.Request) {
+		JSONSuccess(w, map[string]interface{}{"plan": entitlementsFromContext(r, authFromContext(r).UserID).Plan})
+	}
+	r := mux.NewRouter()
+	r.Use(entitlementMiddleware)
+	r.HandleFunc("/api/transcribe-youtube", requireAuth(plan)).Methods("POST").Name("transcribe-youtube")
+	r.HandleFunc("/api/materials", requireAuth(plan)).Methods("POST").Name("materials-create")
+	return r
+}
+
+func TestEntitlementMiddlewareRejectsOverPlan(t *testing.T) {
+	useTestDatabase(t)
+	useDefaultPlans(t)
+	ctx := t.Context()
+	userID := primitive.NewObjectID()
+	router := entitlementRouter()
+	call := func(path string) (int, map[string]interface{}) {
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, withAuth(httptest.NewRequest(http.MethodPost, path, nil), userID))
+		var resp map[string]interface{}
+		json.Unmarshal(w.Body.Bytes(), &resp)
+		return w.Code, resp
+	}
+	details := func(resp map[string]interface{}) map[string]interface{} {
+		d, _ := resp["details"].(map[string]interface{})
+		return d
+	}
+
+	code, resp := call("/api/transcribe-youtube")
+	if code != http.StatusPaymentRequired || details(resp)["feature"] != FeatureYouTube {
+		t.Fatalf("youtube on free = %d %v, want 402", code, resp)
+	}
+	if plans, _ := details(resp)["upgrade_plans"].([]interface{}); len(plans) != 1 || plans[0] != "premium" {
+		t.Fatalf("upgrade plans = %v, want premium", details(resp)["upgrade_plans"])
+	}
+
+	free := entitlementsFor(FreePlanID).MaxMaterials
+	for i := 0; i < free; i++ {
+		if code, resp := call("/api/materials"); code != http.StatusOK {
+			t.Fatalf("material %d = %d %v", i+1, code, resp)
+		}
+		database.Collection("materials").InsertOne(ctx, bson.M{"_id": primitive.NewObjectID(), "user_id": userID})
+	}
+	code, resp = call("/api/materials")
+	if code != http.StatusPaymentRequired || details(resp)["feature"] != FeatureMaterials || details(resp)["limit"] != float64(free) {
+		t.Fatalf("material over the limit = %d %v, want 402", code, resp)
+	}
+
+	// A paid plan lifts both gates and reaches the handler through the context
+	database.Collection("subscriptions").InsertOne(ctx, Subscription{
+		UserID: userID, PlanID: "premium", Status: SubscriptionActive,
+		CurrentPeriodEnd: time.Now().Add(24 * time.Hour), CreatedAt: time.Now(), UpdatedAt: time.Now(),
+	})
+	for _, path := range []string{"/api/transcribe-youtube", "/api/materials"} {
+		code, resp := call(path)
+		data, _ := resp["data"].(map[string]interface{})
+		if code != http.StatusOK || data["plan"] != "premium" {
+			t.Fatalf("%s on premium = %d %v", path, code, resp)
+		}
+	}
+}
@@ -0,0 +1,278 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/gorilla/mux"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+)
+
+// Стадии обработки, которые видит клиент
+const (
+	StageQueued       = "queued"
+	StageDownloading  = "downloading"
+	StageSegmenting   = "segmenting"
+	StageTranscribing = "transcribing"
+	StageTranscribed  = "transcribed"
+	StageGenerating   = "generating"
+	StageSaving       = "saving"
+	StageCompleted    = "completed"
+	StageFailed       = "failed"
+)
+
+// JobEvent is a single progress update pushed to SSE subscribers
+type JobEvent struct {
+	Type         string    `json:"type"` // snapshot|stage|chunk|transcribed|done|error
+	Stage        string    `json:"stage,omitempty"`
+	ChunkIndex   int       `json:"chunk_index,omitempty"`
+	ChunksDone   int       `json:"chunks_done,omitempty"`
+	ChunksTotal  int       `json:"chunks_total,omitempty"`
+	Text         string    `json:"text,omitempty"`
+	Message      string    `json:"message,omitempty"`
+	MaterialID   string    `json:"material_id,omitempty"`
+	TranscriptID string    `json:"transcript_id,omitempty"`
+	Time         time.Time `json:"time"`
+}
+
+// jobEventHub fans out job events to in-process subscribers
+type jobEventHub struct {
+	mu   sync.Mutex
+	subs map[primitive.ObjectID]map[chan JobEvent]struct{}
+}
+
+var jobEvents = &jobEventHub{subs: map[primitive.ObjectID]map[chan JobEvent]struct{}{}}
+
+// Subscribe registers a listener for the job; call the returned func to unsubscribe
+func (h *jobEventHub) Subscribe(id primitive.ObjectID) (<-chan JobEvent, func()) {
+	ch := make(chan JobEvent, 64)
+	h.mu.Lock()
+	if h.subs[id] == nil {
+		h.subs[id] = map[chan JobEvent]struct{}{}
+	}
+	h.subs[id][ch] = struct{}{}
+	h.mu.Unlock()
+
+	return ch, func() {
+		h.mu.Lock()
+		delete(h.subs[id], ch)
+		if len(h.subs[id]) == 0 {
+			delete(h.subs, id)
+		}
+		h.mu.Unlock()
+	}
+}
+
+// Publish delivers the event to every subscriber; slow subscribers drop events
+func (h *jobEventHub) Publish(id primitive.ObjectID, ev JobEvent) {
+	if ev.Time.IsZero() {
+		ev.Time = time.Now()
+	}
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	for ch := range h.subs[id] {
+		select {
+		case ch <- ev:
+		default:
+		}
+	}
+}
+
+// setJobStage persists the current stage and notifies subscribers
+func setJobStage(id primitive.ObjectID, stage string, message string) {
+	if err := UpdateJob(id, bson.M{"stage": stage}); err != nil {
+		log.Printf("[jobs] failed to save stage %s for %s: %v", stage, id.Hex(), err)
+	}
+	jobEvents.Publish(id, JobEvent{Type: "stage", Stage: stage, Message: message})
+}
+
+// jobIsTerminal reports whether the job will not produce more events.
+// A transcribed job stays open because generation may follow.
+func jobIsTerminal(job *TranscriptionJob) bool {
+	return job.Status == JobStatusFailed || job.Stage == StageCompleted || job.Stage == StageFailed
+}
+
+// loadJobForRequest loads the job from the {id} route var and checks ownership.
+// Writes the error response and returns nil on failure.
+func loadJobForRequest(w http.ResponseWriter, r *http.Request) *TranscriptionJob {
+	id, err := primitive.ObjectIDFromHex(mux.Vars(r)["id"])
+	if err != nil {
+		JSONError(w, http.StatusBadRequest, "Invalid job ID")
+		return nil
+	}
+
+	job, err := GetJob(id)
+	if err != nil {
+		if errors.Is(err, mongo.ErrNoDocuments) {
+			JSONError(w, http.StatusNotFound, "Job not found")
+			return nil
+		}
+		log.Printf("Error loading job %s: %v", id.Hex(), err)
+		JSONError(w, http.StatusInternalServerError, "Internal server error")
+		return nil
+	}
+
+	// Jobs created by a signed-in user are visible only to that user
+	if !job.UserID.IsZero() {
+		auth := extractUserFromJWT(w, r)
+		if auth == nil {
+			return nil
+		}
+		if auth.UserID != job.UserID {
+			JSONError(w, http.StatusNotFound, "Job not found")
+			return nil
+		}
+	}
+	return job
+}
+
+// handleJobEvents streams job progress as Server-Sent Events.
+// The first event is a snapshot of the stored job so late subscribers catch up.
+func handleJobEvents(w http.ResponseWriter, r *http.Request) {
+	job := loadJobForRequest(w, r)
+	if job == nil {
+		return
+	}
+
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		JSONError(w, http.StatusInternalServerError, "Streaming unsupported")
+		return
+	}
+
+	events, unsubscribe := jobEvents.Subscribe(job.ID)
+	defer unsubscribe()
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("Connection", "keep-alive")
+	w.Header().Set("X-Accel-Buffering", "no")
+	w.WriteHeader(http.StatusOK)
+
+	send := func(ev JobEvent) bool {
+		if ev.Time.IsZero() {
+			ev.Time = time.Now()
+		}
+		data, err := json.Marshal(ev)
+		if err != nil {
+			return false
+		}
+		if _, err := fmt.Fprintf(w, "event: %s\ndata: %s\n\n", ev.Type, data); err != nil {
+			return false
+		}
+		flusher.Flush()
+		return true
+	}
+
+	snapshot := func(j *TranscriptionJob) JobEvent {
+		return JobEvent{
+			Type:        "snapshot",
+			Stage:       j.Stage,
+			ChunksDone:  j.ChunksDone,
+			ChunksTotal: j.ChunksTotal,
+			Text:        j.Transcript,
+			Message:     j.Error,
+		}
+	}
+
+	if !send(snapshot(job)) {
+		return
+	}
+	if jobIsTerminal(job) {
+		send(terminalEvent(job))
+		return
+	}
+
+	// Events may come from another instance, so the stored job is re-checked periodically
+	ticker := time.NewTicker(15 * time.Second)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-r.Context().Done():
+			return
+		case ev := <-events:
+			if !send(ev) {
+				return
+			}
+			if ev.Type == "done" || ev.Type == "error" {
+				return
+			}
+		case <-ticker.C:
+			fresh, err := GetJob(job.ID)
+			if err != nil {
+				if _, werr := fmt.Fprint(w, ": ping\n\n"); werr != nil {
+					return
+				}
+				flusher.Flush()
+				continue
+			}
+			if jobIsTerminal(fresh) {
+				send(terminalEvent(fresh))
+				return
+			}
+			if !send(snapshot(fresh)) {
+				return
+			}
+		}
+	}
+}
+
+// terminalEvent builds the final done/error event from the stored job
+func terminalEvent(job *TranscriptionJob) JobEvent {
+	if job.Status == JobStatusFailed || job.Stage == StageFailed {
+		return JobEvent{Type: "error", Stage: StageFailed, Message: job.Error}
+	}
+	ev := JobEvent{
+		Type:        "done",
+		Stage:       StageCompleted,
+		ChunksDone:  job.ChunksDone,
+		ChunksTotal: job.ChunksTotal,
+		Text:        job.Transcript,
+		MaterialID:  job.MaterialID,
+	}
+	if !job.TranscriptID.IsZero() {
+		ev.TranscriptID = job.TranscriptID.Hex()
+	}
+	return ev
+}
+
+// generationJob resolves the optional jobId of a generate request.
+// Returns nil when it is missing, invalid or belongs to another user.
+func generationJob(raw string, userID primitive.ObjectID) *TranscriptionJob {
+	if raw == "" {
+		return nil
+	}
+	id, err := primitive.ObjectIDFromHex(raw)
+	if err != nil {
+		return nil
+	}
+	job, err := GetJob(id)
+	if err != nil || (!job.UserID.IsZero() && job.UserID != userID) {
+		return nil
+	}
+	return job
+}
+
+// finishJobGeneration records the saved material and closes the job stream
+func finishJobGeneration(id primitive.ObjectID, materialID string) {
+	if err := UpdateJob(id, bson.M{"stage": StageCompleted, "material_id": materialID}); err != nil {
+		log.Printf("[jobs] failed to save material for %s: %v", id.Hex(), err)
+	}
+	jobEvents.Publish(id, JobEvent{Type: "done", Stage: StageCompleted, MaterialID: materialID})
+}
+
+// failJobGeneration reports a generation failure; the transcript stays available
+func failJobGeneration(id primitive.ObjectID, message string) {
+	if err := UpdateJob(id, bson.M{"stage": StageFailed, "error": message}); err != nil {
+		log.Printf("[jobs] failed to save generation error for %s: %v", id.Hex(), err)
+	}
+	jobEvents.Publish(id, JobEvent{Type: "error", Stage: StageFailed, Message: message})
+}
@@ -0,0 +1,558 @@
+package main
+
+import (
+	"archive/zip"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// Archive layout version, written to manifest.json. Bump it when a file or field
+// changes meaning so an importer can tell the layouts apart.
+const exportFormatVersion = 1
+
+// exportTTL is how long a finished archive can be downloaded (EXPORT_TTL_HOURS)
+var exportTTL = 24 * time.Hour
+
+// exportQueue delivers export IDs to the export worker
+var exportQueue = make(chan primitive.ObjectID, 64)
+
+// exportKey is where the archive of an export lives in the blob store, so a signed
+// link works on every instance and after a restart
+func exportKey(userID, id primitive.ObjectID) string {
+	return "exports/" + userID.Hex() + "/" + id.Hex() + ".zip"
+}
+
+// ExportManifest is manifest.json, the first file of every archive
+type ExportManifest struct {
+	Format     string         `json:"format"` // always "speakapper-export"
+	Version    int            `json:"version"`
+	ExportedAt time.Time      `json:"exported_at"`
+	UserID     string         `json:"user_id"`
+	Counts     map[string]int `json:"counts"`
+	Files      []string       `json:"files"`
+}
+
+// ExportAccount is account.json: everything about the account besides the profile
+type ExportAccount struct {
+	Subscriptions []Subscription `json:"subscriptions"`
+	Identities    []Identity     `json:"identities"`
+	Sessions      []Session      `json:"sessions"`
+	APIKeys       []APIKey       `json:"api_keys"`
+}
+
+// ExportHistory is history.json: transcription runs and monthly/daily usage
+type ExportHistory struct {
+	Jobs  []TranscriptionJob `json:"jobs"`
+	Usage []UsageRecord      `json:"usage"`
+}
+
+// exportFile is one archive entry: data is marshalled to JSON unless it is a string
+type exportFile struct {
+	name string
+	data interface{}
+}
+
+// urlSignature signs a link to the object id valid until expires. purpose ("export",
+// "audio") keeps a signature for one kind of link from opening another.
+func urlSignature(purpose string, id primitive.ObjectID, expires int64) string {
+	mac := hmac.New(sha256.New, jwtSecret)
+	fmt.Fprintf(mac, "%s:%s:%d", purpose, id.Hex(), expires)
+	return base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+// withDownloadURL fills the signed download link of a finished, unexpired export
+func (e *DataExport) withDownloadURL() *DataExport {
+	if e.Status == ExportDone && e.ExpiresAt != nil && time.Now().Before(*e.ExpiresAt) {
+		expires := e.ExpiresAt.Unix()
+		e.DownloadURL = "/api/exports/" + e.ID.Hex() + "/download?" + url.Values{
+			"expires": {strconv.FormatInt(expires, 10)},
+			"sig":     {urlSignature("export", e.ID, expires)},
+		}.Encode()
+	}
+	return e
+}
+
+// enqueueExport hands the export to the worker without blocking the caller
+func enqueueExport(id primitive.ObjectID) {
+	select {
+	case exportQueue <- id:
+	default:
+		go func() { exportQueue <- id }()
+	}
+}
+
+// startExportWorker processes exportQueue, resumes exports interrupted by a restart
+// and removes expired archives every hour
+func startExportWorker() {
+	exportTTL = time.Duration(getEnvInt("EXPORT_TTL_HOURS", 24)) * time.Hour
+	go func() {
+		for id := range exportQueue {
+			runExport(id)
+		}
+	}()
+	go func() {
+		for {
+			expireExports()
+			time.Sleep(time.Hour)
+		}
+	}()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	coll := database.Collection("data_exports")
+	if _, err := coll.UpdateMany(ctx,
+		bson.M{"status": ExportRunning},
+		bson.M{"$set": bson.M{"status": ExportPending, "updated_at": time.Now()}},
+	); err != nil {
+		log.Printf("[export] failed to reset running exports: %v", err)
+		return
+	}
+	ids, err := coll.Distinct(ctx, "_id", bson.M{"status": ExportPending})
+	if err != nil {
+		log.Printf("[export] failed to load pending exports: %v", err)
+		return
+	}
+	for _, id := range ids {
+		if oid, ok := id.(primitive.ObjectID); ok {
+			enqueueExport(oid)
+		}
+	}
+}
+
+// expireExports deletes archives past their expiry and marks them expired. An archive
+// that could not be deleted stays done and is tried again on the next run.
+func expireExports() {
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+	coll := database.Collection("data_exports")
+	var expired []DataExport
+	cursor, err := coll.Find(ctx, bson.M{"status": ExportDone, "expires_at": bson.M{"$lte": time.Now()}},
+		options.Find().SetProjection(bson.M{"user_id": 1}))
+	if err == nil {
+		err = cursor.All(ctx, &expired)
+	}
+	if err != nil {
+		log.Printf("[export] failed to load expired exports: %v", err)
+		return
+	}
+	for _, e := range expired {
+		if err := blobStore.Delete(ctx, exportKey(e.UserID, e.ID)); err != nil {
+			log.Printf("[export] failed to delete archive of export %s: %v", e.ID.Hex(), err)
+			continue
+		}
+		coll.UpdateOne(ctx, bson.M{"_id": e.ID}, bson.M{"$set": bson.M{"status": ExportExpired, "updated_at": time.Now()}})
+	}
+}
+
+// runExport claims a pending export and builds its archive
+func runExport(id primitive.ObjectID) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	var exp DataExport
+	err := database.Collection("data_exports").FindOneAndUpdate(ctx,
+		bson.M{"_id": id, "status": ExportPending},
+		bson.M{"$set": bson.M{"status": ExportRunning, "updated_at": time.Now()}},
+		options.FindOneAndUpdate().SetReturnDocument(options.After),
+	).Decode(&exp)
+	cancel()
+	if err != nil {
+		if !errors.Is(err, mongo.ErrNoDocuments) {
+			log.Printf("[export] claim %s failed: %v", id.Hex(), err)
+		}
+		return
+	}
+
+	start := time.Now()
+	manifest, size, err := storeExport(exp.UserID, id)
+	now := time.Now()
+	set := bson.M{"updated_at": now, "finished_at": now}
+	if err != nil {
+		set["status"] = ExportFailed
+		set["error"] = err.Error()
+		log.Printf("[export] export=%s user=%s failed: %v", id.Hex(), exp.UserID.Hex(), err)
+	} else {
+		set["status"] = ExportDone
+		set["size"] = size
+		set["counts"] = manifest.Counts
+		set["expires_at"] = now.Add(exportTTL)
+		log.Printf("[export] export=%s user=%s done in %s (%d bytes)", id.Hex(), exp.UserID.Hex(), time.Since(start), size)
+	}
+
+	ctx, cancel = context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if _, err := database.Collection("data_exports").UpdateOne(ctx, bson.M{"_id": id}, bson.M{"$set": set}); err != nil {
+		log.Printf("[export] failed to record export %s: %v", id.Hex(), err)
+	}
+}
+
+// storeExport builds the user's archive in a temporary file and uploads it to the blob store
+func storeExport(userID, id primitive.ObjectID) (*ExportManifest, int64, error) {
+	dir, err := os.MkdirTemp("", "speakapper-export-*")
+	if err != nil {
+		return nil, 0, err
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "export.zip")
+	manifest, size, err := buildExport(userID, path)
+	if err != nil {
+		return nil, 0, err
+	}
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, 0, err
+	}
+	defer f.Close()
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Minute)
+	defer cancel()
+	if err := blobStore.Put(ctx, exportKey(userID, id), f, size, "application/zip"); err != nil {
+		return nil, 0, fmt.Errorf("storing archive: %w", err)
+	}
+	return manifest, size, nil
+}
+
+// findAll decodes every document of coll matching filter into out, oldest first
+func findAll(ctx context.Context, coll string, filter bson.M, out interface{}) error {
+	cursor, err := database.Collection(coll).Find(ctx, filter, options.Find().SetSort(bson.M{"created_at": 1}))
+	if err != nil {
+		return fmt.Errorf("%s: %w", coll, err)
+	}
+	defer cursor.Close(ctx)
+	if err := cursor.All(ctx, out); err != nil {
+		return fmt.Errorf("%s: %w", coll, err)
+	}
+	return nil
+}
+
+// buildExport writes the user's archive to path: JSON files for re-import and Markdown
+// files for reading. Returns the manifest and the archive size.
+func buildExport(userID primitive.ObjectID, path string) (*ExportManifest, int64, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Minute)
+	defer cancel()
+
+	user, err := GetUserByID(userID.Hex())
+	if err != nil {
+		return nil, 0, fmt.Errorf("users: %w", err)
+	}
+	user.HasPassword = user.Password != ""
+	byUser := bson.M{"user_id": userID}
+	notes := []Note{}
+	materials := []Material{}
+	transcripts := []Transcript{}
+	var account ExportAccount
+	var history ExportHistory
+	for _, q := range []struct {
+		coll string
+		out  interface{}
+	}{
+		{"notes", &notes},
+		{"materials", &materials},
+		{"transcripts", &transcripts},
+		{"subscriptions", &account.Subscriptions},
+		{"identities", &account.Identities},
+		{"sessions", &account.Sessions},
+		{"api_keys", &account.APIKeys},
+		{"jobs", &history.Jobs},
+		{"usage", &history.Usage},
+	} {
+		if err := findAll(ctx, q.coll, byUser, q.out); err != nil {
+			return nil, 0, err
+		}
+	}
+
+	manifest := &ExportManifest{
+		Format:     "speakapper-export",
+		Version:    exportFormatVersion,
+		ExportedAt: time.Now().UTC(),
+		UserID:     user.ID,
+		Counts: map[string]int{
+			"notes":       len(notes),
+			"materials":   len(materials),
+			"transcripts": len(transcripts),
+			"jobs":        len(history.Jobs),
+		},
+	}
+	files := []exportFile{
+		{"user.json", user},
+		{"account.json", account},
+		{"notes.json", notes},
+		{"materials.json", materials},
+		{"transcripts.json", transcripts},
+		{"history.json", history},
+		{"README.md", exportReadme(user, manifest)},
+		{"notes.md", notesMarkdown(notes)},
+		{"materials.md", materialsMarkdown(materials)},
+	}
+	for _, t := range transcripts {
+		name := "transcripts/" + t.CreatedAt.UTC().Format("2006-01-02") + "-" + t.ID.Hex() + ".md"
+		files = append(files, exportFile{name, transcriptMarkdown(t)})
+	}
+	manifest.Files = []string{"manifest.json"}
+	for _, f := range files {
+		manifest.Files = append(manifest.Files, f.name)
+	}
+
+	if err := os.MkdirAll(filepath.Dir(path), 0o700); err != nil {
+		return nil, 0, err
+	}
+	out, err := os.OpenFile(path, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0o600)
+	if err != nil {
+		return nil, 0, err
+	}
+	defer out.Close()
+	zw := zip.NewWriter(out)
+	if err := writeZipJSON(zw, "manifest.json", manifest); err != nil {
+		return nil, 0, err
+	}
+	for _, f := range files {
+		if s, ok := f.data.(string); ok {
+			err = writeZipFile(zw, f.name, []byte(s))
+		} else {
+			err = writeZipJSON(zw, f.name, f.data)
+		}
+		if err != nil {
+			return nil, 0, fmt.Errorf("%s: %w", f.name, err)
+		}
+	}
+	if err := zw.Close(); err != nil {
+		return nil, 0, err
+	}
+	info, err := out.Stat()
+	if err != nil {
+		return nil, 0, err
+	}
+	return manifest, info.Size(), nil
+}
+
+func writeZipFile(zw *zip.Writer, name string, data []byte) error {
+	w, err := zw.CreateHeader(&zip.FileHeader{Name: name, Method: zip.Deflate, Modified: time.Now()})
+	if err != nil {
+		return err
+	}
+	_, err = w.Write(data)
+	return err
+}
+
+func writeZipJSON(zw *zip.Writer, name string, v interface{}) error {
+	data, err := json.MarshalIndent(v, "", "  ")
+	if err != nil {
+		return err
+	}
+	return writeZipFile(zw, name, data)
+}
+
+func exportReadme(user *User, m *ExportManifest) string {
+	var b strings.Builder
+	fmt.Fprintf(&b, "# SpeakApper data export\n\n")
+	fmt.Fprintf(&b, "- Name: %s %s\n- Email: %s\n- Registered: %s\n- Exported: %s\n- Format version: %d\n\n",
+		user.FirstName, user.LastName, user.Email,
+		user.CreatedAt.UTC().Format("2006-01-02"), m.ExportedAt.Format(time.RFC3339), m.Version)
+	fmt.Fprintf(&b, "| Data | Items |\n|---|---|\n")
+	for _, k := range []string{"notes", "materials", "transcripts", "jobs"} {
+		fmt.Fprintf(&b, "| %s | %d |\n", k, m.Counts[k])
+	}
+	b.WriteString("\nThe `.json` files hold the complete data and can be imported back; " +
+		"`notes.md`, `materials.md` and `transcripts/` are the same content for reading.\n")
+	return b.String()
+}
+
+func notesMarkdown(notes []Note) string {
+	var b strings.Builder
+	b.WriteString("# Notes\n")
+	for _, n := range notes {
+		fmt.Fprintf(&b, "\n## %s\n\n_%s_\n\n%s\n", n.Title, n.CreatedAt.UTC().Format("2006-01-02 15:04"), n.Content)
+	}
+	return b.String()
+}
+
+func materialsMarkdown(materials []Material) string {
+	var b strings.Builder
+	b.WriteString("# Study materials\n")
+	for i, m := range materials {
+		fmt.Fprintf(&b, "\n## Material %d (%s)\n", i+1, m.CreatedAt.UTC().Format("2006-01-02 15:04"))
+		if m.Summary != "" {
+			fmt.Fprintf(&b, "\n### Summary\n\n%s\n", m.Summary)
+		}
+		if len(m.Flashcards) > 0 {
+			b.WriteString("\n### Flashcards\n\n")
+			for _, c := range m.Flashcards {
+				fmt.Fprintf(&b, "- **%s** — %s\n", c.Term, c.Definition)
+				if c.Example != "" {
+					fmt.Fprintf(&b, "  _%s_\n", c.Example)
+				}
+			}
+		}
+		if len(m.Quiz) > 0 {
+			b.WriteString("\n### Quiz\n")
+			for j, q := range m.Quiz {
+				fmt.Fprintf(&b, "\n%d. %s\n", j+1, q.Question)
+				for _, o := range q.Options {
+					fmt.Fprintf(&b, "   - %s\n", o)
+				}
+				for _, p := range q.Pairs {
+					fmt.Fprintf(&b, "   - %s\n", strings.Join(p, " ↔ "))
+				}
+				if q.Answer != "" {
+					fmt.Fprintf(&b, "\n   Answer: %s\n", q.Answer)
+				}
+				if q.Rationale != "" {
+					fmt.Fprintf(&b, "\n   %s\n", q.Rationale)
+				}
+			}
+		}
+	}
+	return b.String()
+}
+
+func transcriptMarkdown(t Transcript) string {
+	var b strings.Builder
+	title := t.Title
+	if title == "" {
+		title = "Transcript " + t.CreatedAt.UTC().Format("2006-01-02 15:04")
+	}
+	fmt.Fprintf(&b, "# %s\n\n- Source: %s\n", title, t.Source)
+	if t.URL != "" {
+		fmt.Fprintf(&b, "- URL: %s\n", t.URL)
+	}
+	if t.Language != "" {
+		fmt.Fprintf(&b, "- Language: %s\n", t.Language)
+	}
+	if len(t.Segments) > 0 {
+		fmt.Fprintf(&b, "\n%s\n", formatTimestampedText(t.Segments))
+	} else {
+		fmt.Fprintf(&b, "\n%s\n", t.Text)
+	}
+	return b.String()
+}
+
+// handleCreateExport starts a data export. While one is still being built it is
+// returned instead of starting another.
+func handleCreateExport(w http.ResponseWriter, r *http.Request) {
+	auth := authFromContext(r)
+	ctx, cancel := context.WithTimeout(r.Context(), 5*time.Second)
+	defer cancel()
+
+	now := time.Now()
+	var exp DataExport
+	res := database.Collection("data_exports").FindOneAndUpdate(ctx,
+		bson.M{"user_id": auth.UserID, "status": bson.M{"$in": []string{ExportPending, ExportRunning}}},
+		bson.M{"$setOnInsert": bson.M{
+			"_id":            primitive.NewObjectID(),
+			"status":         ExportPending,
+			"format_version": exportFormatVersion,
+			"created_at":     now,
+			"updated_at":     now,
+		}},
+		options.FindOneAndUpdate().SetUpsert(true).SetReturnDocument(options.After),
+	)
+	if err := res.Decode(&exp); err != nil {
+		log.Printf("[export] create error for user=%s: %v", auth.UserID.Hex(), err)
+		JSONError(w, http.StatusInternalServerError, "Failed to start export")
+		return
+	}
+	if exp.Status == ExportPending {
+		enqueueExport(exp.ID)
+	}
+	JSONResponse(w, http.StatusAccepted, map[string]interface{}{"success": true, "data": exp})
+}
+
+// handleListExports returns the user's recent exports with download links
+func handleListExports(w http.ResponseWriter, r *http.Request) {
+	auth := authFromContext(r)
+	ctx, cancel := context.WithTimeout(r.Context(), 5*time.Second)
+	defer cancel()
+	exports := []DataExport{}
+	cursor, err := database.Collection("data_exports").Find(ctx,
+		bson.M{"user_id": auth.UserID},
+		options.Find().SetSort(bson.M{"created_at": -1}).SetLimit(10),
+	)
+	if err == nil {
+		err = cursor.All(ctx, &exports)
+	}
+	if err != nil {
+		JSONError(w, http.StatusInternalServerError, "Failed to load exports")
+		return
+	}
+	for i := range exports {
+		exports[i].withDownloadURL()
+	}
+	JSONSuccess(w, map[string]interface{}{"exports": exports})
+}
+
+// handleGetExport returns one of the user's exports
+func handleGetExport(w http.ResponseWriter, r *http.Request) {
+	auth := authFromContext(r)
+	id, err := primitive.ObjectIDFromHex(mux.Vars(r)["id"])
+	if err != nil {
+		JSONError(w, http.StatusBadRequest, "Invalid ID format")
+		return
+	}
+	ctx, cancel := context.WithTimeout(r.Context(), 5*time.Second)
+	defer cancel()
+	var exp DataExport
+	if err := database.Collection("data_exports").FindOne(ctx, bson.M{"_id": id, "user_id": auth.UserID}).Decode(&exp); err != nil {
+		JSONError(w, http.StatusNotFound, "Export not found")
+		return
+	}
+	JSONSuccess(w, exp.withDownloadURL())
+}
+
+// handleDownloadExport serves the archive to a signed, unexpired link. It needs no
+// Authorization header so the link works as a plain browser download.
+func handleDownloadExport(w http.ResponseWriter, r *http.Request) {
+	id, err := primitive.ObjectIDFromHex(mux.Vars(r)["id"])
+	if err != nil {
+		JSONError(w, http.StatusBadRequest, "Invalid ID format")
+		return
+	}
+	expires, _ := strconv.ParseInt(r.URL.Query().Get("expires"), 10, 64)
+	sig := r.URL.Query().Get("sig")
+	if expires < time.Now().Unix() || !hmac.Equal([]byte(sig), []byte(urlSignature("export", id, expires))) {
+		JSONError(w, http.StatusForbidden, "Download link is invalid or expired")
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(r.Context(), 5*time.Second)
+	defer cancel()
+	var exp DataExport
+	if err := database.Collection("data_exports").FindOne(ctx, bson.M{"_id": id, "status": ExportDone}).Decode(&exp); err != nil {
+		JSONError(w, http.StatusNotFound, "Export not found")
+		return
+	}
+	body, err := blobStore.Open(r.Context(), exportKey(exp.UserID, id), 0, -1)
+	if err != nil {
+		if !errors.Is(err, errBlobNotFound) {
+			log.Printf("[export] download %s: %v", id.Hex(), err)
+		}
+		JSONError(w, http.StatusNotFound, "Export not found")
+		return
+	}
+	defer body.Close()
+
+	name := "speakapper-export-" + exp.CreatedAt.UTC().Format("2006-01-02") + ".zip"
+	w.Header().Set("Content-Type", "application/zip")
+	w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=%q", name))
+	w.Header().Set("Content-Length", strconv.FormatInt(exp.Size, 10))
+	w.Header().Set("Cache-Control", "private, no-store")
+	if _, err := io.Copy(w, body); err != nil {
+		log.Printf("[export] download %s interrupted: %v", id.Hex(), err)
+	}
+}
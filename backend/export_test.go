@@ -0,0 +1,212 @@
+package main
+
+import (
+	"archive/zip"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/mux"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// useTestExports gives the exports a fresh blob store
+func useTestExports(t *testing.T) {
+	t.Helper()
+	useTestDatabase(t)
+	prev := blobStore
+	blobStore = &LocalBlobStore{Dir: t.TempDir()}
+	t.Cleanup(func() { blobStore = prev })
+}
+
+// insertExportUser creates a user with one note and one transcript
+func insertExportUser(t *testing.T) primitive.ObjectID {
+	t.Helper()
+	ctx := t.Context()
+	userID := primitive.NewObjectID()
+	if _, err := database.Collection("users").InsertOne(ctx, User{ID: userID.Hex(), FirstName: "Ada", Email: "ada@example.com", Password: "hash"}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := database.Collection("notes").InsertOne(ctx, Note{ID: primitive.NewObjectID(), UserID: userID, Title: "Lecture 1", Content: "Analytical engine", CreatedAt: time.Now()}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := database.Collection("transcripts").InsertOne(ctx, Transcript{ID: primitive.NewObjectID(), UserID: userID, Source: TranscriptSourceUpload, Text: "hello", CreatedAt: time.Now()}); err != nil {
+		t.Fatal(err)
+	}
+	// Someone else's data must not end up in the archive
+	database.Collection("notes").InsertOne(ctx, Note{ID: primitive.NewObjectID(), UserID: primitive.NewObjectID(), Title: "Not mine"})
+	return userID
+}
+
+// downloadExport calls handleDownloadExport with the query of a download link
+func downloadExport(t *testing.T, id primitive.ObjectID, query url.Values) *httptest.ResponseRecorder {
+	t.Helper()
+	r := httptest.NewRequest(http.MethodGet, "/api/exports/"+id.Hex()+"/download?"+query.Encode(), nil)
+	r = mux.SetURLVars(r, map[string]string{"id": id.Hex()})
+	w := httptest.NewRecorder()
+	handleDownloadExport(w, r)
+	return w
+}
+
+func signedExportQuery(id primitive.ObjectID, expires time.Time) url.Values {
+	return url.Values{
+		"expires": {strconv.FormatInt(expires.Unix(), 10)},
+		"sig":     {urlSignature("export", id, expires.Unix())},
+	}
+}
+
+func TestDownloadExportRejectsBadLinks(t *testing.T) {
+	id := primitive.NewObjectID()
+	future := time.Now().Add(time.Hour)
+	past := time.Now().Add(-time.Minute)
+	tests := []struct {
+		name  string
+		query url.Values
+	}{
+		{"no signature", url.Values{"expires": {strconv.FormatInt(future.Unix(), 10)}}},
+		{"expired", signedExportQuery(id, past)},
+		{"expiry moved", url.Values{"expires": {strconv.FormatInt(future.Unix()+3600, 10)}, "sig": signedExportQuery(id, future)["sig"]}},
+		{"other export", signedExportQuery(primitive.NewObjectID(), future)},
+		{"audio link", url.Values{"expires": {strconv.FormatInt(future.Unix(), 10)}, "sig": {urlSignature("audio", id, future.Unix())}}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			// Rejected before the database is touched, so no MongoDB is needed
+			if w := downloadExport(t, id, tt.query); w.Code != http.StatusForbidden {
+				t.Fatalf("download = %d %s, want 403", w.Code, w.Body)
+			}
+		})
+	}
+}
+
+func TestBuildExportManifest(t *testing.T) {
+	useTestExports(t)
+	userID := insertExportUser(t)
+
+	path := filepath.Join(t.TempDir(), "export.zip")
+	manifest, size, err := buildExport(userID, path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	zr, err := zip.OpenReader(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer zr.Close()
+	if size == 0 {
+		t.Fatal("size = 0")
+	}
+
+	files := map[string][]byte{}
+	var names []string
+	for _, f := range zr.File {
+		rc, _ := f.Open()
+		b, _ := io.ReadAll(rc)
+		rc.Close()
+		files[f.Name] = b
+		names = append(names, f.Name)
+	}
+	if names[0] != "manifest.json" {
+		t.Fatalf("first file = %s, want manifest.json", names[0])
+	}
+	var m ExportManifest
+	if err := json.Unmarshal(files["manifest.json"], &m); err != nil {
+		t.Fatal(err)
+	}
+	if m.Format != "speakapper-export" || m.Version != exportFormatVersion || m.UserID != userID.Hex() {
+		t.Fatalf("manifest = %+v", m)
+	}
+	if m.Counts["notes"] != 1 || m.Counts["transcripts"] != 1 || m.Counts["materials"] != 0 {
+		t.Fatalf("counts = %v", m.Counts)
+	}
+	// The manifest lists exactly the files of the archive
+	listed := append([]string(nil), m.Files...)
+	sort.Strings(listed)
+	sort.Strings(names)
+	if strings.Join(listed, ",") != strings.Join(names, ",") {
+		t.Fatalf("manifest files %v, archive %v", m.Files, names)
+	}
+	if len(manifest.Files) != len(m.Files) {
+		t.Fatalf("returned manifest lists %d files, archive %d", len(manifest.Files), len(m.Files))
+	}
+
+	var notes []Note
+	if err := json.Unmarshal(files["notes.json"], &notes); err != nil || len(notes) != 1 || notes[0].Title != "Lecture 1" {
+		t.Fatalf("notes.json = %s", files["notes.json"])
+	}
+	if bytes.Contains(files["user.json"], []byte("hash")) || !bytes.Contains(files["user.json"], []byte(`"hasPassword": true`)) {
+		t.Fatalf("user.json = %s, want no password but hasPassword", files["user.json"])
+	}
+	if !bytes.Contains(files["notes.md"], []byte("Analytical engine")) {
+		t.Fatalf("notes.md = %s", files["notes.md"])
+	}
+}
+
+func TestExportIsDownloadableFromAnyInstance(t *testing.T) {
+	useTestExports(t)
+	userID := insertExportUser(t)
+	ctx := t.Context()
+
+	r := withAuth(httptest.NewRequest(http.MethodPost, "/api/user/exports", nil), userID)
+	w := httptest.NewRecorder()
+	handleCreateExport(w, r)
+	if w.Code != http.StatusAccepted {
+		t.Fatalf("create = %d %s", w.Code, w.Body)
+	}
+	id := <-exportQueue
+	runExport(id)
+
+	var exp DataExport
+	if err := database.Collection("data_exports").FindOne(ctx, bson.M{"_id": id}).Decode(&exp); err != nil {
+		t.Fatal(err)
+	}
+	if exp.Status != ExportDone || exp.ExpiresAt == nil {
+		t.Fatalf("export = %+v", exp)
+	}
+	link, err := url.Parse(exp.withDownloadURL().DownloadURL)
+	if err != nil || link.Path != "/api/exports/"+id.Hex()+"/download" {
+		t.Fatalf("download url = %q", exp.DownloadURL)
+	}
+
+	// Nothing is kept on the disk of the instance that built it
+	w = downloadExport(t, id, link.Query())
+	if w.Code != http.StatusOK || w.Header().Get("Content-Type") != "application/zip" {
+		t.Fatalf("download = %d %s", w.Code, w.Body)
+	}
+	if _, err := zip.NewReader(bytes.NewReader(w.Body.Bytes()), int64(w.Body.Len())); err != nil {
+		t.Fatalf("downloaded archive: %v", err)
+	}
+
+	// Another user neither sees the export nor gets a link to it
+	other := mux.SetURLVars(withAuth(httptest.NewRequest(http.MethodGet, "/api/user/exports/"+id.Hex(), nil), primitive.NewObjectID()), map[string]string{"id": id.Hex()})
+	w = httptest.NewRecorder()
+	handleGetExport(w, other)
+	if w.Code != http.StatusNotFound {
+		t.Fatalf("someone else's export = %d, want 404", w.Code)
+	}
+
+	// Past its expiry the archive is deleted from the store
+	database.Collection("data_exports").UpdateOne(ctx, bson.M{"_id": id}, bson.M{"$set": bson.M{"expires_at": time.Now().Add(-time.Minute)}})
+	expireExports()
+	if _, err := blobStore.Open(ctx, exportKey(userID, id), 0, -1); !errors.Is(err, errBlobNotFound) {
+		t.Fatalf("archive after expiry: %v, want it deleted", err)
+	}
+	database.Collection("data_exports").FindOne(ctx, bson.M{"_id": id}).Decode(&exp)
+	if exp.Status != ExportExpired {
+		t.Fatalf("status = %s, want expired", exp.Status)
+	}
+	if w := downloadExport(t, id, link.Query()); w.Code != http.StatusNotFound {
+		t.Fatalf("download after expiry = %d, want 404", w.Code)
+	}
+}
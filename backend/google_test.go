@@ -0,0 +1,200 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/rsa"
+	"encoding/base64"
+	"encoding/json"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+)
+
+// testKeyServer publishes an RSA key as a JWKS and signs tokens with it
+type testKeyServer struct {
+	*httptest.Server
+	key *rsa.PrivateKey
+	kid string
+}
+
+func newTestKeyServer(t *testing.T) *testKeyServer {
+	t.Helper()
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ks := &testKeyServer{key: key, kid: "test-key"}
+	ks.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Cache-Control", "public, max-age=600")
+		json.NewEncoder(w).Encode(map[string]interface{}{"keys": []map[string]string{{
+			"kty": "RSA",
+			"kid": ks.kid,
+			"n":   base64.RawURLEncoding.EncodeToString(key.N.Bytes()),
+			"e":   base64.RawURLEncoding.EncodeToString(big.NewInt(int64(key.E)).Bytes()),
+		}}})
+	}))
+	t.Cleanup(ks.Close)
+	return ks
+}
+
+// sign returns an RS256 token with the server's key id
+func (ks *testKeyServer) sign(t *testing.T, claims jwt.MapClaims) string {
+	t.Helper()
+	tok := jwt.NewWithClaims(jwt.SigningMethodRS256, claims)
+	tok.Header["kid"] = ks.kid
+	s, err := tok.SignedString(ks.key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return s
+}
+
+func googleClaims(overrides jwt.MapClaims) jwt.MapClaims {
+	now := time.Now()
+	claims := jwt.MapClaims{
+		"iss":            "https://accounts.google.com",
+		"aud":            "web-client",
+		"sub":            "1234567890",
+		"email":          "ada@example.com",
+		"email_verified": true,
+		"given_name":     "Ada",
+		"iat":            now.Unix(),
+		"exp":            now.Add(time.Hour).Unix(),
+	}
+	for k, v := range overrides {
+		if v == nil {
+			delete(claims, k)
+			continue
+		}
+		claims[k] = v
+	}
+	return claims
+}
+
+func TestGoogleVerifyIDToken(t *testing.T) {
+	ks := newTestKeyServer(t)
+	other := newTestKeyServer(t)
+	v := &GoogleVerifier{
+		ClientIDs:  []string{"web-client", "ios-client"},
+		HTTPClient: ks.Client(),
+		jwks:       &JWKSCache{URL: ks.URL, HTTPClient: ks.Client()},
+	}
+
+	tests := []struct {
+		name    string
+		token   string
+		wantErr string
+	}{
+		{"valid", ks.sign(t, googleClaims(nil)), ""},
+		{"second client id", ks.sign(t, googleClaims(jwt.MapClaims{"aud": "ios-client"})), ""},
+		{"legacy string email_verified", ks.sign(t, googleClaims(jwt.MapClaims{"email_verified": "true"})), ""},
+		{"other audience", ks.sign(t, googleClaims(jwt.MapClaims{"aud": "someone-else"})), "audience"},
+		{"other issuer", ks.sign(t, googleClaims(jwt.MapClaims{"iss": "https://evil.example"})), "issuer"},
+		{"expired", ks.sign(t, googleClaims(jwt.MapClaims{"exp": time.Now().Add(-time.Hour).Unix()})), "expired"},
+		{"no expiry", ks.sign(t, googleClaims(jwt.MapClaims{"exp": nil})), "exp"},
+		{"unverified email", ks.sign(t, googleClaims(jwt.MapClaims{"email_verified": false})), "email not verified"},
+		{"no email", ks.sign(t, googleClaims(jwt.MapClaims{"email": nil})), "no email"},
+		{"signed by unknown key", other.sign(t, googleClaims(jwt.MapClaims{})), "verification error"},
+		{"garbage", "not.a.token", "invalid Google ID token"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			info, err := v.VerifyIDToken(context.Background(), tt.token)
+			if tt.wantErr == "" {
+				if err != nil {
+					t.Fatalf("unexpected error: %v", err)
+				}
+				if info.Email != "ada@example.com" || info.ID != "1234567890" || !info.VerifiedEmail {
+					t.Fatalf("unexpected profile: %+v", info)
+				}
+				return
+			}
+			if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+				t.Fatalf("error = %v, want it to contain %q", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestGoogleVerifyIDTokenNotConfigured(t *testing.T) {
+	v := &GoogleVerifier{}
+	if _, err := v.VerifyIDToken(context.Background(), "x"); err != errGoogleNotConfigured {
+		t.Fatalf("error = %v, want errGoogleNotConfigured", err)
+	}
+}
+
+func TestGoogleVerifyAccessToken(t *testing.T) {
+	tests := []struct {
+		name     string
+		aud      string
+		userInfo string
+		wantErr  string
+	}{
+		{"verified", "web-client", `{"id":"1","email":"ada@example.com","verified_email":true}`, ""},
+		{"unverified email", "web-client", `{"id":"1","email":"ada@example.com","verified_email":false}`, "email not verified"},
+		{"missing verified flag", "web-client", `{"id":"1","email":"ada@example.com"}`, "email not verified"},
+		{"other client", "someone-else", `{"id":"1","email":"ada@example.com","verified_email":true}`, "another client"},
+		{"no email", "web-client", `{"id":"1","verified_email":true}`, "no email"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			mux := http.NewServeMux()
+			mux.HandleFunc("/tokeninfo", func(w http.ResponseWriter, r *http.Request) {
+				if r.Method != http.MethodPost || r.FormValue("access_token") != "tok" {
+					http.Error(w, "bad request", http.StatusBadRequest)
+					return
+				}
+				w.Write([]byte(`{"aud":"` + tt.aud + `"}`))
+			})
+			mux.HandleFunc("/userinfo", func(w http.ResponseWriter, r *http.Request) {
+				if r.Header.Get("Authorization") != "Bearer tok" {
+					http.Error(w, "unauthorized", http.StatusUnauthorized)
+					return
+				}
+				w.Write([]byte(tt.userInfo))
+			})
+			srv := httptest.NewServer(mux)
+			defer srv.Close()
+
+			v := &GoogleVerifier{
+				ClientIDs:    []string{"web-client"},
+				TokenInfoURL: srv.URL + "/tokeninfo",
+				UserInfoURL:  srv.URL + "/userinfo",
+				HTTPClient:   srv.Client(),
+			}
+			info, err := v.VerifyAccessToken(context.Background(), "tok")
+			if tt.wantErr == "" {
+				if err != nil || info.Email != "ada@example.com" {
+					t.Fatalf("info = %+v, err = %v", info, err)
+				}
+				return
+			}
+			if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+				t.Fatalf("error = %v, want it to contain %q", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestJWKSCacheRefetchesOnUnknownKid(t *testing.T) {
+	ks := newTestKeyServer(t)
+	cache := &JWKSCache{URL: ks.URL, HTTPClient: ks.Client()}
+	if _, err := cache.Key(context.Background(), ks.kid); err != nil {
+		t.Fatal(err)
+	}
+	// A rotated key is only looked up again after jwksMinRefresh
+	ks.kid = "rotated"
+	if _, err := cache.Key(context.Background(), "rotated"); err == nil {
+		t.Fatal("expected unknown kid to be rejected within jwksMinRefresh")
+	}
+	cache.fetchedAt = time.Now().Add(-2 * jwksMinRefresh)
+	if _, err := cache.Key(context.Background(), "rotated"); err != nil {
+		t.Fatalf("rotated key not picked up: %v", err)
+	}
+}
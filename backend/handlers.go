@@ -1,13 +1,10 @@
 package main
 
 import (
-	"bytes"
 	"context"
 	"encoding/json"
-	"fmt"
 	"io"
 	"log"
-	"mime/multipart"
 	"net/http"
 	"os"
 	"path/filepath"
@@ -79,20 +76,25 @@ func signupHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	// Generate JWT token
-	token, err := generateJWT(user)
+	// Transcription and generation stay locked until the address is confirmed
+	sendEmailAsync(user, sendVerificationEmail)
+
+	// Start a device session: short-lived access token + rotating refresh token
+	tokens, err := startSession(r, user)
 	if err != nil {
-		log.Printf("Error generating JWT: %v", err)
+		log.Printf("Error starting session: %v", err)
 		JSONError(w, http.StatusInternalServerError, "Internal server error")
 		return
 	}
 
 	// Send response
 	JSONResponse(w, http.StatusOK, SignupResponse{
-		Success: true,
-		Message: "User registered successfully",
-		User:    user,
-		Token:   token,
+		Success:      true,
+		Message:      "User registered successfully",
+		User:         user,
+		Token:        tokens.AccessToken,
+		RefreshToken: tokens.RefreshToken,
+		ExpiresIn:    tokens.ExpiresIn,
 	})
 }
 
@@ -109,34 +111,32 @@ func loginHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	// Get user from database
-	user, err := GetUserByEmail(req.Email)
-	if err != nil {
-		JSONError(w, http.StatusUnauthorized, "Invalid credentials")
+	// Progressive lockout after repeated failures (see lockout.go)
+	ctx, cancel := context.WithTimeout(r.Context(), 5*time.Second)
+	defer cancel()
+	if wait := loginLockRemaining(ctx, req.Email, clientIP(r)); wait > 0 {
+		writeLoginLocked(w, wait)
 		return
 	}
 
-	// Check password
-	if err := bcrypt.CompareHashAndPassword([]byte(user.Password), []byte(req.Password)); err != nil {
-		JSONError(w, http.StatusUnauthorized, "Invalid credentials")
-		return
+	// Get user from database
+	user, err := GetUserByEmail(req.Email)
+	if err == nil {
+		// Check password
+		err = bcrypt.CompareHashAndPassword([]byte(user.Password), []byte(req.Password))
 	}
-
-	// Generate JWT token
-	token, err := generateJWT(user)
 	if err != nil {
-		log.Printf("Error generating JWT: %v", err)
-		JSONError(w, http.StatusInternalServerError, "Internal server error")
+		if wait := recordLoginFailure(ctx, req.Email, clientIP(r)); wait > 0 {
+			writeLoginLocked(w, wait)
+			return
+		}
+		JSONError(w, http.StatusUnauthorized, "Invalid credentials")
 		return
 	}
 
-	// Send response
-	JSONResponse(w, http.StatusOK, map[string]interface{}{
-		"success": true,
-		"message": "Login successful",
-		"user":    user,
-		"token":   token,
-	})
+	// Session, or a 2FA challenge when the user has two-factor authentication on.
+	// The failure streak is cleared only once the session is issued (after the second factor).
+	completeLogin(w, r, user, "Login successful")
 }
 
 // googleSignupHandler handles Google OAuth signup
@@ -195,13 +195,27 @@ func googleSignupHandler(w http.ResponseWriter, r *http.Request) {
 			JSONError(w, http.StatusInternalServerError, "Internal server error")
 			return
 		}
+		// Google has confirmed the mailbox of an account that was never verified:
+		// it goes to the mailbox owner, not to whoever registered it with a password
+		if !user.EmailVerified && googleUser.VerifiedEmail {
+			if err := claimUnverifiedAccount(user, "google"); err != nil {
+				log.Printf("Error claiming unverified account: %v", err)
+				JSONError(w, http.StatusInternalServerError, "Internal server error")
+				return
+			}
+		}
 	} else {
 		// Create new user
 		user = &User{
-			FirstName: googleUser.GivenName,
-			LastName:  googleUser.FamilyName,
-			Email:     googleUser.Email,
-			Password:  "", // Google users don't have passwords
+			FirstName:     googleUser.GivenName,
+			LastName:      googleUser.FamilyName,
+			Email:         googleUser.Email,
+			Password:      "", // Google users don't have passwords
+			EmailVerified: googleUser.VerifiedEmail,
+		}
+		if user.EmailVerified {
+			now := time.Now()
+			user.EmailVerifiedAt = &now
 		}
 
 		if err := CreateUser(user); err != nil {
@@ -211,45 +225,23 @@ func googleSignupHandler(w http.ResponseWriter, r *http.Request) {
 		}
 	}
 
-	// Generate JWT token
-	token, err := generateJWT(user)
-	if err != nil {
-		log.Printf("Error generating JWT: %v", err)
-		JSONError(w, http.StatusInternalServerError, "Internal server error")
-		return
-	}
-
-	// Send response
-	JSONResponse(w, http.StatusOK, map[string]interface{}{
-		"success": true,
-		"message": "Google authentication successful",
-		"user":    user,
-		"token":   token,
-	})
-}
-
-// getAllUsersHandler handles getting all users
-func getAllUsersHandler(w http.ResponseWriter, r *http.Request) {
-	users, err := GetAllUsers()
-	if err != nil {
-		JSONErrorWithDetails(w, http.StatusInternalServerError, "Ошибка при получении пользователей", err.Error())
-		return
-	}
-
-	JSONResponse(w, http.StatusOK, map[string]interface{}{
-		"success": true,
-		"users":   users,
-		"count":   len(users),
-	})
+	// Session, or a 2FA challenge when the user has two-factor authentication on
+	completeLogin(w, r, user, "Google authentication successful")
 }
 
-// handleTranscribe handles audio file transcription
+// handleTranscribe accepts an audio upload and queues a background transcription job.
+// Progress is available via GET /api/jobs/{id}.
 func handleTranscribe(w http.ResponseWriter, r *http.Request) {
 	if r.Method != "POST" {
 		JSONError(w, http.StatusMethodNotAllowed, "Method not allowed")
 		return
 	}
 
+	userID := authFromContext(r).UserID
+	if !requireQuota(w, userID, UsageAudio) {
+		return
+	}
+
 	// Parse multipart form (allow large files)
 	if err := r.ParseMultipartForm(1024 << 20); err != nil { // 1GB streamed to temp
 		JSONError(w, http.StatusBadRequest, "Failed to parse form")
@@ -265,101 +257,96 @@ func handleTranscribe(w http.ResponseWriter, r *http.Request) {
 
 	log.Printf("Received audio file: %s, size: %d bytes", header.Filename, header.Size)
 
-	// Save upload to temp file on disk to avoid memory issues
-	tmpDir := os.TempDir()
-	tmpIn := filepath.Join(tmpDir, fmt.Sprintf("upload_%d_%s", time.Now().UnixNano(), filepath.Base(header.Filename)))
-	out, err := os.Create(tmpIn)
+	// Save upload into the job directory so it survives until the job finishes
+	// Dashboard recordings are marked with source=recording
+	source := TranscriptSourceUpload
+	if r.FormValue("source") == TranscriptSourceRecording {
+		source = TranscriptSourceRecording
+	}
+	job := &TranscriptionJob{
+		ID:       primitive.NewObjectID(),
+		UserID:   userID,
+		Source:   source,
+		Filename: filepath.Base(header.Filename),
+		Size:     header.Size,
+		Language: r.FormValue("language"),
+		Mode:     "single",
+	}
+	if job.Language == "auto" {
+		job.Language = ""
+	}
+	// Threshold for long audio (e.g., > 20MB)
+	if header.Size > longAudioThreshold {
+		job.Mode = "segmented"
+	}
+
+	workDir := jobWorkDir(job.ID)
+	if err := os.MkdirAll(workDir, 0o755); err != nil {
+		JSONError(w, http.StatusInternalServerError, "Failed to create job directory")
+		return
+	}
+	job.InputPath = filepath.Join(workDir, "input"+filepath.Ext(job.Filename))
+	out, err := os.Create(job.InputPath)
 	if err != nil {
+		os.RemoveAll(workDir)
 		JSONError(w, http.StatusInternalServerError, "Failed to create temp file")
 		return
 	}
 	if _, err := io.Copy(out, file); err != nil {
 		out.Close()
-		os.Remove(tmpIn)
+		os.RemoveAll(workDir)
 		JSONError(w, http.StatusInternalServerError, "Failed to save file")
 		return
 	}
 	out.Close()
-	defer os.Remove(tmpIn)
 
-	// Threshold for long audio (e.g., > 20MB)
-	const longThreshold = 20 * 1024 * 1024
-	if header.Size > longThreshold {
-		text, err := transcribeLongAudio(tmpIn, "")
-		if err != nil {
-			log.Printf("Long transcription error: %v", err)
-			JSONError(w, http.StatusInternalServerError, "Transcription failed")
+	if err := submitUploadedJob(r, job); err != nil {
+		if ue, ok := err.(*UpgradeRequiredError); ok {
+			writeUpgradeRequired(w, ue)
 			return
 		}
-		JSONResponse(w, http.StatusOK, map[string]interface{}{
-			"success":       true,
-			"transcription": text,
-			"filename":      header.Filename,
-			"size":          header.Size,
-			"mode":          "segmented",
-		})
-		return
-	}
-
-	// Small file: read and send directly
-	fileBytes, err := os.ReadFile(tmpIn)
-	if err != nil {
-		JSONError(w, http.StatusInternalServerError, "Failed to read temp file")
+		log.Printf("Error creating transcription job: %v", err)
+		JSONError(w, http.StatusInternalServerError, "Failed to create transcription job")
 		return
 	}
 
-	var requestBody bytes.Buffer
-	writer := multipart.NewWriter(&requestBody)
-	part, err := writer.CreateFormFile("file", header.Filename)
-	if err != nil {
-		JSONError(w, http.StatusInternalServerError, "Failed to create form file")
-		return
-	}
-	part.Write(fileBytes)
-	writer.WriteField("model", "whisper-1")
-	writer.Close()
+	JSONResponse(w, http.StatusAccepted, map[string]interface{}{
+		"success":  true,
+		"jobId":    job.ID.Hex(),
+		"status":   job.Status,
+		"filename": header.Filename,
+		"size":     header.Size,
+		"mode":     job.Mode,
+	})
+}
 
-	req, err := http.NewRequest("POST", "https://api.openai.com/v1/audio/transcriptions", &requestBody)
-	if err != nil {
-		JSONError(w, http.StatusInternalServerError, "Failed to create request")
-		return
+// submitUploadedJob checks the saved input against the plan, copies it to the blob store,
+// then creates and queues the job. The job directory and the copy are removed when the
+// job is not created.
+func submitUploadedJob(r *http.Request, job *TranscriptionJob) error {
+	workDir := jobWorkDir(job.ID)
+	// Plans cap the length of a single recording
+	if d, err := probeAudioDuration(job.InputPath); err == nil {
+		job.Duration = d
+		pe := entitlementsFromContext(r, job.UserID)
+		if err := checkAudioLength(pe.Plan, pe.Entitlements, d); err != nil {
+			os.RemoveAll(workDir)
+			return err
+		}
+	} else {
+		log.Printf("submitUploadedJob: %v", err)
 	}
-	req.Header.Set("Authorization", "Bearer "+openaiAPIKey)
-	req.Header.Set("Content-Type", writer.FormDataContentType())
 
-	client := &http.Client{Timeout: 120 * time.Second}
-	resp, err := client.Do(req)
-	if err != nil {
-		log.Printf("OpenAI API error: %v", err)
-		JSONError(w, http.StatusInternalServerError, "Failed to transcribe audio")
-		return
+	if err := storeJobInput(r.Context(), job); err != nil {
+		os.RemoveAll(workDir)
+		return err
 	}
-	defer resp.Body.Close()
-
-	respBody, err := io.ReadAll(resp.Body)
-	if err != nil {
-		JSONError(w, http.StatusInternalServerError, "Failed to read response")
-		return
-	}
-	if resp.StatusCode != http.StatusOK {
-		log.Printf("OpenAI API error: %s - %s", resp.Status, string(respBody))
-		JSONError(w, http.StatusInternalServerError, "Transcription failed")
-		return
+	if err := CreateJob(job); err != nil {
+		cleanupJob(job)
+		return err
 	}
-
-	var whisperResp WhisperResponse
-	if err := json.Unmarshal(respBody, &whisperResp); err != nil {
-		JSONError(w, http.StatusInternalServerError, "Failed to parse response")
-		return
-	}
-
-	JSONResponse(w, http.StatusOK, map[string]interface{}{
-		"success":       true,
-		"transcription": whisperResp.Text,
-		"filename":      header.Filename,
-		"size":          header.Size,
-		"mode":          "single",
-	})
+	enqueueJob(job.ID)
+	return nil
 }
 
 // getNoteByID gets a single note by ID with ownership check
@@ -419,6 +406,9 @@ func getMaterialByID(w http.ResponseWriter, r *http.Request) {
 		JSONError(w, http.StatusNotFound, "Not found")
 		return
 	}
+	mats := []Material{mat}
+	fillMaterialTranscripts(mats)
+	mat = mats[0]
 
 	ff := mat.Flashcards
 	if ff == nil {
@@ -429,14 +419,15 @@ func getMaterialByID(w http.ResponseWriter, r *http.Request) {
 		qq = []QuizQuestion{}
 	}
 	JSONResponse(w, http.StatusOK, map[string]interface{}{"success": true, "material": map[string]interface{}{
-		"id":         mat.ID,
-		"user_id":    mat.UserID,
-		"transcript": mat.Transcript,
-		"flashcards": ff,
-		"quiz":       qq,
-		"summary":    mat.Summary,
-		"created_at": mat.CreatedAt,
-		"updated_at": mat.UpdatedAt,
+		"id":            mat.ID,
+		"user_id":       mat.UserID,
+		"transcript_id": mat.TranscriptID,
+		"transcript":    mat.Transcript,
+		"flashcards":    ff,
+		"quiz":          qq,
+		"summary":       mat.Summary,
+		"created_at":    mat.CreatedAt,
+		"updated_at":    mat.UpdatedAt,
 	}})
 }
 
@@ -473,6 +464,7 @@ func getUserHandler(w http.ResponseWriter, r *http.Request) {
 
 	log.Printf("[getUserHandler] Found user: %s %s (%s)", user.FirstName, user.LastName, user.Email)
 	// Don't return password hash
+	user.HasPassword = user.Password != ""
 	user.Password = ""
 
 	JSONResponse(w, http.StatusOK, user)
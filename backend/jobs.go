@@ -0,0 +1,622 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// Files above this size are split into ~10-minute chunks before transcription
+const longAudioThreshold = 20 * 1024 * 1024
+
+// Length of one ffmpeg segment in seconds
+const chunkSeconds = 600
+
+// transcribeConcurrency limits parallel chunk uploads within one job (TRANSCRIBE_CONCURRENCY)
+var transcribeConcurrency = 3
+
+// jobQueue delivers job IDs to the background workers
+var jobQueue = make(chan primitive.ObjectID, 256)
+
+// jobsDir returns the directory where job inputs and chunks are kept between restarts
+func jobsDir() string {
+	if d := os.Getenv("JOBS_DIR"); d != "" {
+		return d
+	}
+	return filepath.Join(os.TempDir(), "speakapper-jobs")
+}
+
+// jobWorkDir returns the working directory of a single job
+func jobWorkDir(id primitive.ObjectID) string {
+	return filepath.Join(jobsDir(), id.Hex())
+}
+
+// jobInputKey is where the input of a job is kept in the blob store until the job ends
+func jobInputKey(job *TranscriptionJob) string {
+	return "jobs/" + job.ID.Hex() + "/input" + filepath.Ext(job.InputPath)
+}
+
+// storeJobInput copies the job input to the blob store and sets job.InputKey, so a job
+// resumed after a restart or on another instance does not depend on this instance's disk
+func storeJobInput(ctx context.Context, job *TranscriptionJob) error {
+	f, err := os.Open(job.InputPath)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	info, err := f.Stat()
+	if err != nil {
+		return err
+	}
+	key := jobInputKey(job)
+	if err := blobStore.Put(ctx, key, f, info.Size(), "application/octet-stream"); err != nil {
+		return fmt.Errorf("storing job input: %w", err)
+	}
+	job.InputKey = key
+	return nil
+}
+
+// cleanupJob removes the local work directory and the stored input of a finished job
+func cleanupJob(job *TranscriptionJob) {
+	os.RemoveAll(jobWorkDir(job.ID))
+	if job.InputKey == "" {
+		return
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+	if err := blobStore.Delete(ctx, job.InputKey); err != nil {
+		log.Printf("[jobs] job=%s failed to delete input %s: %v", job.ID.Hex(), job.InputKey, err)
+	}
+}
+
+// CreateJob saves a new transcription job
+func CreateJob(job *TranscriptionJob) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	if job.ID.IsZero() {
+		job.ID = primitive.NewObjectID()
+	}
+	job.CreatedAt = time.Now()
+	job.UpdatedAt = job.CreatedAt
+	if job.Status == "" {
+		job.Status = JobStatusQueued
+	}
+	if job.Stage == "" {
+		job.Stage = StageQueued
+	}
+
+	_, err := database.Collection("jobs").InsertOne(ctx, job)
+	return err
+}
+
+// GetJob loads a transcription job by ID
+func GetJob(id primitive.ObjectID) (*TranscriptionJob, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	var job TranscriptionJob
+	if err := database.Collection("jobs").FindOne(ctx, bson.M{"_id": id}).Decode(&job); err != nil {
+		return nil, err
+	}
+	return &job, nil
+}
+
+// UpdateJob applies a $set to the job and bumps updated_at
+func UpdateJob(id primitive.ObjectID, set bson.M) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	set["updated_at"] = time.Now()
+	_, err := database.Collection("jobs").UpdateOne(ctx, bson.M{"_id": id}, bson.M{"$set": set})
+	return err
+}
+
+// claimJob atomically moves a queued job into the running state.
+// Returns mongo.ErrNoDocuments if the job was already taken.
+func claimJob(id primitive.ObjectID) (*TranscriptionJob, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	var job TranscriptionJob
+	err := database.Collection("jobs").FindOneAndUpdate(ctx,
+		bson.M{"_id": id, "status": JobStatusQueued},
+		bson.M{"$set": bson.M{"status": JobStatusRunning, "updated_at": time.Now()}},
+		options.FindOneAndUpdate().SetReturnDocument(options.After),
+	).Decode(&job)
+	if err != nil {
+		return nil, err
+	}
+	return &job, nil
+}
+
+// enqueueJob hands the job to the workers without blocking the caller
+func enqueueJob(id primitive.ObjectID) {
+	select {
+	case jobQueue <- id:
+	default:
+		go func() { jobQueue <- id }()
+	}
+}
+
+// startJobWorkers launches n background workers processing jobQueue
+func startJobWorkers(n int) {
+	if n < 1 {
+		n = 1
+	}
+	for i := 0; i < n; i++ {
+		go func(worker int) {
+			for id := range jobQueue {
+				runJob(worker, id)
+			}
+		}(i)
+	}
+	log.Printf("✅ Started %d transcription job workers", n)
+}
+
+// resumeJobs re-enqueues jobs interrupted by a restart.
+// Running jobs are moved back to queued; finished chunks are kept and skipped.
+func resumeJobs() {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	coll := database.Collection("jobs")
+	if _, err := coll.UpdateMany(ctx,
+		bson.M{"status": JobStatusRunning},
+		bson.M{"$set": bson.M{"status": JobStatusQueued, "updated_at": time.Now()}},
+	); err != nil {
+		log.Printf("[jobs] failed to reset running jobs: %v", err)
+		return
+	}
+
+	cursor, err := coll.Find(ctx, bson.M{"status": JobStatusQueued}, options.Find().SetProjection(bson.M{"_id": 1}))
+	if err != nil {
+		log.Printf("[jobs] failed to load queued jobs: %v", err)
+		return
+	}
+	defer cursor.Close(ctx)
+
+	var pending []struct {
+		ID primitive.ObjectID `bson:"_id"`
+	}
+	if err := cursor.All(ctx, &pending); err != nil {
+		log.Printf("[jobs] failed to decode queued jobs: %v", err)
+		return
+	}
+	for _, p := range pending {
+		enqueueJob(p.ID)
+	}
+	if len(pending) > 0 {
+		log.Printf("[jobs] resumed %d pending jobs", len(pending))
+	}
+}
+
+// runJob claims and processes a single job, recording failures on the job
+func runJob(worker int, id primitive.ObjectID) {
+	job, err := claimJob(id)
+	if err != nil {
+		if !errors.Is(err, mongo.ErrNoDocuments) {
+			log.Printf("[jobs] worker=%d claim %s failed: %v", worker, id.Hex(), err)
+		}
+		return
+	}
+
+	log.Printf("[jobs] worker=%d start job=%s source=%s mode=%s chunks=%d/%d", worker, id.Hex(), job.Source, job.Mode, job.ChunksDone, job.ChunksTotal)
+	start := time.Now()
+	if err := processTranscriptionJob(job); err != nil {
+		log.Printf("[jobs] worker=%d job=%s failed: %v", worker, id.Hex(), err)
+		failJob(id, err)
+		cleanupJob(job)
+		return
+	}
+	log.Printf("[jobs] worker=%d job=%s completed in %s", worker, id.Hex(), time.Since(start))
+}
+
+// failJob marks the job as failed and notifies subscribers
+func failJob(id primitive.ObjectID, err error) {
+	set := bson.M{
+		"status":      JobStatusFailed,
+		"stage":       StageFailed,
+		"error":       err.Error(),
+		"finished_at": time.Now(),
+	}
+	var ytErr *ytDownloadError
+	if errors.As(err, &ytErr) {
+		set["error_detail"] = ytErr.Details
+		set["fetch_attempts"] = ytErr.Attempts
+	}
+	if uerr := UpdateJob(id, set); uerr != nil {
+		log.Printf("[jobs] failed to mark job %s as failed: %v", id.Hex(), uerr)
+	}
+	jobEvents.Publish(id, JobEvent{Type: "error", Stage: StageFailed, Message: err.Error()})
+}
+
+// processTranscriptionJob downloads (for YouTube), segments the input (if needed)
+// and transcribes every chunk that is not finished yet, persisting progress after each one
+func processTranscriptionJob(job *TranscriptionJob) error {
+	workDir := jobWorkDir(job.ID)
+
+	// The input lives in the blob store (re-transcriptions start from the stored
+	// recording); the job may resume on an instance that never had it on disk
+	if key := job.sourceKey(); key != "" && !fileExists(job.InputPath) {
+		setJobStage(job.ID, StageDownloading, "")
+		if err := fetchStoredAudio(job, key, workDir); err != nil {
+			return err
+		}
+	}
+
+	if job.Source == "youtube" && !fileExists(job.InputPath) {
+		setJobStage(job.ID, StageDownloading, job.URL)
+		if err := os.MkdirAll(workDir, 0o755); err != nil {
+			return err
+		}
+		// Existing subtitles make Whisper unnecessary
+		if policy := captionsPolicy(job.Captions); policy != CaptionsOff {
+			caps, err := fetchYouTubeCaptions(job.URL, job.Language, policy)
+			if err == nil {
+				return finishWithCaptions(job, caps)
+			}
+			log.Printf("[jobs] job=%s: transcribing audio, no usable captions: %v", job.ID.Hex(), err)
+		}
+		path, err := downloadYouTubeAudio(job.URL, workDir)
+		if err != nil {
+			return err
+		}
+		if info, err := os.Stat(path); err == nil {
+			log.Printf("YouTube transcribe: downloaded file=%s size=%d bytes", path, info.Size())
+			job.Size = info.Size()
+		}
+		job.InputPath = path
+		job.Filename = filepath.Base(path)
+		// Kept in the blob store so a resumed job does not download the video again
+		if err := storeJobInput(context.Background(), job); err != nil {
+			return err
+		}
+		if err := UpdateJob(job.ID, bson.M{"input_path": path, "input_key": job.InputKey, "filename": job.Filename, "size": job.Size}); err != nil {
+			return err
+		}
+	}
+
+	if !fileExists(job.InputPath) {
+		return fmt.Errorf("input file is missing: %s", job.InputPath)
+	}
+
+	// The recording length is billed against the owner's audio quota
+	if job.Duration == 0 {
+		if d, err := probeAudioDuration(job.InputPath); err != nil {
+			log.Printf("[jobs] job=%s: %v", job.ID.Hex(), err)
+		} else {
+			job.Duration = d
+			UpdateJob(job.ID, bson.M{"duration": d})
+		}
+	}
+	if !job.UserID.IsZero() && job.ChunksDone == 0 {
+		// YouTube videos are only measured here, uploads were checked on upload already
+		plan, err := userPlan(job.UserID)
+		if err != nil {
+			return err
+		}
+		if err := checkAudioLength(plan, entitlementsFor(plan), job.Duration); err != nil {
+			return err
+		}
+		if err := checkQuota(job.UserID, UsageAudio, job.Duration/60); err != nil {
+			return err
+		}
+	}
+
+	if job.Mode != "single" {
+		setJobStage(job.ID, StageSegmenting, "")
+	}
+	chunkFiles, err := jobChunkFiles(job, workDir)
+	if err != nil {
+		return err
+	}
+
+	// Reset progress when the chunk layout does not match what was stored
+	if len(job.Chunks) != len(chunkFiles) {
+		job.Chunks = make([]JobChunk, len(chunkFiles))
+		if job.Mode != "single" {
+			for i, offset := range chunkOffsets(filepath.Join(workDir, "chunks"), chunkFiles) {
+				job.Chunks[i].Offset = offset
+			}
+		}
+		job.ChunksDone = 0
+		job.ChunksTotal = len(chunkFiles)
+		if err := UpdateJob(job.ID, bson.M{
+			"chunks":       job.Chunks,
+			"chunks_done":  0,
+			"chunks_total": job.ChunksTotal,
+			"transcript":   "",
+		}); err != nil {
+			return err
+		}
+	}
+
+	// Failed chunks from a previous run get another chance
+	var pending []int
+	job.ChunksDone, job.ChunksFailed = 0, 0
+	for i := range job.Chunks {
+		if job.Chunks[i].Failed {
+			job.Chunks[i] = JobChunk{Offset: job.Chunks[i].Offset}
+		}
+		if job.Chunks[i].Done {
+			job.ChunksDone++
+		} else {
+			pending = append(pending, i)
+		}
+	}
+
+	setJobStage(job.ID, StageTranscribing, fmt.Sprintf("%d/%d", job.ChunksDone, job.ChunksTotal))
+
+	workers := transcribeConcurrency
+	if workers > len(pending) {
+		workers = len(pending)
+	}
+	queue := make(chan int)
+	var mu sync.Mutex // guards job and serializes progress writes
+	var persistErr error
+	var lastChunkErr error
+	detectedLanguage := job.Language
+	var wg sync.WaitGroup
+	for w := 0; w < workers; w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range queue {
+				name := filepath.Base(chunkFiles[i])
+				if job.Mode == "single" {
+					name = job.Filename
+				}
+				res, err := transcriber.Transcribe(context.Background(), TranscribeRequest{Path: chunkFiles[i], Filename: name, Language: job.Language})
+
+				mu.Lock()
+				chunk := JobChunk{Done: true, Offset: job.Chunks[i].Offset}
+				if err != nil {
+					// Keep going: the gap is marked in the transcript instead of failing the job
+					log.Printf("[jobs] job=%s chunk %d/%d failed: %v", job.ID.Hex(), i+1, len(chunkFiles), err)
+					chunk.Failed = true
+					chunk.Error = err.Error()
+					chunk.Text = chunkGapMarker(job.Mode, chunk.Offset, job.chunkEnd(i))
+					job.ChunksFailed++
+					lastChunkErr = err
+				} else {
+					chunk.Text = strings.TrimSpace(res.Text)
+					chunk.Segments = offsetSegments(res.Segments, chunk.Offset)
+					if detectedLanguage == "" {
+						detectedLanguage = res.Language
+					}
+				}
+				job.Chunks[i] = chunk
+				job.ChunksDone++
+				job.Transcript = job.joinedTranscript()
+				if err := UpdateJob(job.ID, bson.M{
+					fmt.Sprintf("chunks.%d", i): chunk,
+					"chunks_done":               job.ChunksDone,
+					"chunks_failed":             job.ChunksFailed,
+					"transcript":                job.Transcript,
+				}); err != nil && persistErr == nil {
+					persistErr = err
+				}
+				ev := JobEvent{
+					Type:        "chunk",
+					Stage:       StageTranscribing,
+					ChunkIndex:  i,
+					ChunksDone:  job.ChunksDone,
+					ChunksTotal: job.ChunksTotal,
+					Text:        chunk.Text,
+				}
+				if chunk.Failed {
+					ev.Message = chunk.Error
+				}
+				jobEvents.Publish(job.ID, ev)
+				mu.Unlock()
+			}
+		}()
+	}
+	for _, i := range pending {
+		queue <- i
+	}
+	close(queue)
+	wg.Wait()
+
+	if persistErr != nil {
+		return persistErr
+	}
+	if job.ChunksFailed == len(chunkFiles) {
+		return fmt.Errorf("all %d chunks failed: %w", len(chunkFiles), lastChunkErr)
+	}
+
+	job.Segments = job.joinedSegments()
+	if err := completeJob(job, detectedLanguage); err != nil {
+		return err
+	}
+	audioSeconds := job.Duration
+	if audioSeconds == 0 && len(job.Segments) > 0 {
+		audioSeconds = job.Segments[len(job.Segments)-1].End
+	}
+	recordUsage(job.UserID, audioSeconds, 0)
+	if !job.TranscriptID.IsZero() && job.AudioKey == "" {
+		if err := storeTranscriptAudio(job, workDir); err != nil {
+			log.Printf("[job %s] audio was not stored: %v", job.ID.Hex(), err)
+		}
+	}
+	cleanupJob(job)
+	return nil
+}
+
+// sourceKey returns the blob the job input is fetched from when it is not on disk
+func (j *TranscriptionJob) sourceKey() string {
+	if j.InputKey != "" {
+		return j.InputKey
+	}
+	return j.AudioKey
+}
+
+// completeJob marks a job with a finished transcript as completed, saves the transcript
+// of signed-in users and announces it with the "transcribed" event
+func completeJob(job *TranscriptionJob, language string) error {
+	done := bson.M{
+		"status":      JobStatusCompleted,
+		"stage":       StageTranscribed,
+		"mode":        job.Mode,
+		"transcript":  job.Transcript,
+		"segments":    job.Segments,
+		"finished_at": time.Now(),
+	}
+	// Signed-in users keep the result in their transcripts; a re-transcription
+	// replaces the text of the transcript it was started for
+	if !job.UserID.IsZero() {
+		if job.AudioKey != "" {
+			if err := replaceJobTranscript(job, language); err != nil {
+				return fmt.Errorf("saving transcript: %w", err)
+			}
+		} else {
+			t, err := saveJobTranscript(job, language)
+			if err != nil {
+				return fmt.Errorf("saving transcript: %w", err)
+			}
+			job.TranscriptID = t.ID
+		}
+		done["transcript_id"] = job.TranscriptID
+	}
+	if err := UpdateJob(job.ID, done); err != nil {
+		return err
+	}
+	ev := JobEvent{
+		Type:        "transcribed",
+		Stage:       StageTranscribed,
+		ChunksDone:  job.ChunksDone,
+		ChunksTotal: job.ChunksTotal,
+		Text:        job.Transcript,
+	}
+	if !job.TranscriptID.IsZero() {
+		ev.TranscriptID = job.TranscriptID.Hex()
+	}
+	if job.ChunksFailed > 0 {
+		ev.Message = fmt.Sprintf("%d of %d chunks could not be transcribed", job.ChunksFailed, job.ChunksTotal)
+	}
+	jobEvents.Publish(job.ID, ev)
+	return nil
+}
+
+// chunkGapMarker is the placeholder written in place of a chunk that kept failing
+func chunkGapMarker(mode string, from, to float64) string {
+	if mode == "single" {
+		return "[audio could not be transcribed]"
+	}
+	return fmt.Sprintf("[%s–%s: fragment could not be transcribed]",
+		formatClock(time.Duration(from*float64(time.Second))), formatClock(time.Duration(to*float64(time.Second))))
+}
+
+// chunkEnd estimates where chunk i ends: the next chunk's start or one segment length
+func (j *TranscriptionJob) chunkEnd(i int) float64 {
+	if i+1 < len(j.Chunks) {
+		return j.Chunks[i+1].Offset
+	}
+	return j.Chunks[i].Offset + chunkSeconds
+}
+
+// joinedSegments concatenates chunk segments in order. Chunks without
+// timestamps (failed or from a backend without segments) become one segment.
+func (j *TranscriptionJob) joinedSegments() []TranscriptSegment {
+	var out []TranscriptSegment
+	for i, c := range j.Chunks {
+		if !c.Done {
+			continue
+		}
+		if len(c.Segments) > 0 {
+			out = append(out, c.Segments...)
+			continue
+		}
+		if c.Text != "" {
+			out = append(out, TranscriptSegment{Start: c.Offset, End: j.chunkEnd(i), Text: c.Text})
+		}
+	}
+	return out
+}
+
+// formatClock renders a duration as H:MM:SS
+func formatClock(d time.Duration) string {
+	secs := int(d.Seconds())
+	return fmt.Sprintf("%d:%02d:%02d", secs/3600, secs/60%60, secs%60)
+}
+
+// fileExists reports whether path points to an existing file
+func fileExists(path string) bool {
+	if path == "" {
+		return false
+	}
+	_, err := os.Stat(path)
+	return err == nil
+}
+
+// jobChunkFiles returns the audio files to transcribe for the job.
+// Single-mode jobs use the input as is; segmented jobs reuse chunks left by
+// a previous run when their count matches, otherwise ffmpeg is run again.
+func jobChunkFiles(job *TranscriptionJob, workDir string) ([]string, error) {
+	if job.Mode == "single" {
+		return []string{job.InputPath}, nil
+	}
+
+	chunksDir := filepath.Join(workDir, "chunks")
+	if job.ChunksTotal > 0 {
+		if existing, err := listChunkFiles(chunksDir); err == nil && len(existing) == job.ChunksTotal {
+			return existing, nil
+		}
+	}
+
+	os.RemoveAll(chunksDir)
+	if err := os.MkdirAll(chunksDir, 0o755); err != nil {
+		return nil, err
+	}
+	return segmentAudio(job.InputPath, chunksDir)
+}
+
+// joinedTranscript concatenates finished chunks in order
+func (j *TranscriptionJob) joinedTranscript() string {
+	parts := make([]string, 0, len(j.Chunks))
+	for _, c := range j.Chunks {
+		if c.Done && c.Text != "" {
+			parts = append(parts, c.Text)
+		}
+	}
+	return strings.Join(parts, "\n")
+}
+
+// handleGetJob returns the state and progress of a transcription job
+func handleGetJob(w http.ResponseWriter, r *http.Request) {
+	job := loadJobForRequest(w, r)
+	if job == nil {
+		return
+	}
+
+	JSONResponse(w, http.StatusOK, map[string]interface{}{
+		"success": true,
+		"job":     job,
+	})
+}
+
+// handleExportJob downloads the finished transcript as SRT, WebVTT or timestamped text
+func handleExportJob(w http.ResponseWriter, r *http.Request) {
+	job := loadJobForRequest(w, r)
+	if job == nil {
+		return
+	}
+	if job.Status != JobStatusCompleted {
+		JSONError(w, http.StatusConflict, "Transcription is not finished yet")
+		return
+	}
+	writeTranscriptExport(w, r, "transcript_"+job.ID.Hex(), job.Transcript, job.Segments)
+}
@@ -0,0 +1,59 @@
+package main
+
+import (
+	"errors"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+func TestJobResumesFromStoredInputOnAnotherInstance(t *testing.T) {
+	useTestDatabase(t)
+	t.Setenv("JOBS_DIR", t.TempDir())
+	prevStore, prevTranscriber := blobStore, transcriber
+	blobStore = &LocalBlobStore{Dir: t.TempDir()}
+	transcriber = &FakeTranscriber{Text: "resumed"}
+	t.Cleanup(func() { blobStore, transcriber = prevStore, prevTranscriber })
+	ctx := t.Context()
+
+	job := &TranscriptionJob{ID: primitive.NewObjectID(), UserID: primitive.NewObjectID(), Source: TranscriptSourceUpload, Filename: "lecture.mp3", Mode: "single"}
+	job.InputPath = filepath.Join(jobWorkDir(job.ID), "input.mp3")
+	os.MkdirAll(filepath.Dir(job.InputPath), 0o755)
+	if err := os.WriteFile(job.InputPath, []byte("recorded audio"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if err := submitUploadedJob(httptest.NewRequest("POST", "/api/transcribe", nil), job); err != nil {
+		t.Fatal(err)
+	}
+	<-jobQueue
+
+	stored, err := GetJob(job.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stored.InputKey == "" {
+		t.Fatal("the job input was not copied to the blob store")
+	}
+
+	// The instance that accepted the upload is gone with its disk
+	os.RemoveAll(jobWorkDir(job.ID))
+	if err := processTranscriptionJob(stored); err != nil {
+		t.Fatal(err)
+	}
+	done, err := GetJob(job.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if done.Status != JobStatusCompleted || done.Transcript != "resumed" {
+		t.Fatalf("job = %s %q, want completed from the stored input", done.Status, done.Transcript)
+	}
+	if _, err := blobStore.Open(ctx, stored.InputKey, 0, -1); !errors.Is(err, errBlobNotFound) {
+		t.Fatalf("stored input after completion: %v, want it deleted", err)
+	}
+	if _, err := os.Stat(jobWorkDir(job.ID)); !os.IsNotExist(err) {
+		t.Fatalf("work directory is left behind: %v", err)
+	}
+}
@@ -0,0 +1,142 @@
+package main
+
+import (
+	"context"
+	"crypto/rsa"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"math/big"
+	"net/http"
+	"regexp"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+)
+
+// jwksDefaultTTL is used when the JWKS response has no Cache-Control max-age
+const jwksDefaultTTL = time.Hour
+
+// jwksMinRefresh limits refetches triggered by tokens with an unknown kid
+const jwksMinRefresh = time.Minute
+
+// JWKSCache fetches and caches the RSA signing keys an identity provider publishes
+// at its jwks_uri (Google, OpenID Connect providers)
+type JWKSCache struct {
+	URL        string
+	HTTPClient *http.Client
+
+	mu        sync.Mutex
+	keys      map[string]*rsa.PublicKey
+	expiresAt time.Time
+	fetchedAt time.Time
+}
+
+// parseIDToken verifies an RS256 ID token against keys and checks audience, expiry and
+// issued-at; the issuer is checked by the caller since providers differ in its format
+func parseIDToken(ctx context.Context, raw string, keys *JWKSCache, audiences []string, claims jwt.Claims) error {
+	_, err := jwt.ParseWithClaims(raw, claims, func(t *jwt.Token) (interface{}, error) {
+		kid, _ := t.Header["kid"].(string)
+		return keys.Key(ctx, kid)
+	},
+		jwt.WithValidMethods([]string{"RS256"}),
+		jwt.WithAudience(audiences...),
+		jwt.WithExpirationRequired(),
+		jwt.WithIssuedAt(),
+		jwt.WithLeeway(30*time.Second),
+	)
+	return err
+}
+
+// Key returns the public key for kid from the cached JWKS. The set is refetched when
+// it expires or, at most once per jwksMinRefresh, when kid is unknown (key rotation).
+func (c *JWKSCache) Key(ctx context.Context, kid string) (*rsa.PublicKey, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	now := time.Now()
+	if k, ok := c.keys[kid]; ok && now.Before(c.expiresAt) {
+		return k, nil
+	}
+	if now.Before(c.expiresAt) && now.Sub(c.fetchedAt) < jwksMinRefresh {
+		return nil, fmt.Errorf("unknown key id %q", kid)
+	}
+	if err := c.fetch(ctx); err != nil {
+		// A temporarily unreachable JWKS endpoint should not lock everyone out
+		if k, ok := c.keys[kid]; ok {
+			log.Printf("[jwks] refresh of %s failed, using cached keys: %v", c.URL, err)
+			return k, nil
+		}
+		return nil, err
+	}
+	if k, ok := c.keys[kid]; ok {
+		return k, nil
+	}
+	return nil, fmt.Errorf("unknown key id %q", kid)
+}
+
+// fetch loads the keys from URL; the caller holds c.mu
+func (c *JWKSCache) fetch(ctx context.Context) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, c.URL, nil)
+	if err != nil {
+		return err
+	}
+	resp, err := c.HTTPClient.Do(req)
+	if err != nil {
+		return fmt.Errorf("fetch JWKS: %w", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("fetch JWKS: status %d", resp.StatusCode)
+	}
+	var set struct {
+		Keys []struct {
+			Kty string `json:"kty"`
+			Kid string `json:"kid"`
+			N   string `json:"n"`
+			E   string `json:"e"`
+		} `json:"keys"`
+	}
+	if err := json.NewDecoder(io.LimitReader(resp.Body, 1<<20)).Decode(&set); err != nil {
+		return fmt.Errorf("parse JWKS: %w", err)
+	}
+
+	keys := make(map[string]*rsa.PublicKey, len(set.Keys))
+	for _, k := range set.Keys {
+		if k.Kty != "RSA" {
+			continue
+		}
+		n, errN := base64.RawURLEncoding.DecodeString(k.N)
+		e, errE := base64.RawURLEncoding.DecodeString(k.E)
+		if errN != nil || errE != nil || len(e) == 0 || len(e) > 4 {
+			log.Printf("[jwks] skipping malformed key %q from %s", k.Kid, c.URL)
+			continue
+		}
+		keys[k.Kid] = &rsa.PublicKey{N: new(big.Int).SetBytes(n), E: int(new(big.Int).SetBytes(e).Int64())}
+	}
+	if len(keys) == 0 {
+		return fmt.Errorf("JWKS has no RSA keys")
+	}
+
+	now := time.Now()
+	c.keys = keys
+	c.fetchedAt = now
+	c.expiresAt = now.Add(cacheMaxAge(resp.Header.Get("Cache-Control"), jwksDefaultTTL))
+	return nil
+}
+
+var maxAgeRe = regexp.MustCompile(`max-age=(\d+)`)
+
+// cacheMaxAge returns the max-age of a Cache-Control header, or def
+func cacheMaxAge(header string, def time.Duration) time.Duration {
+	if m := maxAgeRe.FindStringSubmatch(header); m != nil {
+		if secs, err := strconv.Atoi(m[1]); err == nil && secs > 0 {
+			return time.Duration(secs) * time.Second
+		}
+	}
+	return def
+}
@@ -0,0 +1,254 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// ChatMessage is a single chat turn sent to the model
+type ChatMessage struct {
+	Role    string `json:"role"`
+	Content string `json:"content"`
+}
+
+// CompletionRequest is a provider-independent chat completion request
+type CompletionRequest struct {
+	Messages []ChatMessage
+	JSON     bool // ask the model for a JSON object
+}
+
+// CompletionResult is the model answer plus token usage when the provider reports it
+type CompletionResult struct {
+	Content          string
+	PromptTokens     int
+	CompletionTokens int
+}
+
+// LLMProvider generates chat completions for flashcard/quiz generation
+type LLMProvider interface {
+	Name() string
+	Complete(ctx context.Context, req CompletionRequest) (*CompletionResult, error)
+}
+
+// llmProvider is the provider selected at startup via LLM_PROVIDER
+var llmProvider LLMProvider
+
+// newLLMProviderFromEnv builds the provider selected by LLM_PROVIDER
+// (openai|openai-compatible|mock) with LLM_MODEL, LLM_TEMPERATURE and LLM_TIMEOUT_SECONDS.
+// Network providers retry transient failures (LLM_MAX_ATTEMPTS, LLM_RETRY_BASE_MS).
+func newLLMProviderFromEnv() (LLMProvider, error) {
+	model := getEnvOrFile("LLM_MODEL")
+	if model == "" {
+		model = "gpt-4o-mini"
+	}
+	temperature := 0.3
+	if v := getEnvOrFile("LLM_TEMPERATURE"); v != "" {
+		t, err := strconv.ParseFloat(v, 64)
+		if err != nil {
+			return nil, fmt.Errorf("invalid LLM_TEMPERATURE %q: %w", v, err)
+		}
+		temperature = t
+	}
+	timeout := time.Duration(getEnvInt("LLM_TIMEOUT_SECONDS", 70)) * time.Second
+	policy := RetryPolicy{
+		MaxAttempts: getEnvInt("LLM_MAX_ATTEMPTS", 3),
+		BaseDelay:   time.Duration(getEnvInt("LLM_RETRY_BASE_MS", 1000)) * time.Millisecond,
+		MaxDelay:    30 * time.Second,
+	}
+
+	switch kind := strings.ToLower(getEnvOrFile("LLM_PROVIDER")); kind {
+	case "", "openai":
+		if openaiAPIKey == "" {
+			return nil, fmt.Errorf("OPENAI_API_KEY is required for LLM_PROVIDER=openai")
+		}
+		return &RetryingLLMProvider{Inner: &OpenAICompatibleProvider{
+			Label:       "openai",
+			BaseURL:     "https://api.openai.com/v1",
+			APIKey:      openaiAPIKey,
+			Model:       model,
+			Temperature: temperature,
+			Timeout:     timeout,
+			JSONMode:    true,
+		}, Policy: policy}, nil
+	case "openai-compatible", "ollama", "llamacpp", "vllm":
+		baseURL := getEnvOrFile("LLM_BASE_URL")
+		if baseURL == "" {
+			return nil, fmt.Errorf("LLM_BASE_URL is required for LLM_PROVIDER=%s", kind)
+		}
+		return &RetryingLLMProvider{Inner: &OpenAICompatibleProvider{
+			Label:       kind,
+			BaseURL:     baseURL,
+			APIKey:      getEnvOrFile("LLM_API_KEY"),
+			Model:       model,
+			Temperature: temperature,
+			Timeout:     timeout,
+			JSONMode:    getEnvOrFile("LLM_JSON_MODE") != "false",
+		}, Policy: policy}, nil
+	case "mock":
+		p := &ScriptedLLMProvider{}
+		if path := getEnvOrFile("LLM_MOCK_RESPONSES_FILE"); path != "" {
+			b, err := os.ReadFile(path)
+			if err != nil {
+				return nil, fmt.Errorf("reading LLM_MOCK_RESPONSES_FILE: %w", err)
+			}
+			// Either a JSON array of responses or a single response
+			if err := json.Unmarshal(b, &p.Responses); err != nil {
+				p.Responses = []string{string(b)}
+			}
+		}
+		return p, nil
+	default:
+		return nil, fmt.Errorf("unknown LLM_PROVIDER %q (expected openai, openai-compatible or mock)", kind)
+	}
+}
+
+// OpenAICompatibleProvider talks to OpenAI or any server implementing
+// /chat/completions (Ollama, llama.cpp server, vLLM)
+type OpenAICompatibleProvider struct {
+	Label       string
+	BaseURL     string
+	APIKey      string
+	Model       string
+	Temperature float64
+	Timeout     time.Duration
+	JSONMode    bool // send response_format=json_object
+}
+
+func (p *OpenAICompatibleProvider) Name() string { return p.Label + ":" + p.Model }
+
+func (p *OpenAICompatibleProvider) Complete(ctx context.Context, req CompletionRequest) (*CompletionResult, error) {
+	chatReq := map[string]interface{}{
+		"model":       p.Model,
+		"temperature": p.Temperature,
+		"messages":    req.Messages,
+	}
+	if req.JSON && p.JSONMode {
+		chatReq["response_format"] = map[string]string{"type": "json_object"}
+	}
+
+	buf, _ := json.Marshal(chatReq)
+	url := strings.TrimRight(p.BaseURL, "/") + "/chat/completions"
+	httpReq, err := http.NewRequestWithContext(ctx, "POST", url, bytes.NewReader(buf))
+	if err != nil {
+		return nil, err
+	}
+	if p.APIKey != "" {
+		httpReq.Header.Set("Authorization", "Bearer "+p.APIKey)
+	}
+	httpReq.Header.Set("Content-Type", "application/json")
+
+	httpClient := &http.Client{Timeout: p.Timeout}
+	resp, err := httpClient.Do(httpReq)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	respBytes, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read response: %w", err)
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("chat API error: %w", newHTTPStatusError(resp, respBytes))
+	}
+
+	var chatResp struct {
+		Choices []struct {
+			Message struct {
+				Content string `json:"content"`
+			} `json:"message"`
+		} `json:"choices"`
+		Usage struct {
+			PromptTokens     int `json:"prompt_tokens"`
+			CompletionTokens int `json:"completion_tokens"`
+		} `json:"usage"`
+	}
+	if err := json.Unmarshal(respBytes, &chatResp); err != nil {
+		return nil, fmt.Errorf("failed to parse chat response: %w", err)
+	}
+	if len(chatResp.Choices) == 0 {
+		return nil, fmt.Errorf("empty chat response")
+	}
+	return &CompletionResult{
+		Content:          chatResp.Choices[0].Message.Content,
+		PromptTokens:     chatResp.Usage.PromptTokens,
+		CompletionTokens: chatResp.Usage.CompletionTokens,
+	}, nil
+}
+
+// RetryingLLMProvider retries transient failures (429/5xx, timeouts) of the inner provider
+type RetryingLLMProvider struct {
+	Inner  LLMProvider
+	Policy RetryPolicy
+}
+
+func (p *RetryingLLMProvider) Name() string { return p.Inner.Name() }
+
+func (p *RetryingLLMProvider) Complete(ctx context.Context, req CompletionRequest) (*CompletionResult, error) {
+	var res *CompletionResult
+	err := p.Policy.Do(ctx, "complete with "+p.Inner.Name(), func() error {
+		var err error
+		res, err = p.Inner.Complete(ctx, req)
+		return err
+	})
+	return res, err
+}
+
+// defaultMockResponse is returned by ScriptedLLMProvider when no script is set
+const defaultMockResponse = `{
+  "flashcards": [
+    {"term": "Mock term", "definition": "Definition produced by the mock provider", "example": "Example"}
+  ],
+  "quiz": {
+    "multipleChoice": [
+      {"question": "Which provider generated this?", "options": ["mock", "openai", "ollama", "vllm"], "answer": "mock"}
+    ],
+    "trueFalse": [
+      {"statement": "This quiz was generated without a network call.", "answer": true}
+    ]
+  },
+  "summary": "Mock summary."
+}`
+
+// ScriptedLLMProvider replays canned responses in order (the last one repeats).
+// Used in CI and local development without an API key.
+type ScriptedLLMProvider struct {
+	Responses []string
+
+	mu    sync.Mutex
+	calls int
+}
+
+func (p *ScriptedLLMProvider) Name() string { return "mock" }
+
+func (p *ScriptedLLMProvider) Complete(ctx context.Context, req CompletionRequest) (*CompletionResult, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	content := defaultMockResponse
+	if len(p.Responses) > 0 {
+		i := p.calls
+		if i >= len(p.Responses) {
+			i = len(p.Responses) - 1
+		}
+		content = p.Responses[i]
+	}
+	p.calls++
+	return &CompletionResult{Content: content}, nil
+}
+
+// Calls returns how many completions were requested
+func (p *ScriptedLLMProvider) Calls() int {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.calls
+}
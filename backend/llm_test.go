@@ -0,0 +1,217 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestNewLLMProviderFromEnv(t *testing.T) {
+	dir := t.TempDir()
+	script := filepath.Join(dir, "script.json")
+	os.WriteFile(script, []byte(`["first", "second"]`), 0o600)
+	single := filepath.Join(dir, "single.json")
+	os.WriteFile(single, []byte(`{"flashcards": []}`), 0o600)
+
+	tests := []struct {
+		name      string
+		apiKey    string
+		env       map[string]string
+		wantName  string
+		wantRetry bool
+		wantReply []string // first responses of the mock provider
+		wantErr   string
+	}{
+		{name: "openai by default", apiKey: "sk-test", wantName: "openai:gpt-4o-mini", wantRetry: true},
+		{name: "openai model", apiKey: "sk-test", env: map[string]string{"LLM_PROVIDER": "OpenAI", "LLM_MODEL": "gpt-4o"}, wantName: "openai:gpt-4o", wantRetry: true},
+		{name: "openai without a key", wantErr: "OPENAI_API_KEY"},
+		{name: "compatible server", env: map[string]string{"LLM_PROVIDER": "ollama", "LLM_BASE_URL": "http://localhost:11434/v1", "LLM_MODEL": "llama3"}, wantName: "ollama:llama3", wantRetry: true},
+		{name: "compatible server without a base URL", env: map[string]string{"LLM_PROVIDER": "openai-compatible"}, wantErr: "LLM_BASE_URL"},
+		{name: "mock", env: map[string]string{"LLM_PROVIDER": "mock"}, wantName: "mock", wantReply: []string{defaultMockResponse}},
+		{name: "mock script", env: map[string]string{"LLM_PROVIDER": "mock", "LLM_MOCK_RESPONSES_FILE": script}, wantName: "mock", wantReply: []string{"first", "second", "second"}},
+		{name: "mock single response", env: map[string]string{"LLM_PROVIDER": "mock", "LLM_MOCK_RESPONSES_FILE": single}, wantName: "mock", wantReply: []string{`{"flashcards": []}`}},
+		{name: "mock script missing", env: map[string]string{"LLM_PROVIDER": "mock", "LLM_MOCK_RESPONSES_FILE": filepath.Join(dir, "missing.json")}, wantErr: "LLM_MOCK_RESPONSES_FILE"},
+		{name: "invalid temperature", apiKey: "sk-test", env: map[string]string{"LLM_TEMPERATURE": "warm"}, wantErr: "invalid LLM_TEMPERATURE"},
+		{name: "unknown", env: map[string]string{"LLM_PROVIDER": "anthropic"}, wantErr: "unknown LLM_PROVIDER"},
+	}
+	vars := []string{"LLM_PROVIDER", "LLM_MODEL", "LLM_TEMPERATURE", "LLM_TIMEOUT_SECONDS", "LLM_BASE_URL", "LLM_API_KEY", "LLM_JSON_MODE", "LLM_MOCK_RESPONSES_FILE", "LLM_MAX_ATTEMPTS", "LLM_RETRY_BASE_MS"}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			for _, v := range vars {
+				t.Setenv(v, tt.env[v])
+				t.Setenv(v+"_FILE", "")
+			}
+			useOpenAIKey(t, tt.apiKey)
+			p, err := newLLMProviderFromEnv()
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Fatalf("error = %v, want it to contain %q", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if p.Name() != tt.wantName {
+				t.Fatalf("name = %q, want %q", p.Name(), tt.wantName)
+			}
+			if _, ok := p.(*RetryingLLMProvider); ok != tt.wantRetry {
+				t.Fatalf("provider %T, want retries = %v", p, tt.wantRetry)
+			}
+			for i, want := range tt.wantReply {
+				res, err := p.Complete(context.Background(), CompletionRequest{JSON: true})
+				if err != nil || res.Content != want {
+					t.Fatalf("response %d = %+v, %v, want %q", i, res, err, want)
+				}
+			}
+		})
+	}
+}
+
+// flakyLLMProvider fails with errs in turn before handing over to the scripted provider
+type flakyLLMProvider struct {
+	ScriptedLLMProvider
+	errs  []error
+	tries int
+}
+
+func (p *flakyLLMProvider) Complete(ctx context.Context, req CompletionRequest) (*CompletionResult, error) {
+	p.tries++
+	if p.tries <= len(p.errs) {
+		return nil, p.errs[p.tries-1]
+	}
+	return p.ScriptedLLMProvider.Complete(ctx, req)
+}
+
+func TestRetryingLLMProvider(t *testing.T) {
+	unavailable := &HTTPStatusError{StatusCode: http.StatusServiceUnavailable, Status: "503 Service Unavailable"}
+	rateLimited := &HTTPStatusError{StatusCode: http.StatusTooManyRequests, Status: "429 Too Many Requests"}
+	unauthorized := &HTTPStatusError{StatusCode: http.StatusUnauthorized, Status: "401 Unauthorized"}
+	tests := []struct {
+		name      string
+		errs      []error
+		wantTries int
+		wantErr   error
+	}{
+		{name: "first try", wantTries: 1},
+		{name: "recovers from 429 and 5xx", errs: []error{rateLimited, unavailable}, wantTries: 3},
+		{name: "gives up after max attempts", errs: []error{unavailable, unavailable, unavailable, unavailable}, wantTries: 3, wantErr: unavailable},
+		{name: "client error is final", errs: []error{unauthorized}, wantTries: 1, wantErr: unauthorized},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			inner := &flakyLLMProvider{ScriptedLLMProvider: ScriptedLLMProvider{Responses: []string{"ok"}}, errs: tt.errs}
+			p := &RetryingLLMProvider{Inner: inner, Policy: RetryPolicy{MaxAttempts: 3, BaseDelay: time.Millisecond, MaxDelay: 5 * time.Millisecond}}
+			res, err := p.Complete(context.Background(), CompletionRequest{})
+			if inner.tries != tt.wantTries {
+				t.Fatalf("tries = %d, want %d", inner.tries, tt.wantTries)
+			}
+			if tt.wantErr != nil {
+				if !errors.Is(err, tt.wantErr) {
+					t.Fatalf("error = %v, want %v", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil || res.Content != "ok" || inner.Calls() != 1 {
+				t.Fatalf("result = %+v, %v after %d completions", res, err, inner.Calls())
+			}
+		})
+	}
+}
+
+func TestOpenAICompatibleProviderRetriesFromEnv(t *testing.T) {
+	var mu sync.Mutex
+	var bodies []map[string]interface{}
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var body map[string]interface{}
+		json.NewDecoder(r.Body).Decode(&body)
+		mu.Lock()
+		bodies = append(bodies, body)
+		n := len(bodies)
+		mu.Unlock()
+		if r.URL.Path != "/v1/chat/completions" || r.Header.Get("Authorization") != "Bearer local-key" {
+			http.Error(w, "bad request", http.StatusBadRequest)
+			return
+		}
+		if n == 1 {
+			http.Error(w, `{"error":"model is loading"}`, http.StatusServiceUnavailable)
+			return
+		}
+		w.Write([]byte(`{"choices":[{"message":{"content":"{\"flashcards\":[]}"}}],"usage":{"prompt_tokens":12,"completion_tokens":3}}`))
+	}))
+	defer srv.Close()
+
+	t.Setenv("LLM_PROVIDER", "vllm")
+	t.Setenv("LLM_BASE_URL", srv.URL+"/v1/")
+	t.Setenv("LLM_API_KEY", "local-key")
+	t.Setenv("LLM_MODEL", "qwen")
+	t.Setenv("LLM_TEMPERATURE", "")
+	t.Setenv("LLM_JSON_MODE", "false")
+	t.Setenv("LLM_MAX_ATTEMPTS", "")
+	t.Setenv("LLM_RETRY_BASE_MS", "1")
+	p, err := newLLMProviderFromEnv()
+	if err != nil {
+		t.Fatal(err)
+	}
+	res, err := p.Complete(context.Background(), CompletionRequest{
+		Messages: []ChatMessage{{Role: "user", Content: "cards please"}},
+		JSON:     true,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if res.Content != `{"flashcards":[]}` || res.PromptTokens != 12 || res.CompletionTokens != 3 {
+		t.Fatalf("result = %+v", res)
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+	if len(bodies) != 2 {
+		t.Fatalf("requests = %d, want a retry after the 503", len(bodies))
+	}
+	if bodies[1]["model"] != "qwen" || bodies[1]["temperature"] != 0.3 {
+		t.Fatalf("request = %v", bodies[1])
+	}
+	// LLM_JSON_MODE=false keeps response_format away from servers that reject it
+	if _, ok := bodies[1]["response_format"]; ok {
+		t.Fatalf("response_format sent with LLM_JSON_MODE=false: %v", bodies[1])
+	}
+}
+
+func TestOpenAICompatibleProviderClientErrorIsFinal(t *testing.T) {
+	var mu sync.Mutex
+	calls := 0
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		calls++
+		mu.Unlock()
+		http.Error(w, `{"error":"invalid api key"}`, http.StatusUnauthorized)
+	}))
+	defer srv.Close()
+
+	p := &RetryingLLMProvider{
+		Inner:  &OpenAICompatibleProvider{Label: "openai-compatible", BaseURL: srv.URL, Model: "m", Timeout: time.Second},
+		Policy: RetryPolicy{MaxAttempts: 3, BaseDelay: time.Millisecond, MaxDelay: 5 * time.Millisecond},
+	}
+	_, err := p.Complete(context.Background(), CompletionRequest{})
+	var statusErr *HTTPStatusError
+	if !errors.As(err, &statusErr) || statusErr.StatusCode != http.StatusUnauthorized {
+		t.Fatalf("error = %v, want the 401", err)
+	}
+	if !strings.Contains(err.Error(), "chat API error") {
+		t.Fatalf("error = %v, want it labelled as a chat API error", err)
+	}
+	mu.Lock()
+	defer mu.Unlock()
+	if calls != 1 {
+		t.Fatalf("calls = %d, want no retry of a 401", calls)
+	}
+}
@@ -0,0 +1,127 @@
+package main
+
+import (
+	"context"
+	"log"
+	"net/http"
+	"strconv"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// Progressive lockout: from the loginLockoutThreshold-th failed password in a row the
+// account is locked for loginLockoutBase, doubling with every further failure up to
+// loginLockoutMax. A failure streak is forgotten after loginFailureMemory without failures.
+//
+// Streaks are kept per email and client IP, so someone guessing from elsewhere cannot
+// lock the owner out of their account; the per-IP rate limit bounds guessing across
+// many addresses.
+const (
+	loginLockoutThreshold = 5
+	loginLockoutBase      = time.Minute
+	loginLockoutMax       = time.Hour
+	loginFailureMemory    = 24 * time.Hour
+)
+
+// loginLockKey is the key a failure streak is kept under: the normalized email and the
+// caller's address
+func loginLockKey(email, ip string) string {
+	return normalizeEmail(email) + "|" + ip
+}
+
+// loginLockoutFor returns the lock after the given number of consecutive failures
+func loginLockoutFor(failures int) time.Duration {
+	if failures < loginLockoutThreshold {
+		return 0
+	}
+	lock := loginLockoutBase
+	for i := loginLockoutThreshold; i < failures && lock < loginLockoutMax; i++ {
+		lock *= 2
+	}
+	if lock > loginLockoutMax {
+		lock = loginLockoutMax
+	}
+	return lock
+}
+
+// loginLockRemaining returns how long sign-in with this email stays locked for ip
+func loginLockRemaining(ctx context.Context, email, ip string) time.Duration {
+	var doc struct {
+		LockedUntil time.Time `bson:"locked_until"`
+	}
+	err := database.Collection("login_failures").FindOne(ctx, bson.M{"_id": loginLockKey(email, ip)}).Decode(&doc)
+	if err != nil {
+		if err != mongo.ErrNoDocuments {
+			log.Printf("[lockout] lookup error: %v", err)
+		}
+		return 0
+	}
+	return time.Until(doc.LockedUntil)
+}
+
+// recordLoginFailure counts a failed sign-in and returns the lock it triggers, if any
+func recordLoginFailure(ctx context.Context, email, ip string) time.Duration {
+	now := time.Now()
+	// count = 1 after a quiet period, count + 1 otherwise
+	pipeline := mongo.Pipeline{
+		{{Key: "$set", Value: bson.M{
+			"count": bson.M{"$cond": bson.A{
+				bson.M{"$gt": bson.A{bson.M{"$ifNull": bson.A{"$last_failed_at", time.Time{}}}, now.Add(-loginFailureMemory)}},
+				bson.M{"$add": bson.A{bson.M{"$ifNull": bson.A{"$count", 0}}, 1}},
+				1,
+			}},
+			"last_failed_at": now,
+			"expires_at":     now.Add(loginFailureMemory),
+		}}},
+	}
+	var doc struct {
+		Count int `bson:"count"`
+	}
+	key := loginLockKey(email, ip)
+	coll := database.Collection("login_failures")
+	err := coll.FindOneAndUpdate(ctx, bson.M{"_id": key}, pipeline,
+		options.FindOneAndUpdate().SetUpsert(true).SetReturnDocument(options.After),
+	).Decode(&doc)
+	if err != nil {
+		log.Printf("[lockout] failed to record failure: %v", err)
+		return 0
+	}
+	lock := loginLockoutFor(doc.Count)
+	if lock > 0 {
+		coll.UpdateOne(ctx, bson.M{"_id": key}, bson.M{"$set": bson.M{"locked_until": now.Add(lock)}})
+		log.Printf("[lockout] sign-in from %s locked for %s after %d failed attempts", ip, lock, doc.Count)
+	}
+	return lock
+}
+
+// clearLoginFailures resets the streak of ip after a successful sign-in from it
+func clearLoginFailures(ctx context.Context, email, ip string) {
+	if _, err := database.Collection("login_failures").DeleteOne(ctx, bson.M{"_id": loginLockKey(email, ip)}); err != nil {
+		log.Printf("[lockout] failed to clear failures: %v", err)
+	}
+}
+
+// writeLoginLocked answers a sign-in attempt on a locked account
+func writeLoginLocked(w http.ResponseWriter, wait time.Duration) {
+	w.Header().Set("Retry-After", strconv.Itoa(ceilSeconds(wait)))
+	JSONErrorWithDetails(w, http.StatusTooManyRequests, "Too many failed sign-in attempts, please try again later", map[string]interface{}{
+		"code":        "login_locked",
+		"retry_after": ceilSeconds(wait),
+	})
+}
+
+// ensureLoginFailureIndex lets Mongo drop failure streaks once they are forgotten
+func ensureLoginFailureIndex() {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	_, err := database.Collection("login_failures").Indexes().CreateOne(ctx, mongo.IndexModel{
+		Keys:    bson.M{"expires_at": 1},
+		Options: options.Index().SetExpireAfterSeconds(0),
+	})
+	if err != nil {
+		log.Printf("[lockout] failed to create TTL index: %v", err)
+	}
+}
@@ -0,0 +1,128 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"golang.org/x/crypto/bcrypt"
+)
+
+func TestLoginLockoutFor(t *testing.T) {
+	for failures, want := range map[int]time.Duration{
+		0:  0,
+		4:  0,
+		5:  time.Minute,
+		6:  2 * time.Minute,
+		8:  8 * time.Minute,
+		10: 32 * time.Minute,
+		11: time.Hour, // capped
+		50: time.Hour,
+	} {
+		if got := loginLockoutFor(failures); got != want {
+			t.Errorf("loginLockoutFor(%d) = %s, want %s", failures, got, want)
+		}
+	}
+}
+
+// postJSON calls handler with a JSON body and decodes the JSON response
+func postJSON(t *testing.T, handler http.HandlerFunc, path string, body interface{}) (int, map[string]interface{}) {
+	t.Helper()
+	return postJSONFrom(t, handler, path, "192.0.2.1", body)
+}
+
+// postJSONFrom is postJSON from the client address ip
+func postJSONFrom(t *testing.T, handler http.HandlerFunc, path, ip string, body interface{}) (int, map[string]interface{}) {
+	t.Helper()
+	b, _ := json.Marshal(body)
+	r := httptest.NewRequest(http.MethodPost, path, bytes.NewReader(b))
+	r.RemoteAddr = ip + ":1234"
+	w := httptest.NewRecorder()
+	handler(w, r)
+	var resp map[string]interface{}
+	json.Unmarshal(w.Body.Bytes(), &resp)
+	return w.Code, resp
+}
+
+func TestSecondFactorFailuresCountTowardLockout(t *testing.T) {
+	useTestDatabase(t)
+	ctx := t.Context()
+
+	hashed, _ := bcrypt.GenerateFromPassword([]byte("correct horse"), bcrypt.MinCost)
+	userID := primitive.NewObjectID()
+	user := User{ID: userID.Hex(), Email: "ada@example.com", Password: string(hashed), EmailVerified: true, Role: RoleUser}
+	if _, err := database.Collection("users").InsertOne(ctx, user); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := database.Collection("two_factor").InsertOne(ctx, TwoFactor{
+		UserID: userID, Secret: "JBSWY3DPEHPK3PXP", Enabled: true, CreatedAt: time.Now(),
+	}); err != nil {
+		t.Fatal(err)
+	}
+	login := map[string]string{"email": "ada@example.com", "password": "correct horse"}
+
+	// Each round knows the password but guesses the second factor once: the password
+	// must not reset the streak, so the lockout still kicks in
+	for round := 1; round <= loginLockoutThreshold; round++ {
+		code, resp := postJSON(t, loginHandler, "/api/login", login)
+		if code != http.StatusOK || resp["two_factor_required"] != true {
+			t.Fatalf("round %d: login = %d %v", round, code, resp)
+		}
+		code, resp = postJSON(t, handleTwoFactorVerify, "/api/auth/2fa/verify", map[string]string{
+			"challenge_token": resp["challenge_token"].(string),
+			"recovery_code":   "not-a-code",
+		})
+		want := http.StatusUnauthorized
+		if round == loginLockoutThreshold {
+			want = http.StatusTooManyRequests
+		}
+		if code != want {
+			t.Fatalf("round %d: 2fa verify = %d %v, want %d", round, code, resp, want)
+		}
+	}
+
+	if code, _ := postJSON(t, loginHandler, "/api/login", login); code != http.StatusTooManyRequests {
+		t.Fatalf("login while locked = %d, want 429", code)
+	}
+	if loginLockRemaining(ctx, "ada@example.com", "192.0.2.1") <= 0 {
+		t.Fatal("expected the email to be locked")
+	}
+}
+
+func TestLockoutDoesNotLockOutTheOwner(t *testing.T) {
+	useTestDatabase(t)
+	ctx := t.Context()
+
+	hashed, _ := bcrypt.GenerateFromPassword([]byte("correct horse"), bcrypt.MinCost)
+	user := User{ID: primitive.NewObjectID().Hex(), Email: "ada@example.com", Password: string(hashed), EmailVerified: true, Role: RoleUser}
+	if _, err := database.Collection("users").InsertOne(ctx, user); err != nil {
+		t.Fatal(err)
+	}
+
+	// Someone else guesses until their address is locked
+	guess := map[string]string{"email": "Ada@Example.com", "password": "wrong"}
+	for i := 1; i < loginLockoutThreshold; i++ {
+		if code, _ := postJSONFrom(t, loginHandler, "/api/login", "203.0.113.9", guess); code != http.StatusUnauthorized {
+			t.Fatalf("guess %d = %d, want 401", i, code)
+		}
+	}
+	if code, resp := postJSONFrom(t, loginHandler, "/api/login", "203.0.113.9", guess); code != http.StatusTooManyRequests {
+		t.Fatalf("last guess = %d %v, want 429", code, resp)
+	}
+	login := map[string]string{"email": "ada@example.com", "password": "correct horse"}
+	if code, _ := postJSONFrom(t, loginHandler, "/api/login", "203.0.113.9", login); code != http.StatusTooManyRequests {
+		t.Fatalf("right password from the locked address = %d, want 429", code)
+	}
+
+	// The owner signs in from their own address as usual
+	if code, resp := postJSONFrom(t, loginHandler, "/api/login", "198.51.100.7", login); code != http.StatusOK || resp["success"] != true {
+		t.Fatalf("owner login = %d %v, want 200", code, resp)
+	}
+	if loginLockRemaining(ctx, "ada@example.com", "203.0.113.9") <= 0 {
+		t.Fatal("the owner's sign-in unlocked the guessing address")
+	}
+}
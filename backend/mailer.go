@@ -0,0 +1,172 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"fmt"
+	"log"
+	"mime"
+	"net"
+	"net/smtp"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"time"
+)
+
+// Email is a plain-text message to one recipient
+type Email struct {
+	To      string
+	Subject string
+	Text    string
+}
+
+// Mailer delivers transactional emails (verification, password reset)
+type Mailer interface {
+	Name() string
+	Send(ctx context.Context, msg Email) error
+}
+
+// mailer is the mailer selected at startup via MAILER
+var mailer Mailer = &LogMailer{}
+
+// newMailerFromEnv builds the mailer selected by MAILER (log|smtp)
+func newMailerFromEnv() (Mailer, error) {
+	from := getEnvOrFile("MAIL_FROM")
+	if from == "" {
+		from = "SpeakApper <no-reply@speakapper.local>"
+	}
+	switch kind := strings.ToLower(getEnvOrFile("MAILER")); kind {
+	case "", "log":
+		return &LogMailer{From: from, Dir: getEnvOrFile("MAIL_DIR")}, nil
+	case "smtp":
+		m := &SMTPMailer{
+			Host:     getEnvOrFile("SMTP_HOST"),
+			Port:     getEnvOrFile("SMTP_PORT"),
+			Username: getEnvOrFile("SMTP_USERNAME"),
+			Password: getEnvOrFile("SMTP_PASSWORD"),
+			From:     from,
+		}
+		if m.Host == "" {
+			return nil, fmt.Errorf("MAILER=smtp requires SMTP_HOST")
+		}
+		if m.Port == "" {
+			m.Port = "587"
+		}
+		return m, nil
+	default:
+		return nil, fmt.Errorf("unknown MAILER %q (expected log or smtp)", kind)
+	}
+}
+
+// formatEmail renders msg as an RFC 5322 message
+func formatEmail(from string, msg Email) []byte {
+	var b strings.Builder
+	fmt.Fprintf(&b, "From: %s\r\n", from)
+	fmt.Fprintf(&b, "To: %s\r\n", msg.To)
+	fmt.Fprintf(&b, "Subject: %s\r\n", mime.QEncoding.Encode("utf-8", msg.Subject))
+	fmt.Fprintf(&b, "Date: %s\r\n", time.Now().Format(time.RFC1123Z))
+	b.WriteString("MIME-Version: 1.0\r\n")
+	b.WriteString("Content-Type: text/plain; charset=UTF-8\r\n")
+	b.WriteString("Content-Transfer-Encoding: 8bit\r\n\r\n")
+	b.WriteString(strings.ReplaceAll(msg.Text, "\n", "\r\n"))
+	return []byte(b.String())
+}
+
+// SMTPMailer sends through an SMTP server: implicit TLS on port 465,
+// STARTTLS when the server offers it otherwise
+type SMTPMailer struct {
+	Host     string
+	Port     string
+	Username string
+	Password string
+	From     string
+}
+
+func (m *SMTPMailer) Name() string { return "smtp" }
+
+func (m *SMTPMailer) Send(ctx context.Context, msg Email) error {
+	addr := net.JoinHostPort(m.Host, m.Port)
+	dialer := &net.Dialer{Timeout: 10 * time.Second}
+	var conn net.Conn
+	var err error
+	if m.Port == "465" {
+		conn, err = (&tls.Dialer{NetDialer: dialer, Config: &tls.Config{ServerName: m.Host}}).DialContext(ctx, "tcp", addr)
+	} else {
+		conn, err = dialer.DialContext(ctx, "tcp", addr)
+	}
+	if err != nil {
+		return fmt.Errorf("smtp dial: %w", err)
+	}
+	if deadline, ok := ctx.Deadline(); ok {
+		conn.SetDeadline(deadline)
+	}
+
+	c, err := smtp.NewClient(conn, m.Host)
+	if err != nil {
+		conn.Close()
+		return fmt.Errorf("smtp handshake: %w", err)
+	}
+	defer c.Close()
+
+	if ok, _ := c.Extension("STARTTLS"); ok {
+		if err := c.StartTLS(&tls.Config{ServerName: m.Host}); err != nil {
+			return fmt.Errorf("smtp starttls: %w", err)
+		}
+	}
+	if m.Username != "" {
+		if err := c.Auth(smtp.PlainAuth("", m.Username, m.Password, m.Host)); err != nil {
+			return fmt.Errorf("smtp auth: %w", err)
+		}
+	}
+	if err := c.Mail(envelopeAddress(m.From)); err != nil {
+		return fmt.Errorf("smtp MAIL FROM: %w", err)
+	}
+	if err := c.Rcpt(msg.To); err != nil {
+		return fmt.Errorf("smtp RCPT TO: %w", err)
+	}
+	wc, err := c.Data()
+	if err != nil {
+		return fmt.Errorf("smtp DATA: %w", err)
+	}
+	if _, err := wc.Write(formatEmail(m.From, msg)); err != nil {
+		wc.Close()
+		return fmt.Errorf("smtp write: %w", err)
+	}
+	if err := wc.Close(); err != nil {
+		return fmt.Errorf("smtp DATA: %w", err)
+	}
+	return c.Quit()
+}
+
+// envelopeAddress extracts the bare address from "Name <addr>"
+func envelopeAddress(from string) string {
+	if i := strings.LastIndex(from, "<"); i >= 0 {
+		return strings.TrimSuffix(from[i+1:], ">")
+	}
+	return from
+}
+
+// LogMailer is for local development: emails are written to the log and,
+// when Dir is set (MAIL_DIR), saved there as .eml files
+type LogMailer struct {
+	From string
+	Dir  string
+}
+
+func (m *LogMailer) Name() string { return "log" }
+
+var unsafeFileChars = regexp.MustCompile(`[^a-zA-Z0-9._-]+`)
+
+func (m *LogMailer) Send(ctx context.Context, msg Email) error {
+	log.Printf("[mailer] to=%s subject=%q\n%s", msg.To, msg.Subject, msg.Text)
+	if m.Dir == "" {
+		return nil
+	}
+	if err := os.MkdirAll(m.Dir, 0o755); err != nil {
+		return err
+	}
+	name := fmt.Sprintf("%s-%s.eml", time.Now().Format("20060102-150405.000"), unsafeFileChars.ReplaceAllString(msg.To, "_"))
+	return os.WriteFile(filepath.Join(m.Dir, name), formatEmail(m.From, msg), 0o644)
+}
@@ -1,19 +1,18 @@
 package main
 
 import (
-	"bytes"
 	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
 	"log"
-	"mime/multipart"
 	"net/http"
-	"net/url"
 	"os"
 	"os/exec"
 	"path/filepath"
 	"slices"
+	"strconv"
 	"strings"
 	"time"
 
@@ -38,17 +37,33 @@ func getEnvOrFile(key string) string {
 	return ""
 }
 
-// handleTranscribeYouTube transcribes YouTube by URL using yt-dlp + Whisper
+// getEnvInt returns the integer value of the env var `key`, or def when unset or invalid.
+func getEnvInt(key string, def int) int {
+	v := getEnvOrFile(key)
+	if v == "" {
+		return def
+	}
+	n, err := strconv.Atoi(v)
+	if err != nil {
+		log.Printf("⚠️  %s=%q is not a number, using %d", key, v, def)
+		return def
+	}
+	return n
+}
+
+// handleTranscribeYouTube queues a background job that downloads YouTube audio with yt-dlp
+// and transcribes it with Whisper. Progress is available via /api/jobs/{id}.
 func handleTranscribeYouTube(w http.ResponseWriter, r *http.Request) {
 	if r.Method != http.MethodPost {
 		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
 		return
 	}
 
-	// Expect JSON: {"url": "https://youtu.be/..."}
+	// Expect JSON: {"url": "https://youtu.be/...", "captions": "off|manual|auto"}
 	var body struct {
 		URL      string `json:"url"`
 		Language string `json:"language,omitempty"`
+		Captions string `json:"captions,omitempty"`
 	}
 	if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
 		log.Printf("YouTube transcribe: invalid body: %v", err)
@@ -60,319 +75,61 @@ func handleTranscribeYouTube(w http.ResponseWriter, r *http.Request) {
 		http.Error(w, "url is required", http.StatusBadRequest)
 		return
 	}
+	if err := checkYouTubeURL(body.URL); err != nil {
+		log.Printf("YouTube transcribe: rejected url=%q", body.URL)
+		JSONError(w, http.StatusBadRequest, "url must be a YouTube video link")
+		return
+	}
 	log.Printf("YouTube transcribe: start url=%s", body.URL)
 
 	// Check yt-dlp availability
-	if _, err := exec.LookPath("yt-dlp"); err != nil {
+	if _, err := exec.LookPath(ytdlpBin()); err != nil {
 		log.Printf("yt-dlp not found: %v", err)
 		JSONErrorWithDetails(w, http.StatusFailedDependency, "yt-dlp is required on server", "Install with: brew install yt-dlp (mac) or pipx install yt-dlp")
 		return
 	}
 
-	// Prepare temp paths
-	tmpDir := os.TempDir()
-	base := fmt.Sprintf("yt_%d", time.Now().UnixNano())
-	outPath := filepath.Join(tmpDir, base+".mp3")
-
-	// Download audio with robust format preferences and fallbacks to avoid m3u8 403
-	// 1) Prefer non-m3u8 m4a to avoid HLS fragment 403
-	// 2) Fallback to generic bestaudio/best
-	// 3) Try using cookies from Chrome/Safari (mac) to bypass geo/age restrictions
-	ytdlpOutput := func(args ...string) ([]byte, error) {
-		cmd := exec.Command("yt-dlp", args...)
-		return cmd.CombinedOutput()
-	}
-
-	outPattern := filepath.Join(tmpDir, base+".%(ext)s")
-	// Optional cookies.txt from env to avoid browser permissions
-	var cookiesArgs []string
-	cp := getEnvOrFile("YTDLP_COOKIES")
-	if cp == "" {
-		log.Println("INFO: YTDLP_COOKIES environment variable not set. Will try --cookies-from-browser as fallback.")
-		// Fallback: try to extract cookies from browser automatically
-		cookiesArgs = []string{"--cookies-from-browser", "chrome"}
-	} else if _, err := os.Stat(cp); err == nil {
-		// случай 1: YTDLP_COOKIES = путь к файлу
-		cookiesArgs = []string{"--cookies", cp}
-		log.Printf("SUCCESS: yt-dlp will use cookies file at: %s", cp)
-	} else {
-		// случай 2: YTDLP_COOKIES = содержимое
-		tmp := "/tmp/yt-cookies.txt"
-		if err := os.WriteFile(tmp, []byte(cp), 0o600); err != nil {
-			log.Printf("ERROR: failed to write cookies from env to file: %v", err)
-			// Fallback to browser cookies if file creation fails
-			cookiesArgs = []string{"--cookies-from-browser", "chrome"}
-		} else {
-			cookiesArgs = []string{"--cookies", tmp}
-			log.Printf("SUCCESS: yt-dlp will use cookies from env, written to: %s", tmp)
-		}
+	// Convert "auto" to empty string for OpenAI Whisper API
+	language := body.Language
+	if language == "auto" {
+		language = ""
 	}
 
-	// Log chosen cookies mode and output pattern for diagnostics
-	cookiesMode := "none"
-	if len(cookiesArgs) >= 2 && cookiesArgs[0] == "--cookies" {
-		cookiesMode = "file:" + cookiesArgs[1]
-	} else if len(cookiesArgs) >= 2 && cookiesArgs[0] == "--cookies-from-browser" {
-		cookiesMode = "from-browser:" + cookiesArgs[1]
-	}
-	log.Printf("yt-dlp: cookiesMode=%s outPattern=%s base=%s", cookiesMode, outPattern, base)
-
-	// Define a helper to try different player clients with cookies if available
-	tryClient := func(clientName string, format string) ([]byte, error) {
-		args := append([]string{
-			"-R", "3",
-			"--fragment-retries", "3",
-			"--force-ipv4",
-			"--geo-bypass",
-			"--no-check-certificate",
-			"--add-header", "Accept-Language: en-US,en;q=0.9,ru;q=0.8",
-			"--referer", "https://www.youtube.com/",
-			"--extractor-args", fmt.Sprintf("youtube:player_client=%s", clientName),
-			"-f", format,
-			"-x",
-			"--audio-format", "mp3",
-			"-o", outPattern,
-		}, cookiesArgs...)
-		args = append(args, body.URL)
-		log.Printf("yt-dlp try-client=%s args=%v", clientName, args)
-		return ytdlpOutput(args...)
-	}
-
-	// Helper to check if error is authentication-related
-	isAuthError := func(output []byte) bool {
-		// Normalize quotes/case to catch messages like “you’re” vs "you're"
-		s := strings.ToLower(string(output))
-		s = strings.ReplaceAll(s, "’", "'")
-		return strings.Contains(s, "sign in to confirm you're not a bot") ||
-			strings.Contains(s, "sign in to confirm you") ||
-			strings.Contains(s, "this video is not available") ||
-			strings.Contains(s, "private video") ||
-			strings.Contains(s, "video unavailable") ||
-			strings.Contains(s, "cookies are no longer valid") ||
-			strings.Contains(s, "use --cookies-from-browser") ||
-			strings.Contains(s, "requires authentication")
-	}
-
-	// attempt 1: web client with strict non-HLS preference
-	outBytes, err := tryClient("web", "bestaudio[ext=m4a]/bestaudio[protocol!=m3u8]/bestaudio/best")
-	if err != nil {
-		log.Printf("yt-dlp attempt1 (web) failed: %v; output: %s", err, string(outBytes))
-		// attempt 2: web simpler
-		outBytes2, err2 := tryClient("web", "bestaudio/best")
-		if err2 != nil {
-			log.Printf("yt-dlp attempt2 (web simple) failed: %v; output: %s", err2, string(outBytes2))
-			// attempt 3: android client
-			outBytesA, errA := tryClient("android", "bestaudio[ext=m4a]/bestaudio/best")
-			if errA != nil {
-				log.Printf("yt-dlp attempt3 (android) failed: %v; output: %s", errA, string(outBytesA))
-				// attempt 4: ios client
-				outBytesI, errI := tryClient("ios", "bestaudio[ext=m4a]/bestaudio/best")
-				if errI != nil {
-					log.Printf("yt-dlp attempt4 (ios) failed: %v; output: %s", errI, string(outBytesI))
-					// attempt 5: tvhtml5 client
-					outBytesT, errT := tryClient("tvhtml5", "bestaudio[ext=m4a]/bestaudio/best")
-					if errT != nil {
-						log.Printf("yt-dlp attempt5 (tvhtml5) failed: %v; output: %s", errT, string(outBytesT))
-						// attempt 6: try with updated yt-dlp and additional bypass options
-						args3c := []string{
-							"--cookies-from-browser", "chrome",
-							"-R", "3",
-							"--fragment-retries", "3",
-							"--force-ipv4",
-							"--geo-bypass",
-							"--no-check-certificate",
-							"--user-agent", "Mozilla/5.0 (Windows NT 10.0; Win64; x64) AppleWebKit/537.36 (KHTML, like Gecko) Chrome/120.0.0.0 Safari/537.36",
-							"--extractor-args", "youtube:player_client=web,youtube:skip=hls",
-							"-f", "bestaudio[ext=m4a]/bestaudio/best",
-							"-x",
-							"--audio-format", "mp3",
-							"-o", outPattern,
-							body.URL,
-						}
-						log.Printf("yt-dlp retry (with Chrome cookies): args=%v", args3c)
-						outBytes3c, err3c := ytdlpOutput(args3c...)
-						if err3c != nil {
-							log.Printf("yt-dlp chrome-cookies failed: %v; output: %s", err3c, string(outBytes3c))
-							// Fallback 7: Try anonymous Piped API proxy (no YouTube auth required)
-							pipedBase := getEnvOrFile("PIPED_INSTANCE")
-							if pipedBase == "" {
-								pipedBase = "https://piped.video"
-							}
-							// Extract video ID from URL
-							var vid string
-							if u, perr := url.Parse(body.URL); perr == nil {
-								host := strings.ToLower(u.Host)
-								path := strings.Trim(u.Path, "/")
-								if strings.Contains(host, "youtu.be") {
-									vid = path
-								} else {
-									qv := u.Query().Get("v")
-									if qv != "" {
-										vid = qv
-									} else {
-										// handle /shorts/{id}, /embed/{id}
-										parts := strings.Split(path, "/")
-										if len(parts) > 0 {
-											vid = parts[len(parts)-1]
-										}
-									}
-								}
-							}
-							if vid != "" {
-								apiURL := fmt.Sprintf("%s/api/v1/streams/%s", strings.TrimRight(pipedBase, "/"), vid)
-								log.Printf("Piped fallback: GET %s", apiURL)
-								httpClient := &http.Client{Timeout: 60 * time.Second}
-								resp, perr := httpClient.Get(apiURL)
-								if perr == nil && resp != nil && resp.StatusCode == http.StatusOK {
-									var piped struct {
-										AudioStreams []struct {
-											URL      string `json:"url"`
-											Bitrate  int    `json:"bitrate"`
-											MimeType string `json:"mimeType"`
-										} `json:"audioStreams"`
-									}
-									bodyBytes, _ := io.ReadAll(resp.Body)
-									resp.Body.Close()
-									if jerr := json.Unmarshal(bodyBytes, &piped); jerr == nil && len(piped.AudioStreams) > 0 {
-										// pick highest bitrate
-										best := piped.AudioStreams[0]
-										for _, s := range piped.AudioStreams[1:] {
-											if s.Bitrate > best.Bitrate {
-												best = s
-											}
-										}
-										// decide extension by mime
-										ext := ".m4a"
-										if strings.Contains(strings.ToLower(best.MimeType), "webm") {
-											ext = ".webm"
-										}
-										// download stream
-										outAlt := filepath.Join(tmpDir, base+ext)
-										log.Printf("Piped fallback: downloading %s -> %s", best.URL, outAlt)
-										sresp, gerr := httpClient.Get(best.URL)
-										if gerr == nil && sresp != nil && sresp.StatusCode == http.StatusOK {
-											f, ferr := os.Create(outAlt)
-											if ferr == nil {
-												_, cerr := io.Copy(f, sresp.Body)
-												f.Close()
-												sresp.Body.Close()
-												if cerr == nil {
-													// Success: proceed with this file
-													log.Printf("Piped fallback: saved %s", outAlt)
-												} else {
-													log.Printf("Piped fallback: write error: %v", cerr)
-												}
-											} else {
-												log.Printf("Piped fallback: create file error: %v", ferr)
-											}
-										} else if sresp != nil {
-											if sresp.Body != nil {
-												sresp.Body.Close()
-											}
-											log.Printf("Piped fallback: stream GET failed: %s", sresp.Status)
-										} else if gerr != nil {
-											log.Printf("Piped fallback: stream GET error: %v", gerr)
-										}
-									} else {
-										if jerr != nil {
-											log.Printf("Piped fallback: JSON parse error: %v; body=%s", jerr, string(bodyBytes))
-										} else {
-											log.Printf("Piped fallback: no audioStreams found")
-										}
-									}
-								} else {
-									if resp != nil {
-										io.Copy(io.Discard, resp.Body)
-										resp.Body.Close()
-										log.Printf("Piped fallback: API status=%v", resp.Status)
-									}
-									if perr != nil {
-										log.Printf("Piped fallback: API error: %v", perr)
-									}
-								}
-							} else {
-								log.Printf("Piped fallback: cannot extract video ID from URL: %s", body.URL)
-							}
-							// After Piped attempt, continue to file detection below (base.*)
-						}
-					}
-				}
-			}
-		}
+	userID := authFromContext(r).UserID
+	if !requireQuota(w, userID, UsageAudio) {
+		return
 	}
 
-	// Collect all yt-dlp logs for debugging
-	var ytdlpLogs []string
-	var allOutputs [][]byte
-	if err != nil {
-		ytdlpLogs = append(ytdlpLogs, fmt.Sprintf("yt-dlp attempt1 (web) failed: %v; output: %s", err, string(outBytes)))
-		allOutputs = append(allOutputs, outBytes)
-	}
-
-	// Determine produced file. We expect mp3 with base.mp3
-	if _, err := os.Stat(outPath); err != nil {
-		// try to find any produced file
-		entries, _ := os.ReadDir(tmpDir)
-		found := ""
-		for _, e := range entries {
-			if strings.HasPrefix(e.Name(), base+".") {
-				found = filepath.Join(tmpDir, e.Name())
-				break
-			}
-		}
-		if found == "" {
-			log.Printf("YouTube transcribe: audio not found after yt-dlp, base=%s", base)
-			// Collect all previous logs
-			// This is a bit manual, but will capture the flow for debugging
-			// The `err` variable holds the last error in the chain
-			finalErrorDetails := strings.Join(ytdlpLogs, "\n")
-
-			// Check if this is an authentication error from any attempt
-			isAuth := false
-			for _, output := range allOutputs {
-				if isAuthError(output) {
-					isAuth = true
-					break
-				}
-			}
-			if isAuth {
-				JSONErrorWithDetails(w, http.StatusForbidden,
-					"YouTube requires authentication. Please ensure cookies are properly configured.",
-					"This video requires sign-in to access. The server needs valid YouTube cookies to download age-restricted or private content.\n\nDetails:\n"+finalErrorDetails)
-			} else {
-				JSONErrorWithDetails(w, http.StatusInternalServerError, "Audio file not found after download", finalErrorDetails)
-			}
-			return
-		}
-		outPath = found
+	if body.Captions != "" && !validCaptionsPolicy(body.Captions) {
+		JSONError(w, http.StatusBadRequest, "captions must be off, manual or auto")
+		return
 	}
-	defer os.Remove(outPath)
 
-	// Всегда используем сегментированную транскрипцию для YouTube
-	info, _ := os.Stat(outPath)
-	if info != nil {
-		log.Printf("YouTube transcribe: downloaded file=%s size=%d bytes", outPath, info.Size())
-	}
-	// Convert "auto" to empty string for OpenAI Whisper API
-	language := body.Language
-	if language == "auto" {
-		language = ""
+	// Всегда используем сегментированную транскрипцию для YouTube; если у видео есть
+	// субтитры, задача возьмёт их и сменит mode на captions или auto-captions
+	job := &TranscriptionJob{
+		UserID:   userID,
+		Source:   "youtube",
+		URL:      body.URL,
+		Language: language,
+		Mode:     "segmented",
+		Captions: body.Captions,
 	}
-	text, err := transcribeLongAudio(outPath, language)
-	if err != nil {
-		log.Printf("YouTube segmented transcription error: %v", err)
-		JSONErrorWithDetails(w, http.StatusInternalServerError, "Transcription failed", err.Error())
+	if err := CreateJob(job); err != nil {
+		log.Printf("YouTube transcribe: failed to create job: %v", err)
+		JSONError(w, http.StatusInternalServerError, "Failed to create transcription job")
 		return
 	}
-	JSONResponse(w, http.StatusOK, map[string]interface{}{
-		"success":       true,
-		"transcription": text,
-		"source":        "youtube",
-		"url":           body.URL,
-		"mode":          "segmented",
-	})
+	enqueueJob(job.ID)
 
-	log.Printf("YouTube transcribe: success segmented url=%s", body.URL)
+	JSONResponse(w, http.StatusAccepted, map[string]interface{}{
+		"success": true,
+		"jobId":   job.ID.Hex(),
+		"status":  job.Status,
+		"source":  "youtube",
+		"url":     body.URL,
+		"mode":    "segmented",
+	})
 }
 
 // Генерация и сохранение материалов в одну операцию
@@ -385,13 +142,13 @@ func handleGenerateAndSave(w http.ResponseWriter, r *http.Request) {
 	// Debug: вход в обработчик
 	log.Println("[handleGenerateAndSave] start")
 
-	// Извлекаем пользователя из JWT
-	auth := extractUserFromJWT(w, r)
-	if auth == nil {
-		return
-	}
+	// Пользователь из JWT (requireAuth)
+	auth := authFromContext(r)
 	userID := auth.UserID
 	log.Printf("[handleGenerateAndSave] userID=%s", userID.Hex())
+	if !requireQuota(w, userID, UsageTokens) {
+		return
+	}
 
 	// Читаем тело запроса
 	var reqBody GenerateRequest
@@ -400,11 +157,50 @@ func handleGenerateAndSave(w http.ResponseWriter, r *http.Request) {
 		JSONError(w, http.StatusBadRequest, "Invalid request body")
 		return
 	}
+
+	// Прогресс генерации публикуется в поток событий задачи транскрипции
+	jobID := primitive.NilObjectID
+	transcriptRef := reqBody.TranscriptID
+	if job := generationJob(reqBody.JobID, userID); job != nil {
+		jobID = job.ID
+		if transcriptRef == "" && !job.TranscriptID.IsZero() {
+			transcriptRef = job.TranscriptID.Hex()
+		}
+	}
+
+	// Материал ссылается на сохранённый транскрипт вместо копии текста
+	if reqBody.Transcript == "" && reqBody.TranscriptID != "" {
+		if id, err := primitive.ObjectIDFromHex(reqBody.TranscriptID); err == nil {
+			if t, err := GetTranscript(id, userID); err == nil {
+				reqBody.Transcript = t.Text
+			}
+		}
+	}
 	if reqBody.Transcript == "" {
 		log.Println("[handleGenerateAndSave] empty transcript")
 		JSONError(w, http.StatusBadRequest, "Transcript is required")
 		return
 	}
+	transcriptID, err := resolveTranscriptRef(userID, transcriptRef, reqBody.Transcript, reqBody.Language)
+	if err != nil {
+		if errors.Is(err, errTranscriptNotFound) {
+			JSONError(w, http.StatusBadRequest, "Transcript not found")
+			return
+		}
+		log.Printf("[handleGenerateAndSave] saving transcript error: %v", err)
+		JSONError(w, http.StatusInternalServerError, "Failed to save transcript")
+		return
+	}
+
+	saved := false
+	if !jobID.IsZero() {
+		setJobStage(jobID, StageGenerating, "")
+		defer func() {
+			if !saved {
+				failJobGeneration(jobID, "Generation failed")
+			}
+		}()
+	}
 
 	// Подсчёт желаемого числа вопросов от объёма текста
 	words := len(strings.Fields(reqBody.Transcript))
@@ -418,6 +214,11 @@ func handleGenerateAndSave(w http.ResponseWriter, r *http.Request) {
 			targetQuiz = 30
 		}
 	}
+	// План может ограничивать размер квиза
+	ent := entitlementsFromContext(r, userID)
+	if ent.MaxQuizQuestions > 0 && targetQuiz > ent.MaxQuizQuestions {
+		targetQuiz = ent.MaxQuizQuestions
+	}
 	log.Printf("[handleGenerateAndSave] transcript_len=%d words=%d targetQuiz~=%d", len(reqBody.Transcript), words, targetQuiz)
 
 	// Улучшенный промпт для флешкарточек, квиза и краткого summary с подсчетом слов
@@ -490,74 +291,35 @@ func handleGenerateAndSave(w http.ResponseWriter, r *http.Request) {
 		reqBody.Language, targetQuiz, reqBody.Transcript,
 	)
 
-	chatReq := map[string]interface{}{
-		"model":           "gpt-4o-mini",
-		"temperature":     0.3,
-		"response_format": map[string]string{"type": "json_object"},
-		"messages": []map[string]string{
-			{"role": "system", "content": systemPrompt},
-			{"role": "user", "content": userPrompt},
+	completion, err := llmProvider.Complete(r.Context(), CompletionRequest{
+		JSON: true,
+		Messages: []ChatMessage{
+			{Role: "system", Content: systemPrompt},
+			{Role: "user", Content: userPrompt},
 		},
-	}
-	buf, _ := json.Marshal(chatReq)
-	httpReq, err := http.NewRequest("POST", "https://api.openai.com/v1/chat/completions", bytes.NewReader(buf))
-	if err != nil {
-		http.Error(w, "Failed to create request", http.StatusInternalServerError)
-		return
-	}
-	httpReq.Header.Set("Authorization", "Bearer "+openaiAPIKey)
-	httpReq.Header.Set("Content-Type", "application/json")
-
-	httpClient := &http.Client{Timeout: 70 * time.Second}
-	resp, err := httpClient.Do(httpReq)
+	})
 	if err != nil {
-		log.Printf("[handleGenerateAndSave] OpenAI chat API error: %v", err)
+		log.Printf("[handleGenerateAndSave] %s error: %v", llmProvider.Name(), err)
 		JSONErrorWithDetails(w, http.StatusInternalServerError, "Failed to generate materials", err.Error())
 		return
 	}
-	defer resp.Body.Close()
-
-	respBytes, err := io.ReadAll(resp.Body)
-	if err != nil {
-		JSONError(w, http.StatusInternalServerError, "Failed to read response")
-		return
-	}
-	if resp.StatusCode != http.StatusOK {
-		log.Printf("[handleGenerateAndSave] OpenAI chat API error: %s - %s", resp.Status, string(respBytes))
-		JSONErrorWithDetails(w, http.StatusInternalServerError, "Generation failed", resp.Status)
-		return
-	}
-
-	var openaiResp struct {
-		Choices []struct {
-			Message struct {
-				Content string `json:"content"`
-			} `json:"message"`
-		} `json:"choices"`
-	}
-	if err := json.Unmarshal(respBytes, &openaiResp); err != nil {
-		JSONError(w, http.StatusInternalServerError, "Failed to parse OpenAI response")
-		return
-	}
-	if len(openaiResp.Choices) == 0 {
-		JSONError(w, http.StatusInternalServerError, "Empty OpenAI response")
-		return
-	}
+	content := completion.Content
+	recordUsage(userID, 0, completionTokens(completion, systemPrompt+userPrompt))
 
 	// Parse raw response first
 	var payloadRaw GeneratePayloadRaw
 	var payload GeneratePayload
 	parsed := false
 
-	if err := json.Unmarshal([]byte(openaiResp.Choices[0].Message.Content), &payloadRaw); err != nil {
-		clean := strings.TrimSpace(openaiResp.Choices[0].Message.Content)
+	if err := json.Unmarshal([]byte(content), &payloadRaw); err != nil {
+		clean := strings.TrimSpace(content)
 		clean = strings.TrimPrefix(clean, "```json")
 		clean = strings.TrimPrefix(clean, "```")
 		clean = strings.TrimSuffix(clean, "```")
 		clean = strings.TrimSpace(clean)
 		if err2 := json.Unmarshal([]byte(clean), &payloadRaw); err2 != nil {
 			// Попытка 3: извлечь JSON по первым и последним фигурным скобкам
-			raw := openaiResp.Choices[0].Message.Content
+			raw := content
 			i := strings.Index(raw, "{")
 			j := strings.LastIndex(raw, "}")
 			if i >= 0 && j > i {
@@ -573,7 +335,7 @@ func handleGenerateAndSave(w http.ResponseWriter, r *http.Request) {
 			}
 			if !parsed {
 				// Не валидный JSON: фиксируем и переходим к бэкенд-фоллбеку ниже
-				log.Printf("[handleGenerateAndSave] Failed to unmarshal AI JSON: %v; content: %s", err, openaiResp.Choices[0].Message.Content)
+				log.Printf("[handleGenerateAndSave] Failed to unmarshal AI JSON: %v; content: %s", err, content)
 			}
 		} else {
 			parsed = true
@@ -735,18 +497,28 @@ func handleGenerateAndSave(w http.ResponseWriter, r *http.Request) {
 		log.Printf("[handleGenerateAndSave] fallback used: flashcards=%d quiz=%d", len(payload.Flashcards), len(payload.Quiz))
 	}
 
+	quizCapped := false
+	if ent.MaxQuizQuestions > 0 && len(payload.Quiz) > ent.MaxQuizQuestions {
+		log.Printf("[handleGenerateAndSave] quiz capped by plan %s: %d -> %d", ent.Plan, len(payload.Quiz), ent.MaxQuizQuestions)
+		payload.Quiz = payload.Quiz[:ent.MaxQuizQuestions]
+		quizCapped = true
+	}
+
 	// Diagnostics: log generation counts
 	log.Printf("[handleGenerateAndSave] generated: flashcards=%d quiz=%d", len(payload.Flashcards), len(payload.Quiz))
 
 	// Сохраняем материал в MongoDB с привязкой к пользователю
 	material := Material{
-		UserID:     userID,
-		Transcript: reqBody.Transcript,
-		Summary:    payload.Summary,
-		Flashcards: payload.Flashcards,
-		Quiz:       payload.Quiz,
-		CreatedAt:  time.Now(),
-		UpdatedAt:  time.Now(),
+		UserID:       userID,
+		TranscriptID: transcriptID,
+		Summary:      payload.Summary,
+		Flashcards:   payload.Flashcards,
+		Quiz:         payload.Quiz,
+		CreatedAt:    time.Now(),
+		UpdatedAt:    time.Now(),
+	}
+	if !jobID.IsZero() {
+		setJobStage(jobID, StageSaving, "")
 	}
 	log.Printf("[handleGenerateAndSave] inserting material: user=%s flashcards=%d quiz=%d", userID.Hex(), len(payload.Flashcards), len(payload.Quiz))
 	collection := client.Database("speakapper").Collection("materials")
@@ -761,6 +533,11 @@ func handleGenerateAndSave(w http.ResponseWriter, r *http.Request) {
 	}
 	log.Printf("[handleGenerateAndSave] inserted material _id=%v (type=%T) in %s", result.InsertedID, result.InsertedID, time.Since(startIns))
 	material.ID = result.InsertedID.(primitive.ObjectID)
+	material.Transcript = reqBody.Transcript
+	saved = true
+	if !jobID.IsZero() {
+		finishJobGeneration(jobID, material.ID.Hex())
+	}
 
 	// Guard against null slices in JSON
 	respFlash := material.Flashcards
@@ -772,11 +549,12 @@ func handleGenerateAndSave(w http.ResponseWriter, r *http.Request) {
 		respQuiz = []QuizQuestion{}
 	}
 	JSONResponse(w, http.StatusOK, map[string]interface{}{
-		"success":    true,
-		"material":   material,
-		"flashcards": respFlash,
-		"quiz":       respQuiz,
-		"summary":    material.Summary,
+		"success":     true,
+		"material":    material,
+		"flashcards":  respFlash,
+		"quiz":        respQuiz,
+		"summary":     material.Summary,
+		"quiz_capped": quizCapped,
 	})
 }
 
@@ -789,40 +567,7 @@ var jwtSecret []byte
 var openaiAPIKey string
 
 func handleMaterials(w http.ResponseWriter, r *http.Request) {
-	// Extract user ID from JWT token
-	authHeader := r.Header.Get("Authorization")
-	if authHeader == "" {
-		http.Error(w, "Authorization header required", http.StatusUnauthorized)
-		return
-	}
-
-	tokenString := strings.TrimPrefix(authHeader, "Bearer ")
-	token, err := jwt.Parse(tokenString, func(token *jwt.Token) (interface{}, error) {
-		return jwtSecret, nil
-	})
-
-	if err != nil || !token.Valid {
-		http.Error(w, "Invalid token", http.StatusUnauthorized)
-		return
-	}
-
-	claims, ok := token.Claims.(jwt.MapClaims)
-	if !ok {
-		http.Error(w, "Invalid token claims", http.StatusUnauthorized)
-		return
-	}
-
-	userIDStr, ok := claims["user_id"].(string)
-	if !ok {
-		http.Error(w, "Invalid user ID in token", http.StatusUnauthorized)
-		return
-	}
-
-	userID, err := primitive.ObjectIDFromHex(userIDStr)
-	if err != nil {
-		http.Error(w, "Invalid user ID format", http.StatusBadRequest)
-		return
-	}
+	userID := authFromContext(r).UserID
 
 	// Handle GET request - fetch user materials
 	if r.Method == "GET" {
@@ -843,6 +588,7 @@ func handleMaterials(w http.ResponseWriter, r *http.Request) {
 			http.Error(w, "Failed to decode materials", http.StatusInternalServerError)
 			return
 		}
+		fillMaterialTranscripts(materials)
 
 		// Convert ObjectIDs to strings for JSON response
 		var responseMaterials []map[string]interface{}
@@ -856,12 +602,13 @@ func handleMaterials(w http.ResponseWriter, r *http.Request) {
 				q = []QuizQuestion{}
 			}
 			responseMaterials = append(responseMaterials, map[string]interface{}{
-				"id":         mat.ID.Hex(),
-				"transcript": mat.Transcript,
-				"flashcards": f,
-				"quiz":       q,
-				"created_at": mat.CreatedAt,
-				"updated_at": mat.UpdatedAt,
+				"id":            mat.ID.Hex(),
+				"transcript_id": mat.TranscriptID,
+				"transcript":    mat.Transcript,
+				"flashcards":    f,
+				"quiz":          q,
+				"created_at":    mat.CreatedAt,
+				"updated_at":    mat.UpdatedAt,
 			})
 		}
 
@@ -874,9 +621,10 @@ func handleMaterials(w http.ResponseWriter, r *http.Request) {
 
 	// Handle POST request - create new material
 	var materialData struct {
-		Transcript string         `json:"transcript"`
-		Flashcards []Flashcard    `json:"flashcards"`
-		Quiz       []QuizQuestion `json:"quiz"`
+		Transcript   string         `json:"transcript"`
+		TranscriptID string         `json:"transcriptId"`
+		Flashcards   []Flashcard    `json:"flashcards"`
+		Quiz         []QuizQuestion `json:"quiz"`
 	}
 
 	if err := json.NewDecoder(r.Body).Decode(&materialData); err != nil {
@@ -892,14 +640,25 @@ func handleMaterials(w http.ResponseWriter, r *http.Request) {
 		materialData.Quiz = []QuizQuestion{}
 	}
 
+	transcriptID, err := resolveTranscriptRef(userID, materialData.TranscriptID, materialData.Transcript, "")
+	if err != nil {
+		if errors.Is(err, errTranscriptNotFound) {
+			http.Error(w, "Transcript not found", http.StatusBadRequest)
+			return
+		}
+		log.Printf("[handleMaterials:POST] saving transcript error: %v", err)
+		http.Error(w, "Failed to save transcript", http.StatusInternalServerError)
+		return
+	}
+
 	// Create material
 	material := Material{
-		UserID:     userID,
-		Transcript: materialData.Transcript,
-		Flashcards: materialData.Flashcards,
-		Quiz:       materialData.Quiz,
-		CreatedAt:  time.Now(),
-		UpdatedAt:  time.Now(),
+		UserID:       userID,
+		TranscriptID: transcriptID,
+		Flashcards:   materialData.Flashcards,
+		Quiz:         materialData.Quiz,
+		CreatedAt:    time.Now(),
+		UpdatedAt:    time.Now(),
 	}
 
 	// Save to MongoDB
@@ -918,6 +677,7 @@ func handleMaterials(w http.ResponseWriter, r *http.Request) {
 
 	// Set the ID from the inserted document
 	material.ID = result.InsertedID.(primitive.ObjectID)
+	material.Transcript = materialData.Transcript
 
 	// Return the created material
 	JSONResponse(w, http.StatusOK, map[string]interface{}{
@@ -958,14 +718,15 @@ func handleNotes(w http.ResponseWriter, r *http.Request) {
 		var responseNotes []map[string]interface{}
 		for _, note := range notes {
 			responseNotes = append(responseNotes, map[string]interface{}{
-				"id":          note.ID.Hex(),
-				"title":       note.Title,
-				"content":     note.Content,
-				"type":        note.Type,
-				"tab":         note.Tab,
-				"last_opened": note.LastOpened,
-				"created_at":  note.CreatedAt,
-				"updated_at":  note.UpdatedAt,
+				"id":            note.ID.Hex(),
+				"title":         note.Title,
+				"content":       note.Content,
+				"type":          note.Type,
+				"tab":           note.Tab,
+				"transcript_id": note.TranscriptID,
+				"last_opened":   note.LastOpened,
+				"created_at":    note.CreatedAt,
+				"updated_at":    note.UpdatedAt,
 			})
 		}
 
@@ -979,10 +740,11 @@ func handleNotes(w http.ResponseWriter, r *http.Request) {
 	// Handle POST request - create new note
 	// Parse request body
 	var noteData struct {
-		Title   string `json:"title"`
-		Content string `json:"content"`
-		Type    string `json:"type"`
-		Tab     string `json:"tab"`
+		Title        string `json:"title"`
+		Content      string `json:"content"`
+		Type         string `json:"type"`
+		Tab          string `json:"tab"`
+		TranscriptID string `json:"transcriptId"`
 	}
 
 	if err := json.NewDecoder(r.Body).Decode(&noteData); err != nil {
@@ -990,16 +752,32 @@ func handleNotes(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	// Notes may link to a saved transcript instead of copying it into content
+	var transcriptID primitive.ObjectID
+	if noteData.TranscriptID != "" {
+		id, err := primitive.ObjectIDFromHex(noteData.TranscriptID)
+		if err != nil {
+			http.Error(w, "Invalid transcriptId", http.StatusBadRequest)
+			return
+		}
+		if _, err := GetTranscript(id, userID); err != nil {
+			http.Error(w, "Transcript not found", http.StatusBadRequest)
+			return
+		}
+		transcriptID = id
+	}
+
 	// Create note
 	note := Note{
-		UserID:     userID,
-		Title:      noteData.Title,
-		Content:    noteData.Content,
-		Type:       noteData.Type,
-		Tab:        noteData.Tab,
-		LastOpened: "Just now",
-		CreatedAt:  time.Now(),
-		UpdatedAt:  time.Now(),
+		TranscriptID: transcriptID,
+		UserID:       userID,
+		Title:        noteData.Title,
+		Content:      noteData.Content,
+		Type:         noteData.Type,
+		Tab:          noteData.Tab,
+		LastOpened:   "Just now",
+		CreatedAt:    time.Now(),
+		UpdatedAt:    time.Now(),
 	}
 
 	// Save to MongoDB
@@ -1021,94 +799,91 @@ func handleNotes(w http.ResponseWriter, r *http.Request) {
 	})
 }
 
-func transcribeLongAudio(inputPath string, language string) (string, error) {
+// segmentAudio splits the input into ~10-minute mono 16kHz chunks inside workDir
+// and returns their paths in playback order
+func segmentAudio(inputPath string, workDir string) ([]string, error) {
 	// Check ffmpeg availability
 	if _, err := exec.LookPath("ffmpeg"); err != nil {
-		return "", fmt.Errorf("ffmpeg not found: %w", err)
+		return nil, fmt.Errorf("ffmpeg not found: %w", err)
 	}
 
-	workDir, err := os.MkdirTemp(os.TempDir(), "chunks_*")
-	if err != nil {
-		return "", err
-	}
-	defer os.RemoveAll(workDir)
-
 	// Segment into ~10-minute chunks, mono 16kHz low bitrate to reduce size
+	// segments.csv records where each chunk starts in the original recording
 	chunkPattern := filepath.Join(workDir, "chunk_%03d.mp3")
-	cmd := exec.Command("ffmpeg", "-y", "-i", inputPath, "-ac", "1", "-ar", "16000", "-b:a", "64k", "-f", "segment", "-segment_time", "600", chunkPattern)
+	cmd := exec.Command("ffmpeg", "-y", "-i", inputPath, "-ac", "1", "-ar", "16000", "-b:a", "64k", "-f", "segment", "-segment_time", strconv.Itoa(chunkSeconds),
+		"-segment_list", filepath.Join(workDir, "segments.csv"), "-segment_list_type", "csv", chunkPattern)
 	cmd.Stdout = os.Stdout
 	cmd.Stderr = os.Stderr
 	if err := cmd.Run(); err != nil {
-		return "", fmt.Errorf("ffmpeg segment failed: %w", err)
+		return nil, fmt.Errorf("ffmpeg segment failed: %w", err)
 	}
 
-	// Collect chunks
-	entries, err := os.ReadDir(workDir)
+	chunkFiles, err := listChunkFiles(workDir)
 	if err != nil {
-		return "", err
-	}
-	var chunkFiles []string
-	for _, e := range entries {
-		if !e.IsDir() && strings.HasPrefix(e.Name(), "chunk_") {
-			chunkFiles = append(chunkFiles, filepath.Join(workDir, e.Name()))
-		}
+		return nil, err
 	}
 	if len(chunkFiles) == 0 {
-		return "", fmt.Errorf("no chunks produced")
+		return nil, fmt.Errorf("no chunks produced")
 	}
-	// Sort by name to keep order
-	slices.Sort(chunkFiles)
+	return chunkFiles, nil
+}
 
-	var fullText strings.Builder
-	httpClient := &http.Client{Timeout: 180 * time.Second}
-	for _, path := range chunkFiles {
-		// Build multipart per chunk
-		var body bytes.Buffer
-		mw := multipart.NewWriter(&body)
-		chunk, err := os.ReadFile(path)
-		if err != nil {
-			return "", err
-		}
-		p, err := mw.CreateFormFile("file", filepath.Base(path))
-		if err != nil {
-			return "", err
-		}
-		if _, err := p.Write(chunk); err != nil {
-			return "", err
-		}
-		mw.WriteField("model", "whisper-1")
-		if language != "" {
-			mw.WriteField("language", language)
-		}
-		mw.Close()
+// probeAudioDuration returns the length of the recording in seconds using ffprobe
+func probeAudioDuration(path string) (float64, error) {
+	out, err := exec.Command("ffprobe", "-v", "error", "-show_entries", "format=duration",
+		"-of", "default=noprint_wrappers=1:nokey=1", path).Output()
+	if err != nil {
+		return 0, fmt.Errorf("ffprobe failed: %w", err)
+	}
+	d, err := strconv.ParseFloat(strings.TrimSpace(string(out)), 64)
+	if err != nil {
+		return 0, fmt.Errorf("ffprobe returned %q: %w", strings.TrimSpace(string(out)), err)
+	}
+	return d, nil
+}
 
-		req, err := http.NewRequest("POST", "https://api.openai.com/v1/audio/transcriptions", &body)
-		if err != nil {
-			return "", err
+// chunkOffsets returns the start time (seconds) of each chunk in dir, read from the
+// ffmpeg segment list; chunks missing from the list fall back to index*chunkSeconds
+func chunkOffsets(dir string, chunkFiles []string) []float64 {
+	starts := map[string]float64{}
+	if data, err := os.ReadFile(filepath.Join(dir, "segments.csv")); err == nil {
+		for _, line := range strings.Split(string(data), "\n") {
+			fields := strings.Split(strings.TrimSpace(line), ",")
+			if len(fields) < 2 {
+				continue
+			}
+			if start, err := strconv.ParseFloat(fields[1], 64); err == nil {
+				starts[fields[0]] = start
+			}
 		}
-		req.Header.Set("Authorization", "Bearer "+openaiAPIKey)
-		req.Header.Set("Content-Type", mw.FormDataContentType())
+	}
 
-		resp, err := httpClient.Do(req)
-		if err != nil {
-			return "", err
-		}
-		respBytes, _ := io.ReadAll(resp.Body)
-		resp.Body.Close()
-		if resp.StatusCode != http.StatusOK {
-			return "", fmt.Errorf("chunk transcribe error: %s - %s", resp.Status, string(respBytes))
-		}
-		var wr WhisperResponse
-		if err := json.Unmarshal(respBytes, &wr); err != nil {
-			return "", err
+	offsets := make([]float64, len(chunkFiles))
+	for i, path := range chunkFiles {
+		if start, ok := starts[filepath.Base(path)]; ok {
+			offsets[i] = start
+		} else {
+			offsets[i] = float64(i * chunkSeconds)
 		}
-		fullText.WriteString(strings.TrimSpace(wr.Text))
-		fullText.WriteString("\n")
-		// throttle a bit to be safe
-		time.Sleep(500 * time.Millisecond)
 	}
+	return offsets
+}
 
-	return fullText.String(), nil
+// listChunkFiles returns chunk_* files in dir sorted by name
+func listChunkFiles(dir string) ([]string, error) {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+	var chunkFiles []string
+	for _, e := range entries {
+		if !e.IsDir() && strings.HasPrefix(e.Name(), "chunk_") {
+			chunkFiles = append(chunkFiles, filepath.Join(dir, e.Name()))
+		}
+	}
+	// Sort by name to keep order
+	slices.Sort(chunkFiles)
+	return chunkFiles, nil
 }
 
 func handleGenerate(w http.ResponseWriter, r *http.Request) {
@@ -1126,6 +901,10 @@ func handleGenerate(w http.ResponseWriter, r *http.Request) {
 		http.Error(w, "Transcript is required", http.StatusBadRequest)
 		return
 	}
+	userID := authFromContext(r).UserID
+	if !requireQuota(w, userID, UsageTokens) {
+		return
+	}
 
 	// Build chat completion request
 	systemPrompt := `Ты — профессиональный генератор flashcards, quiz и кратких конспектов (summary) для эффективного обучения.
@@ -1191,74 +970,34 @@ func handleGenerate(w http.ResponseWriter, r *http.Request) {
 
 ФОРМАТ ОТВЕТА: Верни только JSON с полями: { "flashcards": [...], "quiz": ..., "summary": "...", "languageCode"? }. Каждая flashcard должна содержать {term, definition, example?}. Каждый quiz вопрос должен содержать {id?, type, question, options?, answer?, correct?, rationale?}.`
 
-	chatReq := map[string]interface{}{
-		"model":           "gpt-4o-mini",
-		"temperature":     0.3,
-		"response_format": map[string]string{"type": "json_object"},
-		"messages": []map[string]string{
-			{"role": "system", "content": systemPrompt},
-			{"role": "user", "content": fmt.Sprintf("Language hint: %s\nTranscript:\n%s\n\nReturn JSON only.", reqBody.Language, reqBody.Transcript)},
+	userPrompt := fmt.Sprintf("Language hint: %s\nTranscript:\n%s\n\nReturn JSON only.", reqBody.Language, reqBody.Transcript)
+	completion, err := llmProvider.Complete(r.Context(), CompletionRequest{
+		JSON: true,
+		Messages: []ChatMessage{
+			{Role: "system", Content: systemPrompt},
+			{Role: "user", Content: userPrompt},
 		},
-	}
-
-	buf, _ := json.Marshal(chatReq)
-	httpReq, err := http.NewRequest("POST", "https://api.openai.com/v1/chat/completions", bytes.NewReader(buf))
-	if err != nil {
-		http.Error(w, "Failed to create request", http.StatusInternalServerError)
-		return
-	}
-	httpReq.Header.Set("Authorization", "Bearer "+openaiAPIKey)
-	httpReq.Header.Set("Content-Type", "application/json")
-
-	httpClient := &http.Client{Timeout: 45 * time.Second}
-	resp, err := httpClient.Do(httpReq)
+	})
 	if err != nil {
-		log.Printf("OpenAI chat API error: %v", err)
+		log.Printf("%s chat error: %v", llmProvider.Name(), err)
 		http.Error(w, "Failed to generate materials", http.StatusInternalServerError)
 		return
 	}
-	defer resp.Body.Close()
-
-	respBytes, err := io.ReadAll(resp.Body)
-	if err != nil {
-		http.Error(w, "Failed to read response", http.StatusInternalServerError)
-		return
-	}
-	if resp.StatusCode != http.StatusOK {
-		log.Printf("OpenAI chat API error: %s - %s", resp.Status, string(respBytes))
-		http.Error(w, "Generation failed", http.StatusInternalServerError)
-		return
-	}
-
-	// Parse choices[0].message.content
-	var openaiResp struct {
-		Choices []struct {
-			Message struct {
-				Content string `json:"content"`
-			} `json:"message"`
-		} `json:"choices"`
-	}
-	if err := json.Unmarshal(respBytes, &openaiResp); err != nil {
-		http.Error(w, "Failed to parse OpenAI response", http.StatusInternalServerError)
-		return
-	}
-	if len(openaiResp.Choices) == 0 {
-		http.Error(w, "Empty OpenAI response", http.StatusInternalServerError)
-		return
-	}
+	content := completion.Content
+	recordUsage(userID, 0, completionTokens(completion, systemPrompt+userPrompt))
 
 	// Parse raw response first
 	var payloadRaw GeneratePayloadRaw
-	if err := json.Unmarshal([]byte(openaiResp.Choices[0].Message.Content), &payloadRaw); err != nil {
+	if err := json.Unmarshal([]byte(content), &payloadRaw); err != nil {
 		// If model returned fenced code block, try strip
-		clean := openaiResp.Choices[0].Message.Content
+		clean := content
 		clean = strings.TrimSpace(clean)
 		// naive cleanup of Markdown fences
 		clean = strings.TrimPrefix(clean, "```json")
 		clean = strings.TrimPrefix(clean, "```")
 		clean = strings.TrimSuffix(clean, "```")
 		if err2 := json.Unmarshal([]byte(clean), &payloadRaw); err2 != nil {
-			log.Printf("Failed to unmarshal AI JSON: %v; content: %s", err, openaiResp.Choices[0].Message.Content)
+			log.Printf("Failed to unmarshal AI JSON: %v; content: %s", err, content)
 			http.Error(w, "Invalid JSON from model", http.StatusInternalServerError)
 			return
 		}
@@ -1396,10 +1135,23 @@ func main() {
 	loadDotEnv(filepath.Join("..", ".env"), ".env")
 
 	// Читаем OpenAI API ключ из переменной окружения
+	// Обязателен только для бэкендов openai (см. TRANSCRIBER и LLM_PROVIDER)
 	openaiAPIKey = getEnvOrFile("OPENAI_API_KEY")
-	if openaiAPIKey == "" {
-		log.Fatal("❌ OPENAI_API_KEY не задан в переменных окружения!")
+
+	// Бэкенд транскрипции: openai (по умолчанию), local (whisper.cpp/faster-whisper) или fake
+	var err error
+	transcriber, err = newTranscriberFromEnv()
+	if err != nil {
+		log.Fatal("❌ Ошибка настройки транскрипции: ", err)
+	}
+	log.Printf("🎙️  Transcriber: %s", transcriber.Name())
+
+	// Провайдер LLM для генерации карточек/квизов: openai, openai-compatible (Ollama, llama.cpp, vLLM) или mock
+	llmProvider, err = newLLMProviderFromEnv()
+	if err != nil {
+		log.Fatal("❌ Ошибка настройки LLM: ", err)
 	}
+	log.Printf("🧠 LLM provider: %s", llmProvider.Name())
 
 	// Читаем JWT секрет из окружения (с дефолтом и предупреждением)
 	if envSecret := os.Getenv("JWT_SECRET"); envSecret != "" {
@@ -1416,6 +1168,79 @@ func main() {
 	if database != nil {
 		log.Printf("✅ Mongo database selected: %s", database.Name())
 	}
+	markLegacyUsersVerified()
+	ensureUserIndexes()
+	ensureIdentityIndex()
+	bootstrapAdmins()
+
+	// Фоновые воркеры транскрипции + возобновление прерванных задач
+	transcribeConcurrency = getEnvInt("TRANSCRIBE_CONCURRENCY", transcribeConcurrency)
+	if transcribeConcurrency < 1 {
+		transcribeConcurrency = 1
+	}
+	quotaLimits = quotaLimitsFromEnv()
+	ensureUsageIndex()
+	accessTokenTTL = time.Duration(getEnvInt("ACCESS_TOKEN_TTL_MINUTES", 15)) * time.Minute
+	refreshTokenTTL = time.Duration(getEnvInt("REFRESH_TOKEN_TTL_DAYS", 30)) * 24 * time.Hour
+
+	// Подписки: каталог планов (SUBSCRIPTION_PLANS_FILE) и платёжный провайдер (PAYMENT_PROVIDER)
+	if plans, err = loadPlansFromEnv(); err != nil {
+		log.Fatal("❌ Ошибка загрузки планов подписки: ", err)
+	}
+	if paymentProvider, err = newPaymentProviderFromEnv(); err != nil {
+		log.Fatal("❌ Ошибка настройки платёжного провайдера: ", err)
+	}
+	if rateLimiter, err = newRateLimiterFromEnv(); err != nil {
+		log.Fatal("❌ Ошибка настройки rate limiting: ", err)
+	}
+	if err := parseRateLimits(getEnvOrFile("RATE_LIMITS"), routeLimits); err != nil {
+		log.Fatal("❌ Ошибка в RATE_LIMITS: ", err)
+	}
+	ensureLoginFailureIndex()
+	if audioFetchers, err = newFetcherChainFromEnv(); err != nil {
+		log.Fatal("❌ Ошибка в YOUTUBE_FETCHERS: ", err)
+	}
+	if blobStore, err = newBlobStoreFromEnv(); err != nil {
+		log.Fatal("❌ Ошибка настройки хранилища аудио: ", err)
+	}
+	log.Printf("🗄️  Blob store: %s", blobStore.Name())
+	trustedProxyHops = getEnvInt("TRUSTED_PROXY_HOPS", 0)
+	webhookSecret = getEnvOrFile("PAYMENT_WEBHOOK_SECRET")
+	if webhookSecret == "" {
+		log.Println("⚠️  PAYMENT_WEBHOOK_SECRET не задан, /api/subscription/webhook отклоняет все события")
+	}
+	if paymentProvider == nil {
+		log.Println("⚠️  PAYMENT_PROVIDER не задан, оплата отключена: checkout и webhook отвечают 503")
+	} else {
+		log.Printf("💳 Payment provider: %s, plans: %d", paymentProvider.Name(), len(plans))
+	}
+
+	// Вход через Google: ID-токены проверяются по JWKS, aud — по GOOGLE_CLIENT_ID
+	googleVerifier = newGoogleVerifierFromEnv()
+	if len(googleVerifier.ClientIDs) == 0 {
+		log.Println("⚠️  GOOGLE_CLIENT_ID не задан, вход через Google отключён")
+	}
+
+	// Вход через OpenID Connect (Microsoft Entra, Keycloak, ...): реестр из OIDC_PROVIDERS_FILE
+	if oidcProviders, err = loadOIDCProvidersFromEnv(); err != nil {
+		log.Fatal("❌ Ошибка загрузки OIDC-провайдеров: ", err)
+	}
+	if len(oidcProviders) > 0 {
+		log.Printf("🔑 OIDC providers: %d", len(oidcProviders))
+	}
+
+	// Письма подтверждения email и сброса пароля (MAILER)
+	if mailer, err = newMailerFromEnv(); err != nil {
+		log.Fatal("❌ Ошибка настройки почты: ", err)
+	}
+	log.Printf("✉️  Mailer: %s", mailer.Name())
+
+	startJobWorkers(getEnvInt("TRANSCRIBE_JOB_WORKERS", 2))
+	resumeJobs()
+	startDeletionWorker()
+	startExportWorker()
+	startUploadSweeper()
+
 	r := mux.NewRouter()
 
 	// Настройка CORS
@@ -1426,10 +1251,13 @@ func main() {
 			"http://127.0.0.1:3001",
 			"http://127.0.0.1:3000",
 		}),
-		handlers.AllowedMethods([]string{"GET", "POST", "PUT", "DELETE", "OPTIONS"}),
-		handlers.AllowedHeaders([]string{"Content-Type", "Authorization"}),
+		handlers.AllowedMethods([]string{"GET", "HEAD", "POST", "PUT", "PATCH", "DELETE", "OPTIONS"}),
+		handlers.AllowedHeaders([]string{"Content-Type", "Authorization", "Range",
+			"Tus-Resumable", "Upload-Length", "Upload-Offset", "Upload-Metadata", "Upload-Checksum"}),
 		handlers.AllowCredentials(),
-		handlers.ExposedHeaders([]string{"Cross-Origin-Opener-Policy"}),
+		handlers.ExposedHeaders([]string{"Cross-Origin-Opener-Policy", "Content-Range", "Accept-Ranges", "Location",
+			"Tus-Resumable", "Tus-Version", "Tus-Extension", "Tus-Max-Size", "Tus-Checksum-Algorithm",
+			"Upload-Offset", "Upload-Length", "Upload-Expires", "Upload-Job-Id"}),
 	)
 
 	// Add COOP headers middleware
@@ -1443,22 +1271,89 @@ func main() {
 	}
 
 	// Роуты
-	r.HandleFunc("/api/signup", signupHandler).Methods("POST")
-	r.HandleFunc("/api/login", loginHandler).Methods("POST")
-	r.HandleFunc("/api/google-signup", googleSignupHandler).Methods("POST")
+	r.HandleFunc("/api/signup", signupHandler).Methods("POST").Name("signup")
+	r.HandleFunc("/api/login", loginHandler).Methods("POST").Name("login")
+	r.HandleFunc("/api/google-signup", googleSignupHandler).Methods("POST").Name("google-signup")
+	r.HandleFunc("/api/auth/refresh", handleAuthRefresh).Methods("POST").Name("refresh")
+	r.HandleFunc("/api/auth/logout", handleAuthLogout).Methods("POST")
+	r.HandleFunc("/api/auth/sessions", requireAuth(handleListSessions)).Methods("GET")
+	r.HandleFunc("/api/auth/sessions", requireAuth(noImpersonation(handleRevokeOtherSessions))).Methods("DELETE")
+	r.HandleFunc("/api/auth/sessions/{id}", requireAuth(noImpersonation(handleRevokeSession))).Methods("DELETE")
+	r.HandleFunc("/api/auth/verify-email", handleVerifyEmail).Methods("POST").Name("verify-email")
+	r.HandleFunc("/api/auth/verify-email/resend", requireAuth(handleResendVerification)).Methods("POST")
+	r.HandleFunc("/api/auth/password/forgot", handleForgotPassword).Methods("POST").Name("password-forgot")
+	r.HandleFunc("/api/auth/password/reset", handleResetPassword).Methods("POST").Name("password-reset")
+	r.HandleFunc("/api/auth/2fa", requireAuth(handleTwoFactorStatus)).Methods("GET")
+	r.HandleFunc("/api/auth/2fa/enroll", requireAuth(noImpersonation(handleTwoFactorEnroll))).Methods("POST")
+	r.HandleFunc("/api/auth/2fa/confirm", requireAuth(noImpersonation(handleTwoFactorConfirm))).Methods("POST")
+	r.HandleFunc("/api/auth/2fa/disable", requireAuth(noImpersonation(handleTwoFactorDisable))).Methods("POST")
+	r.HandleFunc("/api/auth/2fa/recovery-codes", requireAuth(noImpersonation(handleTwoFactorRecoveryCodes))).Methods("POST")
+	r.HandleFunc("/api/auth/2fa/verify", handleTwoFactorVerify).Methods("POST").Name("2fa-verify")
+	r.HandleFunc("/api/auth/oidc/providers", handleOIDCProviders).Methods("GET")
+	r.HandleFunc("/api/auth/oidc/callback", handleOIDCCallback).Methods("POST").Name("oidc-callback")
+	r.HandleFunc("/api/auth/oidc/{provider}/start", handleOIDCStart).Methods("POST")
+	r.HandleFunc("/api/auth/oidc/{provider}/link", requireAuth(noImpersonation(handleOIDCLink))).Methods("POST")
+	r.HandleFunc("/api/auth/identities", requireAuth(handleListIdentities)).Methods("GET")
+	r.HandleFunc("/api/auth/identities/{id}", requireAuth(noImpersonation(handleUnlinkIdentity))).Methods("DELETE")
+	r.HandleFunc("/api/admin/users", requireRole(RoleAdmin)(handleAdminListUsers)).Methods("GET")
+	r.HandleFunc("/api/admin/users/{id}", requireRole(RoleAdmin)(handleAdminGetUser)).Methods("GET")
+	r.HandleFunc("/api/admin/users/{id}/suspend", requireRole(RoleAdmin)(handleAdminSuspendUser)).Methods("POST")
+	r.HandleFunc("/api/admin/users/{id}/unsuspend", requireRole(RoleAdmin)(handleAdminUnsuspendUser)).Methods("POST")
+	r.HandleFunc("/api/admin/users/{id}/role", requireRole(RoleAdmin)(handleAdminSetRole)).Methods("PUT")
+	r.HandleFunc("/api/admin/users/{id}/reset-quota", requireRole(RoleAdmin)(handleAdminResetQuota)).Methods("POST")
+	r.HandleFunc("/api/admin/users/{id}/impersonate", requireRole(RoleAdmin)(handleAdminImpersonate)).Methods("POST")
+	r.HandleFunc("/api/admin/deletions", requireRole(RoleAdmin)(handleAdminListDeletions)).Methods("GET")
+	r.HandleFunc("/api/admin/deletions/{id}/retry", requireRole(RoleAdmin)(handleAdminRetryDeletion)).Methods("POST")
+	r.HandleFunc("/api/admin/audit", requireRole(RoleAdmin)(handleAdminAuditLog)).Methods("GET")
+	r.HandleFunc("/api/admin/youtube-fetchers", requireRole(RoleAdmin)(handleAdminYouTubeFetchers)).Methods("GET")
 	r.HandleFunc("/api/health", healthHandler).Methods("GET")
-	r.HandleFunc("/api/users", getAllUsersHandler).Methods("GET")
 	r.HandleFunc("/api/user", getUserHandler).Methods("GET")
-	r.HandleFunc("/api/transcribe", handleTranscribe).Methods("POST")
-	r.HandleFunc("/api/transcribe-youtube", handleTranscribeYouTube).Methods("POST")
+	r.HandleFunc("/api/user", requireAuth(handleUpdateProfile)).Methods("PUT")
+	r.HandleFunc("/api/user", requireAuth(noImpersonation(handleDeleteAccount))).Methods("DELETE")
+	r.HandleFunc("/api/user/exports", requireAuth(noImpersonation(handleCreateExport))).Methods("POST")
+	r.HandleFunc("/api/user/exports", requireAuth(noImpersonation(handleListExports))).Methods("GET")
+	r.HandleFunc("/api/user/exports/{id}", requireAuth(noImpersonation(handleGetExport))).Methods("GET")
+	r.HandleFunc("/api/exports/{id}/download", handleDownloadExport).Methods("GET")
+	r.HandleFunc("/api/user/api-keys", requireAuth(handleListAPIKeys)).Methods("GET")
+	r.HandleFunc("/api/user/api-keys", requireAuth(noImpersonation(handleCreateAPIKey))).Methods("POST")
+	r.HandleFunc("/api/user/api-keys/{id}", requireAuth(noImpersonation(handleRevokeAPIKey))).Methods("DELETE")
+	r.HandleFunc("/api/user/password", requireAuth(noImpersonation(handleChangePassword))).Methods("POST")
+	r.HandleFunc("/api/transcribe", requireAuth(requireVerifiedEmail(handleTranscribe))).Methods("POST").Name("transcribe")
+	// Возобновляемая загрузка (tus 1.0.0), завершённая загрузка становится задачей транскрипции
+	r.HandleFunc("/api/uploads", requireAuth(requireVerifiedEmail(handleCreateUpload))).Methods("POST").Name("upload-create")
+	r.HandleFunc("/api/uploads/{id}", requireAuth(handleUploadStatus)).Methods("HEAD", "GET").Name("upload")
+	r.HandleFunc("/api/uploads/{id}", requireAuth(handlePatchUpload)).Methods("PATCH").Name("upload-patch")
+	r.HandleFunc("/api/uploads/{id}", requireAuth(handleDeleteUpload)).Methods("DELETE").Name("upload-delete")
+	r.HandleFunc("/api/transcribe-youtube", requireAuth(requireVerifiedEmail(handleTranscribeYouTube))).Methods("POST").Name("transcribe-youtube")
+	r.HandleFunc("/api/usage", requireAuth(handleUsage)).Methods("GET")
+	r.HandleFunc("/api/jobs/{id}", handleGetJob).Methods("GET").Name("job")
+	r.HandleFunc("/api/jobs/{id}/events", handleJobEvents).Methods("GET").Name("job-events")
+	r.HandleFunc("/api/jobs/{id}/export", handleExportJob).Methods("GET").Name("job-export")
 	r.HandleFunc("/api/notes", handleNotes).Methods("POST")
-	r.HandleFunc("/api/notes", handleNotes).Methods("GET")
-	r.HandleFunc("/api/generate", handleGenerate).Methods("POST")
-	r.HandleFunc("/api/materials", handleMaterials).Methods("POST", "GET")
-	r.HandleFunc("/api/generate-and-save", handleGenerateAndSave).Methods("POST")
-	r.HandleFunc("/api/notes/{id}", getNoteByID).Methods("GET")
+	r.HandleFunc("/api/notes", handleNotes).Methods("GET").Name("notes-list")
+	r.HandleFunc("/api/generate", requireAuth(requireVerifiedEmail(handleGenerate))).Methods("POST").Name("generate")
+	r.HandleFunc("/api/materials", requireAuth(handleMaterials)).Methods("POST").Name("materials-create")
+	r.HandleFunc("/api/materials", requireAuth(handleMaterials)).Methods("GET").Name("materials-list")
+	r.HandleFunc("/api/generate-and-save", requireAuth(requireVerifiedEmail(handleGenerateAndSave))).Methods("POST").Name("generate-and-save")
+	r.HandleFunc("/api/transcripts", handleTranscripts).Methods("GET").Name("transcripts-list")
+	r.HandleFunc("/api/transcripts", handleTranscripts).Methods("POST")
+	r.HandleFunc("/api/transcripts/{id}", getTranscriptByID).Methods("GET").Name("transcript")
+	r.HandleFunc("/api/transcripts/{id}", updateTranscriptByID).Methods("PUT")
+	r.HandleFunc("/api/transcripts/{id}", deleteTranscriptByID).Methods("DELETE")
+	r.HandleFunc("/api/transcripts/{id}/export", exportTranscriptByID).Methods("GET").Name("transcript-export")
+	r.HandleFunc("/api/transcripts/{id}/audio", handleTranscriptAudio).Methods("GET", "HEAD").Name("transcript-audio")
+	r.HandleFunc("/api/transcripts/{id}/audio-url", handleTranscriptAudioURL).Methods("GET").Name("transcript-audio-url")
+	r.HandleFunc("/api/transcripts/{id}/retranscribe", requireAuth(requireVerifiedEmail(handleRetranscribeTranscript))).Methods("POST").Name("transcript-retranscribe")
+	r.HandleFunc("/api/subscription/plans", handleSubscriptionPlans).Methods("GET")
+	r.HandleFunc("/api/subscription/status", requireAuth(handleSubscriptionStatus)).Methods("GET")
+	r.HandleFunc("/api/subscription/checkout", requireAuth(noImpersonation(requireVerifiedEmail(handleSubscriptionCheckout)))).Methods("POST")
+	r.HandleFunc("/api/subscription/webhook", handleSubscriptionWebhook).Methods("POST")
+	if _, ok := paymentProvider.(*FakePaymentProvider); ok {
+		r.HandleFunc("/api/subscription/fake-checkout/{session}", requireAuth(noImpersonation(handleFakeCheckout))).Methods("GET")
+	}
+	r.HandleFunc("/api/notes/{id}", getNoteByID).Methods("GET").Name("note")
 	r.HandleFunc("/api/notes/{id}", deleteNoteByID).Methods("DELETE")
-	r.HandleFunc("/api/materials/{id}", getMaterialByID).Methods("GET")
+	r.HandleFunc("/api/materials/{id}", getMaterialByID).Methods("GET").Name("material")
 	r.HandleFunc("/api/materials/{id}", deleteMaterialByID).Methods("DELETE")
 
 	// Serve Vite build (dist) with SPA fallback
@@ -1475,8 +1370,12 @@ func main() {
 		log.Printf("⚠️ FRONTEND_DIST not set and no dist/index.html found; SPA serving disabled")
 	}
 
+	// Rate limiting и ограничения тарифов для именованных роутов (см. routeLimits, routeFeatures)
+	r.Use(rateLimitMiddleware)
+	r.Use(entitlementMiddleware)
+
 	// Применяем CORS и COOP middleware
-	handler := corsMiddleware(coopMiddleware(r))
+	handler := tusDiscovery(corsMiddleware(coopMiddleware(r)))
 
 	// Read PORT from env for container platforms (default 8080)
 	port := os.Getenv("PORT")
@@ -1496,12 +1395,23 @@ func main() {
 }
 
 // Генерация JWT токена
-func generateJWT(user *User) (string, error) {
-	token := jwt.NewWithClaims(jwt.SigningMethodHS256, jwt.MapClaims{
+func generateJWT(user *User, sessionID string) (string, error) {
+	return signAccessToken(user, sessionID, accessTokenTTL, nil)
+}
+
+// signAccessToken signs an access JWT; impersonatorID marks a support session
+func signAccessToken(user *User, sessionID string, ttl time.Duration, impersonatorID *primitive.ObjectID) (string, error) {
+	claims := jwt.MapClaims{
 		"user_id": user.ID,
 		"email":   user.Email,
-		"exp":     time.Now().Add(time.Hour * 24 * 7).Unix(), // 7 дней
-	})
+		"role":    normalizeRole(user.Role),
+		"sid":     sessionID,
+		"exp":     time.Now().Add(ttl).Unix(),
+	}
+	if impersonatorID != nil {
+		claims["imp"] = impersonatorID.Hex()
+	}
+	token := jwt.NewWithClaims(jwt.SigningMethodHS256, claims)
 
 	return token.SignedString(jwtSecret)
 }
@@ -16,6 +16,18 @@ type User struct {
 	Email     string    `json:"email"`
 	Password  string    `json:"-"` // Не отправляем пароль в JSON
 	CreatedAt time.Time `json:"createdAt"`
+	// Пока email не подтверждён, транскрипция, генерация и оплата недоступны
+	EmailVerified   bool       `json:"emailVerified"`
+	EmailVerifiedAt *time.Time `json:"emailVerifiedAt,omitempty"`
+	// Роль (RoleUser|RoleTeacher|RoleAdmin) попадает в JWT; пустая у старых аккаунтов — RoleUser
+	Role string `json:"role"`
+	// Заблокированный администратором аккаунт не может войти, его сессии отозваны
+	SuspendedAt   *time.Time `json:"suspendedAt,omitempty"`
+	SuspendReason string     `json:"suspendReason,omitempty"`
+	// Пользователь запросил удаление: вход закрыт, данные удаляет фоновая задача
+	DeletionRequestedAt *time.Time `json:"deletionRequestedAt,omitempty"`
+	// Вычисляется в GET /api/user: у аккаунтов Google и OIDC пароля может не быть
+	HasPassword bool `bson:"-" json:"hasPassword"`
 }
 
 // SignupRequest представляет запрос на регистрацию
@@ -28,10 +40,12 @@ type SignupRequest struct {
 
 // SignupResponse представляет ответ на регистрацию
 type SignupResponse struct {
-	Success bool   `json:"success"`
-	Message string `json:"message"`
-	User    *User  `json:"user,omitempty"`
-	Token   string `json:"token,omitempty"`
+	Success      bool   `json:"success"`
+	Message      string `json:"message"`
+	User         *User  `json:"user,omitempty"`
+	Token        string `json:"token,omitempty"`
+	RefreshToken string `json:"refresh_token,omitempty"`
+	ExpiresIn    int    `json:"expires_in,omitempty"`
 }
 
 // LoginRequest представляет запрос на вход
@@ -54,26 +68,46 @@ type WhisperRequest struct {
 }
 
 type WhisperResponse struct {
-	Text string `json:"text"`
+	Text     string           `json:"text"`
+	Language string           `json:"language,omitempty"` // verbose_json
+	Duration float64          `json:"duration,omitempty"` // verbose_json
+	Segments []WhisperSegment `json:"segments,omitempty"` // verbose_json
+}
+
+type WhisperSegment struct {
+	ID    int     `json:"id"`
+	Start float64 `json:"start"`
+	End   float64 `json:"end"`
+	Text  string  `json:"text"`
+}
+
+// TranscriptSegment фрагмент транскрипта с таймкодами (секунды от начала записи)
+type TranscriptSegment struct {
+	Start float64 `bson:"start" json:"start"`
+	End   float64 `bson:"end" json:"end"`
+	Text  string  `bson:"text" json:"text"`
 }
 
 // Note структура для MongoDB
 type Note struct {
-	ID         primitive.ObjectID `bson:"_id,omitempty" json:"id"`
-	UserID     primitive.ObjectID `bson:"user_id" json:"user_id"`
-	Title      string             `bson:"title" json:"title"`
-	Content    string             `bson:"content" json:"content"`
-	Type       string             `bson:"type" json:"type"`
-	Tab        string             `bson:"tab" json:"tab"`
-	LastOpened string             `bson:"last_opened" json:"last_opened"`
-	CreatedAt  time.Time          `bson:"created_at" json:"created_at"`
-	UpdatedAt  time.Time          `bson:"updated_at" json:"updated_at"`
+	ID           primitive.ObjectID `bson:"_id,omitempty" json:"id"`
+	UserID       primitive.ObjectID `bson:"user_id" json:"user_id"`
+	Title        string             `bson:"title" json:"title"`
+	Content      string             `bson:"content" json:"content"`
+	Type         string             `bson:"type" json:"type"`
+	Tab          string             `bson:"tab" json:"tab"`
+	TranscriptID primitive.ObjectID `bson:"transcript_id,omitempty" json:"transcript_id,omitempty"`
+	LastOpened   string             `bson:"last_opened" json:"last_opened"`
+	CreatedAt    time.Time          `bson:"created_at" json:"created_at"`
+	UpdatedAt    time.Time          `bson:"updated_at" json:"updated_at"`
 }
 
 // GPT generation types
 type GenerateRequest struct {
-	Transcript string `json:"transcript"`
-	Language   string `json:"language,omitempty"`
+	Transcript   string `json:"transcript"`
+	TranscriptID string `json:"transcriptId,omitempty"` // ссылка на сохранённый транскрипт вместо текста
+	Language     string `json:"language,omitempty"`
+	JobID        string `json:"jobId,omitempty"` // progress is published to this job's event stream
 }
 
 type Flashcard struct {
@@ -156,12 +190,337 @@ type GeneratePayload struct {
 
 // Учебные материалы (материализованные карточки/квиз)
 type Material struct {
-	ID         primitive.ObjectID `bson:"_id,omitempty" json:"id"`
+	ID     primitive.ObjectID `bson:"_id,omitempty" json:"id"`
+	UserID primitive.ObjectID `bson:"user_id" json:"user_id"`
+	// Текст хранится в transcripts; поле transcript заполняется при чтении (и у старых записей)
+	TranscriptID primitive.ObjectID `bson:"transcript_id,omitempty" json:"transcript_id,omitempty"`
+	Transcript   string             `bson:"transcript,omitempty" json:"transcript"`
+	Summary      string             `bson:"summary,omitempty" json:"summary,omitempty"`
+	Flashcards   []Flashcard        `bson:"flashcards" json:"flashcards"`
+	Quiz         []QuizQuestion     `bson:"quiz" json:"quiz"`
+	CreatedAt    time.Time          `bson:"created_at" json:"created_at"`
+	UpdatedAt    time.Time          `bson:"updated_at" json:"updated_at"`
+}
+
+// Статусы фоновых задач транскрипции
+const (
+	JobStatusQueued    = "queued"
+	JobStatusRunning   = "running"
+	JobStatusCompleted = "completed"
+	JobStatusFailed    = "failed"
+)
+
+// JobChunk хранит результат одного сегмента аудио
+type JobChunk struct {
+	Done   bool   `bson:"done" json:"done"`
+	Failed bool   `bson:"failed,omitempty" json:"failed,omitempty"` // сегмент пропущен после всех ретраев
+	Error  string `bson:"error,omitempty" json:"error,omitempty"`
+	Text   string `bson:"text" json:"text"`
+	// Смещение сегмента в исходной записи и таймкоды внутри него (уже со смещением)
+	Offset   float64             `bson:"offset" json:"offset"`
+	Segments []TranscriptSegment `bson:"segments,omitempty" json:"segments,omitempty"`
+}
+
+// TranscriptionJob фоновая задача транскрипции (коллекция jobs)
+type TranscriptionJob struct {
+	ID           primitive.ObjectID  `bson:"_id,omitempty" json:"id"`
+	UserID       primitive.ObjectID  `bson:"user_id,omitempty" json:"user_id,omitempty"`
+	Status       string              `bson:"status" json:"status"`
+	Source       string              `bson:"source" json:"source"` // upload|youtube
+	Stage        string              `bson:"stage" json:"stage"`
+	URL          string              `bson:"url,omitempty" json:"url,omitempty"`
+	Filename     string              `bson:"filename,omitempty" json:"filename,omitempty"`
+	Size         int64               `bson:"size,omitempty" json:"size,omitempty"`
+	Duration     float64             `bson:"duration,omitempty" json:"duration,omitempty"` // секунды, определяется ffprobe
+	InputPath    string              `bson:"input_path" json:"-"`
+	Language     string              `bson:"language,omitempty" json:"language,omitempty"`
+	Mode         string              `bson:"mode" json:"mode"`                             // single|segmented|captions|auto-captions
+	Captions     string              `bson:"captions,omitempty" json:"captions,omitempty"` // off|manual|auto, для YouTube
+	ChunksDone   int                 `bson:"chunks_done" json:"chunks_done"`
+	ChunksTotal  int                 `bson:"chunks_total" json:"chunks_total"`
+	ChunksFailed int                 `bson:"chunks_failed" json:"chunks_failed"`
+	Chunks       []JobChunk          `bson:"chunks,omitempty" json:"-"`
+	Transcript   string              `bson:"transcript" json:"transcript"`
+	Segments     []TranscriptSegment `bson:"segments,omitempty" json:"segments,omitempty"`
+	Error        string              `bson:"error,omitempty" json:"error,omitempty"`
+	ErrorDetail  string              `bson:"error_detail,omitempty" json:"error_detail,omitempty"`
+	// Попытки скачать аудио с YouTube, если все стратегии не сработали
+	FetchAttempts []FetchAttempt     `bson:"fetch_attempts,omitempty" json:"fetch_attempts,omitempty"`
+	MaterialID    string             `bson:"material_id,omitempty" json:"material_id,omitempty"`
+	TranscriptID  primitive.ObjectID `bson:"transcript_id,omitempty" json:"transcript_id,omitempty"`
+	// Повторная транскрипция: ключ сохранённой записи в BlobStore, результат заменяет текст TranscriptID
+	AudioKey string `bson:"audio_key,omitempty" json:"-"`
+	// Копия входного файла в BlobStore: задачу может продолжить любой инстанс после рестарта
+	InputKey   string     `bson:"input_key,omitempty" json:"-"`
+	CreatedAt  time.Time  `bson:"created_at" json:"created_at"`
+	UpdatedAt  time.Time  `bson:"updated_at" json:"updated_at"`
+	FinishedAt *time.Time `bson:"finished_at,omitempty" json:"finished_at,omitempty"`
+}
+
+// Источники транскриптов
+const (
+	TranscriptSourceUpload    = "upload"
+	TranscriptSourceYouTube   = "youtube"
+	TranscriptSourceRecording = "recording"
+	TranscriptSourceText      = "text" // текст, присланный клиентом напрямую
+)
+
+// Transcript сохранённый транскрипт пользователя (коллекция transcripts)
+type Transcript struct {
+	ID        primitive.ObjectID  `bson:"_id,omitempty" json:"id"`
+	UserID    primitive.ObjectID  `bson:"user_id" json:"user_id"`
+	JobID     primitive.ObjectID  `bson:"job_id,omitempty" json:"job_id,omitempty"`
+	Source    string              `bson:"source" json:"source"` // upload|youtube|recording|text
+	Title     string              `bson:"title,omitempty" json:"title,omitempty"`
+	Filename  string              `bson:"filename,omitempty" json:"filename,omitempty"`
+	URL       string              `bson:"url,omitempty" json:"url,omitempty"`
+	Duration  float64             `bson:"duration,omitempty" json:"duration,omitempty"` // секунды
+	Language  string              `bson:"language,omitempty" json:"language,omitempty"`
+	Mode      string              `bson:"mode,omitempty" json:"mode,omitempty"` // single|segmented|captions|auto-captions
+	Text      string              `bson:"text" json:"text"`
+	Segments  []TranscriptSegment `bson:"segments,omitempty" json:"segments,omitempty"`
+	Audio     *StoredAudio        `bson:"audio,omitempty" json:"audio,omitempty"` // исходная запись, если сохранена
+	CreatedAt time.Time           `bson:"created_at" json:"created_at"`
+	UpdatedAt time.Time           `bson:"updated_at" json:"updated_at"`
+}
+
+// StoredAudio нормализованная запись транскрипта в хранилище blob-объектов
+type StoredAudio struct {
+	Key         string    `bson:"key" json:"-"` // ключ в BlobStore
+	ContentType string    `bson:"content_type" json:"content_type"`
+	Size        int64     `bson:"size" json:"size"` // байты
+	StoredAt    time.Time `bson:"stored_at" json:"stored_at"`
+}
+
+// UsageRecord накопленное потребление пользователя за день или месяц (коллекция usage)
+type UsageRecord struct {
+	UserID       primitive.ObjectID `bson:"user_id" json:"user_id"`
+	Period       string             `bson:"period" json:"period"` // day|month
+	Key          string             `bson:"key" json:"key"`       // 2006-01-02 или 2006-01 (UTC)
+	AudioSeconds float64            `bson:"audio_seconds" json:"audio_seconds"`
+	Tokens       int64              `bson:"tokens" json:"tokens"`
+	UpdatedAt    time.Time          `bson:"updated_at" json:"updated_at"`
+}
+
+// Статусы подписки
+const (
+	SubscriptionPending  = "pending"  // checkout создан, оплаты ещё нет
+	SubscriptionActive   = "active"   // оплачена до current_period_end
+	SubscriptionCanceled = "canceled" // отменена пользователем или провайдером
+	SubscriptionExpired  = "expired"  // срок истёк без продления
+	SubscriptionReplaced = "replaced" // заменена подпиской на другой план
+)
+
+// Subscription подписка пользователя на план (коллекция subscriptions)
+type Subscription struct {
+	ID               primitive.ObjectID `bson:"_id,omitempty" json:"id"`
+	UserID           primitive.ObjectID `bson:"user_id" json:"user_id"`
+	PlanID           string             `bson:"plan_id" json:"plan_id"`
+	Status           string             `bson:"status" json:"status"`
+	Provider         string             `bson:"provider" json:"provider"`
+	ProviderRef      string             `bson:"provider_ref" json:"provider_ref"` // id checkout-сессии у провайдера
+	ProviderSubID    string             `bson:"provider_subscription_id,omitempty" json:"provider_subscription_id,omitempty"`
+	LastEventAt      time.Time          `bson:"last_event_at,omitempty" json:"-"` // время последнего применённого webhook
+	CurrentPeriodEnd time.Time          `bson:"current_period_end,omitempty" json:"current_period_end,omitempty"`
+	CreatedAt        time.Time          `bson:"created_at" json:"created_at"`
+	UpdatedAt        time.Time          `bson:"updated_at" json:"updated_at"`
+}
+
+// WebhookEventRecord сырое событие платёжного провайдера (коллекция webhook_events).
+// _id = provider:event_id, поэтому повторная доставка не создаёт дубль.
+type WebhookEventRecord struct {
+	ID          string     `bson:"_id" json:"id"`
+	Provider    string     `bson:"provider" json:"provider"`
+	EventID     string     `bson:"event_id" json:"event_id"`
+	Type        string     `bson:"type" json:"type"`
+	Payload     string     `bson:"payload" json:"payload"`
+	Deliveries  int        `bson:"deliveries" json:"deliveries"`
+	ReceivedAt  time.Time  `bson:"received_at" json:"received_at"`
+	ProcessedAt *time.Time `bson:"processed_at,omitempty" json:"processed_at,omitempty"`
+	Result      string     `bson:"result,omitempty" json:"result,omitempty"`
+	Error       string     `bson:"error,omitempty" json:"error,omitempty"`
+}
+
+// Session устройство, на котором выполнен вход (коллекция sessions).
+// Хранится только хеш refresh-токена; при каждом обновлении токен меняется.
+type Session struct {
+	ID              primitive.ObjectID `bson:"_id" json:"id"`
+	UserID          primitive.ObjectID `bson:"user_id" json:"user_id"`
+	RefreshHash     string             `bson:"refresh_hash" json:"-"`
+	PrevRefreshHash string             `bson:"prev_refresh_hash,omitempty" json:"-"` // для обнаружения повторного использования
+	UserAgent       string             `bson:"user_agent,omitempty" json:"user_agent,omitempty"`
+	IP              string             `bson:"ip,omitempty" json:"ip,omitempty"`
+	CreatedAt       time.Time          `bson:"created_at" json:"created_at"`
+	LastUsedAt      time.Time          `bson:"last_used_at" json:"last_used_at"`
+	ExpiresAt       time.Time          `bson:"expires_at" json:"expires_at"`
+	RevokedAt       *time.Time         `bson:"revoked_at" json:"revoked_at,omitempty"`
+	RevokeReason    string             `bson:"revoke_reason,omitempty" json:"revoke_reason,omitempty"`
+	// Сессия поддержки: администратор вошёл под пользователем, refresh-токена нет
+	ImpersonatedBy *primitive.ObjectID `bson:"impersonated_by,omitempty" json:"impersonated_by,omitempty"`
+}
+
+// EmailToken одноразовая ссылка из письма (коллекция email_tokens).
+// Хранится только хеш токена; токен действует для адреса, на который был отправлен.
+type EmailToken struct {
+	ID        primitive.ObjectID `bson:"_id"`
+	UserID    primitive.ObjectID `bson:"user_id"`
+	Email     string             `bson:"email"`
+	Purpose   string             `bson:"purpose"` // EmailTokenVerify|EmailTokenReset
+	TokenHash string             `bson:"token_hash"`
+	CreatedAt time.Time          `bson:"created_at"`
+	ExpiresAt time.Time          `bson:"expires_at"`
+	UsedAt    *time.Time         `bson:"used_at"`
+}
+
+// Identity внешний аккаунт (OpenID Connect), привязанный к пользователю (коллекция identities).
+// У пользователя может быть несколько identity; пара provider+subject уникальна.
+type Identity struct {
+	ID          primitive.ObjectID `bson:"_id" json:"id"`
+	UserID      primitive.ObjectID `bson:"user_id" json:"-"`
+	Provider    string             `bson:"provider" json:"provider"`
+	Subject     string             `bson:"subject" json:"-"`
+	Email       string             `bson:"email,omitempty" json:"email,omitempty"`
+	CreatedAt   time.Time          `bson:"created_at" json:"created_at"`
+	LastLoginAt time.Time          `bson:"last_login_at" json:"last_login_at"`
+}
+
+// OIDCState начатый вход через OIDC-провайдера (коллекция oidc_states).
+// _id — хеш параметра state; запись удаляется при возврате от провайдера.
+type OIDCState struct {
+	ID           string              `bson:"_id"`
+	Provider     string              `bson:"provider"`
+	CodeVerifier string              `bson:"code_verifier"` // PKCE
+	Nonce        string              `bson:"nonce"`
+	LinkUserID   *primitive.ObjectID `bson:"link_user_id,omitempty"` // привязка к уже вошедшему пользователю
+	CreatedAt    time.Time           `bson:"created_at"`
+	ExpiresAt    time.Time           `bson:"expires_at"`
+}
+
+// TwoFactor настройки TOTP пользователя (коллекция two_factor, _id = user_id).
+// Коды восстановления хранятся только в виде SHA-256 и удаляются при использовании.
+type TwoFactor struct {
+	UserID         primitive.ObjectID `bson:"_id"`
+	Secret         string             `bson:"secret"` // base32, без паддинга
+	Enabled        bool               `bson:"enabled"`
+	RecoveryHashes []string           `bson:"recovery_hashes"`
+	LastStep       int64              `bson:"last_step"` // последний принятый шаг TOTP, повтор кода отклоняется
+	CreatedAt      time.Time          `bson:"created_at"`
+	EnabledAt      *time.Time         `bson:"enabled_at,omitempty"`
+}
+
+// LoginChallenge второй шаг входа с 2FA (коллекция login_challenges).
+// Хранится только хеш токена; после нескольких неверных кодов токен перестаёт действовать.
+type LoginChallenge struct {
+	ID        string             `bson:"_id"`
+	UserID    primitive.ObjectID `bson:"user_id"`
+	Attempts  int                `bson:"attempts"`
+	CreatedAt time.Time          `bson:"created_at"`
+	ExpiresAt time.Time          `bson:"expires_at"`
+}
+
+// AuditEntry действие администратора (коллекция audit_log)
+type AuditEntry struct {
+	ID         primitive.ObjectID     `bson:"_id" json:"id"`
+	ActorID    primitive.ObjectID     `bson:"actor_id" json:"actor_id"`
+	ActorEmail string                 `bson:"actor_email" json:"actor_email"`
+	Action     string                 `bson:"action" json:"action"`
+	TargetID   string                 `bson:"target_id,omitempty" json:"target_id,omitempty"` // id пользователя
+	Details    map[string]interface{} `bson:"details,omitempty" json:"details,omitempty"`
+	IP         string                 `bson:"ip,omitempty" json:"ip,omitempty"`
+	CreatedAt  time.Time              `bson:"created_at" json:"created_at"`
+}
+
+// Статусы удаления аккаунта
+const (
+	DeletionPending = "pending" // ждёт воркера или повторной попытки
+	DeletionRunning = "running"
+	DeletionDone    = "done"
+	DeletionFailed  = "failed" // попытки исчерпаны, повторить может администратор
+)
+
+// AccountDeletion фоновое удаление аккаунта со всеми данными (коллекция account_deletions)
+type AccountDeletion struct {
+	ID         primitive.ObjectID `bson:"_id" json:"id"`
 	UserID     primitive.ObjectID `bson:"user_id" json:"user_id"`
-	Transcript string             `bson:"transcript" json:"transcript"`
-	Summary    string             `bson:"summary,omitempty" json:"summary,omitempty"`
-	Flashcards []Flashcard        `bson:"flashcards" json:"flashcards"`
-	Quiz       []QuizQuestion     `bson:"quiz" json:"quiz"`
+	Status     string             `bson:"status" json:"status"`
+	Attempts   int                `bson:"attempts" json:"attempts"`
+	Error      string             `bson:"error,omitempty" json:"error,omitempty"`
+	Removed    map[string]int64   `bson:"removed,omitempty" json:"removed,omitempty"` // коллекция -> удалено документов
 	CreatedAt  time.Time          `bson:"created_at" json:"created_at"`
 	UpdatedAt  time.Time          `bson:"updated_at" json:"updated_at"`
+	FinishedAt *time.Time         `bson:"finished_at,omitempty" json:"finished_at,omitempty"`
+}
+
+// Статусы выгрузки данных
+const (
+	ExportPending = "pending"
+	ExportRunning = "running"
+	ExportDone    = "done"
+	ExportFailed  = "failed"
+	ExportExpired = "expired" // архив удалён по истечении срока
+)
+
+// DataExport выгрузка всех данных пользователя в ZIP (коллекция data_exports)
+type DataExport struct {
+	ID            primitive.ObjectID `bson:"_id" json:"id"`
+	UserID        primitive.ObjectID `bson:"user_id" json:"-"`
+	Status        string             `bson:"status" json:"status"`
+	FormatVersion int                `bson:"format_version" json:"format_version"`
+	Error         string             `bson:"error,omitempty" json:"error,omitempty"`
+	Size          int64              `bson:"size,omitempty" json:"size,omitempty"` // байты
+	Counts        map[string]int     `bson:"counts,omitempty" json:"counts,omitempty"`
+	CreatedAt     time.Time          `bson:"created_at" json:"created_at"`
+	UpdatedAt     time.Time          `bson:"updated_at" json:"updated_at"`
+	FinishedAt    *time.Time         `bson:"finished_at,omitempty" json:"finished_at,omitempty"`
+	ExpiresAt     *time.Time         `bson:"expires_at,omitempty" json:"expires_at,omitempty"`
+	// Подписанная ссылка, действует до ExpiresAt; не хранится
+	DownloadURL string `bson:"-" json:"download_url,omitempty"`
+}
+
+// APIKey персональный ключ для скриптов (коллекция api_keys). Хранится только SHA-256
+// ключа; префикс виден в списке, чтобы ключи можно было различить.
+type APIKey struct {
+	ID         primitive.ObjectID `bson:"_id" json:"id"`
+	UserID     primitive.ObjectID `bson:"user_id" json:"-"`
+	Name       string             `bson:"name" json:"name"`
+	Prefix     string             `bson:"prefix" json:"prefix"`
+	Hash       string             `bson:"hash" json:"-"`
+	Scopes     []string           `bson:"scopes" json:"scopes"` // transcribe|generate|read-materials
+	CreatedAt  time.Time          `bson:"created_at" json:"created_at"`
+	LastUsedAt *time.Time         `bson:"last_used_at,omitempty" json:"last_used_at,omitempty"`
+	ExpiresAt  *time.Time         `bson:"expires_at,omitempty" json:"expires_at,omitempty"`
+	RevokedAt  *time.Time         `bson:"revoked_at" json:"revoked_at,omitempty"`
+}
+
+// Статусы загрузки по протоколу tus
+const (
+	UploadInProgress = "uploading"
+	UploadFinishing  = "finishing" // последний PATCH собирает файл и создаёт задачу
+	UploadCompleted  = "completed" // файл передан в задачу транскрипции
+	UploadFailed     = "failed"
+)
+
+// Upload возобновляемая загрузка записи (коллекция uploads). Принятые части лежат в
+// BlobStore (Parts по порядку); Offset — сколько из Length уже получено.
+type Upload struct {
+	ID        primitive.ObjectID  `bson:"_id" json:"id"`
+	UserID    primitive.ObjectID  `bson:"user_id" json:"-"`
+	Filename  string              `bson:"filename" json:"filename"`
+	Source    string              `bson:"source" json:"source"` // upload|recording
+	Language  string              `bson:"language,omitempty" json:"language,omitempty"`
+	Length    int64               `bson:"length" json:"length"` // байты
+	Offset    int64               `bson:"offset" json:"offset"`
+	Status    string              `bson:"status" json:"status"`
+	Error     string              `bson:"error,omitempty" json:"error,omitempty"`
+	Parts     []UploadPart        `bson:"parts,omitempty" json:"-"`
+	JobID     *primitive.ObjectID `bson:"job_id,omitempty" json:"job_id,omitempty"`
+	CreatedAt time.Time           `bson:"created_at" json:"created_at"`
+	UpdatedAt time.Time           `bson:"updated_at" json:"updated_at"`
+	ExpiresAt time.Time           `bson:"expires_at" json:"expires_at"`
+}
+
+// UploadPart одна принятая часть загрузки в BlobStore
+type UploadPart struct {
+	Key  string `bson:"key"`
+	Size int64  `bson:"size"` // байты
 }
@@ -0,0 +1,693 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+	"github.com/gorilla/mux"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// oidcStateTTL is how long the user has to complete the login at the provider
+const oidcStateTTL = 10 * time.Minute
+
+// oidcDiscoveryTTL is how long a discovery document is cached
+const oidcDiscoveryTTL = 24 * time.Hour
+
+// OIDCClaimMap names the claims that are mapped into User; empty fields use the
+// standard claims (sub, email, email_verified, given_name, family_name, name)
+type OIDCClaimMap struct {
+	Subject       string `json:"subject"`
+	Email         string `json:"email"`
+	EmailVerified string `json:"email_verified"`
+	FirstName     string `json:"first_name"`
+	LastName      string `json:"last_name"`
+	Name          string `json:"name"`
+}
+
+// OIDCProviderConfig is one entry of OIDC_PROVIDERS_FILE
+type OIDCProviderConfig struct {
+	ID              string       `json:"id"`   // used in URLs and stored on identities
+	Name            string       `json:"name"` // label of the login button
+	Issuer          string       `json:"issuer"`
+	ClientID        string       `json:"client_id"`
+	ClientSecret    string       `json:"client_secret"`
+	ClientSecretEnv string       `json:"client_secret_env"` // read the secret from this env var (or its _FILE)
+	Scopes          []string     `json:"scopes"`
+	Claims          OIDCClaimMap `json:"claims"`
+	// TrustEmail signs a new identity into the existing account with the same email
+	// when the provider says the email is verified. Only for providers that own the domain.
+	TrustEmail bool `json:"trust_email"`
+}
+
+// oidcDiscovery is the part of /.well-known/openid-configuration we use
+type oidcDiscovery struct {
+	Issuer                string `json:"issuer"`
+	AuthorizationEndpoint string `json:"authorization_endpoint"`
+	TokenEndpoint         string `json:"token_endpoint"`
+	UserinfoEndpoint      string `json:"userinfo_endpoint"`
+	JWKSURI               string `json:"jwks_uri"`
+}
+
+// OIDCProvider is a configured provider with its lazily loaded discovery document
+type OIDCProvider struct {
+	OIDCProviderConfig
+	HTTPClient *http.Client
+
+	mu           sync.Mutex
+	discovery    *oidcDiscovery
+	discoveredAt time.Time
+	jwks         *JWKSCache
+}
+
+// oidcProviders is the registry loaded at startup from OIDC_PROVIDERS_FILE, in file order
+var oidcProviders []*OIDCProvider
+
+// loadOIDCProvidersFromEnv reads the provider registry (JSON array of OIDCProviderConfig)
+func loadOIDCProvidersFromEnv() ([]*OIDCProvider, error) {
+	path := getEnvOrFile("OIDC_PROVIDERS_FILE")
+	if path == "" {
+		return nil, nil
+	}
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("reading OIDC_PROVIDERS_FILE: %w", err)
+	}
+	var list []OIDCProviderConfig
+	if err := json.Unmarshal(b, &list); err != nil {
+		return nil, fmt.Errorf("parsing OIDC_PROVIDERS_FILE: %w", err)
+	}
+	seen := map[string]bool{}
+	var out []*OIDCProvider
+	for i, c := range list {
+		if c.ID == "" || seen[c.ID] {
+			return nil, fmt.Errorf("OIDC provider %d: id is empty or duplicated", i)
+		}
+		if c.Issuer == "" || c.ClientID == "" {
+			return nil, fmt.Errorf("OIDC provider %q: issuer and client_id are required", c.ID)
+		}
+		if c.ClientSecretEnv != "" {
+			c.ClientSecret = getEnvOrFile(c.ClientSecretEnv)
+		}
+		if c.Name == "" {
+			c.Name = c.ID
+		}
+		if len(c.Scopes) == 0 {
+			c.Scopes = []string{"openid", "email", "profile"}
+		}
+		seen[c.ID] = true
+		out = append(out, &OIDCProvider{
+			OIDCProviderConfig: c,
+			HTTPClient:         &http.Client{Timeout: 10 * time.Second},
+		})
+	}
+	return out, nil
+}
+
+// findOIDCProvider returns the registered provider with the given ID
+func findOIDCProvider(id string) (*OIDCProvider, bool) {
+	for _, p := range oidcProviders {
+		if p.ID == id {
+			return p, true
+		}
+	}
+	return nil, false
+}
+
+// oidcRedirectURL is where providers send the user back: a frontend page that posts
+// code and state to /api/auth/oidc/callback (OIDC_REDIRECT_URL)
+func oidcRedirectURL() string {
+	if v := getEnvOrFile("OIDC_REDIRECT_URL"); v != "" {
+		return v
+	}
+	return appBaseURL() + "/auth/oidc/callback"
+}
+
+// discover returns the provider's discovery document, fetching it on first use
+func (p *OIDCProvider) discover(ctx context.Context) (*oidcDiscovery, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.discovery != nil && time.Since(p.discoveredAt) < oidcDiscoveryTTL {
+		return p.discovery, nil
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet,
+		strings.TrimRight(p.Issuer, "/")+"/.well-known/openid-configuration", nil)
+	if err != nil {
+		return nil, err
+	}
+	var d oidcDiscovery
+	if err := doJSON(p.HTTPClient, req, &d); err != nil {
+		if p.discovery != nil {
+			log.Printf("[oidc] %s: discovery refresh failed, using cached document: %v", p.ID, err)
+			return p.discovery, nil
+		}
+		return nil, fmt.Errorf("%s discovery: %w", p.ID, err)
+	}
+	// OpenID Connect Discovery 4.3: the document must be for the configured issuer
+	if strings.TrimRight(d.Issuer, "/") != strings.TrimRight(p.Issuer, "/") {
+		return nil, fmt.Errorf("%s discovery: issuer %q does not match %q", p.ID, d.Issuer, p.Issuer)
+	}
+	if d.AuthorizationEndpoint == "" || d.TokenEndpoint == "" || d.JWKSURI == "" {
+		return nil, fmt.Errorf("%s discovery: authorization, token or jwks endpoint missing", p.ID)
+	}
+	if p.jwks == nil || p.jwks.URL != d.JWKSURI {
+		p.jwks = &JWKSCache{URL: d.JWKSURI, HTTPClient: p.HTTPClient}
+	}
+	p.discovery = &d
+	p.discoveredAt = time.Now()
+	return p.discovery, nil
+}
+
+// pkceChallenge is the S256 code challenge for a PKCE verifier
+func pkceChallenge(verifier string) string {
+	sum := sha256.Sum256([]byte(verifier))
+	return base64.RawURLEncoding.EncodeToString(sum[:])
+}
+
+// authorizationURL stores a new login attempt and returns the provider URL to send the
+// user to, together with the state the frontend should expect back
+func (p *OIDCProvider) authorizationURL(ctx context.Context, linkUserID *primitive.ObjectID) (string, string, error) {
+	d, err := p.discover(ctx)
+	if err != nil {
+		return "", "", err
+	}
+	state, err := randomToken(32)
+	if err != nil {
+		return "", "", err
+	}
+	verifier, err := randomToken(32)
+	if err != nil {
+		return "", "", err
+	}
+	nonce, err := randomToken(16)
+	if err != nil {
+		return "", "", err
+	}
+
+	now := time.Now()
+	if _, err := database.Collection("oidc_states").InsertOne(ctx, OIDCState{
+		ID:           hashToken(state),
+		Provider:     p.ID,
+		CodeVerifier: verifier,
+		Nonce:        nonce,
+		LinkUserID:   linkUserID,
+		CreatedAt:    now,
+		ExpiresAt:    now.Add(oidcStateTTL),
+	}); err != nil {
+		return "", "", err
+	}
+
+	q := url.Values{
+		"response_type":         {"code"},
+		"client_id":             {p.ClientID},
+		"redirect_uri":          {oidcRedirectURL()},
+		"scope":                 {strings.Join(p.Scopes, " ")},
+		"state":                 {state},
+		"nonce":                 {nonce},
+		"code_challenge":        {pkceChallenge(verifier)},
+		"code_challenge_method": {"S256"},
+	}
+	sep := "?"
+	if strings.Contains(d.AuthorizationEndpoint, "?") {
+		sep = "&"
+	}
+	return d.AuthorizationEndpoint + sep + q.Encode(), state, nil
+}
+
+// exchangeCode redeems the authorization code and returns the verified ID token claims,
+// merged with userinfo when the ID token does not carry the mapped email
+func (p *OIDCProvider) exchangeCode(ctx context.Context, code string, st *OIDCState) (jwt.MapClaims, error) {
+	d, err := p.discover(ctx)
+	if err != nil {
+		return nil, err
+	}
+	form := url.Values{
+		"grant_type":    {"authorization_code"},
+		"code":          {code},
+		"redirect_uri":  {oidcRedirectURL()},
+		"client_id":     {p.ClientID},
+		"code_verifier": {st.CodeVerifier},
+	}
+	if p.ClientSecret != "" {
+		form.Set("client_secret", p.ClientSecret)
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, d.TokenEndpoint, strings.NewReader(form.Encode()))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.Header.Set("Accept", "application/json")
+	var tok struct {
+		IDToken     string `json:"id_token"`
+		AccessToken string `json:"access_token"`
+	}
+	if err := doJSON(p.HTTPClient, req, &tok); err != nil {
+		return nil, fmt.Errorf("%s token exchange: %w", p.ID, err)
+	}
+	if tok.IDToken == "" {
+		return nil, fmt.Errorf("%s token exchange: no id_token in response", p.ID)
+	}
+
+	claims := jwt.MapClaims{}
+	if err := parseIDToken(ctx, tok.IDToken, p.jwks, []string{p.ClientID}, claims); err != nil {
+		return nil, fmt.Errorf("%s id_token: %w", p.ID, err)
+	}
+	if iss, _ := claims["iss"].(string); strings.TrimRight(iss, "/") != strings.TrimRight(d.Issuer, "/") {
+		return nil, fmt.Errorf("%s id_token: unexpected issuer %q", p.ID, iss)
+	}
+	if nonce, _ := claims["nonce"].(string); nonce != st.Nonce {
+		return nil, fmt.Errorf("%s id_token: nonce mismatch", p.ID)
+	}
+
+	if claimString(claims, p.claim(p.Claims.Email, "email")) == "" && d.UserinfoEndpoint != "" && tok.AccessToken != "" {
+		req, err := http.NewRequestWithContext(ctx, http.MethodGet, d.UserinfoEndpoint, nil)
+		if err != nil {
+			return nil, err
+		}
+		req.Header.Set("Authorization", "Bearer "+tok.AccessToken)
+		var info map[string]interface{}
+		if err := doJSON(p.HTTPClient, req, &info); err != nil {
+			return nil, fmt.Errorf("%s userinfo: %w", p.ID, err)
+		}
+		// OpenID Connect Core 5.3.2: userinfo must be about the same subject
+		if sub, _ := info["sub"].(string); sub != claimString(claims, "sub") {
+			return nil, fmt.Errorf("%s userinfo: subject mismatch", p.ID)
+		}
+		for k, v := range info {
+			if _, ok := claims[k]; !ok {
+				claims[k] = v
+			}
+		}
+	}
+	return claims, nil
+}
+
+// oidcProfile is what the claim mapping produces for User and Identity
+type oidcProfile struct {
+	Subject       string
+	Email         string
+	EmailVerified bool
+	FirstName     string
+	LastName      string
+}
+
+func (p *OIDCProvider) claim(configured, standard string) string {
+	if configured != "" {
+		return configured
+	}
+	return standard
+}
+
+// profile maps the provider's claims using its claim map
+func (p *OIDCProvider) profile(claims jwt.MapClaims) oidcProfile {
+	c := p.Claims
+	prof := oidcProfile{
+		Subject:   claimString(claims, p.claim(c.Subject, "sub")),
+		Email:     normalizeEmail(claimString(claims, p.claim(c.Email, "email"))),
+		FirstName: claimString(claims, p.claim(c.FirstName, "given_name")),
+		LastName:  claimString(claims, p.claim(c.LastName, "family_name")),
+	}
+	prof.EmailVerified, _ = strconv.ParseBool(claimString(claims, p.claim(c.EmailVerified, "email_verified")))
+	if prof.FirstName == "" && prof.LastName == "" {
+		name := claimString(claims, p.claim(c.Name, "name"))
+		prof.FirstName, prof.LastName, _ = strings.Cut(strings.TrimSpace(name), " ")
+	}
+	return prof
+}
+
+// claimString returns a claim as a string (bools and numbers are formatted)
+func claimString(claims jwt.MapClaims, name string) string {
+	switch v := claims[name].(type) {
+	case nil:
+		return ""
+	case string:
+		return v
+	default:
+		return fmt.Sprint(v)
+	}
+}
+
+// doJSON performs req and decodes a 2xx JSON response into out
+func doJSON(client *http.Client, req *http.Request, out interface{}) error {
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("status %d", resp.StatusCode)
+	}
+	return json.NewDecoder(resp.Body).Decode(out)
+}
+
+var (
+	errIdentityTaken  = errors.New("this account is already linked to another user")
+	errEmailInUse     = errors.New("an account with this email already exists; sign in and link this provider in settings")
+	errIdentityNoMail = errors.New("the provider did not return an email address")
+)
+
+// findIdentity returns the identity for provider+subject, or nil
+func findIdentity(ctx context.Context, provider, subject string) (*Identity, error) {
+	var id Identity
+	err := database.Collection("identities").FindOne(ctx, bson.M{"provider": provider, "subject": subject}).Decode(&id)
+	if errors.Is(err, mongo.ErrNoDocuments) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &id, nil
+}
+
+// ensureIdentityIndex makes a provider account linkable to one user only, also when
+// two callbacks for it race
+func ensureIdentityIndex() {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	_, err := database.Collection("identities").Indexes().CreateOne(ctx, mongo.IndexModel{
+		Keys:    bson.D{{Key: "provider", Value: 1}, {Key: "subject", Value: 1}},
+		Options: options.Index().SetUnique(true),
+	})
+	if err != nil {
+		log.Printf("[oidc] failed to create identities index: %v", err)
+	}
+}
+
+// linkIdentity attaches a provider account to the user. errIdentityTaken means the
+// account is already linked to someone else.
+func linkIdentity(ctx context.Context, userID primitive.ObjectID, provider string, prof oidcProfile) (*Identity, error) {
+	now := time.Now()
+	id := &Identity{
+		ID:          primitive.NewObjectID(),
+		UserID:      userID,
+		Provider:    provider,
+		Subject:     prof.Subject,
+		Email:       prof.Email,
+		CreatedAt:   now,
+		LastLoginAt: now,
+	}
+	if _, err := database.Collection("identities").InsertOne(ctx, id); err != nil {
+		if !mongo.IsDuplicateKeyError(err) {
+			return nil, err
+		}
+		// A concurrent callback linked it first
+		existing, ferr := findIdentity(ctx, provider, prof.Subject)
+		if ferr != nil {
+			return nil, ferr
+		}
+		if existing == nil || existing.UserID != userID {
+			return nil, errIdentityTaken
+		}
+		return existing, nil
+	}
+	return id, nil
+}
+
+// resolveOIDCUser finds or creates the user a provider account signs in as:
+// a linked identity, an existing account when the provider is trusted for the email,
+// or a new account
+func resolveOIDCUser(ctx context.Context, p *OIDCProvider, prof oidcProfile) (*User, error) {
+	user, err := resolveOIDCUserOnce(ctx, p, prof)
+	if mongo.IsDuplicateKeyError(err) || errors.Is(err, errIdentityTaken) {
+		// A concurrent callback for the same provider account created the user or linked
+		// the identity first (unique indexes on users.email and identities); go by its result
+		user, err = resolveOIDCUserOnce(ctx, p, prof)
+	}
+	return user, err
+}
+
+func resolveOIDCUserOnce(ctx context.Context, p *OIDCProvider, prof oidcProfile) (*User, error) {
+	existing, err := findIdentity(ctx, p.ID, prof.Subject)
+	if err != nil {
+		return nil, err
+	}
+	if existing != nil {
+		database.Collection("identities").UpdateOne(ctx, bson.M{"_id": existing.ID},
+			bson.M{"$set": bson.M{"last_login_at": time.Now()}})
+		return GetUserByID(existing.UserID.Hex())
+	}
+
+	if prof.Email == "" {
+		return nil, errIdentityNoMail
+	}
+	user, err := GetUserByEmail(prof.Email)
+	if err != nil && !errors.Is(err, mongo.ErrNoDocuments) {
+		return nil, err
+	}
+	if user != nil {
+		if !p.TrustEmail || !prof.EmailVerified {
+			return nil, errEmailInUse
+		}
+		if !user.EmailVerified {
+			if err := claimUnverifiedAccount(user, p.ID); err != nil {
+				return nil, err
+			}
+		}
+	} else {
+		user = &User{
+			FirstName:     prof.FirstName,
+			LastName:      prof.LastName,
+			Email:         prof.Email,
+			EmailVerified: prof.EmailVerified,
+		}
+		if user.EmailVerified {
+			now := time.Now()
+			user.EmailVerifiedAt = &now
+		}
+		if err := CreateUser(user); err != nil {
+			return nil, err
+		}
+	}
+
+	userID, err := primitive.ObjectIDFromHex(user.ID)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := linkIdentity(ctx, userID, p.ID, prof); err != nil {
+		return nil, err
+	}
+	return user, nil
+}
+
+// handleOIDCProviders lists the configured providers for the login page
+func handleOIDCProviders(w http.ResponseWriter, r *http.Request) {
+	list := make([]map[string]string, 0, len(oidcProviders))
+	for _, p := range oidcProviders {
+		list = append(list, map[string]string{"id": p.ID, "name": p.Name})
+	}
+	JSONResponse(w, http.StatusOK, map[string]interface{}{"success": true, "providers": list})
+}
+
+// handleOIDCStart begins a login with the provider
+func handleOIDCStart(w http.ResponseWriter, r *http.Request) {
+	startOIDC(w, r, nil)
+}
+
+// handleOIDCLink begins linking the provider to the signed-in user
+func handleOIDCLink(w http.ResponseWriter, r *http.Request) {
+	auth := authFromContext(r)
+	startOIDC(w, r, &auth.UserID)
+}
+
+func startOIDC(w http.ResponseWriter, r *http.Request, linkUserID *primitive.ObjectID) {
+	p, ok := findOIDCProvider(mux.Vars(r)["provider"])
+	if !ok {
+		JSONError(w, http.StatusNotFound, "Unknown identity provider")
+		return
+	}
+	ctx, cancel := context.WithTimeout(r.Context(), 15*time.Second)
+	defer cancel()
+	authURL, state, err := p.authorizationURL(ctx, linkUserID)
+	if err != nil {
+		log.Printf("[oidc] %s: start failed: %v", p.ID, err)
+		JSONError(w, http.StatusBadGateway, "Identity provider is unavailable")
+		return
+	}
+	JSONResponse(w, http.StatusOK, map[string]interface{}{
+		"success":           true,
+		"authorization_url": authURL,
+		"state":             state,
+	})
+}
+
+// handleOIDCCallback completes the flow with the code and state the provider
+// redirected back with: signs the user in, or links the identity for link flows
+func handleOIDCCallback(w http.ResponseWriter, r *http.Request) {
+	var body struct {
+		Code  string `json:"code"`
+		State string `json:"state"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&body); err != nil || body.Code == "" || body.State == "" {
+		JSONError(w, http.StatusBadRequest, "code and state are required")
+		return
+	}
+	ctx, cancel := context.WithTimeout(r.Context(), 20*time.Second)
+	defer cancel()
+
+	// The state is single-use: deleting it makes a replayed callback fail
+	var st OIDCState
+	err := database.Collection("oidc_states").FindOneAndDelete(ctx, bson.M{
+		"_id":        hashToken(body.State),
+		"expires_at": bson.M{"$gt": time.Now()},
+	}).Decode(&st)
+	if errors.Is(err, mongo.ErrNoDocuments) {
+		JSONError(w, http.StatusBadRequest, "Login attempt is invalid or expired, please try again")
+		return
+	}
+	if err != nil {
+		log.Printf("[oidc] state lookup error: %v", err)
+		JSONError(w, http.StatusInternalServerError, "Internal server error")
+		return
+	}
+	p, ok := findOIDCProvider(st.Provider)
+	if !ok {
+		JSONError(w, http.StatusBadRequest, "Unknown identity provider")
+		return
+	}
+
+	// A link flow must be finished by the same signed-in user who started it
+	if st.LinkUserID != nil {
+		auth := extractUserFromJWT(w, r)
+		if auth == nil {
+			return
+		}
+		if auth.UserID != *st.LinkUserID {
+			JSONError(w, http.StatusForbidden, "Link was started by another user")
+			return
+		}
+	}
+
+	claims, err := p.exchangeCode(ctx, body.Code, &st)
+	if err != nil {
+		log.Printf("[oidc] %v", err)
+		JSONError(w, http.StatusUnauthorized, "Sign-in with "+p.Name+" failed")
+		return
+	}
+	prof := p.profile(claims)
+	if prof.Subject == "" {
+		log.Printf("[oidc] %s: no subject claim", p.ID)
+		JSONError(w, http.StatusUnauthorized, "Sign-in with "+p.Name+" failed")
+		return
+	}
+
+	if st.LinkUserID != nil {
+		identity, err := findIdentity(ctx, p.ID, prof.Subject)
+		if err == nil && identity == nil {
+			identity, err = linkIdentity(ctx, *st.LinkUserID, p.ID, prof)
+		} else if err == nil && identity.UserID != *st.LinkUserID {
+			err = errIdentityTaken
+		}
+		if errors.Is(err, errIdentityTaken) {
+			JSONError(w, http.StatusConflict, "This "+p.Name+" account is already linked to another user")
+			return
+		}
+		if err != nil {
+			log.Printf("[oidc] %s: link error: %v", p.ID, err)
+			JSONError(w, http.StatusInternalServerError, "Failed to link account")
+			return
+		}
+		JSONResponse(w, http.StatusOK, map[string]interface{}{
+			"success":  true,
+			"message":  p.Name + " account linked",
+			"linked":   true,
+			"identity": identity,
+		})
+		return
+	}
+
+	user, err := resolveOIDCUser(ctx, p, prof)
+	switch {
+	case errors.Is(err, errEmailInUse):
+		JSONErrorWithDetails(w, http.StatusConflict, "An account with this email already exists", map[string]interface{}{
+			"code":  "link_required",
+			"email": prof.Email,
+		})
+		return
+	case errors.Is(err, errIdentityNoMail):
+		JSONError(w, http.StatusBadRequest, p.Name+" did not share an email address")
+		return
+	case err != nil:
+		log.Printf("[oidc] %s: login error: %v", p.ID, err)
+		JSONError(w, http.StatusInternalServerError, "Internal server error")
+		return
+	}
+
+	completeLogin(w, r, user, p.Name+" authentication successful")
+}
+
+// handleListIdentities lists the provider accounts linked to the user
+func handleListIdentities(w http.ResponseWriter, r *http.Request) {
+	auth := authFromContext(r)
+	ctx, cancel := context.WithTimeout(r.Context(), 5*time.Second)
+	defer cancel()
+
+	cursor, err := database.Collection("identities").Find(ctx, bson.M{"user_id": auth.UserID},
+		options.Find().SetSort(bson.M{"created_at": 1}))
+	if err != nil {
+		JSONError(w, http.StatusInternalServerError, "Failed to load identities")
+		return
+	}
+	defer cursor.Close(ctx)
+	list := []Identity{}
+	if err := cursor.All(ctx, &list); err != nil {
+		JSONError(w, http.StatusInternalServerError, "Failed to load identities")
+		return
+	}
+	JSONResponse(w, http.StatusOK, map[string]interface{}{"success": true, "identities": list})
+}
+
+// handleUnlinkIdentity removes a linked provider account. The last way to sign in
+// (no password and no other identity) cannot be removed.
+func handleUnlinkIdentity(w http.ResponseWriter, r *http.Request) {
+	auth := authFromContext(r)
+	id, err := primitive.ObjectIDFromHex(mux.Vars(r)["id"])
+	if err != nil {
+		JSONError(w, http.StatusBadRequest, "Invalid ID format")
+		return
+	}
+	ctx, cancel := context.WithTimeout(r.Context(), 5*time.Second)
+	defer cancel()
+
+	user, err := GetUserByID(auth.UserID.Hex())
+	if err != nil {
+		JSONError(w, http.StatusNotFound, "User not found")
+		return
+	}
+	coll := database.Collection("identities")
+	n, err := coll.CountDocuments(ctx, bson.M{"user_id": auth.UserID})
+	if err != nil {
+		JSONError(w, http.StatusInternalServerError, "Failed to unlink identity")
+		return
+	}
+	if user.Password == "" && n <= 1 {
+		JSONError(w, http.StatusConflict, "Set a password or link another account before removing this one")
+		return
+	}
+	res, err := coll.DeleteOne(ctx, bson.M{"_id": id, "user_id": auth.UserID})
+	if err != nil {
+		JSONError(w, http.StatusInternalServerError, "Failed to unlink identity")
+		return
+	}
+	if res.DeletedCount == 0 {
+		JSONError(w, http.StatusNotFound, "Identity not found")
+		return
+	}
+	JSONResponse(w, http.StatusOK, map[string]interface{}{"success": true, "message": "Identity unlinked"})
+}
@@ -0,0 +1,294 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+	"go.mongodb.org/mongo-driver/bson"
+)
+
+// mockOIDCServer is a minimal OpenID provider: discovery, token and userinfo endpoints,
+// with the keys served by a testKeyServer
+type mockOIDCServer struct {
+	*httptest.Server
+	keys *testKeyServer
+
+	mu       sync.Mutex
+	issuer   string                 // issuer in the discovery document, the server URL by default
+	idClaims jwt.MapClaims          // claims of the next id_token
+	userInfo map[string]interface{} // userinfo response
+	form     url.Values             // last token request
+}
+
+func newMockOIDCServer(t *testing.T) *mockOIDCServer {
+	t.Helper()
+	m := &mockOIDCServer{keys: newTestKeyServer(t)}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/.well-known/openid-configuration", func(w http.ResponseWriter, r *http.Request) {
+		m.mu.Lock()
+		issuer := m.issuer
+		m.mu.Unlock()
+		if issuer == "" {
+			issuer = m.URL
+		}
+		json.NewEncoder(w).Encode(map[string]string{
+			"issuer":                 issuer,
+			"authorization_endpoint": m.URL + "/authorize",
+			"token_endpoint":         m.URL + "/token",
+			"userinfo_endpoint":      m.URL + "/userinfo",
+			"jwks_uri":               m.keys.URL,
+		})
+	})
+	mux.HandleFunc("/token", func(w http.ResponseWriter, r *http.Request) {
+		r.ParseForm()
+		m.mu.Lock()
+		m.form = r.PostForm
+		claims := m.idClaims
+		m.mu.Unlock()
+		if r.PostForm.Get("code") != "good-code" {
+			http.Error(w, `{"error":"invalid_grant"}`, http.StatusBadRequest)
+			return
+		}
+		json.NewEncoder(w).Encode(map[string]string{
+			"access_token": "access-123",
+			"token_type":   "Bearer",
+			"id_token":     m.keys.sign(t, claims),
+		})
+	})
+	mux.HandleFunc("/userinfo", func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Authorization") != "Bearer access-123" {
+			http.Error(w, "unauthorized", http.StatusUnauthorized)
+			return
+		}
+		m.mu.Lock()
+		defer m.mu.Unlock()
+		json.NewEncoder(w).Encode(m.userInfo)
+	})
+	m.Server = httptest.NewServer(mux)
+	t.Cleanup(m.Close)
+	return m
+}
+
+// claims returns valid id_token claims for the provider, with overrides (nil deletes)
+func (m *mockOIDCServer) claims(overrides jwt.MapClaims) jwt.MapClaims {
+	now := time.Now()
+	claims := jwt.MapClaims{
+		"iss":            m.URL,
+		"aud":            "speakapper",
+		"sub":            "user-42",
+		"nonce":          "nonce-1",
+		"email":          "Ada@Example.COM",
+		"email_verified": true,
+		"given_name":     "Ada",
+		"family_name":    "Lovelace",
+		"iat":            now.Unix(),
+		"exp":            now.Add(time.Hour).Unix(),
+	}
+	for k, v := range overrides {
+		if v == nil {
+			delete(claims, k)
+			continue
+		}
+		claims[k] = v
+	}
+	return claims
+}
+
+func (m *mockOIDCServer) provider(cfg OIDCProviderConfig) *OIDCProvider {
+	cfg.Issuer = m.URL
+	if cfg.ID == "" {
+		cfg.ID = "mock"
+	}
+	cfg.ClientID = "speakapper"
+	return &OIDCProvider{OIDCProviderConfig: cfg, HTTPClient: m.Client()}
+}
+
+var testOIDCState = &OIDCState{CodeVerifier: "verifier-1", Nonce: "nonce-1"}
+
+func TestOIDCExchangeCode(t *testing.T) {
+	m := newMockOIDCServer(t)
+	m.idClaims = m.claims(nil)
+	p := m.provider(OIDCProviderConfig{ClientSecret: "secret"})
+
+	claims, err := p.exchangeCode(context.Background(), "good-code", testOIDCState)
+	if err != nil {
+		t.Fatal(err)
+	}
+	prof := p.profile(claims)
+	want := oidcProfile{Subject: "user-42", Email: "ada@example.com", EmailVerified: true, FirstName: "Ada", LastName: "Lovelace"}
+	if prof != want {
+		t.Fatalf("profile = %+v, want %+v", prof, want)
+	}
+
+	for k, v := range map[string]string{
+		"grant_type":    "authorization_code",
+		"code_verifier": "verifier-1",
+		"client_id":     "speakapper",
+		"client_secret": "secret",
+		"redirect_uri":  oidcRedirectURL(),
+	} {
+		if got := m.form.Get(k); got != v {
+			t.Errorf("token request %s = %q, want %q", k, got, v)
+		}
+	}
+}
+
+func TestOIDCExchangeCodeRejects(t *testing.T) {
+	tests := []struct {
+		name    string
+		claims  jwt.MapClaims
+		code    string
+		issuer  string
+		wantErr string
+	}{
+		{name: "nonce mismatch", claims: jwt.MapClaims{"nonce": "replayed"}, wantErr: "nonce mismatch"},
+		{name: "missing nonce", claims: jwt.MapClaims{"nonce": nil}, wantErr: "nonce mismatch"},
+		{name: "other audience", claims: jwt.MapClaims{"aud": "another-app"}, wantErr: "audience"},
+		{name: "other issuer in token", claims: jwt.MapClaims{"iss": "https://evil.example"}, wantErr: "unexpected issuer"},
+		{name: "expired", claims: jwt.MapClaims{"exp": time.Now().Add(-time.Hour).Unix()}, wantErr: "expired"},
+		{name: "bad code", code: "stolen-code", wantErr: "token exchange"},
+		{name: "discovery for another issuer", issuer: "https://evil.example", wantErr: "does not match"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			m := newMockOIDCServer(t)
+			m.idClaims = m.claims(tt.claims)
+			m.issuer = tt.issuer
+			code := tt.code
+			if code == "" {
+				code = "good-code"
+			}
+			_, err := m.provider(OIDCProviderConfig{}).exchangeCode(context.Background(), code, testOIDCState)
+			if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+				t.Fatalf("error = %v, want it to contain %q", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestOIDCUserinfoFillsMissingEmail(t *testing.T) {
+	m := newMockOIDCServer(t)
+	m.idClaims = m.claims(jwt.MapClaims{"email": nil, "email_verified": nil})
+	m.userInfo = map[string]interface{}{"sub": "user-42", "email": "ada@example.com", "email_verified": "true"}
+	p := m.provider(OIDCProviderConfig{})
+
+	claims, err := p.exchangeCode(context.Background(), "good-code", testOIDCState)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if prof := p.profile(claims); prof.Email != "ada@example.com" || !prof.EmailVerified {
+		t.Fatalf("profile = %+v, want email from userinfo", prof)
+	}
+
+	// Userinfo about someone else must not be merged
+	m.userInfo["sub"] = "someone-else"
+	if _, err := p.exchangeCode(context.Background(), "good-code", testOIDCState); err == nil || !strings.Contains(err.Error(), "subject mismatch") {
+		t.Fatalf("error = %v, want subject mismatch", err)
+	}
+}
+
+func TestOIDCProfileClaimMap(t *testing.T) {
+	p := &OIDCProvider{OIDCProviderConfig: OIDCProviderConfig{Claims: OIDCClaimMap{
+		Subject:       "oid",
+		Email:         "mail",
+		EmailVerified: "mail_verified",
+	}}}
+	prof := p.profile(jwt.MapClaims{
+		"sub":           "ignored",
+		"oid":           "abc",
+		"mail":          " Grace.Hopper@Navy.MIL ",
+		"mail_verified": true,
+		"name":          "Grace Brewster Hopper",
+	})
+	want := oidcProfile{Subject: "abc", Email: "grace.hopper@navy.mil", EmailVerified: true, FirstName: "Grace", LastName: "Brewster Hopper"}
+	if prof != want {
+		t.Fatalf("profile = %+v, want %+v", prof, want)
+	}
+}
+
+func TestResolveOIDCUserLinksExistingAccountOnce(t *testing.T) {
+	useTestDatabase(t)
+	ensureUserIndexes()
+	ensureIdentityIndex()
+	ctx := context.Background()
+
+	// Existing account whose email differs only in case
+	if _, err := database.Collection("users").InsertOne(ctx, User{ID: "existing", Email: "Ada@Example.com", EmailVerified: true}); err != nil {
+		t.Fatal(err)
+	}
+	p := &OIDCProvider{OIDCProviderConfig: OIDCProviderConfig{ID: "corp", TrustEmail: true}}
+	prof := oidcProfile{Subject: "user-42", Email: "ada@example.com", EmailVerified: true}
+
+	var wg sync.WaitGroup
+	ids := make([]string, 8)
+	errs := make([]error, len(ids))
+	for i := range ids {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			user, err := resolveOIDCUser(ctx, p, prof)
+			errs[i] = err
+			if user != nil {
+				ids[i] = user.ID
+			}
+		}(i)
+	}
+	wg.Wait()
+	for i := range ids {
+		if errs[i] != nil || ids[i] != "existing" {
+			t.Fatalf("callback %d: user = %q, err = %v", i, ids[i], errs[i])
+		}
+	}
+
+	if n, _ := database.Collection("users").CountDocuments(ctx, bson.M{}); n != 1 {
+		t.Fatalf("users = %d, want the existing account only", n)
+	}
+	if n, _ := database.Collection("identities").CountDocuments(ctx, bson.M{"provider": "corp", "subject": "user-42"}); n != 1 {
+		t.Fatalf("identities = %d, want 1", n)
+	}
+}
+
+func TestResolveOIDCUserConcurrentSignup(t *testing.T) {
+	useTestDatabase(t)
+	ensureUserIndexes()
+	ensureIdentityIndex()
+	ctx := context.Background()
+
+	p := &OIDCProvider{OIDCProviderConfig: OIDCProviderConfig{ID: "corp", TrustEmail: true}}
+	prof := oidcProfile{Subject: "new-1", Email: "new@example.com", EmailVerified: true}
+
+	var wg sync.WaitGroup
+	ids := make([]string, 8)
+	errs := make([]error, len(ids))
+	for i := range ids {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			user, err := resolveOIDCUser(ctx, p, prof)
+			errs[i] = err
+			if user != nil {
+				ids[i] = user.ID
+			}
+		}(i)
+	}
+	wg.Wait()
+	for i := range ids {
+		if errs[i] != nil || ids[i] != ids[0] {
+			t.Fatalf("callback %d: user = %q (first %q), err = %v", i, ids[i], ids[0], errs[i])
+		}
+	}
+	if n, _ := database.Collection("users").CountDocuments(ctx, bson.M{}); n != 1 {
+		t.Fatalf("users = %d, want 1", n)
+	}
+	if n, _ := database.Collection("identities").CountDocuments(ctx, bson.M{}); n != 1 {
+		t.Fatalf("identities = %d, want 1", n)
+	}
+}
@@ -1,3 +1,282 @@
 package main
 
-// Lemon Squeezy integration has been removed.
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// CheckoutRequest describes a payment session for one plan
+type CheckoutRequest struct {
+	SessionID  string
+	UserID     primitive.ObjectID
+	Email      string
+	Plan       Plan
+	SuccessURL string
+	CancelURL  string
+}
+
+// CheckoutSession is what the provider returns: where to send the user to pay
+type CheckoutSession struct {
+	ID          string // provider reference stored on the subscription
+	CheckoutURL string
+}
+
+// WebhookEvent is a provider webhook normalized to what the subscription needs
+type WebhookEvent struct {
+	ID             string // provider event ID used to deduplicate redeliveries
+	Type           string // e.g. subscription_created, subscription_cancelled
+	SessionID      string // our checkout session (passed to the provider as custom data)
+	UserID         string
+	SubscriptionID string // provider's subscription ID
+	PriceID        string // provider's price/variant, mapped to Plan.ProviderPriceID
+	Status         string // SubscriptionActive|SubscriptionCanceled|SubscriptionExpired, empty to keep
+	PeriodEnd      time.Time
+	OccurredAt     time.Time
+}
+
+// PaymentProvider creates hosted checkout sessions and parses the provider's webhooks
+type PaymentProvider interface {
+	Name() string
+	CreateCheckout(ctx context.Context, req CheckoutRequest) (*CheckoutSession, error)
+	ParseWebhook(body []byte) (*WebhookEvent, error)
+}
+
+// paymentProvider is the provider selected at startup via PAYMENT_PROVIDER,
+// nil when payments are disabled
+var paymentProvider PaymentProvider
+
+// newPaymentProviderFromEnv builds the provider selected by PAYMENT_PROVIDER
+// (lemonsqueezy|fake). Without PAYMENT_PROVIDER payments are disabled and nil is returned:
+// checkout and webhooks answer 503. The fake provider grants plans for free, so it only
+// runs together with DEV_MODE=true.
+func newPaymentProviderFromEnv() (PaymentProvider, error) {
+	switch kind := strings.ToLower(getEnvOrFile("PAYMENT_PROVIDER")); kind {
+	case "":
+		return nil, nil
+	case "lemonsqueezy", "lemon-squeezy":
+		p := &LemonSqueezyProvider{
+			BaseURL:    "https://api.lemonsqueezy.com/v1",
+			APIKey:     getEnvOrFile("LEMON_SQUEEZY_API_KEY"),
+			StoreID:    getEnvOrFile("LEMON_SQUEEZY_STORE_ID"),
+			HTTPClient: &http.Client{Timeout: 15 * time.Second},
+		}
+		if p.APIKey == "" || p.StoreID == "" {
+			return nil, errors.New("LEMON_SQUEEZY_API_KEY and LEMON_SQUEEZY_STORE_ID are required for PAYMENT_PROVIDER=lemonsqueezy")
+		}
+		for _, plan := range plans {
+			if plan.ProviderPriceID == "" {
+				return nil, fmt.Errorf("plan %q has no Lemon Squeezy variant (provider_price_id or LEMON_SQUEEZY_%s_VARIANT_ID)", plan.ID, strings.ToUpper(plan.ID))
+			}
+		}
+		return p, nil
+	case "fake":
+		if !devMode() {
+			return nil, errors.New("PAYMENT_PROVIDER=fake activates subscriptions without payment and requires DEV_MODE=true")
+		}
+		return &FakePaymentProvider{BaseURL: appBaseURL()}, nil
+	default:
+		return nil, fmt.Errorf("unknown PAYMENT_PROVIDER %q (expected lemonsqueezy or fake)", kind)
+	}
+}
+
+// devMode reports whether DEV_MODE enables development-only endpoints
+func devMode() bool {
+	on, _ := strconv.ParseBool(getEnvOrFile("DEV_MODE"))
+	return on
+}
+
+// appBaseURL is the public URL of the app used in redirects (APP_URL)
+func appBaseURL() string {
+	if v := getEnvOrFile("APP_URL"); v != "" {
+		return strings.TrimRight(v, "/")
+	}
+	return "http://localhost:3000"
+}
+
+// LemonSqueezyProvider creates hosted checkouts through the Lemon Squeezy API.
+// Plans map to store variants via Plan.ProviderPriceID; our checkout session and user
+// travel as custom data and come back in the subscription webhooks.
+type LemonSqueezyProvider struct {
+	BaseURL    string
+	APIKey     string
+	StoreID    string
+	HTTPClient *http.Client
+}
+
+func (p *LemonSqueezyProvider) Name() string { return "lemonsqueezy" }
+
+func (p *LemonSqueezyProvider) CreateCheckout(ctx context.Context, req CheckoutRequest) (*CheckoutSession, error) {
+	if req.Plan.ProviderPriceID == "" {
+		return nil, fmt.Errorf("plan %q has no Lemon Squeezy variant", req.Plan.ID)
+	}
+	relation := func(typ, id string) map[string]interface{} {
+		return map[string]interface{}{"data": map[string]string{"type": typ, "id": id}}
+	}
+	payload := map[string]interface{}{
+		"data": map[string]interface{}{
+			"type": "checkouts",
+			"attributes": map[string]interface{}{
+				"checkout_data": map[string]interface{}{
+					"email": req.Email,
+					"custom": map[string]string{
+						"user_id":    req.UserID.Hex(),
+						"session_id": req.SessionID,
+					},
+				},
+				"product_options": map[string]interface{}{
+					"redirect_url": req.SuccessURL,
+				},
+			},
+			"relationships": map[string]interface{}{
+				"store":   relation("stores", p.StoreID),
+				"variant": relation("variants", req.Plan.ProviderPriceID),
+			},
+		},
+	}
+	buf, _ := json.Marshal(payload)
+	httpReq, err := http.NewRequestWithContext(ctx, http.MethodPost, strings.TrimRight(p.BaseURL, "/")+"/checkouts", bytes.NewReader(buf))
+	if err != nil {
+		return nil, err
+	}
+	httpReq.Header.Set("Accept", "application/vnd.api+json")
+	httpReq.Header.Set("Content-Type", "application/vnd.api+json")
+	httpReq.Header.Set("Authorization", "Bearer "+p.APIKey)
+
+	resp, err := p.HTTPClient.Do(httpReq)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	respBytes, err := io.ReadAll(io.LimitReader(resp.Body, 1<<20))
+	if err != nil {
+		return nil, fmt.Errorf("failed to read checkout response: %w", err)
+	}
+	if resp.StatusCode != http.StatusCreated && resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("lemonsqueezy checkout: %w", newHTTPStatusError(resp, respBytes))
+	}
+
+	var checkout struct {
+		Data struct {
+			ID         string `json:"id"`
+			Attributes struct {
+				URL string `json:"url"`
+			} `json:"attributes"`
+		} `json:"data"`
+	}
+	if err := json.Unmarshal(respBytes, &checkout); err != nil {
+		return nil, fmt.Errorf("failed to parse checkout response: %w", err)
+	}
+	if checkout.Data.ID == "" || checkout.Data.Attributes.URL == "" {
+		return nil, errors.New("lemonsqueezy checkout: response has no id or url")
+	}
+	return &CheckoutSession{ID: checkout.Data.ID, CheckoutURL: checkout.Data.Attributes.URL}, nil
+}
+
+func (p *LemonSqueezyProvider) ParseWebhook(body []byte) (*WebhookEvent, error) {
+	return parseSubscriptionWebhook(body)
+}
+
+// FakePaymentProvider "charges" instantly: its checkout URL points back at this
+// server, which activates the caller's pending subscription and redirects to the
+// success page. Used for local development and tests (PAYMENT_PROVIDER=fake, DEV_MODE=true).
+type FakePaymentProvider struct {
+	BaseURL string
+}
+
+func (p *FakePaymentProvider) Name() string { return "fake" }
+
+func (p *FakePaymentProvider) CreateCheckout(ctx context.Context, req CheckoutRequest) (*CheckoutSession, error) {
+	id := "fake_" + req.SessionID
+	return &CheckoutSession{
+		ID:          id,
+		CheckoutURL: p.BaseURL + "/api/subscription/fake-checkout/" + url.PathEscape(id),
+	}, nil
+}
+
+func (p *FakePaymentProvider) ParseWebhook(body []byte) (*WebhookEvent, error) {
+	return parseSubscriptionWebhook(body)
+}
+
+// parseSubscriptionWebhook parses the Lemon Squeezy subscription payload
+// ({"meta": {"event_name", "custom_data"}, "data": {"id", "attributes"}}), also used by the
+// fake provider. testdata/webhooks holds samples in this format.
+func parseSubscriptionWebhook(body []byte) (*WebhookEvent, error) {
+	var payload struct {
+		Meta struct {
+			EventID    string `json:"event_id"`
+			EventName  string `json:"event_name"`
+			CustomData struct {
+				UserID    string `json:"user_id"`
+				SessionID string `json:"session_id"`
+			} `json:"custom_data"`
+		} `json:"meta"`
+		Data struct {
+			ID         string `json:"id"`
+			Attributes struct {
+				Status    string      `json:"status"`
+				VariantID json.Number `json:"variant_id"`
+				RenewsAt  *time.Time  `json:"renews_at"`
+				EndsAt    *time.Time  `json:"ends_at"`
+				UpdatedAt *time.Time  `json:"updated_at"`
+			} `json:"attributes"`
+		} `json:"data"`
+	}
+	if err := json.Unmarshal(body, &payload); err != nil {
+		return nil, fmt.Errorf("invalid webhook payload: %w", err)
+	}
+	if payload.Meta.EventName == "" {
+		return nil, fmt.Errorf("invalid webhook payload: meta.event_name is missing")
+	}
+
+	attrs := payload.Data.Attributes
+	ev := &WebhookEvent{
+		ID:             payload.Meta.EventID,
+		Type:           payload.Meta.EventName,
+		SessionID:      payload.Meta.CustomData.SessionID,
+		UserID:         payload.Meta.CustomData.UserID,
+		SubscriptionID: payload.Data.ID,
+		PriceID:        attrs.VariantID.String(),
+	}
+	// Lemon Squeezy sends no event ID; a redelivery has the same body, so its hash
+	// identifies the event
+	if ev.ID == "" {
+		sum := sha256.Sum256(body)
+		ev.ID = "sha256:" + hex.EncodeToString(sum[:])
+	}
+	if attrs.UpdatedAt != nil {
+		ev.OccurredAt = *attrs.UpdatedAt
+	}
+
+	switch attrs.Status {
+	case "active", "on_trial", "past_due":
+		ev.Status = SubscriptionActive
+		if attrs.RenewsAt != nil {
+			ev.PeriodEnd = *attrs.RenewsAt
+		}
+	case "cancelled", "paused":
+		// Paid time is kept until ends_at
+		ev.Status = SubscriptionCanceled
+		if attrs.EndsAt != nil {
+			ev.PeriodEnd = *attrs.EndsAt
+		}
+	case "expired", "unpaid":
+		ev.Status = SubscriptionExpired
+		if attrs.EndsAt != nil {
+			ev.PeriodEnd = *attrs.EndsAt
+		}
+	}
+	return ev, nil
+}
@@ -0,0 +1,162 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+func TestNewPaymentProviderFromEnv(t *testing.T) {
+	withVariants := []Plan{{ID: "basic", ProviderPriceID: "11111"}, {ID: "premium", ProviderPriceID: "22222"}}
+	tests := []struct {
+		name     string
+		env      map[string]string
+		plans    []Plan
+		wantName string // empty: payments disabled
+		wantErr  string
+	}{
+		{name: "unset disables payments"},
+		{name: "lemonsqueezy", env: map[string]string{"PAYMENT_PROVIDER": "LemonSqueezy", "LEMON_SQUEEZY_API_KEY": "key", "LEMON_SQUEEZY_STORE_ID": "1"}, plans: withVariants, wantName: "lemonsqueezy"},
+		{name: "lemonsqueezy without a key", env: map[string]string{"PAYMENT_PROVIDER": "lemonsqueezy", "LEMON_SQUEEZY_STORE_ID": "1"}, plans: withVariants, wantErr: "LEMON_SQUEEZY_API_KEY"},
+		{name: "lemonsqueezy plan without a variant", env: map[string]string{"PAYMENT_PROVIDER": "lemonsqueezy", "LEMON_SQUEEZY_API_KEY": "key", "LEMON_SQUEEZY_STORE_ID": "1"}, plans: defaultPlans, wantErr: "LEMON_SQUEEZY_BASIC_VARIANT_ID"},
+		{name: "fake without dev mode", env: map[string]string{"PAYMENT_PROVIDER": "fake"}, wantErr: "DEV_MODE"},
+		{name: "fake in dev mode", env: map[string]string{"PAYMENT_PROVIDER": "fake", "DEV_MODE": "true"}, wantName: "fake"},
+		{name: "unknown", env: map[string]string{"PAYMENT_PROVIDER": "stripe"}, wantErr: "unknown PAYMENT_PROVIDER"},
+	}
+	vars := []string{"PAYMENT_PROVIDER", "DEV_MODE", "LEMON_SQUEEZY_API_KEY", "LEMON_SQUEEZY_STORE_ID"}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			for _, v := range vars {
+				t.Setenv(v, tt.env[v])
+				t.Setenv(v+"_FILE", "")
+			}
+			prev := plans
+			plans = tt.plans
+			t.Cleanup(func() { plans = prev })
+
+			p, err := newPaymentProviderFromEnv()
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Fatalf("error = %v, want it to contain %q", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if tt.wantName == "" {
+				if p != nil {
+					t.Fatalf("provider = %s, want payments disabled", p.Name())
+				}
+				return
+			}
+			if p == nil || p.Name() != tt.wantName {
+				t.Fatalf("provider = %v, want %s", p, tt.wantName)
+			}
+		})
+	}
+}
+
+func TestLoadPlansFromEnvVariants(t *testing.T) {
+	t.Setenv("SUBSCRIPTION_PLANS_FILE", "")
+	t.Setenv("SUBSCRIPTION_PLANS_FILE_FILE", "")
+	t.Setenv("LEMON_SQUEEZY_BASIC_VARIANT_ID", "11111")
+	t.Setenv("LEMON_SQUEEZY_PREMIUM_VARIANT_ID", "22222")
+	list, err := loadPlansFromEnv()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(list) != 2 || list[0].ProviderPriceID != "11111" || list[1].ProviderPriceID != "22222" {
+		t.Fatalf("plans = %+v", list)
+	}
+	if defaultPlans[0].ProviderPriceID != "" {
+		t.Fatal("the built-in catalog was modified")
+	}
+}
+
+func TestLemonSqueezyCreateCheckout(t *testing.T) {
+	var got map[string]interface{}
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost || r.URL.Path != "/v1/checkouts" ||
+			r.Header.Get("Authorization") != "Bearer ls-key" ||
+			r.Header.Get("Content-Type") != "application/vnd.api+json" {
+			http.Error(w, `{"errors":[{"detail":"bad request"}]}`, http.StatusBadRequest)
+			return
+		}
+		json.NewDecoder(r.Body).Decode(&got)
+		w.WriteHeader(http.StatusCreated)
+		w.Write([]byte(`{"jsonapi":{"version":"1.0"},"data":{"type":"checkouts","id":"5e8b546c-c561-4a2c-a586-40c18bb2a195",
+			"attributes":{"store_id":1,"variant_id":22222,"url":"https://speakapper.lemonsqueezy.com/checkout/custom/5e8b546c"}}}`))
+	}))
+	defer srv.Close()
+
+	p := &LemonSqueezyProvider{BaseURL: srv.URL + "/v1", APIKey: "ls-key", StoreID: "1", HTTPClient: srv.Client()}
+	userID := primitive.NewObjectID()
+	session, err := p.CreateCheckout(context.Background(), CheckoutRequest{
+		SessionID:  "66f1c0ffee0000000000b001",
+		UserID:     userID,
+		Email:      "ada@example.com",
+		Plan:       Plan{ID: "premium", ProviderPriceID: "22222"},
+		SuccessURL: "https://app.example/pricing?checkout=success",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if session.ID != "5e8b546c-c561-4a2c-a586-40c18bb2a195" || session.CheckoutURL != "https://speakapper.lemonsqueezy.com/checkout/custom/5e8b546c" {
+		t.Fatalf("session = %+v", session)
+	}
+
+	data := got["data"].(map[string]interface{})
+	attrs := data["attributes"].(map[string]interface{})
+	checkoutData := attrs["checkout_data"].(map[string]interface{})
+	custom := checkoutData["custom"].(map[string]interface{})
+	if checkoutData["email"] != "ada@example.com" || custom["user_id"] != userID.Hex() || custom["session_id"] != "66f1c0ffee0000000000b001" {
+		t.Fatalf("checkout_data = %v", checkoutData)
+	}
+	if attrs["product_options"].(map[string]interface{})["redirect_url"] != "https://app.example/pricing?checkout=success" {
+		t.Fatalf("product_options = %v", attrs["product_options"])
+	}
+	rel := data["relationships"].(map[string]interface{})
+	store := rel["store"].(map[string]interface{})["data"].(map[string]interface{})
+	variant := rel["variant"].(map[string]interface{})["data"].(map[string]interface{})
+	if store["id"] != "1" || store["type"] != "stores" || variant["id"] != "22222" || variant["type"] != "variants" {
+		t.Fatalf("relationships = %v", rel)
+	}
+}
+
+func TestLemonSqueezyCreateCheckoutError(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.Error(w, `{"errors":[{"detail":"Unauthenticated."}]}`, http.StatusUnauthorized)
+	}))
+	defer srv.Close()
+
+	p := &LemonSqueezyProvider{BaseURL: srv.URL, APIKey: "revoked", StoreID: "1", HTTPClient: srv.Client()}
+	_, err := p.CreateCheckout(context.Background(), CheckoutRequest{Plan: Plan{ID: "premium", ProviderPriceID: "22222"}})
+	if err == nil || !strings.Contains(err.Error(), "401") {
+		t.Fatalf("error = %v, want the 401", err)
+	}
+	if _, err := p.CreateCheckout(context.Background(), CheckoutRequest{Plan: Plan{ID: "basic"}}); err == nil {
+		t.Fatal("expected an error for a plan without a variant")
+	}
+}
+
+func TestPaymentsDisabled(t *testing.T) {
+	prev := paymentProvider
+	paymentProvider = nil
+	t.Cleanup(func() { paymentProvider = prev })
+
+	r := withAuth(httptest.NewRequest(http.MethodPost, "/api/subscription/checkout", strings.NewReader(`{"plan_id":"premium"}`)), primitive.NewObjectID())
+	w := httptest.NewRecorder()
+	handleSubscriptionCheckout(w, r)
+	if w.Code != http.StatusServiceUnavailable {
+		t.Fatalf("checkout = %d, want 503", w.Code)
+	}
+	if code, _ := postWebhook(t, []byte(`{}`), "sha256=00"); code != http.StatusServiceUnavailable {
+		t.Fatalf("webhook = %d, want 503", code)
+	}
+}
@@ -0,0 +1,349 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"math"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gorilla/mux"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// Keys a limit can be counted by
+const (
+	LimitByIP    = "ip"
+	LimitByUser  = "user"
+	LimitByEmail = "email" // the "email" field of the JSON body
+)
+
+// LimitRule is a token bucket: Limit requests at once, refilled at Limit per Window
+type LimitRule struct {
+	By     string
+	Limit  int
+	Window time.Duration
+}
+
+// policy is the RateLimit-Policy value of the rule, e.g. "10;w=60"
+func (l LimitRule) policy() string {
+	return fmt.Sprintf("%d;w=%d", l.Limit, int(l.Window.Seconds()))
+}
+
+// routeLimits declares the limits of each named route. RATE_LIMITS overrides them,
+// e.g. "login:ip=20/1m,login:email=10/15m,generate:user=30/1h".
+var routeLimits = map[string][]LimitRule{
+	"login":                   {{LimitByIP, 20, time.Minute}, {LimitByEmail, 10, 15 * time.Minute}},
+	"signup":                  {{LimitByIP, 10, time.Hour}},
+	"google-signup":           {{LimitByIP, 30, time.Minute}},
+	"oidc-callback":           {{LimitByIP, 30, time.Minute}},
+	"refresh":                 {{LimitByIP, 60, time.Minute}},
+	"verify-email":            {{LimitByIP, 30, time.Hour}},
+	"password-forgot":         {{LimitByIP, 10, time.Hour}, {LimitByEmail, 3, time.Hour}},
+	"password-reset":          {{LimitByIP, 20, time.Hour}},
+	"2fa-verify":              {{LimitByIP, 20, time.Minute}},
+	"generate":                {{LimitByUser, 30, time.Hour}},
+	"generate-and-save":       {{LimitByUser, 30, time.Hour}},
+	"transcribe":              {{LimitByUser, 20, time.Hour}},
+	"transcribe-youtube":      {{LimitByUser, 20, time.Hour}},
+	"upload-create":           {{LimitByUser, 20, time.Hour}},
+	"transcript-retranscribe": {{LimitByUser, 20, time.Hour}},
+}
+
+// parseRateLimits parses RATE_LIMITS entries "route:by=limit/window" into routeLimits.
+// Rules given for a route replace all of its defaults; limit 0 disables the route's limits.
+func parseRateLimits(spec string, limits map[string][]LimitRule) error {
+	replaced := map[string]bool{}
+	for _, entry := range strings.Split(spec, ",") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+		route, rule, ok := strings.Cut(entry, ":")
+		by, rate, ok2 := strings.Cut(rule, "=")
+		n, window, ok3 := strings.Cut(rate, "/")
+		if !ok || !ok2 || !ok3 {
+			return fmt.Errorf("invalid rate limit %q, expected route:by=limit/window", entry)
+		}
+		if by != LimitByIP && by != LimitByUser && by != LimitByEmail {
+			return fmt.Errorf("invalid rate limit %q: key must be ip, user or email", entry)
+		}
+		limit, err := strconv.Atoi(n)
+		if err != nil || limit < 0 {
+			return fmt.Errorf("invalid rate limit %q: bad limit", entry)
+		}
+		w, err := time.ParseDuration(window)
+		if err != nil || w <= 0 {
+			return fmt.Errorf("invalid rate limit %q: bad window", entry)
+		}
+		if !replaced[route] {
+			replaced[route] = true
+			limits[route] = nil
+		}
+		if limit > 0 {
+			limits[route] = append(limits[route], LimitRule{by, limit, w})
+		}
+	}
+	return nil
+}
+
+// RateDecision is the outcome of taking a token
+type RateDecision struct {
+	Allowed    bool
+	Remaining  int
+	Reset      time.Duration // until the bucket is full again
+	RetryAfter time.Duration // until the next token, when not allowed
+}
+
+// RateLimiter keeps token buckets. Implementations must be safe for concurrent use.
+type RateLimiter interface {
+	Name() string
+	Take(ctx context.Context, key string, rule LimitRule) (RateDecision, error)
+}
+
+// rateLimiter is the backend selected at startup via RATE_LIMIT_BACKEND
+var rateLimiter RateLimiter = NewMemoryRateLimiter()
+
+// newRateLimiterFromEnv builds the backend selected by RATE_LIMIT_BACKEND (memory|mongo)
+func newRateLimiterFromEnv() (RateLimiter, error) {
+	switch kind := strings.ToLower(getEnvOrFile("RATE_LIMIT_BACKEND")); kind {
+	case "", "memory":
+		return NewMemoryRateLimiter(), nil
+	case "mongo":
+		return NewMongoRateLimiter(database.Collection("rate_limits"))
+	default:
+		return nil, fmt.Errorf("unknown RATE_LIMIT_BACKEND %q (expected memory or mongo)", kind)
+	}
+}
+
+// decide applies the token bucket arithmetic shared by the backends: tokens is the
+// bucket level after refilling and before taking
+func decide(tokens float64, rule LimitRule) (RateDecision, float64) {
+	perToken := rule.Window / time.Duration(rule.Limit)
+	d := RateDecision{Allowed: tokens >= 1}
+	if d.Allowed {
+		tokens--
+	} else {
+		d.RetryAfter = time.Duration((1 - tokens) * float64(perToken))
+	}
+	d.Remaining = int(math.Floor(tokens))
+	d.Reset = time.Duration((float64(rule.Limit) - tokens) * float64(perToken))
+	return d, tokens
+}
+
+// refill returns the bucket level after elapsed time, capped at the limit
+func refill(tokens float64, elapsed time.Duration, rule LimitRule) float64 {
+	tokens += elapsed.Seconds() * float64(rule.Limit) / rule.Window.Seconds()
+	return math.Min(tokens, float64(rule.Limit))
+}
+
+// MemoryRateLimiter keeps buckets in process memory; for a single instance
+type MemoryRateLimiter struct {
+	mu      sync.Mutex
+	buckets map[string]*memoryBucket
+	sweptAt time.Time
+}
+
+type memoryBucket struct {
+	tokens float64
+	at     time.Time
+	full   time.Time // when the bucket is full again and can be dropped
+}
+
+func NewMemoryRateLimiter() *MemoryRateLimiter {
+	return &MemoryRateLimiter{buckets: map[string]*memoryBucket{}, sweptAt: time.Now()}
+}
+
+func (m *MemoryRateLimiter) Name() string { return "memory" }
+
+func (m *MemoryRateLimiter) Take(ctx context.Context, key string, rule LimitRule) (RateDecision, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	now := time.Now()
+	b, ok := m.buckets[key]
+	if !ok {
+		b = &memoryBucket{tokens: float64(rule.Limit), at: now}
+		m.buckets[key] = b
+	}
+	var d RateDecision
+	d, b.tokens = decide(refill(b.tokens, now.Sub(b.at), rule), rule)
+	b.at = now
+	b.full = now.Add(d.Reset)
+
+	// Full buckets carry no state; drop them once a minute
+	if now.Sub(m.sweptAt) > time.Minute {
+		for k, v := range m.buckets {
+			if now.After(v.full) {
+				delete(m.buckets, k)
+			}
+		}
+		m.sweptAt = now
+	}
+	return d, nil
+}
+
+// MongoRateLimiter keeps buckets in a collection so all instances share them. Each
+// take is a single atomic pipeline update; idle buckets are removed by a TTL index.
+type MongoRateLimiter struct {
+	coll *mongo.Collection
+}
+
+func NewMongoRateLimiter(coll *mongo.Collection) (*MongoRateLimiter, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	_, err := coll.Indexes().CreateOne(ctx, mongo.IndexModel{
+		Keys:    bson.M{"expires_at": 1},
+		Options: options.Index().SetExpireAfterSeconds(0),
+	})
+	if err != nil {
+		return nil, fmt.Errorf("rate_limits TTL index: %w", err)
+	}
+	return &MongoRateLimiter{coll: coll}, nil
+}
+
+func (m *MongoRateLimiter) Name() string { return "mongo" }
+
+func (m *MongoRateLimiter) Take(ctx context.Context, key string, rule LimitRule) (RateDecision, error) {
+	now := time.Now()
+	limit := float64(rule.Limit)
+	perMs := limit / float64(rule.Window.Milliseconds())
+	// tokens = min(limit, tokens + elapsed_ms * perMs); take one if tokens >= 1
+	refilled := bson.M{"$min": bson.A{limit, bson.M{"$add": bson.A{
+		bson.M{"$ifNull": bson.A{"$tokens", limit}},
+		bson.M{"$multiply": bson.A{perMs, bson.M{"$subtract": bson.A{now, bson.M{"$ifNull": bson.A{"$at", now}}}}}},
+	}}}}
+	pipeline := mongo.Pipeline{
+		{{Key: "$set", Value: bson.M{"tokens": refilled, "at": now}}},
+		{{Key: "$set", Value: bson.M{
+			"allowed":    bson.M{"$gte": bson.A{"$tokens", 1}},
+			"tokens":     bson.M{"$cond": bson.A{bson.M{"$gte": bson.A{"$tokens", 1}}, bson.M{"$subtract": bson.A{"$tokens", 1}}, "$tokens"}},
+			"expires_at": now.Add(rule.Window),
+		}}},
+	}
+	var doc struct {
+		Tokens  float64 `bson:"tokens"`
+		Allowed bool    `bson:"allowed"`
+	}
+	err := m.coll.FindOneAndUpdate(ctx, bson.M{"_id": key}, pipeline,
+		options.FindOneAndUpdate().SetUpsert(true).SetReturnDocument(options.After),
+	).Decode(&doc)
+	if err != nil {
+		return RateDecision{}, err
+	}
+	// Recompute the headers from the level before taking
+	before := doc.Tokens
+	if doc.Allowed {
+		before++
+	}
+	d, _ := decide(before, rule)
+	return d, nil
+}
+
+// rateLimitMiddleware enforces routeLimits on named routes and sets the RateLimit-*
+// headers of the tightest rule. Backend errors let the request through.
+func rateLimitMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		route := mux.CurrentRoute(r)
+		if route == nil {
+			next.ServeHTTP(w, r)
+			return
+		}
+		name := route.GetName()
+		rules := routeLimits[name]
+		if len(rules) == 0 {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		var tightest *RateDecision
+		var tightestRule LimitRule
+		for _, rule := range rules {
+			var subject string
+			switch rule.By {
+			case LimitByIP:
+				subject = clientIP(r)
+			case LimitByEmail:
+				subject = requestEmail(r)
+			case LimitByUser:
+				// Authenticate here like entitlementMiddleware; requireAuth reuses the result
+				auth := authFromContext(r)
+				if auth == nil {
+					if auth = extractUserFromJWT(w, r); auth == nil {
+						return
+					}
+					r = r.WithContext(context.WithValue(r.Context(), authContextKey{}, auth))
+				}
+				subject = auth.UserID.Hex()
+			}
+			if subject == "" {
+				continue
+			}
+
+			ctx, cancel := context.WithTimeout(r.Context(), 2*time.Second)
+			d, err := rateLimiter.Take(ctx, name+":"+rule.By+":"+subject, rule)
+			cancel()
+			if err != nil {
+				log.Printf("[ratelimit] %s backend error on %s: %v", rateLimiter.Name(), name, err)
+				continue
+			}
+			if tightest == nil || !d.Allowed || (tightest.Allowed && d.Remaining < tightest.Remaining) {
+				tightest, tightestRule = &d, rule
+			}
+			if !d.Allowed {
+				break
+			}
+		}
+		if tightest == nil {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		h := w.Header()
+		h.Set("RateLimit-Limit", strconv.Itoa(tightestRule.Limit))
+		h.Set("RateLimit-Remaining", strconv.Itoa(tightest.Remaining))
+		h.Set("RateLimit-Reset", strconv.Itoa(ceilSeconds(tightest.Reset)))
+		h.Set("RateLimit-Policy", tightestRule.policy())
+		if !tightest.Allowed {
+			h.Set("Retry-After", strconv.Itoa(ceilSeconds(tightest.RetryAfter)))
+			JSONError(w, http.StatusTooManyRequests, "Too many requests, please try again later")
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// ceilSeconds rounds d up to whole seconds, at least 1
+func ceilSeconds(d time.Duration) int {
+	s := int(math.Ceil(d.Seconds()))
+	if s < 1 {
+		return 1
+	}
+	return s
+}
+
+// requestEmail peeks at the "email" field of a JSON body and restores the body
+func requestEmail(r *http.Request) string {
+	if r.Body == nil {
+		return ""
+	}
+	body, err := io.ReadAll(io.LimitReader(r.Body, 1<<20))
+	r.Body.Close()
+	r.Body = io.NopCloser(bytes.NewReader(body))
+	if err != nil {
+		return ""
+	}
+	var req struct {
+		Email string `json:"email"`
+	}
+	json.Unmarshal(body, &req)
+	return normalizeEmail(req.Email)
+}
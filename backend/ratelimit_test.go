@@ -0,0 +1,292 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/mux"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+func TestDecide(t *testing.T) {
+	rule := LimitRule{LimitByIP, 10, time.Minute} // a token every 6s
+	tests := []struct {
+		name       string
+		tokens     float64
+		want       RateDecision
+		wantTokens float64
+	}{
+		{"full bucket", 10, RateDecision{Allowed: true, Remaining: 9, Reset: 6 * time.Second}, 9},
+		{"last token", 1, RateDecision{Allowed: true, Remaining: 0, Reset: time.Minute}, 0},
+		{"partial token left over", 2.5, RateDecision{Allowed: true, Remaining: 1, Reset: 51 * time.Second}, 1.5},
+		{"half a token", 0.5, RateDecision{Allowed: false, Remaining: 0, Reset: 57 * time.Second, RetryAfter: 3 * time.Second}, 0.5},
+		{"empty", 0, RateDecision{Allowed: false, Remaining: 0, Reset: time.Minute, RetryAfter: 6 * time.Second}, 0},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			d, tokens := decide(tt.tokens, rule)
+			if d != tt.want || tokens != tt.wantTokens {
+				t.Fatalf("decide(%v) = %+v, %v; want %+v, %v", tt.tokens, d, tokens, tt.want, tt.wantTokens)
+			}
+		})
+	}
+}
+
+func TestRefill(t *testing.T) {
+	rule := LimitRule{LimitByIP, 10, time.Minute}
+	tests := []struct {
+		tokens  float64
+		elapsed time.Duration
+		want    float64
+	}{
+		{0, 0, 0},
+		{0, 30 * time.Second, 5},
+		{2, 6 * time.Second, 3},
+		{9.5, 6 * time.Second, 10}, // capped at the limit
+		{0, 2 * time.Hour, 10},
+	}
+	for _, tt := range tests {
+		if got := refill(tt.tokens, tt.elapsed, rule); got != tt.want {
+			t.Errorf("refill(%v, %s) = %v, want %v", tt.tokens, tt.elapsed, got, tt.want)
+		}
+	}
+}
+
+func TestParseRateLimits(t *testing.T) {
+	defaults := func() map[string][]LimitRule {
+		return map[string][]LimitRule{
+			"login":    {{LimitByIP, 20, time.Minute}, {LimitByEmail, 10, 15 * time.Minute}},
+			"generate": {{LimitByUser, 30, time.Hour}},
+		}
+	}
+	tests := []struct {
+		name    string
+		spec    string
+		want    map[string][]LimitRule
+		wantErr string
+	}{
+		{name: "empty keeps the defaults", spec: "", want: defaults()},
+		{
+			name: "a rule replaces all defaults of its route",
+			spec: "login:ip=5/30s",
+			want: map[string][]LimitRule{"login": {{LimitByIP, 5, 30 * time.Second}}, "generate": {{LimitByUser, 30, time.Hour}}},
+		},
+		{
+			name: "several rules and routes",
+			spec: " login:ip=5/1m , login:email=3/1h,transcribe:user=2/24h",
+			want: map[string][]LimitRule{
+				"login":      {{LimitByIP, 5, time.Minute}, {LimitByEmail, 3, time.Hour}},
+				"generate":   {{LimitByUser, 30, time.Hour}},
+				"transcribe": {{LimitByUser, 2, 24 * time.Hour}},
+			},
+		},
+		{
+			name: "limit 0 disables the route",
+			spec: "generate:user=0/1h",
+			want: map[string][]LimitRule{"login": defaults()["login"], "generate": nil},
+		},
+		{name: "missing route", spec: "ip=5/1m", wantErr: "expected route:by=limit/window"},
+		{name: "missing window", spec: "login:ip=5", wantErr: "expected route:by=limit/window"},
+		{name: "unknown key", spec: "login:device=5/1m", wantErr: "key must be ip, user or email"},
+		{name: "negative limit", spec: "login:ip=-1/1m", wantErr: "bad limit"},
+		{name: "bad window", spec: "login:ip=5/soon", wantErr: "bad window"},
+		{name: "zero window", spec: "login:ip=5/0s", wantErr: "bad window"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			limits := defaults()
+			err := parseRateLimits(tt.spec, limits)
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Fatalf("error = %v, want it to contain %q", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(limits, tt.want) {
+				t.Fatalf("limits = %v, want %v", limits, tt.want)
+			}
+		})
+	}
+}
+
+func TestLimitRulePolicy(t *testing.T) {
+	if got := (LimitRule{LimitByIP, 10, 15 * time.Minute}).policy(); got != "10;w=900" {
+		t.Fatalf("policy = %q, want 10;w=900", got)
+	}
+}
+
+func TestMemoryRateLimiter(t *testing.T) {
+	ctx := context.Background()
+	m := NewMemoryRateLimiter()
+	rule := LimitRule{LimitByIP, 3, time.Hour}
+	for i, want := range []int{2, 1, 0} {
+		d, err := m.Take(ctx, "a", rule)
+		if err != nil || !d.Allowed || d.Remaining != want {
+			t.Fatalf("take %d = %+v, %v; want allowed with %d left", i+1, d, err, want)
+		}
+	}
+	d, _ := m.Take(ctx, "a", rule)
+	if d.Allowed || d.RetryAfter <= 19*time.Minute || d.RetryAfter > 20*time.Minute {
+		t.Fatalf("take over the limit = %+v, want a refusal for about 20m", d)
+	}
+	if d, _ := m.Take(ctx, "b", rule); !d.Allowed || d.Remaining != 2 {
+		t.Fatalf("other key = %+v, want its own bucket", d)
+	}
+
+	// A token comes back every 50ms
+	fast := LimitRule{LimitByIP, 2, 100 * time.Millisecond}
+	m.Take(ctx, "c", fast)
+	m.Take(ctx, "c", fast)
+	if d, _ := m.Take(ctx, "c", fast); d.Allowed {
+		t.Fatalf("empty bucket = %+v, want a refusal", d)
+	}
+	time.Sleep(60 * time.Millisecond)
+	if d, _ := m.Take(ctx, "c", fast); !d.Allowed {
+		t.Fatalf("after refill = %+v, want allowed", d)
+	}
+}
+
+// failingRateLimiter stands in for an unreachable backend
+type failingRateLimiter struct{}
+
+func (failingRateLimiter) Name() string { return "failing" }
+func (failingRateLimiter) Take(context.Context, string, LimitRule) (RateDecision, error) {
+	return RateDecision{}, errors.New("connection refused")
+}
+
+// useTestRateLimits swaps in limits and a fresh limiter and returns a router with a
+// named "login" route (echoing the body it receives), a "generate" route and an
+// unnamed "/health" route behind rateLimitMiddleware
+func useTestRateLimits(t *testing.T, limits map[string][]LimitRule, limiter RateLimiter) *mux.Router {
+	t.Helper()
+	prevLimits, prevLimiter := routeLimits, rateLimiter
+	routeLimits, rateLimiter = limits, limiter
+	t.Cleanup(func() { routeLimits, rateLimiter = prevLimits, prevLimiter })
+
+	echo := func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		w.Write(body)
+	}
+	r := mux.NewRouter()
+	r.Use(rateLimitMiddleware)
+	r.HandleFunc("/api/login", echo).Methods("POST").Name("login")
+	r.HandleFunc("/api/generate", echo).Methods("POST").Name("generate")
+	r.HandleFunc("/health", echo)
+	return r
+}
+
+func rateLimitedRequest(router http.Handler, path, ip, body string) *httptest.ResponseRecorder {
+	r := httptest.NewRequest(http.MethodPost, path, strings.NewReader(body))
+	r.RemoteAddr = ip + ":1234"
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, r)
+	return w
+}
+
+func TestRateLimitMiddleware(t *testing.T) {
+	router := useTestRateLimits(t, map[string][]LimitRule{
+		"login": {{LimitByIP, 2, time.Minute}, {LimitByEmail, 10, time.Hour}},
+	}, NewMemoryRateLimiter())
+	body := `{"email":"ada@example.com"}`
+
+	w := rateLimitedRequest(router, "/api/login", "192.0.2.1", body)
+	if w.Code != http.StatusOK || w.Body.String() != body {
+		t.Fatalf("first = %d %q, want the body passed on", w.Code, w.Body)
+	}
+	want := map[string]string{"RateLimit-Limit": "2", "RateLimit-Remaining": "1", "RateLimit-Reset": "30", "RateLimit-Policy": "2;w=60"}
+	for h, v := range want {
+		if got := w.Header().Get(h); got != v {
+			t.Errorf("%s = %q, want %q", h, got, v)
+		}
+	}
+
+	if w := rateLimitedRequest(router, "/api/login", "192.0.2.1", body); w.Code != http.StatusOK || w.Header().Get("RateLimit-Remaining") != "0" {
+		t.Fatalf("second = %d, remaining %q", w.Code, w.Header().Get("RateLimit-Remaining"))
+	}
+	w = rateLimitedRequest(router, "/api/login", "192.0.2.1", body)
+	if w.Code != http.StatusTooManyRequests {
+		t.Fatalf("third = %d, want 429", w.Code)
+	}
+	if w.Header().Get("Retry-After") != "30" || w.Header().Get("RateLimit-Remaining") != "0" || w.Header().Get("RateLimit-Limit") != "2" {
+		t.Fatalf("429 headers = %v", w.Header())
+	}
+	var resp map[string]interface{}
+	if json.Unmarshal(w.Body.Bytes(), &resp); resp["success"] != false || resp["message"] == nil {
+		t.Fatalf("429 body = %s", w.Body)
+	}
+
+	// Another address has its own bucket; the email bucket is shared but not yet empty
+	if w := rateLimitedRequest(router, "/api/login", "198.51.100.7", body); w.Code != http.StatusOK {
+		t.Fatalf("other address = %d, want 200", w.Code)
+	}
+	// Routes without limits are left alone
+	if w := rateLimitedRequest(router, "/health", "192.0.2.1", ""); w.Code != http.StatusOK || w.Header().Get("RateLimit-Limit") != "" {
+		t.Fatalf("unlimited route = %d %v", w.Code, w.Header())
+	}
+}
+
+func TestRateLimitMiddlewareReportsTightestRule(t *testing.T) {
+	router := useTestRateLimits(t, map[string][]LimitRule{
+		"login": {{LimitByIP, 20, time.Minute}, {LimitByEmail, 2, time.Hour}},
+	}, NewMemoryRateLimiter())
+
+	// The email limit is the one about to run out, whichever address the guesses come from
+	for i, ip := range []string{"192.0.2.1", "192.0.2.2"} {
+		w := rateLimitedRequest(router, "/api/login", ip, `{"email":"Ada@Example.com"}`)
+		if w.Code != http.StatusOK || w.Header().Get("RateLimit-Policy") != "2;w=3600" {
+			t.Fatalf("request %d = %d, policy %q", i+1, w.Code, w.Header().Get("RateLimit-Policy"))
+		}
+	}
+	w := rateLimitedRequest(router, "/api/login", "192.0.2.3", `{"email":"ada@example.com"}`)
+	if w.Code != http.StatusTooManyRequests || w.Header().Get("Retry-After") != "1800" {
+		t.Fatalf("third email attempt = %d, Retry-After %q", w.Code, w.Header().Get("Retry-After"))
+	}
+	// Without an email only the address is limited
+	if w := rateLimitedRequest(router, "/api/login", "192.0.2.3", `{}`); w.Code != http.StatusOK || w.Header().Get("RateLimit-Policy") != "20;w=60" {
+		t.Fatalf("no email = %d, policy %q", w.Code, w.Header().Get("RateLimit-Policy"))
+	}
+}
+
+func TestRateLimitMiddlewareByUser(t *testing.T) {
+	router := useTestRateLimits(t, map[string][]LimitRule{
+		"generate": {{LimitByUser, 1, time.Hour}},
+	}, NewMemoryRateLimiter())
+	generate := func(userID primitive.ObjectID) int {
+		r := withAuth(httptest.NewRequest(http.MethodPost, "/api/generate", nil), userID)
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, r)
+		return w.Code
+	}
+	ada, bob := primitive.NewObjectID(), primitive.NewObjectID()
+	if code := generate(ada); code != http.StatusOK {
+		t.Fatalf("first = %d", code)
+	}
+	if code := generate(ada); code != http.StatusTooManyRequests {
+		t.Fatalf("second = %d, want 429", code)
+	}
+	if code := generate(bob); code != http.StatusOK {
+		t.Fatalf("other user = %d, want their own bucket", code)
+	}
+}
+
+func TestRateLimitMiddlewareFailsOpen(t *testing.T) {
+	router := useTestRateLimits(t, map[string][]LimitRule{
+		"login": {{LimitByIP, 1, time.Minute}},
+	}, failingRateLimiter{})
+	for i := 0; i < 3; i++ {
+		if w := rateLimitedRequest(router, "/api/login", "192.0.2.1", `{}`); w.Code != http.StatusOK || w.Header().Get("RateLimit-Limit") != "" {
+			t.Fatalf("request %d with the backend down = %d %v, want it let through", i+1, w.Code, w.Header())
+		}
+	}
+}
@@ -0,0 +1,115 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"math/rand"
+	"net"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// HTTPStatusError is returned by API clients for non-2xx responses
+type HTTPStatusError struct {
+	StatusCode int
+	Status     string
+	Body       string
+	RetryAfter time.Duration // parsed Retry-After header, 0 if absent
+}
+
+func (e *HTTPStatusError) Error() string {
+	return fmt.Sprintf("%s - %s", e.Status, e.Body)
+}
+
+// newHTTPStatusError builds an HTTPStatusError from the response and its body
+func newHTTPStatusError(resp *http.Response, body []byte) *HTTPStatusError {
+	return &HTTPStatusError{
+		StatusCode: resp.StatusCode,
+		Status:     resp.Status,
+		Body:       string(body),
+		RetryAfter: parseRetryAfter(resp.Header.Get("Retry-After")),
+	}
+}
+
+// parseRetryAfter accepts both delay-seconds and HTTP-date forms
+func parseRetryAfter(v string) time.Duration {
+	if v == "" {
+		return 0
+	}
+	if secs, err := strconv.Atoi(v); err == nil && secs >= 0 {
+		return time.Duration(secs) * time.Second
+	}
+	if t, err := http.ParseTime(v); err == nil {
+		if d := time.Until(t); d > 0 {
+			return d
+		}
+	}
+	return 0
+}
+
+// RetryPolicy retries transient failures with exponential backoff and full jitter
+type RetryPolicy struct {
+	MaxAttempts int
+	BaseDelay   time.Duration
+	MaxDelay    time.Duration
+}
+
+// isRetryable reports whether err is transient: 429/5xx responses or network timeouts.
+// The second value is the server-requested delay, if any.
+func isRetryable(err error) (bool, time.Duration) {
+	var statusErr *HTTPStatusError
+	if errors.As(err, &statusErr) {
+		if statusErr.StatusCode == http.StatusTooManyRequests || statusErr.StatusCode >= 500 {
+			return true, statusErr.RetryAfter
+		}
+		return false, 0
+	}
+	var netErr net.Error
+	if errors.As(err, &netErr) && netErr.Timeout() {
+		return true, 0
+	}
+	return false, 0
+}
+
+// delay returns how long to wait before the next attempt (attempt starts at 1)
+func (p RetryPolicy) delay(attempt int, retryAfter time.Duration) time.Duration {
+	backoff := p.BaseDelay << (attempt - 1)
+	if backoff <= 0 || backoff > p.MaxDelay {
+		backoff = p.MaxDelay
+	}
+	d := time.Duration(rand.Int63n(int64(backoff) + 1))
+	// Never retry earlier than the server asked us to
+	if retryAfter > d {
+		d = retryAfter
+	}
+	return d
+}
+
+// Do runs fn until it succeeds, returns a non-retryable error or attempts run out
+func (p RetryPolicy) Do(ctx context.Context, label string, fn func() error) error {
+	attempts := p.MaxAttempts
+	if attempts < 1 {
+		attempts = 1
+	}
+	var err error
+	for attempt := 1; attempt <= attempts; attempt++ {
+		if err = fn(); err == nil {
+			return nil
+		}
+		retry, retryAfter := isRetryable(err)
+		if !retry || attempt == attempts {
+			return err
+		}
+		d := p.delay(attempt, retryAfter)
+		log.Printf("[retry] %s attempt %d/%d failed: %v; retrying in %s", label, attempt, attempts, err, d)
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(d):
+		}
+	}
+	return err
+}
@@ -0,0 +1,82 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"testing"
+	"time"
+)
+
+func TestParseRetryAfter(t *testing.T) {
+	if got := parseRetryAfter("7"); got != 7*time.Second {
+		t.Errorf("delay-seconds = %s", got)
+	}
+	if got := parseRetryAfter(time.Now().Add(time.Minute).UTC().Format(http.TimeFormat)); got < 58*time.Second || got > time.Minute {
+		t.Errorf("HTTP-date = %s, want about a minute", got)
+	}
+	for _, v := range []string{"", "-1", "soon", time.Now().Add(-time.Minute).UTC().Format(http.TimeFormat)} {
+		if got := parseRetryAfter(v); got != 0 {
+			t.Errorf("parseRetryAfter(%q) = %s, want 0", v, got)
+		}
+	}
+}
+
+func TestIsRetryable(t *testing.T) {
+	tests := []struct {
+		name      string
+		err       error
+		retry     bool
+		wantAfter time.Duration
+	}{
+		{"429 with Retry-After", &HTTPStatusError{StatusCode: 429, RetryAfter: 3 * time.Second}, true, 3 * time.Second},
+		{"500", &HTTPStatusError{StatusCode: 500}, true, 0},
+		{"wrapped 503", fmt.Errorf("chunk transcribe error: %w", &HTTPStatusError{StatusCode: 503}), true, 0},
+		{"400", &HTTPStatusError{StatusCode: 400}, false, 0},
+		{"401", &HTTPStatusError{StatusCode: 401}, false, 0},
+		{"timeout", os.ErrDeadlineExceeded, true, 0},
+		{"other", errors.New("boom"), false, 0},
+	}
+	for _, tt := range tests {
+		retry, after := isRetryable(tt.err)
+		if retry != tt.retry || after != tt.wantAfter {
+			t.Errorf("%s: isRetryable = %v, %s; want %v, %s", tt.name, retry, after, tt.retry, tt.wantAfter)
+		}
+	}
+}
+
+func TestRetryPolicyDelay(t *testing.T) {
+	p := RetryPolicy{BaseDelay: 100 * time.Millisecond, MaxDelay: time.Second}
+	for attempt, ceiling := range map[int]time.Duration{
+		1:  100 * time.Millisecond,
+		2:  200 * time.Millisecond,
+		4:  800 * time.Millisecond,
+		5:  time.Second, // capped
+		70: time.Second, // the shift overflows
+	} {
+		for i := 0; i < 50; i++ {
+			if d := p.delay(attempt, 0); d < 0 || d > ceiling {
+				t.Fatalf("delay(%d) = %s, want within [0, %s]", attempt, d, ceiling)
+			}
+		}
+	}
+	if d := p.delay(1, 5*time.Second); d != 5*time.Second {
+		t.Fatalf("delay with Retry-After = %s, want 5s", d)
+	}
+}
+
+func TestRetryPolicyDoStopsOnCancel(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	calls := 0
+	p := RetryPolicy{MaxAttempts: 5, BaseDelay: time.Hour, MaxDelay: time.Hour}
+	err := p.Do(ctx, "test", func() error {
+		calls++
+		cancel()
+		return &HTTPStatusError{StatusCode: 503, RetryAfter: time.Hour}
+	})
+	if !errors.Is(err, context.Canceled) || calls != 1 {
+		t.Fatalf("err = %v after %d calls, want context.Canceled after 1", err, calls)
+	}
+}
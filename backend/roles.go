@@ -0,0 +1,84 @@
+package main
+
+import (
+	"context"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// Roles, carried in the access JWT (claim "role")
+const (
+	RoleUser    = "user"
+	RoleTeacher = "teacher"
+	RoleAdmin   = "admin"
+)
+
+var validRoles = []string{RoleUser, RoleTeacher, RoleAdmin}
+
+// normalizeRole maps unknown and empty roles (accounts created before roles) to RoleUser
+func normalizeRole(role string) string {
+	if containsString(validRoles, role) {
+		return role
+	}
+	return RoleUser
+}
+
+// requireRole wraps requireAuth and allows only the given roles. Support sessions
+// (impersonation) never pass, whatever the impersonated user's role is.
+func requireRole(roles ...string) func(http.HandlerFunc) http.HandlerFunc {
+	return func(next http.HandlerFunc) http.HandlerFunc {
+		return requireAuth(func(w http.ResponseWriter, r *http.Request) {
+			auth := authFromContext(r)
+			if auth.ImpersonatorID != nil || !containsString(roles, auth.Role) {
+				JSONError(w, http.StatusForbidden, "Insufficient permissions")
+				return
+			}
+			next(w, r)
+		})
+	}
+}
+
+// noImpersonation keeps support sessions away from account security settings
+// (2FA, linked accounts, devices, payments); wraps requireAuth routes
+func noImpersonation(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if auth := authFromContext(r); auth != nil && auth.ImpersonatorID != nil {
+			JSONError(w, http.StatusForbidden, "Not available while impersonating a user")
+			return
+		}
+		next(w, r)
+	}
+}
+
+// bootstrapAdmins grants RoleAdmin to the accounts listed in ADMIN_EMAILS
+// (comma-separated), so the first admin does not need database access
+func bootstrapAdmins() {
+	var emails []string
+	for _, e := range strings.Split(getEnvOrFile("ADMIN_EMAILS"), ",") {
+		if e = normalizeEmail(e); e != "" {
+			emails = append(emails, e)
+		}
+	}
+	if len(emails) == 0 {
+		return
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	res, err := database.Collection("users").UpdateMany(ctx,
+		bson.M{"email": bson.M{"$in": emails}, "role": bson.M{"$ne": RoleAdmin}},
+		bson.M{"$set": bson.M{"role": RoleAdmin}},
+		options.Update().SetCollation(emailCollation),
+	)
+	if err != nil {
+		log.Printf("[roles] failed to grant admin from ADMIN_EMAILS: %v", err)
+		return
+	}
+	if res.ModifiedCount > 0 {
+		log.Printf("[roles] granted admin to %d accounts from ADMIN_EMAILS", res.ModifiedCount)
+	}
+}
@@ -0,0 +1,110 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/gorilla/mux"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+func TestRequireRoleAndImpersonation(t *testing.T) {
+	ok := func(w http.ResponseWriter, r *http.Request) { JSONSuccess(w, nil) }
+	adminOnly := requireRole(RoleAdmin)(ok)
+	teachers := requireRole(RoleTeacher, RoleAdmin)(ok)
+	security := requireAuth(noImpersonation(ok))
+	support := primitive.NewObjectID()
+
+	tests := []struct {
+		name         string
+		role         string
+		impersonator *primitive.ObjectID
+		handler      http.HandlerFunc
+		want         int
+	}{
+		{"admin on the admin API", RoleAdmin, nil, adminOnly, http.StatusOK},
+		{"teacher on the admin API", RoleTeacher, nil, adminOnly, http.StatusForbidden},
+		{"user on the admin API", RoleUser, nil, adminOnly, http.StatusForbidden},
+		{"unknown role counts as user", "owner", nil, teachers, http.StatusForbidden},
+		{"teacher on a teacher route", RoleTeacher, nil, teachers, http.StatusOK},
+		{"admin on a teacher route", RoleAdmin, nil, teachers, http.StatusOK},
+		{"impersonated admin on the admin API", RoleAdmin, &support, adminOnly, http.StatusForbidden},
+		{"impersonated teacher on a teacher route", RoleTeacher, &support, teachers, http.StatusForbidden},
+		{"user on security settings", RoleUser, nil, security, http.StatusOK},
+		{"impersonated user on security settings", RoleUser, &support, security, http.StatusForbidden},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			auth := &AuthResult{UserID: primitive.NewObjectID(), Role: normalizeRole(tt.role), ImpersonatorID: tt.impersonator}
+			r := httptest.NewRequest(http.MethodGet, "/", nil)
+			r = r.WithContext(context.WithValue(r.Context(), authContextKey{}, auth))
+			w := httptest.NewRecorder()
+			tt.handler(w, r)
+			if w.Code != tt.want {
+				t.Fatalf("status = %d %s, want %d", w.Code, w.Body, tt.want)
+			}
+		})
+	}
+}
+
+func TestImpersonationTokenIsDeniedPrivilegedRoutes(t *testing.T) {
+	useTestDatabase(t)
+	ctx := t.Context()
+	adminID, teacherID := primitive.NewObjectID(), primitive.NewObjectID()
+	for _, u := range []User{
+		{ID: adminID.Hex(), Email: "admin@example.com", EmailVerified: true, Role: RoleAdmin},
+		{ID: teacherID.Hex(), Email: "teacher@example.com", EmailVerified: true, Role: RoleTeacher},
+	} {
+		if _, err := database.Collection("users").InsertOne(ctx, u); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	r := httptest.NewRequest(http.MethodPost, "/api/admin/users/"+teacherID.Hex()+"/impersonate", strings.NewReader(`{"reason":"ticket 42"}`))
+	r = r.WithContext(context.WithValue(r.Context(), authContextKey{}, &AuthResult{UserID: adminID, Role: RoleAdmin}))
+	r = mux.SetURLVars(r, map[string]string{"id": teacherID.Hex()})
+	w := httptest.NewRecorder()
+	handleAdminImpersonate(w, r)
+	if w.Code != http.StatusOK {
+		t.Fatalf("impersonate = %d %s", w.Code, w.Body)
+	}
+	var resp struct {
+		Data struct {
+			Token string `json:"token"`
+		} `json:"data"`
+	}
+	json.Unmarshal(w.Body.Bytes(), &resp)
+
+	var seen *AuthResult
+	ok := func(w http.ResponseWriter, r *http.Request) {
+		seen = authFromContext(r)
+		JSONSuccess(w, nil)
+	}
+	router := mux.NewRouter()
+	router.HandleFunc("/api/admin/users", requireRole(RoleAdmin)(ok))
+	router.HandleFunc("/api/teacher/classes", requireRole(RoleTeacher, RoleAdmin)(ok))
+	router.HandleFunc("/api/user/password", requireAuth(noImpersonation(ok)))
+	router.HandleFunc("/api/notes", requireAuth(ok))
+
+	for path, want := range map[string]int{
+		"/api/admin/users":     http.StatusForbidden,
+		"/api/teacher/classes": http.StatusForbidden, // the teacher's own role does not apply
+		"/api/user/password":   http.StatusForbidden,
+		"/api/notes":           http.StatusOK,
+	} {
+		r := httptest.NewRequest(http.MethodGet, path, nil)
+		r.Header.Set("Authorization", "Bearer "+resp.Data.Token)
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, r)
+		if w.Code != want {
+			t.Errorf("%s = %d %s, want %d", path, w.Code, w.Body, want)
+		}
+	}
+	if seen == nil || seen.UserID != teacherID || seen.ImpersonatorID == nil || *seen.ImpersonatorID != adminID {
+		t.Fatalf("auth = %+v, want the teacher acting through the admin", seen)
+	}
+}
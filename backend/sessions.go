@@ -0,0 +1,415 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"log"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gorilla/mux"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// Token lifetimes, configurable via ACCESS_TOKEN_TTL_MINUTES and REFRESH_TOKEN_TTL_DAYS
+var (
+	accessTokenTTL  = 15 * time.Minute
+	refreshTokenTTL = 30 * 24 * time.Hour
+)
+
+var errSessionInvalid = errors.New("session is revoked or expired")
+
+// TokenPair is returned by login/signup and /api/auth/refresh
+type TokenPair struct {
+	AccessToken  string
+	RefreshToken string
+	ExpiresIn    int // access token lifetime in seconds
+}
+
+// tokenResponse adds the token pair to a login/signup JSON response
+func (t *TokenPair) tokenResponse(resp map[string]interface{}) map[string]interface{} {
+	resp["token"] = t.AccessToken
+	resp["refresh_token"] = t.RefreshToken
+	resp["expires_in"] = t.ExpiresIn
+	return resp
+}
+
+// hashToken returns the hex SHA-256 of a secret token; only hashes are stored
+func hashToken(secret string) string {
+	sum := sha256.Sum256([]byte(secret))
+	return hex.EncodeToString(sum[:])
+}
+
+// randomToken returns n random bytes encoded as URL-safe base64
+func randomToken(n int) (string, error) {
+	b := make([]byte, n)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(b), nil
+}
+
+// trustedProxyHops is the number of proxies in front of the server that append to
+// X-Forwarded-For (TRUSTED_PROXY_HOPS); with 0 the header is ignored
+var trustedProxyHops int
+
+// clientIP returns the caller address. X-Forwarded-For is honored only for the entries
+// appended by the trusted proxies: everything to the left of them, including the
+// left-most entry, is whatever the client sent, so rate limits keyed on it could be
+// dodged by rotating the header.
+func clientIP(r *http.Request) string {
+	if fwd := r.Header.Get("X-Forwarded-For"); fwd != "" && trustedProxyHops > 0 {
+		hops := strings.Split(fwd, ",")
+		if len(hops) >= trustedProxyHops {
+			if ip := strings.TrimSpace(hops[len(hops)-trustedProxyHops]); ip != "" {
+				return ip
+			}
+		}
+	}
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
+
+// startSession creates a device session for the user and issues its first token pair
+func startSession(r *http.Request, user *User) (*TokenPair, error) {
+	userID, err := primitive.ObjectIDFromHex(user.ID)
+	if err != nil {
+		return nil, err
+	}
+	secret, err := randomToken(32)
+	if err != nil {
+		return nil, err
+	}
+
+	now := time.Now()
+	s := Session{
+		ID:          primitive.NewObjectID(),
+		UserID:      userID,
+		RefreshHash: hashToken(secret),
+		UserAgent:   r.UserAgent(),
+		IP:          clientIP(r),
+		CreatedAt:   now,
+		LastUsedAt:  now,
+		ExpiresAt:   now.Add(refreshTokenTTL),
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if _, err := database.Collection("sessions").InsertOne(ctx, s); err != nil {
+		return nil, err
+	}
+	return issueTokens(user, s.ID, secret)
+}
+
+// issueTokens signs an access token for the session; the refresh token is "<session id>.<secret>"
+func issueTokens(user *User, sessionID primitive.ObjectID, secret string) (*TokenPair, error) {
+	access, err := generateJWT(user, sessionID.Hex())
+	if err != nil {
+		return nil, err
+	}
+	return &TokenPair{
+		AccessToken:  access,
+		RefreshToken: sessionID.Hex() + "." + secret,
+		ExpiresIn:    int(accessTokenTTL.Seconds()),
+	}, nil
+}
+
+// parseRefreshToken splits a refresh token into session ID and secret
+func parseRefreshToken(token string) (primitive.ObjectID, string, bool) {
+	sid, secret, ok := strings.Cut(token, ".")
+	if !ok || secret == "" {
+		return primitive.NilObjectID, "", false
+	}
+	id, err := primitive.ObjectIDFromHex(sid)
+	if err != nil {
+		return primitive.NilObjectID, "", false
+	}
+	return id, secret, true
+}
+
+// rotateRefreshToken exchanges a refresh token for a new pair. Presenting an already
+// rotated token means it leaked, so the whole session is revoked.
+func rotateRefreshToken(token string) (*TokenPair, error) {
+	sid, secret, ok := parseRefreshToken(token)
+	if !ok {
+		return nil, errSessionInvalid
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	coll := database.Collection("sessions")
+	var s Session
+	if err := coll.FindOne(ctx, bson.M{"_id": sid}).Decode(&s); err != nil {
+		return nil, errSessionInvalid
+	}
+	if s.RevokedAt != nil || time.Now().After(s.ExpiresAt) {
+		return nil, errSessionInvalid
+	}
+	hash := hashToken(secret)
+	if subtle.ConstantTimeCompare([]byte(hash), []byte(s.RefreshHash)) != 1 {
+		if s.PrevRefreshHash != "" && subtle.ConstantTimeCompare([]byte(hash), []byte(s.PrevRefreshHash)) == 1 {
+			log.Printf("[sessions] refresh token reuse detected, revoking session=%s user=%s", sid.Hex(), s.UserID.Hex())
+			revokeSessions(bson.M{"_id": sid}, "refresh_token_reuse")
+		}
+		return nil, errSessionInvalid
+	}
+
+	user, err := GetUserByID(s.UserID.Hex())
+	if err != nil {
+		// The account is gone, so is the session
+		revokeSessions(bson.M{"_id": sid}, "user_deleted")
+		return nil, errSessionInvalid
+	}
+	if accountBlocked(user) != "" {
+		revokeSessions(bson.M{"_id": sid}, "user_blocked")
+		return nil, errSessionInvalid
+	}
+
+	next, err := randomToken(32)
+	if err != nil {
+		return nil, err
+	}
+	// Compare-and-swap on the old hash so two concurrent refreshes cannot both win
+	res, err := coll.UpdateOne(ctx,
+		bson.M{"_id": sid, "refresh_hash": s.RefreshHash, "revoked_at": nil},
+		bson.M{"$set": bson.M{
+			"refresh_hash":      hashToken(next),
+			"prev_refresh_hash": s.RefreshHash,
+			"last_used_at":      time.Now(),
+			"expires_at":        time.Now().Add(refreshTokenTTL),
+		}},
+	)
+	if err != nil {
+		return nil, err
+	}
+	if res.ModifiedCount == 0 {
+		return nil, errSessionInvalid
+	}
+	return issueTokens(user, sid, next)
+}
+
+// revokeSessions marks matching sessions as revoked
+func revokeSessions(filter bson.M, reason string) (int64, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	filter["revoked_at"] = nil
+	ids, err := database.Collection("sessions").Distinct(ctx, "_id", filter)
+	if err != nil {
+		return 0, err
+	}
+	res, err := database.Collection("sessions").UpdateMany(ctx, filter, bson.M{"$set": bson.M{
+		"revoked_at":    time.Now(),
+		"revoke_reason": reason,
+	}})
+	if err != nil {
+		return 0, err
+	}
+	for _, id := range ids {
+		if oid, ok := id.(primitive.ObjectID); ok {
+			sessionCache.forget(oid)
+		}
+	}
+	return res.ModifiedCount, nil
+}
+
+// revokeUserSessions signs the user out everywhere
+func revokeUserSessions(userID primitive.ObjectID, reason string) (int64, error) {
+	return revokeSessions(bson.M{"user_id": userID}, reason)
+}
+
+// sessionCache remembers recently checked sessions so every API call does not hit Mongo.
+// Revocations on this instance take effect immediately, on other instances within sessionCacheTTL.
+var sessionCache = &activeSessionCache{entries: map[primitive.ObjectID]time.Time{}}
+
+const sessionCacheTTL = 30 * time.Second
+
+type activeSessionCache struct {
+	mu      sync.Mutex
+	entries map[primitive.ObjectID]time.Time // session -> checked at
+}
+
+func (c *activeSessionCache) fresh(id primitive.ObjectID) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	at, ok := c.entries[id]
+	return ok && time.Since(at) < sessionCacheTTL
+}
+
+func (c *activeSessionCache) remember(id primitive.ObjectID) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if len(c.entries) > 10000 {
+		c.entries = map[primitive.ObjectID]time.Time{}
+	}
+	c.entries[id] = time.Now()
+}
+
+func (c *activeSessionCache) forget(id primitive.ObjectID) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	delete(c.entries, id)
+}
+
+// sessionActive reports whether the session behind an access token is still valid
+func sessionActive(sid primitive.ObjectID, userID primitive.ObjectID) bool {
+	if sessionCache.fresh(sid) {
+		return true
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	n, err := database.Collection("sessions").CountDocuments(ctx, bson.M{
+		"_id":        sid,
+		"user_id":    userID,
+		"revoked_at": nil,
+		"expires_at": bson.M{"$gt": time.Now()},
+	})
+	if err != nil {
+		log.Printf("[sessions] lookup failed for session=%s: %v", sid.Hex(), err)
+		return false
+	}
+	if n == 0 {
+		return false
+	}
+	sessionCache.remember(sid)
+	return true
+}
+
+// handleAuthRefresh exchanges a refresh token for a new token pair
+func handleAuthRefresh(w http.ResponseWriter, r *http.Request) {
+	var body struct {
+		RefreshToken string `json:"refresh_token"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&body); err != nil || body.RefreshToken == "" {
+		JSONError(w, http.StatusBadRequest, "refresh_token is required")
+		return
+	}
+	tokens, err := rotateRefreshToken(body.RefreshToken)
+	if err != nil {
+		if errors.Is(err, errSessionInvalid) {
+			JSONError(w, http.StatusUnauthorized, "Session expired, please sign in again")
+			return
+		}
+		log.Printf("[sessions] refresh error: %v", err)
+		JSONError(w, http.StatusInternalServerError, "Failed to refresh session")
+		return
+	}
+	JSONResponse(w, http.StatusOK, tokens.tokenResponse(map[string]interface{}{"success": true}))
+}
+
+// handleAuthLogout revokes the current session, identified by the access token
+// or, when it has already expired, by the refresh token in the body
+func handleAuthLogout(w http.ResponseWriter, r *http.Request) {
+	var body struct {
+		RefreshToken string `json:"refresh_token"`
+	}
+	json.NewDecoder(r.Body).Decode(&body)
+
+	var sid primitive.ObjectID
+	if id, secret, ok := parseRefreshToken(body.RefreshToken); ok {
+		// Only the holder of the current refresh token may end the session this way
+		ctx, cancel := context.WithTimeout(r.Context(), 5*time.Second)
+		defer cancel()
+		n, err := database.Collection("sessions").CountDocuments(ctx, bson.M{"_id": id, "refresh_hash": hashToken(secret)})
+		if err == nil && n > 0 {
+			sid = id
+		}
+	}
+	if sid.IsZero() && r.Header.Get("Authorization") != "" {
+		auth := extractUserFromJWT(w, r)
+		if auth == nil {
+			return
+		}
+		sid = auth.SessionID
+	}
+	if sid.IsZero() {
+		JSONError(w, http.StatusUnauthorized, "No session to log out")
+		return
+	}
+	if _, err := revokeSessions(bson.M{"_id": sid}, "logout"); err != nil {
+		log.Printf("[sessions] logout error: %v", err)
+		JSONError(w, http.StatusInternalServerError, "Failed to log out")
+		return
+	}
+	JSONResponse(w, http.StatusOK, map[string]interface{}{"success": true, "message": "Logged out"})
+}
+
+// handleListSessions lists the user's signed-in devices
+func handleListSessions(w http.ResponseWriter, r *http.Request) {
+	auth := authFromContext(r)
+	ctx, cancel := context.WithTimeout(r.Context(), 5*time.Second)
+	defer cancel()
+
+	cursor, err := database.Collection("sessions").Find(ctx,
+		bson.M{"user_id": auth.UserID, "revoked_at": nil, "expires_at": bson.M{"$gt": time.Now()}},
+		options.Find().SetSort(bson.M{"last_used_at": -1}),
+	)
+	if err != nil {
+		JSONError(w, http.StatusInternalServerError, "Failed to load sessions")
+		return
+	}
+	defer cursor.Close(ctx)
+
+	var list []Session
+	if err := cursor.All(ctx, &list); err != nil {
+		JSONError(w, http.StatusInternalServerError, "Failed to load sessions")
+		return
+	}
+	out := make([]map[string]interface{}, 0, len(list))
+	for _, s := range list {
+		out = append(out, map[string]interface{}{
+			"id":           s.ID.Hex(),
+			"user_agent":   s.UserAgent,
+			"ip":           s.IP,
+			"created_at":   s.CreatedAt,
+			"last_used_at": s.LastUsedAt,
+			"expires_at":   s.ExpiresAt,
+			"current":      s.ID == auth.SessionID,
+		})
+	}
+	JSONResponse(w, http.StatusOK, map[string]interface{}{"success": true, "sessions": out})
+}
+
+// handleRevokeSession signs out one device
+func handleRevokeSession(w http.ResponseWriter, r *http.Request) {
+	auth := authFromContext(r)
+	id, err := primitive.ObjectIDFromHex(mux.Vars(r)["id"])
+	if err != nil {
+		JSONError(w, http.StatusBadRequest, "Invalid ID format")
+		return
+	}
+	n, err := revokeSessions(bson.M{"_id": id, "user_id": auth.UserID}, "revoked_by_user")
+	if err != nil {
+		JSONError(w, http.StatusInternalServerError, "Failed to revoke session")
+		return
+	}
+	if n == 0 {
+		JSONError(w, http.StatusNotFound, "Session not found")
+		return
+	}
+	JSONResponse(w, http.StatusOK, map[string]interface{}{"success": true, "message": "Session revoked"})
+}
+
+// handleRevokeOtherSessions signs out every device except the current one
+func handleRevokeOtherSessions(w http.ResponseWriter, r *http.Request) {
+	auth := authFromContext(r)
+	n, err := revokeSessions(bson.M{"user_id": auth.UserID, "_id": bson.M{"$ne": auth.SessionID}}, "revoked_by_user")
+	if err != nil {
+		JSONError(w, http.StatusInternalServerError, "Failed to revoke sessions")
+		return
+	}
+	JSONResponse(w, http.StatusOK, map[string]interface{}{"success": true, "revoked": n})
+}
@@ -0,0 +1,177 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+func TestClientIP(t *testing.T) {
+	defer func(prev int) { trustedProxyHops = prev }(trustedProxyHops)
+
+	tests := []struct {
+		name string
+		hops int
+		xff  string
+		want string
+	}{
+		{"no proxies, no header", 0, "", "10.0.0.9"},
+		{"no proxies ignores spoofed header", 0, "1.2.3.4", "10.0.0.9"},
+		{"one proxy", 1, "203.0.113.7", "203.0.113.7"},
+		{"one proxy ignores client-supplied entries", 1, "1.2.3.4, 5.6.7.8, 203.0.113.7", "203.0.113.7"},
+		{"two proxies", 2, "1.2.3.4, 203.0.113.7, 10.1.1.1", "203.0.113.7"},
+		{"shorter chain than configured", 2, "1.2.3.4", "10.0.0.9"},
+		{"empty trusted entry", 1, "1.2.3.4, ", "10.0.0.9"},
+		{"proxy configured, no header", 1, "", "10.0.0.9"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			trustedProxyHops = tt.hops
+			r := httptest.NewRequest("GET", "/api/login", nil)
+			r.RemoteAddr = "10.0.0.9:51234"
+			if tt.xff != "" {
+				r.Header.Set("X-Forwarded-For", tt.xff)
+			}
+			if got := clientIP(r); got != tt.want {
+				t.Fatalf("clientIP = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+// startTestSession creates a user and signs them in on one device
+func startTestSession(t *testing.T) (*User, *TokenPair) {
+	t.Helper()
+	id := primitive.NewObjectID().Hex()
+	user := &User{ID: id, Email: id + "@example.com", EmailVerified: true, Role: RoleUser}
+	if _, err := database.Collection("users").InsertOne(t.Context(), user); err != nil {
+		t.Fatal(err)
+	}
+	r := httptest.NewRequest(http.MethodPost, "/api/login", nil)
+	r.Header.Set("User-Agent", "test-device")
+	tokens, err := startSession(r, user)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return user, tokens
+}
+
+// accessAllowed reports whether requests with the access token get through
+func accessAllowed(token string) bool {
+	r := httptest.NewRequest(http.MethodGet, "/api/user/profile", nil)
+	r.Header.Set("Authorization", "Bearer "+token)
+	return extractUserFromJWT(httptest.NewRecorder(), r) != nil
+}
+
+func refresh(t *testing.T, refreshToken string) (int, map[string]interface{}) {
+	t.Helper()
+	return postJSON(t, handleAuthRefresh, "/api/auth/refresh", map[string]string{"refresh_token": refreshToken})
+}
+
+func TestRefreshTokenRotation(t *testing.T) {
+	useTestDatabase(t)
+	_, first := startTestSession(t)
+	sid, _, _ := parseRefreshToken(first.RefreshToken)
+
+	code, resp := refresh(t, first.RefreshToken)
+	if code != http.StatusOK {
+		t.Fatalf("refresh = %d %v", code, resp)
+	}
+	second, _ := resp["refresh_token"].(string)
+	if second == "" || second == first.RefreshToken || resp["token"] == "" {
+		t.Fatalf("refresh response = %v, want a new token pair", resp)
+	}
+	if id, _, _ := parseRefreshToken(second); id != sid {
+		t.Fatalf("rotated token belongs to session %s, want %s", id.Hex(), sid.Hex())
+	}
+	if !accessAllowed(resp["token"].(string)) {
+		t.Fatal("the new access token is rejected")
+	}
+
+	var s Session
+	if err := database.Collection("sessions").FindOne(t.Context(), bson.M{"_id": sid}).Decode(&s); err != nil {
+		t.Fatal(err)
+	}
+	_, secret, _ := parseRefreshToken(second)
+	if s.RefreshHash != hashToken(secret) || s.PrevRefreshHash == "" || s.RevokedAt != nil {
+		t.Fatalf("session = %+v, want the new hash stored and the old one kept for reuse detection", s)
+	}
+
+	// The rotated token keeps rotating; garbage and unknown sessions are plain 401s
+	if code, _ := refresh(t, second); code != http.StatusOK {
+		t.Fatalf("second refresh = %d", code)
+	}
+	for _, bad := range []string{"not-a-token", primitive.NewObjectID().Hex() + ".secret"} {
+		if code, _ := refresh(t, bad); code != http.StatusUnauthorized {
+			t.Fatalf("refresh with %q = %d, want 401", bad, code)
+		}
+	}
+}
+
+func TestRefreshTokenReuseRevokesSession(t *testing.T) {
+	useTestDatabase(t)
+	_, stolen := startTestSession(t)
+	sid, _, _ := parseRefreshToken(stolen.RefreshToken)
+
+	// The owner refreshes; later the thief presents the old token
+	_, resp := refresh(t, stolen.RefreshToken)
+	ownerRefresh, ownerAccess := resp["refresh_token"].(string), resp["token"].(string)
+	if code, _ := refresh(t, stolen.RefreshToken); code != http.StatusUnauthorized {
+		t.Fatalf("reused token = %d, want 401", code)
+	}
+
+	var s Session
+	database.Collection("sessions").FindOne(t.Context(), bson.M{"_id": sid}).Decode(&s)
+	if s.RevokedAt == nil || s.RevokeReason != "refresh_token_reuse" {
+		t.Fatalf("session = %+v, want it revoked for reuse", s)
+	}
+	// Every token of the session is dead, the owner's current ones included
+	if code, _ := refresh(t, ownerRefresh); code != http.StatusUnauthorized {
+		t.Fatalf("owner's refresh after reuse = %d, want 401", code)
+	}
+	if accessAllowed(ownerAccess) || accessAllowed(stolen.AccessToken) {
+		t.Fatal("access tokens of the revoked session still work")
+	}
+}
+
+func TestSessionCacheInvalidation(t *testing.T) {
+	useTestDatabase(t)
+	user, tokens := startTestSession(t)
+	userID, _ := primitive.ObjectIDFromHex(user.ID)
+	sid, _, _ := parseRefreshToken(tokens.RefreshToken)
+	t.Cleanup(func() { sessionCache.forget(sid) })
+
+	if !accessAllowed(tokens.AccessToken) || !sessionCache.fresh(sid) {
+		t.Fatal("an active session is not cached after the first check")
+	}
+
+	// Revoked on another instance: this one trusts its cache for up to sessionCacheTTL
+	database.Collection("sessions").UpdateOne(t.Context(), bson.M{"_id": sid}, bson.M{"$set": bson.M{"revoked_at": time.Now()}})
+	if !sessionActive(sid, userID) {
+		t.Fatal("the cached session was looked up again within the TTL")
+	}
+	sessionCache.mu.Lock()
+	sessionCache.entries[sid] = time.Now().Add(-sessionCacheTTL)
+	sessionCache.mu.Unlock()
+	if sessionActive(sid, userID) || sessionCache.fresh(sid) {
+		t.Fatal("a revoked session is still active once the cache entry is stale")
+	}
+
+	// Revoked on this instance: the cache entry goes at once
+	_, other := startTestSession(t)
+	otherID, _, _ := parseRefreshToken(other.RefreshToken)
+	t.Cleanup(func() { sessionCache.forget(otherID) })
+	if !accessAllowed(other.AccessToken) || !sessionCache.fresh(otherID) {
+		t.Fatal("the second session is not cached")
+	}
+	if _, err := revokeSessions(bson.M{"_id": otherID}, "logout"); err != nil {
+		t.Fatal(err)
+	}
+	if sessionCache.fresh(otherID) || accessAllowed(other.AccessToken) {
+		t.Fatal("revocation did not reach the session cache")
+	}
+}
@@ -0,0 +1,307 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"math"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// Plan is a paid plan shown on the pricing page
+type Plan struct {
+	ID              string  `json:"id"`
+	Name            string  `json:"name"`
+	Description     string  `json:"description"`
+	Price           float64 `json:"price"`
+	Currency        string  `json:"currency"`
+	Interval        string  `json:"interval"` // month|year
+	ProviderPriceID string  `json:"provider_price_id,omitempty"`
+	// Entitlements override the built-in entitlementTable row of this plan
+	Entitlements *Entitlements `json:"entitlements,omitempty"`
+}
+
+// period returns the subscription length granted by one payment
+func (p Plan) period(from time.Time) time.Time {
+	if p.Interval == "year" {
+		return from.AddDate(1, 0, 0)
+	}
+	return from.AddDate(0, 1, 0)
+}
+
+// defaultPlans are used when SUBSCRIPTION_PLANS_FILE is not set
+var defaultPlans = []Plan{
+	{ID: "basic", Name: "Basic", Description: "Для знакомства с сервисом", Price: 9.99, Currency: "USD", Interval: "month"},
+	{ID: "premium", Name: "Premium", Description: "Всё без ограничений и YouTube транскрипция", Price: 19.99, Currency: "USD", Interval: "month"},
+}
+
+// plans is the plan catalog loaded at startup
+var plans = defaultPlans
+
+// loadPlansFromEnv reads the plan catalog from SUBSCRIPTION_PLANS_FILE (JSON array of plans).
+// The built-in plans take their provider price from LEMON_SQUEEZY_<ID>_VARIANT_ID.
+func loadPlansFromEnv() ([]Plan, error) {
+	path := getEnvOrFile("SUBSCRIPTION_PLANS_FILE")
+	if path == "" {
+		list := make([]Plan, len(defaultPlans))
+		for i, p := range defaultPlans {
+			p.ProviderPriceID = getEnvOrFile("LEMON_SQUEEZY_" + strings.ToUpper(p.ID) + "_VARIANT_ID")
+			list[i] = p
+		}
+		return list, nil
+	}
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("reading SUBSCRIPTION_PLANS_FILE: %w", err)
+	}
+	var list []Plan
+	if err := json.Unmarshal(b, &list); err != nil {
+		return nil, fmt.Errorf("parsing SUBSCRIPTION_PLANS_FILE: %w", err)
+	}
+	seen := map[string]bool{}
+	for i, p := range list {
+		if p.ID == "" || seen[p.ID] {
+			return nil, fmt.Errorf("plan %d: id is empty or duplicated", i)
+		}
+		if p.Interval != "month" && p.Interval != "year" {
+			return nil, fmt.Errorf("plan %q: interval must be month or year", p.ID)
+		}
+		seen[p.ID] = true
+	}
+	return list, nil
+}
+
+// planByPriceID returns the plan mapped to the provider's price/variant ID
+func planByPriceID(priceID string) (Plan, bool) {
+	for _, p := range plans {
+		if priceID != "" && p.ProviderPriceID == priceID {
+			return p, true
+		}
+	}
+	return Plan{}, false
+}
+
+// findPlan returns the plan with the given ID
+func findPlan(id string) (Plan, bool) {
+	for _, p := range plans {
+		if p.ID == id {
+			return p, true
+		}
+	}
+	return Plan{}, false
+}
+
+// GetActiveSubscription returns the user's current paid subscription, or nil
+func GetActiveSubscription(userID primitive.ObjectID) (*Subscription, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	var sub Subscription
+	err := database.Collection("subscriptions").FindOne(ctx,
+		bson.M{
+			"user_id": userID,
+			// Canceled subscriptions keep access until the paid period ends
+			"status":             bson.M{"$in": []string{SubscriptionActive, SubscriptionCanceled}},
+			"current_period_end": bson.M{"$gt": time.Now()},
+		},
+		options.FindOne().SetSort(bson.M{"current_period_end": -1}),
+	).Decode(&sub)
+	if errors.Is(err, mongo.ErrNoDocuments) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &sub, nil
+}
+
+// activateSubscription marks the user's pending subscription with the given provider
+// reference as paid for one plan interval and retires the user's other active
+// subscriptions (plan change). A checkout activates only once: afterwards the
+// subscription is no longer pending and mongo.ErrNoDocuments is returned.
+func activateSubscription(userID primitive.ObjectID, providerRef string) (*Subscription, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	coll := database.Collection("subscriptions")
+	filter := bson.M{"provider_ref": providerRef, "user_id": userID, "status": SubscriptionPending}
+	var sub Subscription
+	if err := coll.FindOne(ctx, filter).Decode(&sub); err != nil {
+		return nil, err
+	}
+	now := time.Now()
+	plan, _ := findPlan(sub.PlanID)
+	sub.Status = SubscriptionActive
+	sub.CurrentPeriodEnd = plan.period(now)
+	sub.UpdatedAt = now
+	res, err := coll.UpdateOne(ctx, filter, bson.M{"$set": bson.M{
+		"status":             sub.Status,
+		"current_period_end": sub.CurrentPeriodEnd,
+		"updated_at":         now,
+	}})
+	if err != nil {
+		return nil, err
+	}
+	if res.ModifiedCount == 0 {
+		// A concurrent request completed this checkout first
+		return nil, mongo.ErrNoDocuments
+	}
+	retireOtherSubscriptions(ctx, &sub)
+	return &sub, nil
+}
+
+// retireOtherSubscriptions marks the user's other paid subscriptions as replaced by sub
+func retireOtherSubscriptions(ctx context.Context, sub *Subscription) {
+	if _, err := database.Collection("subscriptions").UpdateMany(ctx,
+		bson.M{
+			"user_id": sub.UserID,
+			"status":  bson.M{"$in": []string{SubscriptionActive, SubscriptionCanceled}},
+			"_id":     bson.M{"$ne": sub.ID},
+		},
+		bson.M{"$set": bson.M{"status": SubscriptionReplaced, "updated_at": time.Now()}},
+	); err != nil {
+		log.Printf("[subscriptions] failed to retire old subscriptions of user=%s: %v", sub.UserID.Hex(), err)
+	}
+}
+
+// SubscriptionStatus is the contract of GET /api/subscription/status
+type SubscriptionStatus struct {
+	IsActive         bool         `json:"is_active"`
+	Plan             string       `json:"plan,omitempty"`
+	Status           string       `json:"status,omitempty"`
+	DaysLeft         int          `json:"days_left"`
+	CurrentPeriodEnd *time.Time   `json:"current_period_end,omitempty"`
+	Entitlements     Entitlements `json:"entitlements"`
+}
+
+// subscriptionStatus summarizes the user's active subscription
+func subscriptionStatus(sub *Subscription) SubscriptionStatus {
+	if sub == nil {
+		return SubscriptionStatus{Entitlements: entitlementsFor(FreePlanID)}
+	}
+	end := sub.CurrentPeriodEnd
+	return SubscriptionStatus{
+		IsActive:         true,
+		Plan:             sub.PlanID,
+		Status:           sub.Status,
+		DaysLeft:         int(math.Ceil(time.Until(end).Hours() / 24)),
+		CurrentPeriodEnd: &end,
+		Entitlements:     entitlementsFor(sub.PlanID),
+	}
+}
+
+// handleSubscriptionPlans lists the plan catalog
+func handleSubscriptionPlans(w http.ResponseWriter, r *http.Request) {
+	JSONSuccess(w, map[string]interface{}{"plans": plans})
+}
+
+// handleSubscriptionStatus returns is_active/plan/days_left for the current user
+func handleSubscriptionStatus(w http.ResponseWriter, r *http.Request) {
+	auth := authFromContext(r)
+	sub, err := GetActiveSubscription(auth.UserID)
+	if err != nil {
+		log.Printf("[subscriptions] status error: %v", err)
+		JSONError(w, http.StatusInternalServerError, "Failed to load subscription")
+		return
+	}
+	JSONSuccess(w, subscriptionStatus(sub))
+}
+
+// handleSubscriptionCheckout creates a pending subscription and a provider checkout session
+func handleSubscriptionCheckout(w http.ResponseWriter, r *http.Request) {
+	if paymentProvider == nil {
+		JSONError(w, http.StatusServiceUnavailable, "Payments are not configured")
+		return
+	}
+	auth := authFromContext(r)
+
+	var body struct {
+		PlanID string `json:"plan_id"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+		JSONError(w, http.StatusBadRequest, "Invalid request body")
+		return
+	}
+	plan, ok := findPlan(body.PlanID)
+	if !ok {
+		JSONError(w, http.StatusBadRequest, "Unknown plan")
+		return
+	}
+
+	active, err := GetActiveSubscription(auth.UserID)
+	if err != nil {
+		log.Printf("[subscriptions] checkout: status error: %v", err)
+		JSONError(w, http.StatusInternalServerError, "Failed to create checkout")
+		return
+	}
+	if active != nil && active.PlanID == plan.ID {
+		JSONError(w, http.StatusConflict, "Plan is already active")
+		return
+	}
+
+	sub := Subscription{
+		ID:        primitive.NewObjectID(),
+		UserID:    auth.UserID,
+		PlanID:    plan.ID,
+		Status:    SubscriptionPending,
+		Provider:  paymentProvider.Name(),
+		CreatedAt: time.Now(),
+	}
+	sub.UpdatedAt = sub.CreatedAt
+
+	session, err := paymentProvider.CreateCheckout(r.Context(), CheckoutRequest{
+		SessionID:  sub.ID.Hex(),
+		UserID:     auth.UserID,
+		Email:      auth.Email,
+		Plan:       plan,
+		SuccessURL: appBaseURL() + "/pricing?checkout=success",
+		CancelURL:  appBaseURL() + "/pricing?checkout=cancel",
+	})
+	if err != nil {
+		log.Printf("[subscriptions] %s checkout error: %v", paymentProvider.Name(), err)
+		JSONError(w, http.StatusBadGateway, "Failed to create checkout")
+		return
+	}
+	sub.ProviderRef = session.ID
+
+	ctx, cancel := context.WithTimeout(r.Context(), 5*time.Second)
+	defer cancel()
+	if _, err := database.Collection("subscriptions").InsertOne(ctx, sub); err != nil {
+		log.Printf("[subscriptions] insert error: %v", err)
+		JSONError(w, http.StatusInternalServerError, "Failed to create checkout")
+		return
+	}
+
+	JSONSuccess(w, map[string]interface{}{
+		"checkout_url": session.CheckoutURL,
+		"session_id":   session.ID,
+	})
+}
+
+// handleFakeCheckout completes the caller's FakePaymentProvider checkout: the pending
+// subscription is activated right away and the browser is sent back to the pricing page
+func handleFakeCheckout(w http.ResponseWriter, r *http.Request) {
+	auth := authFromContext(r)
+	ref := mux.Vars(r)["session"]
+	if _, err := activateSubscription(auth.UserID, ref); err != nil {
+		if errors.Is(err, mongo.ErrNoDocuments) {
+			JSONError(w, http.StatusNotFound, "Checkout session not found or already completed")
+			return
+		}
+		log.Printf("[subscriptions] fake checkout error: %v", err)
+		JSONError(w, http.StatusInternalServerError, "Failed to activate subscription")
+		return
+	}
+	http.Redirect(w, r, appBaseURL()+"/pricing?checkout=success", http.StatusSeeOther)
+}
@@ -0,0 +1,207 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"math"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// subtitleTimestamp renders seconds as HH:MM:SS<sep>mmm (sep is ',' for SRT, '.' for WebVTT)
+func subtitleTimestamp(seconds float64, sep string) string {
+	if seconds < 0 {
+		seconds = 0
+	}
+	ms := int64(math.Round(seconds * 1000))
+	h := ms / 3600000
+	m := ms / 60000 % 60
+	s := ms / 1000 % 60
+	return fmt.Sprintf("%02d:%02d:%02d%s%03d", h, m, s, sep, ms%1000)
+}
+
+// cueText keeps the line breaks of a segment's text but drops blank lines, which would
+// end the cue early
+func cueText(text string) string {
+	var lines []string
+	for _, l := range strings.Split(strings.ReplaceAll(text, "\r\n", "\n"), "\n") {
+		if l = strings.TrimSpace(l); l != "" {
+			lines = append(lines, l)
+		}
+	}
+	return strings.Join(lines, "\n")
+}
+
+// vttEscaper escapes the characters WebVTT cue text reserves; escaping '>' also keeps
+// "-->" out of the payload
+var vttEscaper = strings.NewReplacer("&", "&amp;", "<", "&lt;", ">", "&gt;")
+
+// formatSRT renders segments as SubRip subtitles. SubRip has no escaping, so an arrow
+// in the text is shortened to keep it from reading as a timing line. Segments without
+// text are skipped and the cues numbered without gaps.
+func formatSRT(segments []TranscriptSegment) string {
+	var b strings.Builder
+	n := 0
+	for _, seg := range segments {
+		text := cueText(seg.Text)
+		if text == "" {
+			continue
+		}
+		n++
+		fmt.Fprintf(&b, "%d\n%s --> %s\n%s\n\n", n,
+			subtitleTimestamp(seg.Start, ","), subtitleTimestamp(seg.End, ","), strings.ReplaceAll(text, "-->", "->"))
+	}
+	return b.String()
+}
+
+// formatVTT renders segments as WebVTT subtitles
+func formatVTT(segments []TranscriptSegment) string {
+	var b strings.Builder
+	b.WriteString("WEBVTT\n\n")
+	for _, seg := range segments {
+		text := cueText(seg.Text)
+		if text == "" {
+			continue
+		}
+		fmt.Fprintf(&b, "%s --> %s\n%s\n\n",
+			subtitleTimestamp(seg.Start, "."), subtitleTimestamp(seg.End, "."), vttEscaper.Replace(text))
+	}
+	return b.String()
+}
+
+// formatTimestampedText renders one "[HH:MM:SS] text" line per segment with text
+func formatTimestampedText(segments []TranscriptSegment) string {
+	var b strings.Builder
+	for _, seg := range segments {
+		text := strings.Join(strings.Fields(seg.Text), " ")
+		if text == "" {
+			continue
+		}
+		ts := subtitleTimestamp(seg.Start, ".")
+		fmt.Fprintf(&b, "[%s] %s\n", ts[:strings.LastIndexByte(ts, '.')], text)
+	}
+	return b.String()
+}
+
+// parseSubtitleTimestamp parses HH:MM:SS,mmm / HH:MM:SS.mmm / MM:SS.mmm into seconds
+func parseSubtitleTimestamp(v string) (float64, error) {
+	v = strings.TrimSpace(strings.ReplaceAll(v, ",", "."))
+	parts := strings.Split(v, ":")
+	if len(parts) < 2 || len(parts) > 3 {
+		return 0, fmt.Errorf("invalid timestamp %q", v)
+	}
+	var total float64
+	for _, p := range parts {
+		n, err := strconv.ParseFloat(p, 64)
+		if err != nil {
+			return 0, fmt.Errorf("invalid timestamp %q", v)
+		}
+		total = total*60 + n
+	}
+	return total, nil
+}
+
+// parseSRT parses SubRip (and cue blocks of WebVTT) into segments
+func parseSRT(data string) []TranscriptSegment {
+	var segments []TranscriptSegment
+	var cur *TranscriptSegment
+	var text []string
+
+	flush := func() {
+		if cur != nil {
+			cur.Text = strings.TrimSpace(strings.Join(text, " "))
+			if cur.Text != "" {
+				segments = append(segments, *cur)
+			}
+		}
+		cur = nil
+		text = nil
+	}
+
+	sc := bufio.NewScanner(strings.NewReader(strings.ReplaceAll(data, "\r\n", "\n")))
+	sc.Buffer(make([]byte, 0, 64*1024), 1024*1024)
+	for sc.Scan() {
+		line := strings.TrimSpace(sc.Text())
+		if line == "" {
+			flush()
+			continue
+		}
+		if strings.Contains(line, "-->") {
+			flush()
+			times := strings.SplitN(line, "-->", 2)
+			start, err1 := parseSubtitleTimestamp(times[0])
+			// WebVTT cue settings may follow the end time
+			endField := strings.Fields(times[1])
+			if len(endField) == 0 {
+				continue
+			}
+			end, err2 := parseSubtitleTimestamp(endField[0])
+			if err1 != nil || err2 != nil {
+				continue
+			}
+			cur = &TranscriptSegment{Start: start, End: end}
+			continue
+		}
+		if cur != nil {
+			text = append(text, line)
+		}
+	}
+	flush()
+	return segments
+}
+
+// segmentsText joins segment texts into plain transcript text
+func segmentsText(segments []TranscriptSegment) string {
+	parts := make([]string, 0, len(segments))
+	for _, seg := range segments {
+		if t := strings.TrimSpace(seg.Text); t != "" {
+			parts = append(parts, t)
+		}
+	}
+	return strings.Join(parts, " ")
+}
+
+// offsetSegments shifts segment times by offset seconds
+func offsetSegments(segments []TranscriptSegment, offset float64) []TranscriptSegment {
+	out := make([]TranscriptSegment, len(segments))
+	for i, seg := range segments {
+		out[i] = TranscriptSegment{Start: seg.Start + offset, End: seg.End + offset, Text: strings.TrimSpace(seg.Text)}
+	}
+	return out
+}
+
+// writeTranscriptExport writes the transcript as srt, vtt or timestamped txt
+// depending on the ?format= query parameter (default txt)
+func writeTranscriptExport(w http.ResponseWriter, r *http.Request, baseName string, text string, segments []TranscriptSegment) {
+	format := strings.ToLower(r.URL.Query().Get("format"))
+	if format == "" {
+		format = "txt"
+	}
+
+	var body, contentType string
+	switch format {
+	case "srt":
+		body, contentType = formatSRT(segments), "application/x-subrip; charset=utf-8"
+	case "vtt":
+		body, contentType = formatVTT(segments), "text/vtt; charset=utf-8"
+	case "txt":
+		body, contentType = formatTimestampedText(segments), "text/plain; charset=utf-8"
+		// Transcripts made before timestamps were stored still export as plain text
+		if len(segments) == 0 {
+			body = text
+		}
+	default:
+		JSONError(w, http.StatusBadRequest, "format must be one of srt, vtt, txt")
+		return
+	}
+	if format != "txt" && len(segments) == 0 {
+		JSONError(w, http.StatusNotFound, "Timestamps are not available for this transcript")
+		return
+	}
+
+	w.Header().Set("Content-Type", contentType)
+	w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=%q", baseName+"."+format))
+	w.WriteHeader(http.StatusOK)
+	w.Write([]byte(body))
+}
@@ -0,0 +1,87 @@
+package main
+
+import (
+	"flag"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+var updateGolden = flag.Bool("update", false, "rewrite the golden files in testdata")
+
+// goldenSegments cover rounding, carries into the next unit, hours past 99, empty
+// segments and text that needs escaping
+var goldenSegments = []TranscriptSegment{
+	{Start: 0, End: 1.2344, Text: "  Welcome to the lecture.  "},
+	{Start: 1.2346, End: 59.9996, Text: "Rounds to the nearest millisecond and carries into the minute"},
+	{Start: 60, End: 61, Text: "   "},
+	{Start: 3599.9995, End: 3605.5, Text: "Line one\n\n  line two"},
+	{Start: 3725.042, End: 3730, Text: "Tom & Jerry <i>cartoons</i> --> next"},
+	{Start: 360000.5, End: 360003.25, Text: "A hundred hours in"},
+	{Start: -0.5, End: 0.5, Text: "Negative start"},
+}
+
+// checkGolden compares got with testdata/subtitles/name, rewriting it with -update
+func checkGolden(t *testing.T, name, got string) {
+	t.Helper()
+	path := filepath.Join("testdata", "subtitles", name)
+	if *updateGolden {
+		if err := os.WriteFile(path, []byte(got), 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	want, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got != string(want) {
+		t.Fatalf("%s differs from the golden file:\n--- got\n%s\n--- want\n%s", name, got, want)
+	}
+}
+
+func TestFormatSRTGolden(t *testing.T) {
+	out := formatSRT(goldenSegments)
+	checkGolden(t, "lecture.srt", out)
+
+	// What we write reads back, minus the empty segment
+	back := parseSRT(out)
+	if len(back) != len(goldenSegments)-1 || back[4].Start != 360000.5 || back[3].Text != "Tom & Jerry <i>cartoons</i> -> next" {
+		t.Fatalf("parsed back = %+v", back)
+	}
+}
+
+func TestFormatVTTGolden(t *testing.T) {
+	out := formatVTT(goldenSegments)
+	checkGolden(t, "lecture.vtt", out)
+
+	if back := parseSRT(out); len(back) != len(goldenSegments)-1 || back[2].End != 3605.5 {
+		t.Fatalf("parsed back = %+v", back)
+	}
+}
+
+func TestFormatTimestampedTextGolden(t *testing.T) {
+	checkGolden(t, "lecture.txt", formatTimestampedText(goldenSegments))
+}
+
+func TestSubtitleTimestamp(t *testing.T) {
+	tests := []struct {
+		seconds float64
+		sep     string
+		want    string
+	}{
+		{0, ",", "00:00:00,000"},
+		{1.2344, ",", "00:00:01,234"},
+		{1.2346, ".", "00:00:01.235"},
+		{59.9996, ",", "00:01:00,000"},
+		{3599.9995, ".", "01:00:00.000"},
+		{3725.042, ".", "01:02:05.042"},
+		{359999.999, ",", "99:59:59,999"},
+		{360000.5, ",", "100:00:00,500"},
+		{-3, ".", "00:00:00.000"},
+	}
+	for _, tt := range tests {
+		if got := subtitleTimestamp(tt.seconds, tt.sep); got != tt.want {
+			t.Errorf("subtitleTimestamp(%v) = %q, want %q", tt.seconds, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,281 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"mime/multipart"
+	"net/http"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// TranscribeRequest describes one audio file to transcribe
+type TranscribeRequest struct {
+	Path     string // audio file on disk
+	Filename string // name reported to the backend (extension matters for OpenAI)
+	Language string // ISO code, empty for auto-detect
+}
+
+// TranscriptionResult is the text produced for one audio file.
+// Segment times are relative to the start of that file.
+type TranscriptionResult struct {
+	Text     string
+	Language string
+	Duration float64
+	Segments []TranscriptSegment
+}
+
+// Transcriber turns an audio file into text
+type Transcriber interface {
+	Name() string
+	Transcribe(ctx context.Context, req TranscribeRequest) (*TranscriptionResult, error)
+}
+
+// transcriber is the backend selected at startup via TRANSCRIBER
+var transcriber Transcriber
+
+// newTranscriberFromEnv builds the Transcriber selected by TRANSCRIBER (openai|local|fake)
+func newTranscriberFromEnv() (Transcriber, error) {
+	switch kind := strings.ToLower(getEnvOrFile("TRANSCRIBER")); kind {
+	case "", "openai":
+		if openaiAPIKey == "" {
+			return nil, fmt.Errorf("OPENAI_API_KEY is required for TRANSCRIBER=openai")
+		}
+		t := &OpenAITranscriber{
+			APIKey:         openaiAPIKey,
+			URL:            getEnvOrFile("OPENAI_TRANSCRIBE_URL"),
+			Model:          getEnvOrFile("OPENAI_TRANSCRIBE_MODEL"),
+			ResponseFormat: getEnvOrFile("OPENAI_TRANSCRIBE_FORMAT"),
+		}
+		if t.URL == "" {
+			t.URL = "https://api.openai.com/v1/audio/transcriptions"
+		}
+		if t.Model == "" {
+			t.Model = "whisper-1"
+		}
+		// verbose_json returns segment timestamps; models without it can use json
+		if t.ResponseFormat == "" {
+			t.ResponseFormat = "verbose_json"
+		}
+		return &RetryingTranscriber{
+			Inner: t,
+			Policy: RetryPolicy{
+				MaxAttempts: getEnvInt("TRANSCRIBE_MAX_ATTEMPTS", 4),
+				BaseDelay:   time.Duration(getEnvInt("TRANSCRIBE_RETRY_BASE_MS", 1000)) * time.Millisecond,
+				MaxDelay:    30 * time.Second,
+			},
+		}, nil
+	case "local":
+		t := &LocalWhisperTranscriber{
+			Binary:  getEnvOrFile("WHISPER_BIN"),
+			Model:   getEnvOrFile("WHISPER_MODEL"),
+			Flavor:  strings.ToLower(getEnvOrFile("WHISPER_FLAVOR")),
+			Threads: getEnvInt("WHISPER_THREADS", 0),
+		}
+		if t.Flavor == "" {
+			t.Flavor = "whisper.cpp"
+		}
+		if t.Binary == "" {
+			if t.Flavor == "faster-whisper" {
+				t.Binary = "whisper-ctranslate2"
+			} else {
+				t.Binary = "whisper-cli"
+			}
+		}
+		if t.Model == "" {
+			return nil, fmt.Errorf("WHISPER_MODEL is required for TRANSCRIBER=local")
+		}
+		if _, err := exec.LookPath(t.Binary); err != nil {
+			return nil, fmt.Errorf("whisper binary %q not found: %w", t.Binary, err)
+		}
+		return t, nil
+	case "fake":
+		return &FakeTranscriber{Text: getEnvOrFile("TRANSCRIBER_FAKE_TEXT")}, nil
+	default:
+		return nil, fmt.Errorf("unknown TRANSCRIBER %q (expected openai, local or fake)", kind)
+	}
+}
+
+// OpenAITranscriber calls the OpenAI audio transcription API
+type OpenAITranscriber struct {
+	APIKey         string
+	URL            string
+	Model          string
+	ResponseFormat string // verbose_json|json
+}
+
+func (t *OpenAITranscriber) Name() string { return "openai:" + t.Model }
+
+func (t *OpenAITranscriber) Transcribe(ctx context.Context, req TranscribeRequest) (*TranscriptionResult, error) {
+	// Build multipart per chunk
+	var body bytes.Buffer
+	mw := multipart.NewWriter(&body)
+	chunk, err := os.ReadFile(req.Path)
+	if err != nil {
+		return nil, err
+	}
+	p, err := mw.CreateFormFile("file", req.Filename)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := p.Write(chunk); err != nil {
+		return nil, err
+	}
+	mw.WriteField("model", t.Model)
+	mw.WriteField("response_format", t.ResponseFormat)
+	if t.ResponseFormat == "verbose_json" {
+		mw.WriteField("timestamp_granularities[]", "segment")
+	}
+	if req.Language != "" {
+		mw.WriteField("language", req.Language)
+	}
+	mw.Close()
+
+	httpReq, err := http.NewRequestWithContext(ctx, "POST", t.URL, &body)
+	if err != nil {
+		return nil, err
+	}
+	httpReq.Header.Set("Authorization", "Bearer "+t.APIKey)
+	httpReq.Header.Set("Content-Type", mw.FormDataContentType())
+
+	httpClient := &http.Client{Timeout: 180 * time.Second}
+	resp, err := httpClient.Do(httpReq)
+	if err != nil {
+		return nil, err
+	}
+	respBytes, _ := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("chunk transcribe error: %w", newHTTPStatusError(resp, respBytes))
+	}
+	var wr WhisperResponse
+	if err := json.Unmarshal(respBytes, &wr); err != nil {
+		return nil, err
+	}
+	res := &TranscriptionResult{Text: wr.Text, Language: wr.Language, Duration: wr.Duration}
+	for _, seg := range wr.Segments {
+		res.Segments = append(res.Segments, TranscriptSegment{Start: seg.Start, End: seg.End, Text: strings.TrimSpace(seg.Text)})
+	}
+	return res, nil
+}
+
+// RetryingTranscriber retries transient failures (429/5xx, timeouts) of the inner backend
+type RetryingTranscriber struct {
+	Inner  Transcriber
+	Policy RetryPolicy
+}
+
+func (t *RetryingTranscriber) Name() string { return t.Inner.Name() }
+
+func (t *RetryingTranscriber) Transcribe(ctx context.Context, req TranscribeRequest) (*TranscriptionResult, error) {
+	var res *TranscriptionResult
+	err := t.Policy.Do(ctx, "transcribe "+req.Filename, func() error {
+		var err error
+		res, err = t.Inner.Transcribe(ctx, req)
+		return err
+	})
+	return res, err
+}
+
+// LocalWhisperTranscriber shells out to a whisper.cpp or faster-whisper
+// (whisper-ctranslate2) binary so audio never leaves the server
+type LocalWhisperTranscriber struct {
+	Binary  string
+	Model   string // ggml model path for whisper.cpp, model name/path for faster-whisper
+	Flavor  string // whisper.cpp|faster-whisper
+	Threads int
+}
+
+func (t *LocalWhisperTranscriber) Name() string { return "local:" + t.Flavor }
+
+func (t *LocalWhisperTranscriber) Transcribe(ctx context.Context, req TranscribeRequest) (*TranscriptionResult, error) {
+	workDir, err := os.MkdirTemp(os.TempDir(), "whisper_*")
+	if err != nil {
+		return nil, err
+	}
+	defer os.RemoveAll(workDir)
+
+	// Both CLIs are most reliable with 16kHz mono WAV
+	wavPath := filepath.Join(workDir, "input.wav")
+	conv := exec.CommandContext(ctx, "ffmpeg", "-y", "-i", req.Path, "-ac", "1", "-ar", "16000", "-c:a", "pcm_s16le", wavPath)
+	if out, err := conv.CombinedOutput(); err != nil {
+		return nil, fmt.Errorf("ffmpeg wav conversion failed: %w; output: %s", err, string(out))
+	}
+
+	// SRT output keeps segment timestamps
+	var args []string
+	var srtPath string
+	switch t.Flavor {
+	case "faster-whisper":
+		args = []string{wavPath, "--model", t.Model, "--output_format", "srt", "--output_dir", workDir}
+		if req.Language != "" {
+			args = append(args, "--language", req.Language)
+		}
+		if t.Threads > 0 {
+			args = append(args, "--threads", fmt.Sprint(t.Threads))
+		}
+		srtPath = filepath.Join(workDir, "input.srt")
+	default:
+		outBase := filepath.Join(workDir, "out")
+		args = []string{"-m", t.Model, "-f", wavPath, "-osrt", "-of", outBase}
+		if req.Language != "" {
+			args = append(args, "-l", req.Language)
+		} else {
+			args = append(args, "-l", "auto")
+		}
+		if t.Threads > 0 {
+			args = append(args, "-t", fmt.Sprint(t.Threads))
+		}
+		srtPath = outBase + ".srt"
+	}
+
+	cmd := exec.CommandContext(ctx, t.Binary, args...)
+	if out, err := cmd.CombinedOutput(); err != nil {
+		return nil, fmt.Errorf("%s failed: %w; output: %s", t.Binary, err, string(out))
+	}
+
+	srt, err := os.ReadFile(srtPath)
+	if err != nil {
+		return nil, fmt.Errorf("whisper output not found: %w", err)
+	}
+	segments := parseSRT(string(srt))
+	res := &TranscriptionResult{Text: segmentsText(segments), Language: req.Language, Segments: segments}
+	if len(segments) > 0 {
+		res.Duration = segments[len(segments)-1].End
+	}
+	return res, nil
+}
+
+// FakeTranscriber returns deterministic text derived from the file contents.
+// Used for tests and local development without network access.
+type FakeTranscriber struct {
+	Text string // fixed text; when empty a content hash is used
+}
+
+func (t *FakeTranscriber) Name() string { return "fake" }
+
+func (t *FakeTranscriber) Transcribe(ctx context.Context, req TranscribeRequest) (*TranscriptionResult, error) {
+	text := t.Text
+	if text == "" {
+		data, err := os.ReadFile(req.Path)
+		if err != nil {
+			return nil, err
+		}
+		sum := sha256.Sum256(data)
+		text = fmt.Sprintf("Fake transcript of %s (%s)", req.Filename, hex.EncodeToString(sum[:6]))
+	}
+	return &TranscriptionResult{
+		Text:     text,
+		Language: req.Language,
+		Duration: 1,
+		Segments: []TranscriptSegment{{Start: 0, End: 1, Text: text}},
+	}, nil
+}
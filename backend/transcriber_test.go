@@ -0,0 +1,209 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// useOpenAIKey sets the OPENAI_API_KEY read at startup for the test
+func useOpenAIKey(t *testing.T, key string) {
+	t.Helper()
+	prev := openaiAPIKey
+	openaiAPIKey = key
+	t.Cleanup(func() { openaiAPIKey = prev })
+}
+
+func TestNewTranscriberFromEnv(t *testing.T) {
+	tests := []struct {
+		name     string
+		apiKey   string
+		env      map[string]string
+		wantName string
+		wantErr  string
+	}{
+		{name: "openai by default", apiKey: "sk-test", wantName: "openai:whisper-1"},
+		{name: "openai model", apiKey: "sk-test", env: map[string]string{"TRANSCRIBER": "OpenAI", "OPENAI_TRANSCRIBE_MODEL": "gpt-4o-transcribe"}, wantName: "openai:gpt-4o-transcribe"},
+		{name: "openai without a key", wantErr: "OPENAI_API_KEY"},
+		{name: "fake", env: map[string]string{"TRANSCRIBER": "fake"}, wantName: "fake"},
+		{name: "local without a model", env: map[string]string{"TRANSCRIBER": "local"}, wantErr: "WHISPER_MODEL"},
+		{name: "local without the binary", env: map[string]string{"TRANSCRIBER": "local", "WHISPER_MODEL": "m.bin", "WHISPER_BIN": "/nonexistent/whisper-cli"}, wantErr: "not found"},
+		{name: "unknown", env: map[string]string{"TRANSCRIBER": "azure"}, wantErr: "unknown TRANSCRIBER"},
+	}
+	vars := []string{"TRANSCRIBER", "OPENAI_TRANSCRIBE_MODEL", "OPENAI_TRANSCRIBE_URL", "OPENAI_TRANSCRIBE_FORMAT", "WHISPER_MODEL", "WHISPER_BIN", "WHISPER_FLAVOR"}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			for _, v := range vars {
+				t.Setenv(v, tt.env[v])
+				t.Setenv(v+"_FILE", "")
+			}
+			useOpenAIKey(t, tt.apiKey)
+			tr, err := newTranscriberFromEnv()
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Fatalf("error = %v, want it to contain %q", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if tr.Name() != tt.wantName {
+				t.Fatalf("transcriber = %s, want %s", tr.Name(), tt.wantName)
+			}
+		})
+	}
+}
+
+func TestNewTranscriberFromEnvLocal(t *testing.T) {
+	// Any executable stands in for whisper-cli: only the lookup is checked
+	bin := filepath.Join(t.TempDir(), "whisper-ctranslate2")
+	if err := os.WriteFile(bin, []byte("#!/bin/sh\n"), 0o755); err != nil {
+		t.Fatal(err)
+	}
+	t.Setenv("TRANSCRIBER", "local")
+	t.Setenv("WHISPER_FLAVOR", "Faster-Whisper")
+	t.Setenv("WHISPER_MODEL", "small")
+	t.Setenv("WHISPER_BIN", bin)
+	tr, err := newTranscriberFromEnv()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if lw, ok := tr.(*LocalWhisperTranscriber); !ok || lw.Flavor != "faster-whisper" || lw.Model != "small" {
+		t.Fatalf("transcriber = %#v", tr)
+	}
+}
+
+func writeTestAudio(t *testing.T, content string) string {
+	t.Helper()
+	p := filepath.Join(t.TempDir(), "chunk.mp3")
+	if err := os.WriteFile(p, []byte(content), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	return p
+}
+
+func TestFakeTranscriber(t *testing.T) {
+	req := TranscribeRequest{Path: writeTestAudio(t, "audio"), Filename: "chunk.mp3", Language: "de"}
+	res, err := (&FakeTranscriber{Text: "fixed"}).Transcribe(context.Background(), req)
+	if err != nil || res.Text != "fixed" || res.Language != "de" || len(res.Segments) != 1 {
+		t.Fatalf("fixed text: %+v, %v", res, err)
+	}
+
+	// Without fixed text the result depends on the file only
+	a, _ := (&FakeTranscriber{}).Transcribe(context.Background(), req)
+	b, _ := (&FakeTranscriber{}).Transcribe(context.Background(), req)
+	other, _ := (&FakeTranscriber{}).Transcribe(context.Background(), TranscribeRequest{Path: writeTestAudio(t, "other"), Filename: "chunk.mp3"})
+	if a.Text != b.Text || a.Text == other.Text || !strings.HasPrefix(a.Text, "Fake transcript of chunk.mp3") {
+		t.Fatalf("texts = %q, %q, %q", a.Text, b.Text, other.Text)
+	}
+}
+
+// flakyTranscriber fails with errs in turn before handing over to the fake
+type flakyTranscriber struct {
+	FakeTranscriber
+	errs  []error
+	calls int
+}
+
+func (t *flakyTranscriber) Transcribe(ctx context.Context, req TranscribeRequest) (*TranscriptionResult, error) {
+	t.calls++
+	if t.calls <= len(t.errs) {
+		return nil, t.errs[t.calls-1]
+	}
+	return t.FakeTranscriber.Transcribe(ctx, req)
+}
+
+func TestRetryingTranscriber(t *testing.T) {
+	unavailable := &HTTPStatusError{StatusCode: http.StatusServiceUnavailable, Status: "503 Service Unavailable"}
+	badRequest := &HTTPStatusError{StatusCode: http.StatusBadRequest, Status: "400 Bad Request"}
+	tests := []struct {
+		name      string
+		errs      []error
+		wantCalls int
+		wantErr   error
+	}{
+		{name: "first try", wantCalls: 1},
+		{name: "recovers from 5xx", errs: []error{unavailable, unavailable}, wantCalls: 3},
+		{name: "gives up after max attempts", errs: []error{unavailable, unavailable, unavailable, unavailable}, wantCalls: 3, wantErr: unavailable},
+		{name: "client error is final", errs: []error{badRequest}, wantCalls: 1, wantErr: badRequest},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			inner := &flakyTranscriber{FakeTranscriber: FakeTranscriber{Text: "ok"}, errs: tt.errs}
+			tr := &RetryingTranscriber{Inner: inner, Policy: RetryPolicy{MaxAttempts: 3, BaseDelay: time.Millisecond, MaxDelay: 5 * time.Millisecond}}
+			res, err := tr.Transcribe(context.Background(), TranscribeRequest{Filename: "chunk.mp3"})
+			if inner.calls != tt.wantCalls {
+				t.Fatalf("calls = %d, want %d", inner.calls, tt.wantCalls)
+			}
+			if tt.wantErr != nil {
+				if !errors.Is(err, tt.wantErr) {
+					t.Fatalf("error = %v, want %v", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil || res.Text != "ok" {
+				t.Fatalf("result = %+v, %v", res, err)
+			}
+		})
+	}
+}
+
+func TestOpenAITranscriberRetriesFromEnv(t *testing.T) {
+	var mu sync.Mutex
+	var calls []time.Time
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		calls = append(calls, time.Now())
+		n := len(calls)
+		mu.Unlock()
+		if r.Header.Get("Authorization") != "Bearer sk-test" || r.FormValue("model") != "whisper-1" {
+			http.Error(w, "bad request", http.StatusBadRequest)
+			return
+		}
+		if n == 1 {
+			w.Header().Set("Retry-After", "1")
+			http.Error(w, `{"error":"rate limited"}`, http.StatusTooManyRequests)
+			return
+		}
+		json.NewEncoder(w).Encode(WhisperResponse{Text: "hello", Language: "english", Duration: 2,
+			Segments: []WhisperSegment{{Start: 0, End: 2, Text: " hello "}}})
+	}))
+	defer srv.Close()
+
+	t.Setenv("TRANSCRIBER", "openai")
+	t.Setenv("OPENAI_TRANSCRIBE_URL", srv.URL)
+	t.Setenv("OPENAI_TRANSCRIBE_MODEL", "")
+	t.Setenv("OPENAI_TRANSCRIBE_FORMAT", "")
+	t.Setenv("TRANSCRIBE_MAX_ATTEMPTS", "")
+	t.Setenv("TRANSCRIBE_RETRY_BASE_MS", "1")
+	useOpenAIKey(t, "sk-test")
+	tr, err := newTranscriberFromEnv()
+	if err != nil {
+		t.Fatal(err)
+	}
+	res, err := tr.Transcribe(context.Background(), TranscribeRequest{Path: writeTestAudio(t, "audio"), Filename: "chunk.mp3"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if res.Text != "hello" || len(res.Segments) != 1 || res.Segments[0].Text != "hello" {
+		t.Fatalf("result = %+v", res)
+	}
+	mu.Lock()
+	defer mu.Unlock()
+	if len(calls) != 2 {
+		t.Fatalf("calls = %d, want a retry after the 429", len(calls))
+	}
+	// Retry-After wins over the 1ms backoff
+	if gap := calls[1].Sub(calls[0]); gap < time.Second {
+		t.Fatalf("retried after %s, want at least the Retry-After of 1s", gap)
+	}
+}
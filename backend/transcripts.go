@@ -0,0 +1,408 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// errTranscriptNotFound is returned when a referenced transcript is invalid or not owned by the user
+var errTranscriptNotFound = errors.New("transcript not found")
+
+// CreateTranscript saves a new transcript
+func CreateTranscript(t *Transcript) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	if t.ID.IsZero() {
+		t.ID = primitive.NewObjectID()
+	}
+	t.CreatedAt = time.Now()
+	t.UpdatedAt = t.CreatedAt
+	if t.Duration == 0 && len(t.Segments) > 0 {
+		t.Duration = t.Segments[len(t.Segments)-1].End
+	}
+
+	_, err := database.Collection("transcripts").InsertOne(ctx, t)
+	return err
+}
+
+// GetTranscript loads a transcript owned by userID
+func GetTranscript(id, userID primitive.ObjectID) (*Transcript, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	var t Transcript
+	if err := database.Collection("transcripts").FindOne(ctx, bson.M{"_id": id, "user_id": userID}).Decode(&t); err != nil {
+		return nil, err
+	}
+	return &t, nil
+}
+
+// transcriptTexts returns the text of each transcript by ID (used to fill materials)
+func transcriptTexts(ids []primitive.ObjectID) (map[primitive.ObjectID]string, error) {
+	texts := map[primitive.ObjectID]string{}
+	if len(ids) == 0 {
+		return texts, nil
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	cursor, err := database.Collection("transcripts").Find(ctx,
+		bson.M{"_id": bson.M{"$in": ids}},
+		options.Find().SetProjection(bson.M{"text": 1}),
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer cursor.Close(ctx)
+
+	var docs []struct {
+		ID   primitive.ObjectID `bson:"_id"`
+		Text string             `bson:"text"`
+	}
+	if err := cursor.All(ctx, &docs); err != nil {
+		return nil, err
+	}
+	for _, d := range docs {
+		texts[d.ID] = d.Text
+	}
+	return texts, nil
+}
+
+// fillMaterialTranscripts loads transcript text for materials that only hold a reference
+func fillMaterialTranscripts(materials []Material) {
+	var ids []primitive.ObjectID
+	for _, m := range materials {
+		if !m.TranscriptID.IsZero() && m.Transcript == "" {
+			ids = append(ids, m.TranscriptID)
+		}
+	}
+	texts, err := transcriptTexts(ids)
+	if err != nil {
+		log.Printf("Error loading transcripts for materials: %v", err)
+		return
+	}
+	for i := range materials {
+		if text, ok := texts[materials[i].TranscriptID]; ok && materials[i].Transcript == "" {
+			materials[i].Transcript = text
+		}
+	}
+}
+
+// resolveTranscriptRef returns the transcript a material/note should reference:
+// an explicit transcriptId owned by the user, or a new "text" transcript built from raw text.
+// Returns a zero ID when there is nothing to reference.
+func resolveTranscriptRef(userID primitive.ObjectID, rawID string, text string, language string) (primitive.ObjectID, error) {
+	if rawID != "" {
+		id, err := primitive.ObjectIDFromHex(rawID)
+		if err != nil {
+			return primitive.NilObjectID, errTranscriptNotFound
+		}
+		if _, err := GetTranscript(id, userID); err != nil {
+			return primitive.NilObjectID, errTranscriptNotFound
+		}
+		return id, nil
+	}
+	if strings.TrimSpace(text) == "" {
+		return primitive.NilObjectID, nil
+	}
+	t := &Transcript{
+		UserID:   userID,
+		Source:   TranscriptSourceText,
+		Language: language,
+		Text:     text,
+	}
+	if err := CreateTranscript(t); err != nil {
+		return primitive.NilObjectID, err
+	}
+	return t.ID, nil
+}
+
+// saveJobTranscript stores the finished job as a transcript of its owner
+func saveJobTranscript(job *TranscriptionJob, language string) (*Transcript, error) {
+	t := &Transcript{
+		UserID:   job.UserID,
+		JobID:    job.ID,
+		Source:   job.Source,
+		Filename: job.Filename,
+		URL:      job.URL,
+		Language: language,
+		Mode:     job.Mode,
+		Text:     job.Transcript,
+		Segments: job.Segments,
+	}
+	if t.Source == "" {
+		t.Source = TranscriptSourceUpload
+	}
+	if err := CreateTranscript(t); err != nil {
+		return nil, err
+	}
+	return t, nil
+}
+
+// replaceJobTranscript overwrites the text of the transcript a re-transcription job was
+// started for; title, source and stored audio stay as they were
+func replaceJobTranscript(job *TranscriptionJob, language string) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	set := bson.M{
+		"job_id":     job.ID,
+		"mode":       job.Mode,
+		"text":       job.Transcript,
+		"segments":   job.Segments,
+		"updated_at": time.Now(),
+	}
+	if language != "" {
+		set["language"] = language
+	}
+	if job.Duration > 0 {
+		set["duration"] = job.Duration
+	}
+	res, err := database.Collection("transcripts").UpdateOne(ctx,
+		bson.M{"_id": job.TranscriptID, "user_id": job.UserID},
+		bson.M{"$set": set},
+	)
+	if err == nil && res.MatchedCount == 0 {
+		err = fmt.Errorf("transcript %s no longer exists", job.TranscriptID.Hex())
+	}
+	return err
+}
+
+// transcriptIDFromRequest parses the {id} route var
+func transcriptIDFromRequest(w http.ResponseWriter, r *http.Request) (primitive.ObjectID, bool) {
+	id, err := primitive.ObjectIDFromHex(mux.Vars(r)["id"])
+	if err != nil {
+		JSONError(w, http.StatusBadRequest, "Invalid ID format")
+		return primitive.NilObjectID, false
+	}
+	return id, true
+}
+
+// handleTranscripts lists (GET) or creates (POST) transcripts of the current user
+func handleTranscripts(w http.ResponseWriter, r *http.Request) {
+	auth := extractUserFromJWT(w, r)
+	if auth == nil {
+		return
+	}
+	coll := database.Collection("transcripts")
+
+	if r.Method == "GET" {
+		ctx, cancel := context.WithTimeout(r.Context(), 10*time.Second)
+		defer cancel()
+
+		// Segments can be large, the list only carries text
+		cursor, err := coll.Find(ctx, bson.M{"user_id": auth.UserID},
+			options.Find().SetSort(bson.M{"created_at": -1}).SetProjection(bson.M{"segments": 0}))
+		if err != nil {
+			log.Printf("Error fetching transcripts: %v", err)
+			JSONError(w, http.StatusInternalServerError, "Failed to fetch transcripts")
+			return
+		}
+		defer cursor.Close(ctx)
+
+		transcripts := []Transcript{}
+		if err := cursor.All(ctx, &transcripts); err != nil {
+			log.Printf("Error decoding transcripts: %v", err)
+			JSONError(w, http.StatusInternalServerError, "Failed to decode transcripts")
+			return
+		}
+		JSONResponse(w, http.StatusOK, map[string]interface{}{
+			"success":     true,
+			"transcripts": transcripts,
+		})
+		return
+	}
+
+	var body struct {
+		Source   string              `json:"source"`
+		Title    string              `json:"title"`
+		Filename string              `json:"filename"`
+		URL      string              `json:"url"`
+		Duration float64             `json:"duration"`
+		Language string              `json:"language"`
+		Mode     string              `json:"mode"`
+		Text     string              `json:"text"`
+		Segments []TranscriptSegment `json:"segments"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+		JSONError(w, http.StatusBadRequest, "Invalid request body")
+		return
+	}
+	if strings.TrimSpace(body.Text) == "" {
+		JSONError(w, http.StatusBadRequest, "text is required")
+		return
+	}
+	switch body.Source {
+	case "":
+		body.Source = TranscriptSourceText
+	case TranscriptSourceUpload, TranscriptSourceYouTube, TranscriptSourceRecording, TranscriptSourceText:
+	default:
+		JSONError(w, http.StatusBadRequest, "source must be one of upload, youtube, recording, text")
+		return
+	}
+
+	t := &Transcript{
+		UserID:   auth.UserID,
+		Source:   body.Source,
+		Title:    body.Title,
+		Filename: body.Filename,
+		URL:      body.URL,
+		Duration: body.Duration,
+		Language: body.Language,
+		Mode:     body.Mode,
+		Text:     body.Text,
+		Segments: body.Segments,
+	}
+	if err := CreateTranscript(t); err != nil {
+		log.Printf("Error creating transcript: %v", err)
+		JSONError(w, http.StatusInternalServerError, "Failed to save transcript")
+		return
+	}
+	JSONResponse(w, http.StatusCreated, map[string]interface{}{"success": true, "transcript": t})
+}
+
+// getTranscriptByID returns a single transcript with segments
+func getTranscriptByID(w http.ResponseWriter, r *http.Request) {
+	id, ok := transcriptIDFromRequest(w, r)
+	if !ok {
+		return
+	}
+	auth := extractUserFromJWT(w, r)
+	if auth == nil {
+		return
+	}
+
+	t, err := GetTranscript(id, auth.UserID)
+	if err != nil {
+		JSONError(w, http.StatusNotFound, "Not found")
+		return
+	}
+	JSONResponse(w, http.StatusOK, map[string]interface{}{"success": true, "transcript": t})
+}
+
+// updateTranscriptByID edits title, text and language of a transcript
+func updateTranscriptByID(w http.ResponseWriter, r *http.Request) {
+	id, ok := transcriptIDFromRequest(w, r)
+	if !ok {
+		return
+	}
+	auth := extractUserFromJWT(w, r)
+	if auth == nil {
+		return
+	}
+
+	var body struct {
+		Title    *string `json:"title"`
+		Text     *string `json:"text"`
+		Language *string `json:"language"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+		JSONError(w, http.StatusBadRequest, "Invalid request body")
+		return
+	}
+
+	set := bson.M{"updated_at": time.Now()}
+	if body.Title != nil {
+		set["title"] = *body.Title
+	}
+	if body.Language != nil {
+		set["language"] = *body.Language
+	}
+	if body.Text != nil {
+		if strings.TrimSpace(*body.Text) == "" {
+			JSONError(w, http.StatusBadRequest, "text cannot be empty")
+			return
+		}
+		set["text"] = *body.Text
+	}
+
+	var t Transcript
+	err := database.Collection("transcripts").FindOneAndUpdate(r.Context(),
+		bson.M{"_id": id, "user_id": auth.UserID},
+		bson.M{"$set": set},
+		options.FindOneAndUpdate().SetReturnDocument(options.After),
+	).Decode(&t)
+	if err != nil {
+		if errors.Is(err, mongo.ErrNoDocuments) {
+			JSONError(w, http.StatusNotFound, "Transcript not found")
+			return
+		}
+		log.Printf("Error updating transcript: %v", err)
+		JSONError(w, http.StatusInternalServerError, "Failed to update transcript")
+		return
+	}
+	JSONResponse(w, http.StatusOK, map[string]interface{}{"success": true, "transcript": t})
+}
+
+// deleteTranscriptByID deletes a transcript that no material still references
+func deleteTranscriptByID(w http.ResponseWriter, r *http.Request) {
+	id, ok := transcriptIDFromRequest(w, r)
+	if !ok {
+		return
+	}
+	auth := extractUserFromJWT(w, r)
+	if auth == nil {
+		return
+	}
+
+	inUse, err := database.Collection("materials").CountDocuments(r.Context(), bson.M{"transcript_id": id, "user_id": auth.UserID})
+	if err != nil {
+		JSONError(w, http.StatusInternalServerError, "Failed to delete transcript")
+		return
+	}
+	if inUse > 0 {
+		JSONErrorWithDetails(w, http.StatusConflict, "Transcript is used by materials", map[string]interface{}{"materials": inUse})
+		return
+	}
+
+	var deleted Transcript
+	err = database.Collection("transcripts").FindOneAndDelete(r.Context(), bson.M{"_id": id, "user_id": auth.UserID},
+		options.FindOneAndDelete().SetProjection(bson.M{"audio": 1})).Decode(&deleted)
+	if errors.Is(err, mongo.ErrNoDocuments) {
+		JSONError(w, http.StatusNotFound, "Transcript not found")
+		return
+	}
+	if err != nil {
+		JSONError(w, http.StatusInternalServerError, "Failed to delete transcript")
+		return
+	}
+	deleteTranscriptAudio(r.Context(), deleted.Audio)
+	// Notes only link to the transcript, they keep their own content
+	database.Collection("notes").UpdateMany(r.Context(),
+		bson.M{"transcript_id": id, "user_id": auth.UserID},
+		bson.M{"$unset": bson.M{"transcript_id": ""}})
+
+	JSONResponse(w, http.StatusOK, map[string]interface{}{"success": true, "message": "Transcript deleted successfully"})
+}
+
+// exportTranscriptByID downloads a transcript as SRT, WebVTT or timestamped text
+func exportTranscriptByID(w http.ResponseWriter, r *http.Request) {
+	id, ok := transcriptIDFromRequest(w, r)
+	if !ok {
+		return
+	}
+	auth := extractUserFromJWT(w, r)
+	if auth == nil {
+		return
+	}
+
+	t, err := GetTranscript(id, auth.UserID)
+	if err != nil {
+		JSONError(w, http.StatusNotFound, "Not found")
+		return
+	}
+	writeTranscriptExport(w, r, "transcript_"+t.ID.Hex(), t.Text, t.Segments)
+}
@@ -0,0 +1,489 @@
+package main
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha1"
+	"crypto/subtle"
+	"encoding/base32"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// TOTP parameters (RFC 6238 defaults, understood by every authenticator app)
+const (
+	totpPeriod = 30
+	totpDigits = 6
+	// totpSkew accepts codes one step before and after the current one (clock drift)
+	totpSkew = 1
+)
+
+const (
+	recoveryCodeCount = 10
+	// loginChallengeTTL is how long the second login step may take
+	loginChallengeTTL = 5 * time.Minute
+	// loginChallengeAttempts is how many codes can be tried with one challenge
+	loginChallengeAttempts = 5
+)
+
+var b32 = base32.StdEncoding.WithPadding(base32.NoPadding)
+
+// totpCode computes the code for a time step (RFC 4226 dynamic truncation)
+func totpCode(secret []byte, step int64) string {
+	var msg [8]byte
+	binary.BigEndian.PutUint64(msg[:], uint64(step))
+	mac := hmac.New(sha1.New, secret)
+	mac.Write(msg[:])
+	sum := mac.Sum(nil)
+	off := sum[len(sum)-1] & 0x0f
+	v := binary.BigEndian.Uint32(sum[off:off+4]) & 0x7fffffff
+	return fmt.Sprintf("%0*d", totpDigits, v%1000000)
+}
+
+// totpMatch returns the time step whose code equals code, within totpSkew of now
+func totpMatch(secretB32, code string, now time.Time) (int64, bool) {
+	secret, err := b32.DecodeString(secretB32)
+	if err != nil || len(code) != totpDigits {
+		return 0, false
+	}
+	cur := now.Unix() / totpPeriod
+	for step := cur - totpSkew; step <= cur+totpSkew; step++ {
+		if subtle.ConstantTimeCompare([]byte(totpCode(secret, step)), []byte(code)) == 1 {
+			return step, true
+		}
+	}
+	return 0, false
+}
+
+// otpauthURI is the enrollment URI shown as a QR code by the frontend
+func otpauthURI(email, secret string) string {
+	issuer := getEnvOrFile("TOTP_ISSUER")
+	if issuer == "" {
+		issuer = "SpeakApper"
+	}
+	q := url.Values{
+		"secret":    {secret},
+		"issuer":    {issuer},
+		"algorithm": {"SHA1"},
+		"digits":    {fmt.Sprint(totpDigits)},
+		"period":    {fmt.Sprint(totpPeriod)},
+	}
+	return "otpauth://totp/" + url.PathEscape(issuer+":"+email) + "?" + q.Encode()
+}
+
+// newRecoveryCodes returns fresh codes (shown to the user once) and their hashes
+func newRecoveryCodes() ([]string, []string, error) {
+	codes := make([]string, recoveryCodeCount)
+	hashes := make([]string, recoveryCodeCount)
+	for i := range codes {
+		b := make([]byte, 5)
+		if _, err := rand.Read(b); err != nil {
+			return nil, nil, err
+		}
+		c := strings.ToLower(b32.EncodeToString(b)) // 8 characters
+		codes[i] = c[:4] + "-" + c[4:]
+		hashes[i] = hashToken(c)
+	}
+	return codes, hashes, nil
+}
+
+// normalizeRecoveryCode accepts codes typed with or without the dash and in any case
+func normalizeRecoveryCode(code string) string {
+	return strings.ToLower(strings.NewReplacer("-", "", " ", "").Replace(code))
+}
+
+// getTwoFactor returns the user's TOTP settings, or nil when never enrolled
+func getTwoFactor(ctx context.Context, userID primitive.ObjectID) (*TwoFactor, error) {
+	var tf TwoFactor
+	err := database.Collection("two_factor").FindOne(ctx, bson.M{"_id": userID}).Decode(&tf)
+	if errors.Is(err, mongo.ErrNoDocuments) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &tf, nil
+}
+
+// checkSecondFactor accepts a TOTP code (each code works once) or a recovery code
+// (removed when used) and reports which one matched
+func checkSecondFactor(ctx context.Context, tf *TwoFactor, code, recoveryCode string) (string, bool, error) {
+	coll := database.Collection("two_factor")
+	if code = strings.TrimSpace(code); code != "" {
+		step, ok := totpMatch(tf.Secret, code, time.Now())
+		if !ok {
+			return "", false, nil
+		}
+		res, err := coll.UpdateOne(ctx,
+			bson.M{"_id": tf.UserID, "last_step": bson.M{"$lt": step}},
+			bson.M{"$set": bson.M{"last_step": step}},
+		)
+		if err != nil {
+			return "", false, err
+		}
+		return "totp", res.ModifiedCount == 1, nil
+	}
+	if recoveryCode = normalizeRecoveryCode(recoveryCode); recoveryCode != "" && tf.Enabled {
+		h := hashToken(recoveryCode)
+		res, err := coll.UpdateOne(ctx,
+			bson.M{"_id": tf.UserID, "recovery_hashes": h},
+			bson.M{"$pull": bson.M{"recovery_hashes": h}},
+		)
+		if err != nil {
+			return "", false, err
+		}
+		return "recovery_code", res.ModifiedCount == 1, nil
+	}
+	return "", false, nil
+}
+
+// completeLogin finishes a first-factor login (password, Google, OIDC). Users with 2FA
+// get a challenge token for /api/auth/2fa/verify instead of a session.
+func completeLogin(w http.ResponseWriter, r *http.Request, user *User, message string) {
+	if reason := accountBlocked(user); reason != "" {
+		JSONError(w, http.StatusForbidden, reason)
+		return
+	}
+	userID, err := primitive.ObjectIDFromHex(user.ID)
+	if err != nil {
+		JSONError(w, http.StatusInternalServerError, "Internal server error")
+		return
+	}
+	ctx, cancel := context.WithTimeout(r.Context(), 5*time.Second)
+	defer cancel()
+
+	tf, err := getTwoFactor(ctx, userID)
+	if err != nil {
+		log.Printf("[2fa] lookup error for user=%s: %v", user.ID, err)
+		JSONError(w, http.StatusInternalServerError, "Internal server error")
+		return
+	}
+	if tf != nil && tf.Enabled {
+		challenge, err := randomToken(32)
+		if err != nil {
+			JSONError(w, http.StatusInternalServerError, "Internal server error")
+			return
+		}
+		now := time.Now()
+		if _, err := database.Collection("login_challenges").InsertOne(ctx, LoginChallenge{
+			ID:        hashToken(challenge),
+			UserID:    userID,
+			CreatedAt: now,
+			ExpiresAt: now.Add(loginChallengeTTL),
+		}); err != nil {
+			log.Printf("[2fa] challenge error for user=%s: %v", user.ID, err)
+			JSONError(w, http.StatusInternalServerError, "Internal server error")
+			return
+		}
+		JSONResponse(w, http.StatusOK, map[string]interface{}{
+			"success":             true,
+			"message":             "Enter the code from your authenticator app",
+			"two_factor_required": true,
+			"challenge_token":     challenge,
+			"expires_in":          int(loginChallengeTTL.Seconds()),
+		})
+		return
+	}
+
+	clearLoginFailures(ctx, user.Email, clientIP(r))
+	// Start a device session: short-lived access token + rotating refresh token
+	tokens, err := startSession(r, user)
+	if err != nil {
+		log.Printf("Error starting session: %v", err)
+		JSONError(w, http.StatusInternalServerError, "Internal server error")
+		return
+	}
+	JSONResponse(w, http.StatusOK, tokens.tokenResponse(map[string]interface{}{
+		"success": true,
+		"message": message,
+		"user":    user,
+	}))
+}
+
+// twoFactorRequest is the body of the 2FA endpoints: a TOTP code or a recovery code
+type twoFactorRequest struct {
+	ChallengeToken string `json:"challenge_token"`
+	Code           string `json:"code"`
+	RecoveryCode   string `json:"recovery_code"`
+}
+
+// handleTwoFactorVerify is the second login step: exchanges the challenge token and a
+// code for a session
+func handleTwoFactorVerify(w http.ResponseWriter, r *http.Request) {
+	var body twoFactorRequest
+	if err := json.NewDecoder(r.Body).Decode(&body); err != nil || body.ChallengeToken == "" {
+		JSONError(w, http.StatusBadRequest, "challenge_token and code are required")
+		return
+	}
+	ctx, cancel := context.WithTimeout(r.Context(), 5*time.Second)
+	defer cancel()
+
+	// Every attempt is counted before the code is checked, so guessing is bounded
+	var ch LoginChallenge
+	err := database.Collection("login_challenges").FindOneAndUpdate(ctx,
+		bson.M{
+			"_id":        hashToken(body.ChallengeToken),
+			"expires_at": bson.M{"$gt": time.Now()},
+			"attempts":   bson.M{"$lt": loginChallengeAttempts},
+		},
+		bson.M{"$inc": bson.M{"attempts": 1}},
+		options.FindOneAndUpdate().SetReturnDocument(options.After),
+	).Decode(&ch)
+	if errors.Is(err, mongo.ErrNoDocuments) {
+		JSONError(w, http.StatusUnauthorized, "Sign-in expired, please enter your password again")
+		return
+	}
+	if err != nil {
+		log.Printf("[2fa] challenge lookup error: %v", err)
+		JSONError(w, http.StatusInternalServerError, "Internal server error")
+		return
+	}
+
+	user, err := GetUserByID(ch.UserID.Hex())
+	if err != nil {
+		JSONError(w, http.StatusUnauthorized, "User not found")
+		return
+	}
+	// Wrong codes count toward the same lockout as wrong passwords, so signing in
+	// with the password again does not buy more guesses
+	if wait := loginLockRemaining(ctx, user.Email, clientIP(r)); wait > 0 {
+		writeLoginLocked(w, wait)
+		return
+	}
+
+	tf, err := getTwoFactor(ctx, ch.UserID)
+	if err != nil || tf == nil || !tf.Enabled {
+		JSONError(w, http.StatusUnauthorized, "Sign-in expired, please enter your password again")
+		return
+	}
+	method, ok, err := checkSecondFactor(ctx, tf, body.Code, body.RecoveryCode)
+	if err != nil {
+		log.Printf("[2fa] verify error for user=%s: %v", ch.UserID.Hex(), err)
+		JSONError(w, http.StatusInternalServerError, "Internal server error")
+		return
+	}
+	if !ok {
+		if wait := recordLoginFailure(ctx, user.Email, clientIP(r)); wait > 0 {
+			database.Collection("login_challenges").DeleteOne(ctx, bson.M{"_id": ch.ID})
+			writeLoginLocked(w, wait)
+			return
+		}
+		JSONErrorWithDetails(w, http.StatusUnauthorized, "Invalid code", map[string]interface{}{
+			"attempts_left": loginChallengeAttempts - ch.Attempts,
+		})
+		return
+	}
+	database.Collection("login_challenges").DeleteOne(ctx, bson.M{"_id": ch.ID})
+	clearLoginFailures(ctx, user.Email, clientIP(r))
+
+	if reason := accountBlocked(user); reason != "" {
+		JSONError(w, http.StatusForbidden, reason)
+		return
+	}
+	tokens, err := startSession(r, user)
+	if err != nil {
+		log.Printf("Error starting session: %v", err)
+		JSONError(w, http.StatusInternalServerError, "Internal server error")
+		return
+	}
+	resp := map[string]interface{}{
+		"success": true,
+		"message": "Login successful",
+		"user":    user,
+	}
+	if method == "recovery_code" {
+		resp["recovery_codes_left"] = len(tf.RecoveryHashes) - 1
+	}
+	JSONResponse(w, http.StatusOK, tokens.tokenResponse(resp))
+}
+
+// handleTwoFactorStatus reports whether 2FA is on for the current user
+func handleTwoFactorStatus(w http.ResponseWriter, r *http.Request) {
+	auth := authFromContext(r)
+	tf, err := getTwoFactor(r.Context(), auth.UserID)
+	if err != nil {
+		JSONError(w, http.StatusInternalServerError, "Internal server error")
+		return
+	}
+	status := map[string]interface{}{"enabled": false}
+	if tf != nil && tf.Enabled {
+		status = map[string]interface{}{
+			"enabled":             true,
+			"enabled_at":          tf.EnabledAt,
+			"recovery_codes_left": len(tf.RecoveryHashes),
+		}
+	}
+	JSONSuccess(w, status)
+}
+
+// handleTwoFactorEnroll creates a new TOTP secret; 2FA turns on only after
+// /api/auth/2fa/confirm proves the authenticator app has it
+func handleTwoFactorEnroll(w http.ResponseWriter, r *http.Request) {
+	auth := authFromContext(r)
+	ctx, cancel := context.WithTimeout(r.Context(), 5*time.Second)
+	defer cancel()
+
+	tf, err := getTwoFactor(ctx, auth.UserID)
+	if err != nil {
+		JSONError(w, http.StatusInternalServerError, "Internal server error")
+		return
+	}
+	if tf != nil && tf.Enabled {
+		JSONError(w, http.StatusConflict, "Two-factor authentication is already enabled")
+		return
+	}
+	user, err := GetUserByID(auth.UserID.Hex())
+	if err != nil {
+		JSONError(w, http.StatusNotFound, "User not found")
+		return
+	}
+
+	raw := make([]byte, 20)
+	if _, err := rand.Read(raw); err != nil {
+		JSONError(w, http.StatusInternalServerError, "Internal server error")
+		return
+	}
+	secret := b32.EncodeToString(raw)
+	if _, err := database.Collection("two_factor").ReplaceOne(ctx, bson.M{"_id": auth.UserID}, TwoFactor{
+		UserID:    auth.UserID,
+		Secret:    secret,
+		CreatedAt: time.Now(),
+	}, options.Replace().SetUpsert(true)); err != nil {
+		log.Printf("[2fa] enroll error for user=%s: %v", user.ID, err)
+		JSONError(w, http.StatusInternalServerError, "Internal server error")
+		return
+	}
+	JSONSuccess(w, map[string]interface{}{
+		"secret":      secret,
+		"otpauth_uri": otpauthURI(user.Email, secret),
+	})
+}
+
+// handleTwoFactorConfirm turns 2FA on with the first code from the app and returns
+// the recovery codes (the only time they are shown)
+func handleTwoFactorConfirm(w http.ResponseWriter, r *http.Request) {
+	auth := authFromContext(r)
+	var body twoFactorRequest
+	if err := json.NewDecoder(r.Body).Decode(&body); err != nil || body.Code == "" {
+		JSONError(w, http.StatusBadRequest, "code is required")
+		return
+	}
+	ctx, cancel := context.WithTimeout(r.Context(), 5*time.Second)
+	defer cancel()
+
+	tf, err := getTwoFactor(ctx, auth.UserID)
+	if err != nil {
+		JSONError(w, http.StatusInternalServerError, "Internal server error")
+		return
+	}
+	if tf == nil {
+		JSONError(w, http.StatusBadRequest, "Start enrollment first")
+		return
+	}
+	if tf.Enabled {
+		JSONError(w, http.StatusConflict, "Two-factor authentication is already enabled")
+		return
+	}
+	if _, ok, err := checkSecondFactor(ctx, tf, body.Code, ""); err != nil || !ok {
+		JSONError(w, http.StatusBadRequest, "Invalid code")
+		return
+	}
+	codes, hashes, err := newRecoveryCodes()
+	if err != nil {
+		JSONError(w, http.StatusInternalServerError, "Internal server error")
+		return
+	}
+	now := time.Now()
+	if _, err := database.Collection("two_factor").UpdateOne(ctx, bson.M{"_id": auth.UserID},
+		bson.M{"$set": bson.M{"enabled": true, "enabled_at": now, "recovery_hashes": hashes}},
+	); err != nil {
+		log.Printf("[2fa] confirm error for user=%s: %v", auth.UserID.Hex(), err)
+		JSONError(w, http.StatusInternalServerError, "Internal server error")
+		return
+	}
+	JSONSuccess(w, map[string]interface{}{
+		"enabled":        true,
+		"recovery_codes": codes,
+	})
+}
+
+// requireEnabledTwoFactor loads the user's 2FA and checks a code for endpoints that
+// change it; writes the error response and returns nil when the check fails
+func requireEnabledTwoFactor(w http.ResponseWriter, r *http.Request, body twoFactorRequest) *TwoFactor {
+	auth := authFromContext(r)
+	tf, err := getTwoFactor(r.Context(), auth.UserID)
+	if err != nil {
+		JSONError(w, http.StatusInternalServerError, "Internal server error")
+		return nil
+	}
+	if tf == nil || !tf.Enabled {
+		JSONError(w, http.StatusBadRequest, "Two-factor authentication is not enabled")
+		return nil
+	}
+	_, ok, err := checkSecondFactor(r.Context(), tf, body.Code, body.RecoveryCode)
+	if err != nil {
+		JSONError(w, http.StatusInternalServerError, "Internal server error")
+		return nil
+	}
+	if !ok {
+		JSONError(w, http.StatusBadRequest, "Invalid code")
+		return nil
+	}
+	return tf
+}
+
+// handleTwoFactorDisable turns 2FA off; requires a current code or a recovery code
+func handleTwoFactorDisable(w http.ResponseWriter, r *http.Request) {
+	var body twoFactorRequest
+	if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+		JSONError(w, http.StatusBadRequest, "Invalid request body")
+		return
+	}
+	tf := requireEnabledTwoFactor(w, r, body)
+	if tf == nil {
+		return
+	}
+	if _, err := database.Collection("two_factor").DeleteOne(r.Context(), bson.M{"_id": tf.UserID}); err != nil {
+		JSONError(w, http.StatusInternalServerError, "Internal server error")
+		return
+	}
+	JSONResponse(w, http.StatusOK, map[string]interface{}{"success": true, "message": "Two-factor authentication disabled"})
+}
+
+// handleTwoFactorRecoveryCodes replaces all recovery codes with new ones
+func handleTwoFactorRecoveryCodes(w http.ResponseWriter, r *http.Request) {
+	var body twoFactorRequest
+	if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+		JSONError(w, http.StatusBadRequest, "Invalid request body")
+		return
+	}
+	tf := requireEnabledTwoFactor(w, r, body)
+	if tf == nil {
+		return
+	}
+	codes, hashes, err := newRecoveryCodes()
+	if err != nil {
+		JSONError(w, http.StatusInternalServerError, "Internal server error")
+		return
+	}
+	if _, err := database.Collection("two_factor").UpdateOne(r.Context(), bson.M{"_id": tf.UserID},
+		bson.M{"$set": bson.M{"recovery_hashes": hashes}},
+	); err != nil {
+		JSONError(w, http.StatusInternalServerError, "Internal server error")
+		return
+	}
+	JSONSuccess(w, map[string]interface{}{"recovery_codes": codes})
+}
@@ -0,0 +1,674 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/md5"
+	"crypto/sha1"
+	"crypto/sha256"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gorilla/mux"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// Resumable uploads follow tus 1.0.0 (https://tus.io/protocols/resumable-upload) with the
+// creation, termination, checksum and expiration extensions. A finished upload becomes
+// a transcription job, exactly like a multipart POST /api/transcribe.
+const (
+	tusVersion      = "1.0.0"
+	tusExtensions   = "creation,termination,checksum,expiration"
+	tusChecksums    = "sha1,sha256,md5"
+	maxUploadSize   = 1024 << 20 // same cap as the multipart form of /api/transcribe
+	uploadTTL       = 24 * time.Hour
+	uploadSweepStep = time.Hour
+	// A finishing upload belongs to the request that claimed it for uploadFinishTimeout;
+	// after that the instance is presumed dead and a retried last PATCH takes over
+	uploadFinishTimeout = 15 * time.Minute
+	// How long a retried last PATCH waits for the request that is finishing the upload
+	uploadFinishWait = 30 * time.Second
+
+	statusChecksumMismatch = 460 // defined by the tus checksum extension
+)
+
+// uploadsDir is where a chunk is spooled while it is being received
+// (UPLOADS_DIR, default $TMPDIR/speakapper-uploads)
+func uploadsDir() string {
+	if d := os.Getenv("UPLOADS_DIR"); d != "" {
+		return d
+	}
+	return filepath.Join(os.TempDir(), "speakapper-uploads")
+}
+
+// uploadPartKey names the blob of one accepted chunk. Keys are unique per request, so a
+// request that loses the race for an offset only ever deletes its own part.
+func uploadPartKey(id primitive.ObjectID, offset int64) string {
+	return fmt.Sprintf("uploads/%s/%012d-%s", id.Hex(), offset, primitive.NewObjectID().Hex())
+}
+
+// uploadLocks keeps two PATCH requests of this instance from writing one upload at once.
+// Across instances the offset check when a part is recorded decides which request wins.
+var uploadLocks sync.Map // upload ID -> *sync.Mutex
+
+func lockUpload(id primitive.ObjectID) (unlock func(), ok bool) {
+	v, _ := uploadLocks.LoadOrStore(id, &sync.Mutex{})
+	mu := v.(*sync.Mutex)
+	if !mu.TryLock() {
+		return nil, false
+	}
+	return mu.Unlock, true
+}
+
+// tusDiscovery answers the tus OPTIONS request with the server's capabilities. It has
+// to wrap the CORS middleware, which consumes every OPTIONS request itself.
+func tusDiscovery(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == http.MethodOptions && strings.HasPrefix(r.URL.Path, "/api/uploads") {
+			h := w.Header()
+			h.Set("Tus-Resumable", tusVersion)
+			h.Set("Tus-Version", tusVersion)
+			h.Set("Tus-Extension", tusExtensions)
+			h.Set("Tus-Max-Size", strconv.FormatInt(maxUploadSize, 10))
+			h.Set("Tus-Checksum-Algorithm", tusChecksums)
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// requireTusVersion sets Tus-Resumable on the response and rejects clients speaking
+// another protocol version with 412
+func requireTusVersion(w http.ResponseWriter, r *http.Request) bool {
+	w.Header().Set("Tus-Resumable", tusVersion)
+	if r.Header.Get("Tus-Resumable") != tusVersion {
+		w.Header().Set("Tus-Version", tusVersion)
+		JSONError(w, http.StatusPreconditionFailed, "Unsupported tus version, expected Tus-Resumable: "+tusVersion)
+		return false
+	}
+	return true
+}
+
+// parseUploadMetadata decodes Upload-Metadata: comma-separated "key base64(value)" pairs
+func parseUploadMetadata(header string) map[string]string {
+	meta := map[string]string{}
+	for _, pair := range strings.Split(header, ",") {
+		key, value, _ := strings.Cut(strings.TrimSpace(pair), " ")
+		if key == "" {
+			continue
+		}
+		decoded, err := base64.StdEncoding.DecodeString(value)
+		if err != nil {
+			continue
+		}
+		meta[key] = string(decoded)
+	}
+	return meta
+}
+
+// newChecksumHash returns the hash of an Upload-Checksum algorithm, nil if unsupported
+func newChecksumHash(algo string) hash.Hash {
+	switch algo {
+	case "sha1":
+		return sha1.New()
+	case "sha256":
+		return sha256.New()
+	case "md5":
+		return md5.New()
+	}
+	return nil
+}
+
+// setUploadHeaders describes the upload's progress in tus headers
+func setUploadHeaders(w http.ResponseWriter, u *Upload) {
+	h := w.Header()
+	h.Set("Upload-Offset", strconv.FormatInt(u.Offset, 10))
+	h.Set("Upload-Length", strconv.FormatInt(u.Length, 10))
+	h.Set("Upload-Expires", u.ExpiresAt.UTC().Format(http.TimeFormat))
+	h.Set("Cache-Control", "no-store")
+	if u.JobID != nil {
+		h.Set("Upload-Job-Id", u.JobID.Hex())
+	}
+}
+
+// finishStale reports whether the request finishing the upload is presumed dead
+func (u *Upload) finishStale() bool {
+	return u.Status == UploadFinishing && time.Since(u.UpdatedAt) > uploadFinishTimeout
+}
+
+// getUpload loads an upload of the user
+func getUpload(ctx context.Context, id, userID primitive.ObjectID) (*Upload, error) {
+	var u Upload
+	if err := database.Collection("uploads").FindOne(ctx, bson.M{"_id": id, "user_id": userID}).Decode(&u); err != nil {
+		return nil, err
+	}
+	return &u, nil
+}
+
+// uploadFromRequest loads the {id} upload of the current user, writing 404 or 410 on failure
+func uploadFromRequest(w http.ResponseWriter, r *http.Request) (*Upload, bool) {
+	id, err := primitive.ObjectIDFromHex(mux.Vars(r)["id"])
+	if err != nil {
+		JSONError(w, http.StatusNotFound, "Upload not found")
+		return nil, false
+	}
+	u, err := getUpload(r.Context(), id, authFromContext(r).UserID)
+	if err != nil {
+		if !errors.Is(err, mongo.ErrNoDocuments) {
+			log.Printf("[uploads] lookup error: %v", err)
+		}
+		JSONError(w, http.StatusNotFound, "Upload not found")
+		return nil, false
+	}
+	if u.Status == UploadInProgress && time.Now().After(u.ExpiresAt) {
+		JSONError(w, http.StatusGone, "Upload has expired")
+		return nil, false
+	}
+	return u, true
+}
+
+// handleCreateUpload starts an upload (tus creation). Upload-Length is required;
+// Upload-Metadata may carry filename, language and source (upload|recording).
+func handleCreateUpload(w http.ResponseWriter, r *http.Request) {
+	if !requireTusVersion(w, r) {
+		return
+	}
+	userID := authFromContext(r).UserID
+	if !requireQuota(w, userID, UsageAudio) {
+		return
+	}
+	length, err := strconv.ParseInt(r.Header.Get("Upload-Length"), 10, 64)
+	if err != nil || length <= 0 {
+		JSONError(w, http.StatusBadRequest, "Upload-Length must be a positive number of bytes")
+		return
+	}
+	if length > maxUploadSize {
+		JSONError(w, http.StatusRequestEntityTooLarge, "Upload is larger than "+strconv.Itoa(maxUploadSize>>20)+" MB")
+		return
+	}
+
+	meta := parseUploadMetadata(r.Header.Get("Upload-Metadata"))
+	now := time.Now()
+	u := Upload{
+		ID:        primitive.NewObjectID(),
+		UserID:    userID,
+		Filename:  filepath.Base(meta["filename"]),
+		Source:    TranscriptSourceUpload,
+		Language:  meta["language"],
+		Length:    length,
+		Status:    UploadInProgress,
+		CreatedAt: now,
+		UpdatedAt: now,
+		ExpiresAt: now.Add(uploadTTL),
+	}
+	if u.Filename == "." || u.Filename == string(filepath.Separator) {
+		u.Filename = "audio"
+	}
+	if meta["source"] == TranscriptSourceRecording {
+		u.Source = TranscriptSourceRecording
+	}
+	if u.Language == "auto" {
+		u.Language = ""
+	}
+
+	if _, err := database.Collection("uploads").InsertOne(r.Context(), u); err != nil {
+		log.Printf("[uploads] create error for user=%s: %v", userID.Hex(), err)
+		JSONError(w, http.StatusInternalServerError, "Failed to create upload")
+		return
+	}
+	log.Printf("[uploads] %s started: %s, %d bytes", u.ID.Hex(), u.Filename, u.Length)
+
+	w.Header().Set("Location", "/api/uploads/"+u.ID.Hex())
+	w.Header().Set("Upload-Expires", u.ExpiresAt.UTC().Format(http.TimeFormat))
+	w.WriteHeader(http.StatusCreated)
+}
+
+// handleUploadStatus reports the offset to resume from (HEAD); GET returns the upload
+// as JSON, including the job it turned into
+func handleUploadStatus(w http.ResponseWriter, r *http.Request) {
+	if r.Method == http.MethodHead && !requireTusVersion(w, r) {
+		return
+	}
+	u, ok := uploadFromRequest(w, r)
+	if !ok {
+		return
+	}
+	setUploadHeaders(w, u)
+	if r.Method == http.MethodHead {
+		w.WriteHeader(http.StatusOK)
+		return
+	}
+	JSONSuccess(w, u)
+}
+
+// handlePatchUpload appends a chunk at Upload-Offset. Chunks are kept in the blob store,
+// so any instance can take the next one. Without Upload-Checksum the bytes that arrived
+// before a dropped connection are kept, so the client resumes after them; with a checksum
+// a chunk is kept only whole and verified. The last chunk hands the file to the
+// transcription pipeline and returns the job in Upload-Job-Id.
+func handlePatchUpload(w http.ResponseWriter, r *http.Request) {
+	if !requireTusVersion(w, r) {
+		return
+	}
+	if r.Header.Get("Content-Type") != "application/offset+octet-stream" {
+		JSONError(w, http.StatusUnsupportedMediaType, "Content-Type must be application/offset+octet-stream")
+		return
+	}
+	offset, err := strconv.ParseInt(r.Header.Get("Upload-Offset"), 10, 64)
+	if err != nil || offset < 0 {
+		JSONError(w, http.StatusBadRequest, "Upload-Offset must be a non-negative number")
+		return
+	}
+	var hasher hash.Hash
+	var wantSum []byte
+	if v := r.Header.Get("Upload-Checksum"); v != "" {
+		algo, sum, _ := strings.Cut(v, " ")
+		if hasher = newChecksumHash(algo); hasher == nil {
+			JSONError(w, http.StatusBadRequest, "Unsupported checksum algorithm, expected one of "+tusChecksums)
+			return
+		}
+		if wantSum, err = base64.StdEncoding.DecodeString(sum); err != nil {
+			JSONError(w, http.StatusBadRequest, "Upload-Checksum must be base64-encoded")
+			return
+		}
+	}
+
+	u, ok := uploadFromRequest(w, r)
+	if !ok {
+		return
+	}
+	unlock, ok := lockUpload(u.ID)
+	if !ok {
+		JSONError(w, http.StatusLocked, "Upload is being written by another request")
+		return
+	}
+	defer unlock()
+	// A request that held the lock may have moved the offset or finished the upload
+	if u, err = getUpload(r.Context(), u.ID, u.UserID); err != nil {
+		JSONError(w, http.StatusNotFound, "Upload not found")
+		return
+	}
+	if offset == u.Length && (u.Status == UploadCompleted || u.Status == UploadFinishing && !u.finishStale()) {
+		// The client retries the last chunk after losing our response, or the upload is
+		// being finished by another request, possibly on another instance
+		if awaitFinishedUpload(w, r, u) {
+			setUploadHeaders(w, u)
+			w.WriteHeader(http.StatusNoContent)
+		}
+		return
+	}
+	if u.Status != UploadInProgress && !u.finishStale() {
+		JSONError(w, http.StatusConflict, "Upload is already "+u.Status)
+		return
+	}
+	if offset != u.Offset {
+		JSONErrorWithDetails(w, http.StatusConflict, "Upload-Offset does not match the upload", map[string]interface{}{"offset": u.Offset})
+		return
+	}
+	remaining := u.Length - u.Offset
+	if r.ContentLength > remaining {
+		JSONError(w, http.StatusRequestEntityTooLarge, "Chunk goes past Upload-Length")
+		return
+	}
+
+	spool, n, copyErr, err := spoolUploadChunk(u, r.Body, hasher)
+	if err != nil {
+		log.Printf("[uploads] %s write error: %v", u.ID.Hex(), err)
+		JSONError(w, http.StatusInternalServerError, "Failed to store chunk")
+		return
+	}
+	defer os.Remove(spool)
+	if n > remaining {
+		JSONError(w, http.StatusRequestEntityTooLarge, "Chunk goes past Upload-Length")
+		return
+	}
+	if hasher != nil && (copyErr != nil || !bytes.Equal(hasher.Sum(nil), wantSum)) {
+		JSONError(w, statusChecksumMismatch, "Checksum mismatch")
+		return
+	}
+	if n > 0 {
+		part, err := storeUploadPart(u, spool, n)
+		if err != nil {
+			log.Printf("[uploads] %s could not store the chunk at %d: %v", u.ID.Hex(), u.Offset, err)
+			JSONError(w, http.StatusInternalServerError, "Failed to store chunk")
+			return
+		}
+		// Another instance may have appended at this offset in the meantime
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		res, err := database.Collection("uploads").UpdateOne(ctx,
+			bson.M{"_id": u.ID, "offset": u.Offset, "status": UploadInProgress},
+			bson.M{
+				"$set":  bson.M{"offset": u.Offset + n, "updated_at": time.Now()},
+				"$push": bson.M{"parts": part},
+			},
+		)
+		cancel()
+		if err != nil || res.MatchedCount == 0 {
+			deleteUploadParts([]UploadPart{part})
+			JSONError(w, http.StatusConflict, "Upload changed while writing the chunk")
+			return
+		}
+		u.Offset += n
+		u.Parts = append(u.Parts, part)
+	}
+	if copyErr != nil {
+		// The client is gone; it will ask for the offset with HEAD and resume
+		log.Printf("[uploads] %s interrupted at %d of %d bytes: %v", u.ID.Hex(), u.Offset, u.Length, copyErr)
+		return
+	}
+
+	if u.Offset == u.Length && !finishUpload(w, r, u) {
+		return
+	}
+	setUploadHeaders(w, u)
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// spoolUploadChunk saves the request body to a temporary file, since the blob store needs
+// the size up front. It reads at most one byte past the remaining length so oversized
+// chunks can be detected. copyErr is a failure reading the request, err a failure of the
+// file; the caller removes path.
+func spoolUploadChunk(u *Upload, body io.Reader, hasher hash.Hash) (path string, n int64, copyErr, err error) {
+	if err := os.MkdirAll(uploadsDir(), 0o755); err != nil {
+		return "", 0, nil, err
+	}
+	f, err := os.CreateTemp(uploadsDir(), u.ID.Hex()+"-*")
+	if err != nil {
+		return "", 0, nil, err
+	}
+	var dst io.Writer = f
+	if hasher != nil {
+		dst = io.MultiWriter(f, hasher)
+	}
+	n, copyErr = io.Copy(dst, io.LimitReader(body, u.Length-u.Offset+1))
+	var pathErr *os.PathError
+	if errors.As(copyErr, &pathErr) {
+		f.Close()
+		os.Remove(f.Name())
+		return "", n, nil, copyErr
+	}
+	if err := f.Close(); err != nil {
+		os.Remove(f.Name())
+		return "", n, nil, err
+	}
+	return f.Name(), n, copyErr, nil
+}
+
+// storeUploadPart uploads a spooled chunk of n bytes starting at u.Offset. It does not
+// use the request context: bytes that arrived before the client dropped are kept.
+func storeUploadPart(u *Upload, spool string, n int64) (UploadPart, error) {
+	part := UploadPart{Key: uploadPartKey(u.ID, u.Offset), Size: n}
+	f, err := os.Open(spool)
+	if err != nil {
+		return part, err
+	}
+	defer f.Close()
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Minute)
+	defer cancel()
+	return part, blobStore.Put(ctx, part.Key, f, n, "application/octet-stream")
+}
+
+// deleteUploadParts removes the blobs of an upload's chunks; failures leave orphans only
+func deleteUploadParts(parts []UploadPart) {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+	defer cancel()
+	for _, p := range parts {
+		if err := blobStore.Delete(ctx, p.Key); err != nil {
+			log.Printf("[uploads] failed to delete part %s: %v", p.Key, err)
+		}
+	}
+}
+
+// assembleUpload concatenates the parts of a complete upload into path
+func assembleUpload(ctx context.Context, u *Upload, path string) error {
+	out, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+	for _, p := range u.Parts {
+		body, err := blobStore.Open(ctx, p.Key, 0, -1)
+		if err != nil {
+			out.Close()
+			return fmt.Errorf("part %s: %w", p.Key, err)
+		}
+		_, err = io.Copy(out, body)
+		body.Close()
+		if err != nil {
+			out.Close()
+			return fmt.Errorf("part %s: %w", p.Key, err)
+		}
+	}
+	return out.Close()
+}
+
+// claimUploadFinish moves a complete upload to finishing. Only one request across all
+// instances wins; a finishing upload whose request died is claimed again.
+func claimUploadFinish(ctx context.Context, u *Upload) (bool, error) {
+	now := time.Now()
+	res, err := database.Collection("uploads").UpdateOne(ctx,
+		bson.M{
+			"_id":    u.ID,
+			"offset": u.Length,
+			"$or": []bson.M{
+				{"status": UploadInProgress},
+				{"status": UploadFinishing, "updated_at": bson.M{"$lt": now.Add(-uploadFinishTimeout)}},
+			},
+		},
+		bson.M{"$set": bson.M{"status": UploadFinishing, "updated_at": now}},
+	)
+	if err != nil {
+		return false, err
+	}
+	if res.ModifiedCount == 0 {
+		return false, nil
+	}
+	u.Status = UploadFinishing
+	u.UpdatedAt = now
+	return true, nil
+}
+
+// awaitFinishedUpload waits up to uploadFinishWait for the request finishing u and
+// updates u with the result. It returns true for a completed upload; otherwise the
+// response is written: 423 while it is still finishing, 409 if it failed.
+func awaitFinishedUpload(w http.ResponseWriter, r *http.Request, u *Upload) bool {
+	ctx, cancel := context.WithTimeout(r.Context(), uploadFinishWait)
+	defer cancel()
+	for u.Status == UploadFinishing && !u.finishStale() {
+		select {
+		case <-ctx.Done():
+			w.Header().Set("Retry-After", "5")
+			JSONError(w, http.StatusLocked, "Upload is being finished by another request")
+			return false
+		case <-time.After(250 * time.Millisecond):
+		}
+		next, err := getUpload(ctx, u.ID, u.UserID)
+		if err != nil {
+			if ctx.Err() != nil {
+				continue
+			}
+			JSONError(w, http.StatusNotFound, "Upload not found")
+			return false
+		}
+		*u = *next
+	}
+	switch {
+	case u.Status == UploadCompleted:
+		return true
+	case u.Status == UploadFailed:
+		JSONError(w, http.StatusConflict, "Upload is already failed: "+u.Error)
+		return false
+	default:
+		// The request that claimed it is gone
+		return finishUpload(w, r, u)
+	}
+}
+
+// finishUpload assembles the parts into a new transcription job. It first claims the
+// upload, so a last PATCH retried on another instance cannot create a second job; the
+// loser answers with the winner's result. On failure it writes the error response,
+// marks the upload failed and returns false.
+func finishUpload(w http.ResponseWriter, r *http.Request, u *Upload) bool {
+	claimed, err := claimUploadFinish(r.Context(), u)
+	if err != nil {
+		log.Printf("[uploads] %s could not be claimed: %v", u.ID.Hex(), err)
+		JSONError(w, http.StatusInternalServerError, "Failed to finish upload")
+		return false
+	}
+	if !claimed {
+		next, err := getUpload(r.Context(), u.ID, u.UserID)
+		if err != nil {
+			JSONError(w, http.StatusNotFound, "Upload not found")
+			return false
+		}
+		*u = *next
+		if u.Status == UploadInProgress {
+			// Not complete after all: there is nothing to finish
+			JSONErrorWithDetails(w, http.StatusConflict, "Upload-Offset does not match the upload", map[string]interface{}{"offset": u.Offset})
+			return false
+		}
+		return awaitFinishedUpload(w, r, u)
+	}
+
+	job := &TranscriptionJob{
+		ID:       primitive.NewObjectID(),
+		UserID:   u.UserID,
+		Source:   u.Source,
+		Filename: u.Filename,
+		Size:     u.Length,
+		Language: u.Language,
+		Mode:     "single",
+	}
+	if u.Length > longAudioThreshold {
+		job.Mode = "segmented"
+	}
+	workDir := jobWorkDir(job.ID)
+	job.InputPath = filepath.Join(workDir, "input"+filepath.Ext(job.Filename))
+	err = os.MkdirAll(workDir, 0o755)
+	if err == nil {
+		if err = assembleUpload(r.Context(), u, job.InputPath); err != nil {
+			os.RemoveAll(workDir)
+		}
+	}
+	if err == nil {
+		err = submitUploadedJob(r, job)
+	}
+	if err != nil {
+		failUpload(u, err)
+		if errors.Is(err, errBlobNotFound) {
+			log.Printf("[uploads] %s lost a part: %v", u.ID.Hex(), err)
+			JSONError(w, http.StatusGone, "Upload data is no longer available, start a new upload")
+			return false
+		}
+		if ue, ok := err.(*UpgradeRequiredError); ok {
+			writeUpgradeRequired(w, ue)
+			return false
+		}
+		log.Printf("[uploads] %s could not start a job: %v", u.ID.Hex(), err)
+		JSONError(w, http.StatusInternalServerError, "Failed to create transcription job")
+		return false
+	}
+
+	// The job has its own copy now
+	deleteUploadParts(u.Parts)
+	u.Status = UploadCompleted
+	u.JobID = &job.ID
+	u.Parts = nil
+	if _, err := database.Collection("uploads").UpdateOne(r.Context(), bson.M{"_id": u.ID}, bson.M{
+		"$set":   bson.M{"status": UploadCompleted, "job_id": job.ID, "updated_at": time.Now()},
+		"$unset": bson.M{"parts": ""},
+	}); err != nil {
+		log.Printf("[uploads] %s failed to record job %s: %v", u.ID.Hex(), job.ID.Hex(), err)
+	}
+	log.Printf("[uploads] %s complete, job %s queued", u.ID.Hex(), job.ID.Hex())
+	return true
+}
+
+// failUpload records why a complete upload did not become a job
+func failUpload(u *Upload, cause error) {
+	deleteUploadParts(u.Parts)
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if _, err := database.Collection("uploads").UpdateOne(ctx, bson.M{"_id": u.ID}, bson.M{
+		"$set":   bson.M{"status": UploadFailed, "error": cause.Error(), "updated_at": time.Now()},
+		"$unset": bson.M{"parts": ""},
+	}); err != nil {
+		log.Printf("[uploads] %s failed to record failure: %v", u.ID.Hex(), err)
+	}
+}
+
+// handleDeleteUpload terminates an upload (tus termination) and drops its bytes.
+// A job created from a finished upload keeps running.
+func handleDeleteUpload(w http.ResponseWriter, r *http.Request) {
+	if !requireTusVersion(w, r) {
+		return
+	}
+	u, ok := uploadFromRequest(w, r)
+	if !ok {
+		return
+	}
+	unlock, ok := lockUpload(u.ID)
+	if !ok {
+		JSONError(w, http.StatusLocked, "Upload is being written by another request")
+		return
+	}
+	defer unlock()
+	if u.Status == UploadFinishing && !u.finishStale() {
+		JSONError(w, http.StatusLocked, "Upload is being finished by another request")
+		return
+	}
+	if _, err := database.Collection("uploads").DeleteOne(r.Context(), bson.M{"_id": u.ID}); err != nil {
+		JSONError(w, http.StatusInternalServerError, "Failed to delete upload")
+		return
+	}
+	deleteUploadParts(u.Parts)
+	uploadLocks.Delete(u.ID)
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// startUploadSweeper removes expired uploads and their parts, now and every uploadSweepStep
+func startUploadSweeper() {
+	go func() {
+		for {
+			expireUploads()
+			time.Sleep(uploadSweepStep)
+		}
+	}()
+}
+
+func expireUploads() {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+	defer cancel()
+	var expired []Upload
+	cursor, err := database.Collection("uploads").Find(ctx, bson.M{"expires_at": bson.M{"$lt": time.Now()}},
+		options.Find().SetProjection(bson.M{"parts": 1}))
+	if err == nil {
+		err = cursor.All(ctx, &expired)
+	}
+	if err != nil {
+		log.Printf("[uploads] sweep error: %v", err)
+		return
+	}
+	for _, u := range expired {
+		deleteUploadParts(u.Parts)
+		uploadLocks.Delete(u.ID)
+		if _, err := database.Collection("uploads").DeleteOne(ctx, bson.M{"_id": u.ID}); err != nil {
+			log.Printf("[uploads] failed to delete expired upload %s: %v", u.ID.Hex(), err)
+		}
+	}
+	if len(expired) > 0 {
+		log.Printf("[uploads] removed %d expired uploads", len(expired))
+	}
+}
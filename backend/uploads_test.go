@@ -0,0 +1,201 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/gorilla/mux"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// tusRequest calls handler with the tus headers of a request on upload id ("" to create)
+func tusRequest(t *testing.T, handler http.HandlerFunc, method, id string, userID primitive.ObjectID, headers map[string]string, body string) *httptest.ResponseRecorder {
+	t.Helper()
+	r := httptest.NewRequest(method, "/api/uploads/"+id, strings.NewReader(body))
+	r.Header.Set("Tus-Resumable", tusVersion)
+	for k, v := range headers {
+		r.Header.Set(k, v)
+	}
+	r = mux.SetURLVars(withAuth(r, userID), map[string]string{"id": id})
+	w := httptest.NewRecorder()
+	handler(w, r)
+	return w
+}
+
+// useTestUploads gives the uploads a fresh blob store and job directory
+func useTestUploads(t *testing.T) {
+	t.Helper()
+	useTestDatabase(t)
+	t.Setenv("JOBS_DIR", t.TempDir())
+	t.Setenv("UPLOADS_DIR", t.TempDir())
+	prev := blobStore
+	blobStore = &LocalBlobStore{Dir: t.TempDir()}
+	t.Cleanup(func() { blobStore = prev })
+}
+
+func createTestUpload(t *testing.T, userID primitive.ObjectID, length int) string {
+	t.Helper()
+	w := tusRequest(t, handleCreateUpload, http.MethodPost, "", userID, map[string]string{
+		"Upload-Length":   strconv.Itoa(length),
+		"Upload-Metadata": "filename bGVjdHVyZS5tcDM=", // lecture.mp3
+	}, "")
+	if w.Code != http.StatusCreated {
+		t.Fatalf("create = %d %s", w.Code, w.Body)
+	}
+	return strings.TrimPrefix(w.Header().Get("Location"), "/api/uploads/")
+}
+
+func patchTestUpload(t *testing.T, id string, userID primitive.ObjectID, offset int, chunk string) *httptest.ResponseRecorder {
+	t.Helper()
+	return tusRequest(t, handlePatchUpload, http.MethodPatch, id, userID, map[string]string{
+		"Content-Type":  "application/offset+octet-stream",
+		"Upload-Offset": strconv.Itoa(offset),
+	}, chunk)
+}
+
+func TestUploadResumesOnAnotherInstance(t *testing.T) {
+	useTestUploads(t)
+	userID := primitive.NewObjectID()
+	id := createTestUpload(t, userID, 10)
+
+	if w := patchTestUpload(t, id, userID, 0, "hello"); w.Code != http.StatusNoContent || w.Header().Get("Upload-Offset") != "5" {
+		t.Fatalf("first chunk = %d %s, offset %s", w.Code, w.Body, w.Header().Get("Upload-Offset"))
+	}
+
+	// The next chunk lands on an instance with its own disk and no lock state
+	t.Setenv("UPLOADS_DIR", t.TempDir())
+	uploadLocks.Clear()
+	w := patchTestUpload(t, id, userID, 5, "world")
+	if w.Code != http.StatusNoContent {
+		t.Fatalf("second chunk = %d %s", w.Code, w.Body)
+	}
+	jobID, err := primitive.ObjectIDFromHex(w.Header().Get("Upload-Job-Id"))
+	if err != nil {
+		t.Fatalf("no job id: %v", err)
+	}
+	job, err := GetJob(jobID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if b, err := os.ReadFile(job.InputPath); err != nil || string(b) != "helloworld" {
+		t.Fatalf("job input = %q, %v", b, err)
+	}
+
+	// The parts are gone once the job has its copy
+	oid, _ := primitive.ObjectIDFromHex(id)
+	u, err := getUpload(t.Context(), oid, userID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if u.Status != UploadCompleted || len(u.Parts) != 0 {
+		t.Fatalf("upload = %s with %d parts, want completed without parts", u.Status, len(u.Parts))
+	}
+}
+
+func TestUploadWithLostPartIsGone(t *testing.T) {
+	useTestUploads(t)
+	userID := primitive.NewObjectID()
+	id := createTestUpload(t, userID, 10)
+	if w := patchTestUpload(t, id, userID, 0, "hello"); w.Code != http.StatusNoContent {
+		t.Fatalf("first chunk = %d %s", w.Code, w.Body)
+	}
+
+	// E.g. a blob store that is not shared between instances
+	oid, _ := primitive.ObjectIDFromHex(id)
+	u, _ := getUpload(t.Context(), oid, userID)
+	if err := blobStore.Delete(t.Context(), u.Parts[0].Key); err != nil {
+		t.Fatal(err)
+	}
+	if w := patchTestUpload(t, id, userID, 5, "world"); w.Code != http.StatusGone {
+		t.Fatalf("last chunk = %d %s, want 410", w.Code, w.Body)
+	}
+	if u, _ = getUpload(t.Context(), oid, userID); u.Status != UploadFailed {
+		t.Fatalf("status = %s, want failed", u.Status)
+	}
+}
+
+// completeTestUploadElsewhere records the last chunk as another instance would, without
+// finishing the upload: the state a retried last PATCH finds when that instance is slow
+func completeTestUploadElsewhere(t *testing.T, id string, userID primitive.ObjectID, set bson.M) *Upload {
+	t.Helper()
+	oid, _ := primitive.ObjectIDFromHex(id)
+	u, err := getUpload(t.Context(), oid, userID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	spool := filepath.Join(t.TempDir(), "chunk")
+	os.WriteFile(spool, []byte("world"), 0o600)
+	part, err := storeUploadPart(u, spool, 5)
+	if err != nil {
+		t.Fatal(err)
+	}
+	set["offset"] = u.Length
+	if _, err := database.Collection("uploads").UpdateOne(t.Context(), bson.M{"_id": oid},
+		bson.M{"$set": set, "$push": bson.M{"parts": part}}); err != nil {
+		t.Fatal(err)
+	}
+	if u, err = getUpload(t.Context(), oid, userID); err != nil {
+		t.Fatal(err)
+	}
+	return u
+}
+
+func TestUploadFinishCreatesOneJob(t *testing.T) {
+	useTestUploads(t)
+	userID := primitive.NewObjectID()
+	id := createTestUpload(t, userID, 10)
+	if w := patchTestUpload(t, id, userID, 0, "hello"); w.Code != http.StatusNoContent {
+		t.Fatalf("first chunk = %d %s", w.Code, w.Body)
+	}
+	u := completeTestUploadElsewhere(t, id, userID, bson.M{})
+
+	// Retries of the last PATCH land on several instances at once; the per-instance
+	// locks cannot see each other, so every request gets as far as finishUpload
+	var wg sync.WaitGroup
+	jobIDs := make([]string, 6)
+	for i := range jobIDs {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			mine := *u
+			r := mux.SetURLVars(withAuth(httptest.NewRequest(http.MethodPatch, "/api/uploads/"+id, nil), userID), map[string]string{"id": id})
+			w := httptest.NewRecorder()
+			if finishUpload(w, r, &mine) && mine.JobID != nil {
+				jobIDs[i] = mine.JobID.Hex()
+			}
+		}(i)
+	}
+	wg.Wait()
+	for i, jobID := range jobIDs {
+		if jobID == "" || jobID != jobIDs[0] {
+			t.Fatalf("request %d: job %q, first %q; want every request to answer with the one job", i, jobID, jobIDs[0])
+		}
+	}
+	if n, _ := database.Collection("jobs").CountDocuments(t.Context(), bson.M{"user_id": userID}); n != 1 {
+		t.Fatalf("jobs = %d, want 1", n)
+	}
+}
+
+func TestUploadStaleFinishIsTakenOver(t *testing.T) {
+	useTestUploads(t)
+	userID := primitive.NewObjectID()
+	id := createTestUpload(t, userID, 10)
+	if w := patchTestUpload(t, id, userID, 0, "hello"); w.Code != http.StatusNoContent {
+		t.Fatalf("first chunk = %d %s", w.Code, w.Body)
+	}
+	// The instance that claimed the finish died long ago
+	completeTestUploadElsewhere(t, id, userID, bson.M{"status": UploadFinishing, "updated_at": time.Now().Add(-time.Hour)})
+
+	w := patchTestUpload(t, id, userID, 10, "")
+	if w.Code != http.StatusNoContent || w.Header().Get("Upload-Job-Id") == "" {
+		t.Fatalf("retried last chunk = %d %s, want the job", w.Code, w.Body)
+	}
+}
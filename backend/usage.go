@@ -0,0 +1,302 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"math"
+	"net/http"
+	"strconv"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// Usage metrics tracked per user
+const (
+	UsageAudio  = "audio_minutes"
+	UsageTokens = "tokens"
+)
+
+// Usage periods
+const (
+	PeriodDaily   = "daily"
+	PeriodMonthly = "monthly"
+)
+
+// QuotaLimits are per-user usage limits; 0 means unlimited
+type QuotaLimits struct {
+	AudioMinutesDaily   int
+	AudioMinutesMonthly int
+	TokensDaily         int
+	TokensMonthly       int
+}
+
+// quotaLimits is loaded at startup from QUOTA_* variables
+var quotaLimits = QuotaLimits{
+	AudioMinutesDaily:   60,
+	AudioMinutesMonthly: 600,
+	TokensDaily:         200000,
+	TokensMonthly:       2000000,
+}
+
+// quotaLimitsFromEnv reads QUOTA_AUDIO_MINUTES_DAILY/MONTHLY and QUOTA_TOKENS_DAILY/MONTHLY
+func quotaLimitsFromEnv() QuotaLimits {
+	return QuotaLimits{
+		AudioMinutesDaily:   getEnvInt("QUOTA_AUDIO_MINUTES_DAILY", quotaLimits.AudioMinutesDaily),
+		AudioMinutesMonthly: getEnvInt("QUOTA_AUDIO_MINUTES_MONTHLY", quotaLimits.AudioMinutesMonthly),
+		TokensDaily:         getEnvInt("QUOTA_TOKENS_DAILY", quotaLimits.TokensDaily),
+		TokensMonthly:       getEnvInt("QUOTA_TOKENS_MONTHLY", quotaLimits.TokensMonthly),
+	}
+}
+
+// limit returns the configured limit of metric in period
+func (q QuotaLimits) limit(metric, period string) int {
+	switch {
+	case metric == UsageAudio && period == PeriodDaily:
+		return q.AudioMinutesDaily
+	case metric == UsageAudio:
+		return q.AudioMinutesMonthly
+	case period == PeriodDaily:
+		return q.TokensDaily
+	default:
+		return q.TokensMonthly
+	}
+}
+
+// QuotaUsage is the used/limit/remaining view of one metric in one period
+type QuotaUsage struct {
+	Metric    string    `json:"metric"`
+	Period    string    `json:"period"`
+	Used      float64   `json:"used"`
+	Limit     int       `json:"limit"`
+	Remaining float64   `json:"remaining"`
+	Unlimited bool      `json:"unlimited,omitempty"`
+	ResetsAt  time.Time `json:"resets_at"`
+}
+
+// QuotaError is returned when a request would exceed the user's quota
+type QuotaError struct {
+	Exceeded QuotaUsage
+	Quota    []QuotaUsage
+}
+
+func (e *QuotaError) Error() string {
+	return fmt.Sprintf("%s %s quota exceeded (limit %d, remaining %.1f)",
+		e.Exceeded.Period, e.Exceeded.Metric, e.Exceeded.Limit, e.Exceeded.Remaining)
+}
+
+// StatusCode is 429 when the daily quota runs out (retry tomorrow)
+// and 402 when the monthly quota runs out
+func (e *QuotaError) StatusCode() int {
+	if e.Exceeded.Period == PeriodDaily {
+		return http.StatusTooManyRequests
+	}
+	return http.StatusPaymentRequired
+}
+
+// usageKeys returns the day and month keys of t in UTC
+func usageKeys(t time.Time) (day, month string) {
+	t = t.UTC()
+	return t.Format("2006-01-02"), t.Format("2006-01")
+}
+
+// periodReset returns when the current period of t ends
+func periodReset(t time.Time, period string) time.Time {
+	t = t.UTC()
+	if period == PeriodDaily {
+		return time.Date(t.Year(), t.Month(), t.Day()+1, 0, 0, 0, 0, time.UTC)
+	}
+	return time.Date(t.Year(), t.Month()+1, 1, 0, 0, 0, 0, time.UTC)
+}
+
+// ensureUsageIndex makes the counter of a user's period unique, so concurrent first
+// requests of a day or month upsert into one document instead of splitting the count
+func ensureUsageIndex() {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	_, err := database.Collection("usage").Indexes().CreateOne(ctx, mongo.IndexModel{
+		Keys:    bson.D{{Key: "user_id", Value: 1}, {Key: "period", Value: 1}, {Key: "key", Value: 1}},
+		Options: options.Index().SetUnique(true),
+	})
+	if err != nil {
+		log.Printf("[usage] failed to create unique index: %v", err)
+	}
+}
+
+// recordUsage adds transcribed audio and generation tokens to the user's daily and monthly counters
+func recordUsage(userID primitive.ObjectID, audioSeconds float64, tokens int) {
+	if userID.IsZero() || (audioSeconds <= 0 && tokens <= 0) {
+		return
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	now := time.Now()
+	day, month := usageKeys(now)
+	coll := database.Collection("usage")
+	for period, key := range map[string]string{"day": day, "month": month} {
+		filter := bson.M{"user_id": userID, "period": period, "key": key}
+		update := bson.M{
+			"$inc": bson.M{"audio_seconds": audioSeconds, "tokens": int64(tokens)},
+			"$set": bson.M{"updated_at": now},
+		}
+		_, err := coll.UpdateOne(ctx, filter, update, options.Update().SetUpsert(true))
+		if mongo.IsDuplicateKeyError(err) {
+			// Lost the insert race to a concurrent upsert; the document exists now
+			_, err = coll.UpdateOne(ctx, filter, update)
+		}
+		if err != nil {
+			log.Printf("[usage] failed to record usage for user=%s: %v", userID.Hex(), err)
+		}
+	}
+}
+
+// userUsage returns the user's current daily and monthly counters
+func userUsage(userID primitive.ObjectID, now time.Time) (day, month UsageRecord, err error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	dayKey, monthKey := usageKeys(now)
+	cursor, err := database.Collection("usage").Find(ctx, bson.M{
+		"user_id": userID,
+		"$or": []bson.M{
+			{"period": "day", "key": dayKey},
+			{"period": "month", "key": monthKey},
+		},
+	})
+	if err != nil {
+		return day, month, err
+	}
+	defer cursor.Close(ctx)
+
+	var records []UsageRecord
+	if err := cursor.All(ctx, &records); err != nil {
+		return day, month, err
+	}
+	for _, rec := range records {
+		if rec.Period == "day" {
+			day = rec
+		} else {
+			month = rec
+		}
+	}
+	return day, month, nil
+}
+
+// quotaStatus returns used/limit/remaining for every metric and period
+func quotaStatus(userID primitive.ObjectID) ([]QuotaUsage, error) {
+	now := time.Now()
+	day, month, err := userUsage(userID, now)
+	if err != nil {
+		return nil, err
+	}
+
+	var out []QuotaUsage
+	for _, metric := range []string{UsageAudio, UsageTokens} {
+		for _, period := range []string{PeriodDaily, PeriodMonthly} {
+			rec := day
+			if period == PeriodMonthly {
+				rec = month
+			}
+			used := float64(rec.Tokens)
+			if metric == UsageAudio {
+				used = math.Round(rec.AudioSeconds/60*10) / 10
+			}
+			q := QuotaUsage{
+				Metric:   metric,
+				Period:   period,
+				Used:     used,
+				Limit:    quotaLimits.limit(metric, period),
+				ResetsAt: periodReset(now, period),
+			}
+			if q.Limit <= 0 {
+				q.Unlimited = true
+			} else {
+				q.Remaining = math.Max(0, float64(q.Limit)-used)
+			}
+			out = append(out, q)
+		}
+	}
+	return out, nil
+}
+
+// checkQuota reports a *QuotaError when the user has less than need left of metric.
+// need is in the metric's unit (minutes or tokens); 0 only requires some quota to be left.
+// The monthly limit is checked first since waiting a day does not help there.
+func checkQuota(userID primitive.ObjectID, metric string, need float64) error {
+	status, err := quotaStatus(userID)
+	if err != nil {
+		return err
+	}
+	for _, period := range []string{PeriodMonthly, PeriodDaily} {
+		for _, q := range status {
+			if q.Metric != metric || q.Period != period || q.Unlimited {
+				continue
+			}
+			if q.Remaining <= 0 || need > q.Remaining {
+				return &QuotaError{Exceeded: q, Quota: status}
+			}
+		}
+	}
+	return nil
+}
+
+// writeQuotaError sends a 402/429 response with the remaining quota
+func writeQuotaError(w http.ResponseWriter, qe *QuotaError) {
+	if qe.StatusCode() == http.StatusTooManyRequests {
+		retry := int(time.Until(qe.Exceeded.ResetsAt).Seconds()) + 1
+		w.Header().Set("Retry-After", strconv.Itoa(retry))
+	}
+	msg := "Monthly quota exceeded"
+	if qe.Exceeded.Period == PeriodDaily {
+		msg = "Daily quota exceeded"
+	}
+	JSONErrorWithDetails(w, qe.StatusCode(), msg, map[string]interface{}{
+		"exceeded": qe.Exceeded,
+		"quota":    qe.Quota,
+	})
+}
+
+// requireQuota checks metric for the user and writes the error response when exhausted.
+// Returns false if the request must stop.
+func requireQuota(w http.ResponseWriter, userID primitive.ObjectID, metric string) bool {
+	err := checkQuota(userID, metric, 0)
+	if err == nil {
+		return true
+	}
+	if qe, ok := err.(*QuotaError); ok {
+		writeQuotaError(w, qe)
+		return false
+	}
+	log.Printf("[usage] quota check failed for user=%s: %v", userID.Hex(), err)
+	JSONError(w, http.StatusInternalServerError, "Failed to check quota")
+	return false
+}
+
+// completionTokens returns the tokens used by a completion, estimating ~4 characters
+// per token when the provider does not report usage
+func completionTokens(res *CompletionResult, prompt string) int {
+	if n := res.PromptTokens + res.CompletionTokens; n > 0 {
+		return n
+	}
+	return (len([]rune(prompt)) + len([]rune(res.Content))) / 4
+}
+
+// handleUsage returns the current user's usage and remaining quota
+func handleUsage(w http.ResponseWriter, r *http.Request) {
+	auth := authFromContext(r)
+	status, err := quotaStatus(auth.UserID)
+	if err != nil {
+		log.Printf("[usage] status error: %v", err)
+		JSONError(w, http.StatusInternalServerError, "Failed to load usage")
+		return
+	}
+	JSONResponse(w, http.StatusOK, map[string]interface{}{
+		"success": true,
+		"quota":   status,
+	})
+}
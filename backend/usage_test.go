@@ -0,0 +1,55 @@
+package main
+
+import (
+	"sync"
+	"testing"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+func TestUsageKeysAndReset(t *testing.T) {
+	now := time.Date(2025, 12, 31, 23, 30, 0, 0, time.UTC)
+	day, month := usageKeys(now)
+	if day != "2025-12-31" || month != "2025-12" {
+		t.Fatalf("usageKeys = %q, %q", day, month)
+	}
+	if got := periodReset(now, PeriodDaily); !got.Equal(time.Date(2026, 1, 1, 0, 0, 0, 0, time.UTC)) {
+		t.Errorf("daily reset = %s", got)
+	}
+	if got := periodReset(now, PeriodMonthly); !got.Equal(time.Date(2026, 1, 1, 0, 0, 0, 0, time.UTC)) {
+		t.Errorf("monthly reset = %s", got)
+	}
+}
+
+func TestRecordUsageConcurrentFirstRequests(t *testing.T) {
+	useTestDatabase(t)
+	ensureUsageIndex()
+
+	userID := primitive.NewObjectID()
+	const n = 20
+	var wg sync.WaitGroup
+	for i := 0; i < n; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			recordUsage(userID, 30, 100)
+		}()
+	}
+	wg.Wait()
+
+	ctx := t.Context()
+	if docs, _ := database.Collection("usage").CountDocuments(ctx, bson.M{"user_id": userID}); docs != 2 {
+		t.Fatalf("usage documents = %d, want one per period", docs)
+	}
+	day, month, err := userUsage(userID, time.Now())
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, rec := range []UsageRecord{day, month} {
+		if rec.Tokens != n*100 || rec.AudioSeconds != n*30 {
+			t.Fatalf("%s counter = %d tokens, %.0f s; want %d, %d", rec.Period, rec.Tokens, rec.AudioSeconds, n*100, n*30)
+		}
+	}
+}
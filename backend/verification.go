@@ -0,0 +1,419 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+	"golang.org/x/crypto/bcrypt"
+)
+
+// Purposes of emailed tokens
+const (
+	EmailTokenVerify = "verify_email"
+	EmailTokenReset  = "reset_password"
+)
+
+// emailTokenTTL is how long a link from an email stays valid
+var emailTokenTTL = map[string]time.Duration{
+	EmailTokenVerify: 48 * time.Hour,
+	EmailTokenReset:  time.Hour,
+}
+
+// emailResendInterval is the minimum time between two emails of the same purpose to one user
+const emailResendInterval = time.Minute
+
+// minPasswordLength is enforced when a password is set through a reset link
+const minPasswordLength = 8
+
+var errEmailTokenInvalid = errors.New("link is invalid, expired or already used")
+
+// issueEmailToken creates a single-use token for the user; earlier unused tokens
+// of the same purpose stop working
+func issueEmailToken(user *User, purpose string) (string, error) {
+	userID, err := primitive.ObjectIDFromHex(user.ID)
+	if err != nil {
+		return "", err
+	}
+	secret, err := randomToken(32)
+	if err != nil {
+		return "", err
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	coll := database.Collection("email_tokens")
+	if _, err := coll.DeleteMany(ctx, bson.M{"user_id": userID, "purpose": purpose, "used_at": nil}); err != nil {
+		return "", err
+	}
+	now := time.Now()
+	if _, err := coll.InsertOne(ctx, EmailToken{
+		ID:        primitive.NewObjectID(),
+		UserID:    userID,
+		Email:     user.Email,
+		Purpose:   purpose,
+		TokenHash: hashToken(secret),
+		CreatedAt: now,
+		ExpiresAt: now.Add(emailTokenTTL[purpose]),
+	}); err != nil {
+		return "", err
+	}
+	return secret, nil
+}
+
+// consumeEmailToken marks the token as used and returns it. The update is atomic,
+// so a link works exactly once even if it is opened twice at the same time.
+func consumeEmailToken(purpose, secret string) (*EmailToken, error) {
+	if secret == "" {
+		return nil, errEmailTokenInvalid
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	now := time.Now()
+	var tok EmailToken
+	err := database.Collection("email_tokens").FindOneAndUpdate(ctx,
+		bson.M{
+			"token_hash": hashToken(secret),
+			"purpose":    purpose,
+			"used_at":    nil,
+			"expires_at": bson.M{"$gt": now},
+		},
+		bson.M{"$set": bson.M{"used_at": now}},
+		options.FindOneAndUpdate().SetReturnDocument(options.After),
+	).Decode(&tok)
+	if errors.Is(err, mongo.ErrNoDocuments) {
+		return nil, errEmailTokenInvalid
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &tok, nil
+}
+
+// lastEmailTokenAt returns when the last token of purpose was sent to the user
+func lastEmailTokenAt(userID primitive.ObjectID, purpose string) (time.Time, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	var tok EmailToken
+	err := database.Collection("email_tokens").FindOne(ctx,
+		bson.M{"user_id": userID, "purpose": purpose},
+		options.FindOne().SetSort(bson.M{"created_at": -1}),
+	).Decode(&tok)
+	if errors.Is(err, mongo.ErrNoDocuments) {
+		return time.Time{}, nil
+	}
+	return tok.CreatedAt, err
+}
+
+// sendVerificationEmail emails the user a link confirming their address
+func sendVerificationEmail(ctx context.Context, user *User) error {
+	token, err := issueEmailToken(user, EmailTokenVerify)
+	if err != nil {
+		return err
+	}
+	link := appBaseURL() + "/verify-email?token=" + url.QueryEscape(token)
+	return mailer.Send(ctx, Email{
+		To:      user.Email,
+		Subject: "Подтвердите email в SpeakApper",
+		Text: "Здравствуйте, " + user.FirstName + "!\n\n" +
+			"Чтобы подтвердить адрес и открыть транскрипцию и генерацию материалов, перейдите по ссылке:\n" +
+			link + "\n\n" +
+			"Ссылка действует 48 часов. Если вы не регистрировались в SpeakApper, просто проигнорируйте это письмо.\n",
+	})
+}
+
+// sendPasswordResetEmail emails the user a link to choose a new password
+func sendPasswordResetEmail(ctx context.Context, user *User) error {
+	token, err := issueEmailToken(user, EmailTokenReset)
+	if err != nil {
+		return err
+	}
+	link := appBaseURL() + "/reset-password?token=" + url.QueryEscape(token)
+	return mailer.Send(ctx, Email{
+		To:      user.Email,
+		Subject: "Сброс пароля SpeakApper",
+		Text: "Здравствуйте, " + user.FirstName + "!\n\n" +
+			"Чтобы задать новый пароль, перейдите по ссылке:\n" +
+			link + "\n\n" +
+			"Ссылка действует 1 час и работает один раз. После смены пароля все устройства будут разлогинены.\n" +
+			"Если вы не запрашивали сброс, просто проигнорируйте это письмо.\n",
+	})
+}
+
+// sendEmailAsync sends in the background so the response time does not reveal
+// whether the address is registered and a slow SMTP server does not block the request
+func sendEmailAsync(user *User, send func(context.Context, *User) error) {
+	go func() {
+		ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+		defer cancel()
+		if err := send(ctx, user); err != nil {
+			log.Printf("[mailer] %s: failed to send to user=%s: %v", mailer.Name(), user.ID, err)
+		}
+	}()
+}
+
+// markEmailVerified confirms the user's address
+func markEmailVerified(user *User) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	now := time.Now()
+	_, err := database.Collection("users").UpdateOne(ctx,
+		bson.M{"id": user.ID},
+		bson.M{"$set": bson.M{"emailverified": true, "emailverifiedat": now}},
+	)
+	if err == nil {
+		user.EmailVerified = true
+		user.EmailVerifiedAt = &now
+	}
+	return err
+}
+
+// claimUnverifiedAccount hands an account whose email was never verified to the owner of
+// the mailbox, proven by a social login. Whoever registered it with a password did not prove
+// the address, so the password, second factor, API keys and sessions they may have set up
+// are dropped (pre-account takeover); the owner can set a password via reset later.
+func claimUnverifiedAccount(user *User, provider string) error {
+	userID, err := primitive.ObjectIDFromHex(user.ID)
+	if err != nil {
+		return err
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	now := time.Now()
+	if _, err := database.Collection("users").UpdateOne(ctx,
+		bson.M{"id": user.ID},
+		bson.M{"$set": bson.M{"emailverified": true, "emailverifiedat": now, "password": ""}},
+	); err != nil {
+		return err
+	}
+	user.EmailVerified = true
+	user.EmailVerifiedAt = &now
+	user.Password = ""
+
+	if _, err := database.Collection("two_factor").DeleteOne(ctx, bson.M{"_id": userID}); err != nil {
+		return err
+	}
+	if _, err := database.Collection("api_keys").UpdateMany(ctx,
+		bson.M{"user_id": userID, "revoked_at": nil},
+		bson.M{"$set": bson.M{"revoked_at": now}},
+	); err != nil {
+		return err
+	}
+	if _, err := revokeUserSessions(userID, "email_claimed"); err != nil {
+		return err
+	}
+	log.Printf("[verification] unverified account user=%s claimed via %s: password, 2FA, API keys and sessions reset", user.ID, provider)
+	return nil
+}
+
+// markLegacyUsersVerified treats accounts created before email verification existed as verified
+func markLegacyUsersVerified() {
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+
+	res, err := database.Collection("users").UpdateMany(ctx,
+		bson.M{"emailverified": bson.M{"$exists": false}},
+		bson.M{"$set": bson.M{"emailverified": true}},
+	)
+	if err != nil {
+		log.Printf("[verification] failed to migrate existing users: %v", err)
+		return
+	}
+	if res.ModifiedCount > 0 {
+		log.Printf("[verification] marked %d existing users as verified", res.ModifiedCount)
+	}
+}
+
+// emailTokenUser loads the user a consumed token belongs to. A token sent to an
+// address the user no longer has is rejected.
+func emailTokenUser(tok *EmailToken) (*User, error) {
+	user, err := GetUserByID(tok.UserID.Hex())
+	if err != nil {
+		if errors.Is(err, mongo.ErrNoDocuments) {
+			return nil, errEmailTokenInvalid
+		}
+		return nil, err
+	}
+	if !strings.EqualFold(user.Email, tok.Email) {
+		return nil, errEmailTokenInvalid
+	}
+	return user, nil
+}
+
+// requireVerifiedEmail limits unverified accounts: wraps requireAuth routes that cost
+// money (transcription, generation, checkout)
+func requireVerifiedEmail(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		auth := authFromContext(r)
+		user, err := GetUserByID(auth.UserID.Hex())
+		if err != nil {
+			JSONError(w, http.StatusUnauthorized, "User not found")
+			return
+		}
+		if !user.EmailVerified {
+			JSONErrorWithDetails(w, http.StatusForbidden, "Please confirm your email address first", map[string]interface{}{
+				"code":  "email_unverified",
+				"email": user.Email,
+			})
+			return
+		}
+		next(w, r)
+	}
+}
+
+// handleVerifyEmail confirms the address from the emailed link
+func handleVerifyEmail(w http.ResponseWriter, r *http.Request) {
+	var body struct {
+		Token string `json:"token"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+		JSONError(w, http.StatusBadRequest, "Invalid request body")
+		return
+	}
+	tok, err := consumeEmailToken(EmailTokenVerify, body.Token)
+	if err == nil {
+		var user *User
+		if user, err = emailTokenUser(tok); err == nil {
+			if err = markEmailVerified(user); err == nil {
+				JSONResponse(w, http.StatusOK, map[string]interface{}{
+					"success": true,
+					"message": "Email verified",
+					"user":    user,
+				})
+				return
+			}
+		}
+	}
+	if errors.Is(err, errEmailTokenInvalid) {
+		JSONError(w, http.StatusBadRequest, "Verification link is invalid or expired")
+		return
+	}
+	log.Printf("[verification] verify error: %v", err)
+	JSONError(w, http.StatusInternalServerError, "Failed to verify email")
+}
+
+// handleResendVerification sends a new verification link to the current user
+func handleResendVerification(w http.ResponseWriter, r *http.Request) {
+	auth := authFromContext(r)
+	user, err := GetUserByID(auth.UserID.Hex())
+	if err != nil {
+		JSONError(w, http.StatusNotFound, "User not found")
+		return
+	}
+	if user.EmailVerified {
+		JSONResponse(w, http.StatusOK, map[string]interface{}{"success": true, "message": "Email is already verified"})
+		return
+	}
+	last, err := lastEmailTokenAt(auth.UserID, EmailTokenVerify)
+	if err != nil {
+		log.Printf("[verification] resend lookup error: %v", err)
+		JSONError(w, http.StatusInternalServerError, "Failed to send email")
+		return
+	}
+	if wait := emailResendInterval - time.Since(last); wait > 0 {
+		w.Header().Set("Retry-After", strconv.Itoa(int(wait.Seconds())+1))
+		JSONError(w, http.StatusTooManyRequests, "Please wait before requesting another email")
+		return
+	}
+	if err := sendVerificationEmail(r.Context(), user); err != nil {
+		log.Printf("[verification] %s: resend to user=%s failed: %v", mailer.Name(), user.ID, err)
+		JSONError(w, http.StatusBadGateway, "Failed to send email")
+		return
+	}
+	JSONResponse(w, http.StatusOK, map[string]interface{}{"success": true, "message": "Verification email sent"})
+}
+
+// handleForgotPassword emails a reset link. The response is the same whether or not
+// the address is registered.
+func handleForgotPassword(w http.ResponseWriter, r *http.Request) {
+	var body struct {
+		Email string `json:"email"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&body); err != nil || body.Email == "" {
+		JSONError(w, http.StatusBadRequest, "email is required")
+		return
+	}
+	if user, err := GetUserByEmail(strings.TrimSpace(body.Email)); err == nil {
+		userID, _ := primitive.ObjectIDFromHex(user.ID)
+		last, err := lastEmailTokenAt(userID, EmailTokenReset)
+		if err != nil {
+			log.Printf("[verification] reset lookup error: %v", err)
+		} else if time.Since(last) >= emailResendInterval {
+			sendEmailAsync(user, sendPasswordResetEmail)
+		}
+	}
+	JSONResponse(w, http.StatusOK, map[string]interface{}{
+		"success": true,
+		"message": "If an account with this email exists, a reset link has been sent",
+	})
+}
+
+// handleResetPassword sets a new password from the emailed link and signs the user out everywhere
+func handleResetPassword(w http.ResponseWriter, r *http.Request) {
+	var body struct {
+		Token    string `json:"token"`
+		Password string `json:"password"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+		JSONError(w, http.StatusBadRequest, "Invalid request body")
+		return
+	}
+	if len(body.Password) < minPasswordLength {
+		JSONError(w, http.StatusBadRequest, "Password must be at least "+strconv.Itoa(minPasswordLength)+" characters")
+		return
+	}
+	hashed, err := bcrypt.GenerateFromPassword([]byte(body.Password), bcrypt.DefaultCost)
+	if err != nil {
+		log.Printf("[verification] hashing error: %v", err)
+		JSONError(w, http.StatusInternalServerError, "Internal server error")
+		return
+	}
+
+	tok, err := consumeEmailToken(EmailTokenReset, body.Token)
+	var user *User
+	if err == nil {
+		user, err = emailTokenUser(tok)
+	}
+	if errors.Is(err, errEmailTokenInvalid) {
+		JSONError(w, http.StatusBadRequest, "Reset link is invalid or expired")
+		return
+	}
+	if err != nil {
+		log.Printf("[verification] reset error: %v", err)
+		JSONError(w, http.StatusInternalServerError, "Failed to reset password")
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(r.Context(), 5*time.Second)
+	defer cancel()
+	// Following the link proves the mailbox, so the address counts as verified too
+	if _, err := database.Collection("users").UpdateOne(ctx,
+		bson.M{"id": user.ID},
+		bson.M{"$set": bson.M{"password": string(hashed), "emailverified": true}},
+	); err != nil {
+		log.Printf("[verification] password update error: %v", err)
+		JSONError(w, http.StatusInternalServerError, "Failed to reset password")
+		return
+	}
+	if _, err := revokeUserSessions(tok.UserID, "password_reset"); err != nil {
+		log.Printf("[verification] failed to revoke sessions of user=%s: %v", user.ID, err)
+	}
+	JSONResponse(w, http.StatusOK, map[string]interface{}{
+		"success": true,
+		"message": "Password updated, please sign in",
+	})
+}
@@ -0,0 +1,189 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"regexp"
+	"strings"
+	"testing"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"golang.org/x/crypto/bcrypt"
+)
+
+// recordingMailer hands every sent email to the test
+type recordingMailer struct {
+	sent chan Email
+}
+
+func (m *recordingMailer) Name() string { return "recording" }
+
+func (m *recordingMailer) Send(ctx context.Context, msg Email) error {
+	m.sent <- msg
+	return nil
+}
+
+func useRecordingMailer(t *testing.T) *recordingMailer {
+	t.Helper()
+	m := &recordingMailer{sent: make(chan Email, 10)}
+	prev := mailer
+	mailer = m
+	t.Cleanup(func() { mailer = prev })
+	t.Setenv("APP_URL", "https://app.example")
+	t.Setenv("APP_URL_FILE", "")
+	return m
+}
+
+var emailLinkTokenRe = regexp.MustCompile(`https://app\.example/[a-z-]+\?token=(\S+)`)
+
+// nextEmailToken waits for the next email and returns the token of its link
+func nextEmailToken(t *testing.T, m *recordingMailer, to string) string {
+	t.Helper()
+	select {
+	case msg := <-m.sent:
+		match := emailLinkTokenRe.FindStringSubmatch(msg.Text)
+		if msg.To != to || match == nil {
+			t.Fatalf("email to %s:\n%s\nwant a link for %s", msg.To, msg.Text, to)
+		}
+		token, _ := url.QueryUnescape(match[1])
+		return token
+	case <-time.After(5 * time.Second):
+		t.Fatal("no email was sent")
+		return ""
+	}
+}
+
+func insertVerificationUser(t *testing.T, verified bool, password string) (*User, primitive.ObjectID) {
+	t.Helper()
+	userID := primitive.NewObjectID()
+	user := &User{ID: userID.Hex(), Email: userID.Hex() + "@example.com", FirstName: "Ada", EmailVerified: verified, Role: RoleUser}
+	if password != "" {
+		hashed, _ := bcrypt.GenerateFromPassword([]byte(password), bcrypt.MinCost)
+		user.Password = string(hashed)
+	}
+	if _, err := database.Collection("users").InsertOne(t.Context(), user); err != nil {
+		t.Fatal(err)
+	}
+	return user, userID
+}
+
+func TestEmailLinksRejectedWithoutDatabase(t *testing.T) {
+	if code, _ := postJSON(t, handleVerifyEmail, "/api/auth/verify-email", map[string]string{"token": ""}); code != http.StatusBadRequest {
+		t.Fatalf("verify without token = %d, want 400", code)
+	}
+	code, resp := postJSON(t, handleResetPassword, "/api/auth/password/reset", map[string]string{"token": "x", "password": "short"})
+	if code != http.StatusBadRequest || !strings.Contains(resp["message"].(string), "at least 8") {
+		t.Fatalf("short password = %d %v, want 400", code, resp)
+	}
+}
+
+func TestVerifyEmailFlow(t *testing.T) {
+	useTestDatabase(t)
+	m := useRecordingMailer(t)
+	user, userID := insertVerificationUser(t, false, "")
+
+	paid := requireVerifiedEmail(func(w http.ResponseWriter, r *http.Request) { JSONSuccess(w, nil) })
+	callPaid := func() *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		paid(w, withAuth(httptest.NewRequest(http.MethodPost, "/api/transcribe", nil), userID))
+		return w
+	}
+	if w := callPaid(); w.Code != http.StatusForbidden || !strings.Contains(w.Body.String(), "email_unverified") {
+		t.Fatalf("unverified = %d %s, want 403", w.Code, w.Body)
+	}
+
+	resend := func() *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		handleResendVerification(w, withAuth(httptest.NewRequest(http.MethodPost, "/api/auth/verify-email/resend", nil), userID))
+		return w
+	}
+	if w := resend(); w.Code != http.StatusOK {
+		t.Fatalf("resend = %d %s", w.Code, w.Body)
+	}
+	token := nextEmailToken(t, m, user.Email)
+	if w := resend(); w.Code != http.StatusTooManyRequests || w.Header().Get("Retry-After") == "" {
+		t.Fatalf("second resend = %d, Retry-After %q, want 429", w.Code, w.Header().Get("Retry-After"))
+	}
+
+	if code, resp := postJSON(t, handleVerifyEmail, "/api/auth/verify-email", map[string]string{"token": token}); code != http.StatusOK {
+		t.Fatalf("verify = %d %v", code, resp)
+	}
+	if code, _ := postJSON(t, handleVerifyEmail, "/api/auth/verify-email", map[string]string{"token": token}); code != http.StatusBadRequest {
+		t.Fatalf("second use of the link = %d, want 400", code)
+	}
+	if w := callPaid(); w.Code != http.StatusOK {
+		t.Fatalf("verified = %d %s, want 200", w.Code, w.Body)
+	}
+}
+
+func TestVerifyEmailRejectsStaleLinks(t *testing.T) {
+	useTestDatabase(t)
+	ctx := t.Context()
+	user, userID := insertVerificationUser(t, false, "")
+
+	expired, err := issueEmailToken(user, EmailTokenVerify)
+	if err != nil {
+		t.Fatal(err)
+	}
+	database.Collection("email_tokens").UpdateOne(ctx, bson.M{"user_id": userID}, bson.M{"$set": bson.M{"expires_at": time.Now().Add(-time.Minute)}})
+	if code, _ := postJSON(t, handleVerifyEmail, "/api/auth/verify-email", map[string]string{"token": expired}); code != http.StatusBadRequest {
+		t.Fatalf("expired link = %d, want 400", code)
+	}
+
+	// A newer link replaces the older one
+	older, _ := issueEmailToken(user, EmailTokenVerify)
+	newer, _ := issueEmailToken(user, EmailTokenVerify)
+	if code, _ := postJSON(t, handleVerifyEmail, "/api/auth/verify-email", map[string]string{"token": older}); code != http.StatusBadRequest {
+		t.Fatalf("replaced link = %d, want 400", code)
+	}
+
+	// A link sent to the previous address does not verify the new one
+	database.Collection("users").UpdateOne(ctx, bson.M{"id": user.ID}, bson.M{"$set": bson.M{"email": "new-" + user.Email}})
+	if code, _ := postJSON(t, handleVerifyEmail, "/api/auth/verify-email", map[string]string{"token": newer}); code != http.StatusBadRequest {
+		t.Fatalf("link for the old address = %d, want 400", code)
+	}
+	if u, _ := GetUserByID(user.ID); u.EmailVerified {
+		t.Fatal("the new address was verified by a link sent to the old one")
+	}
+}
+
+func TestPasswordResetFlow(t *testing.T) {
+	useTestDatabase(t)
+	m := useRecordingMailer(t)
+	user, userID := insertVerificationUser(t, false, "old password")
+	if _, err := startSession(httptest.NewRequest(http.MethodPost, "/api/login", nil), user); err != nil {
+		t.Fatal(err)
+	}
+
+	// Unknown addresses get the same answer and no email
+	code, unknown := postJSON(t, handleForgotPassword, "/api/auth/password/forgot", map[string]string{"email": "nobody@example.com"})
+	code2, known := postJSON(t, handleForgotPassword, "/api/auth/password/forgot", map[string]string{"email": strings.ToUpper(user.Email)})
+	if code != http.StatusOK || code2 != http.StatusOK || unknown["message"] != known["message"] {
+		t.Fatalf("forgot = %d %v and %d %v, want the same answer", code, unknown, code2, known)
+	}
+	token := nextEmailToken(t, m, user.Email)
+	select {
+	case msg := <-m.sent:
+		t.Fatalf("unexpected email to %s", msg.To)
+	default:
+	}
+
+	if code, resp := postJSON(t, handleResetPassword, "/api/auth/password/reset", map[string]string{"token": token, "password": "new password"}); code != http.StatusOK {
+		t.Fatalf("reset = %d %v", code, resp)
+	}
+	if code, _ := postJSON(t, handleResetPassword, "/api/auth/password/reset", map[string]string{"token": token, "password": "another one"}); code != http.StatusBadRequest {
+		t.Fatalf("second use of the link = %d, want 400", code)
+	}
+
+	stored, _ := GetUserByID(user.ID)
+	if bcrypt.CompareHashAndPassword([]byte(stored.Password), []byte("new password")) != nil || !stored.EmailVerified {
+		t.Fatalf("user = %+v, want the new password and a verified address", stored)
+	}
+	if n, _ := database.Collection("sessions").CountDocuments(t.Context(), bson.M{"user_id": userID, "revoked_at": nil}); n != 0 {
+		t.Fatalf("%d sessions survived the reset", n)
+	}
+}
@@ -0,0 +1,208 @@
+package main
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"io"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// webhookSecret signs provider webhooks (PAYMENT_WEBHOOK_SECRET)
+var webhookSecret string
+
+// verifyWebhookSignature checks the hex HMAC-SHA256 of the raw body
+// (optionally prefixed with "sha256=") against the shared secret
+func verifyWebhookSignature(body []byte, signature, secret string) bool {
+	signature = strings.TrimPrefix(strings.TrimSpace(signature), "sha256=")
+	got, err := hex.DecodeString(signature)
+	if err != nil || secret == "" {
+		return false
+	}
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write(body)
+	return hmac.Equal(got, mac.Sum(nil))
+}
+
+// findWebhookSubscription locates the subscription an event refers to: by the provider's
+// subscription ID, then by our checkout session ID from custom data
+func findWebhookSubscription(ctx context.Context, ev *WebhookEvent) (*Subscription, error) {
+	coll := database.Collection("subscriptions")
+	var sub Subscription
+	if ev.SubscriptionID != "" {
+		err := coll.FindOne(ctx, bson.M{"provider": paymentProvider.Name(), "provider_subscription_id": ev.SubscriptionID}).Decode(&sub)
+		if err == nil {
+			return &sub, nil
+		}
+		if !errors.Is(err, mongo.ErrNoDocuments) {
+			return nil, err
+		}
+	}
+	if id, err := primitive.ObjectIDFromHex(ev.SessionID); err == nil {
+		if err := coll.FindOne(ctx, bson.M{"_id": id}).Decode(&sub); err == nil {
+			return &sub, nil
+		} else if !errors.Is(err, mongo.ErrNoDocuments) {
+			return nil, err
+		}
+	}
+	return nil, mongo.ErrNoDocuments
+}
+
+// applyWebhookEvent updates the subscription state from a provider event.
+// Applying the same event twice leaves the same state; events older than the last
+// applied one are skipped so out-of-order redeliveries cannot roll the state back.
+// Returns a short description of what happened.
+func applyWebhookEvent(ev *WebhookEvent) (string, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	now := time.Now()
+	coll := database.Collection("subscriptions")
+	sub, err := findWebhookSubscription(ctx, ev)
+	if errors.Is(err, mongo.ErrNoDocuments) {
+		// Subscription started outside our checkout (e.g. in the provider dashboard)
+		userID, idErr := primitive.ObjectIDFromHex(ev.UserID)
+		plan, ok := planByPriceID(ev.PriceID)
+		if idErr != nil || !ok || ev.SubscriptionID == "" {
+			return "ignored: unknown subscription", nil
+		}
+		sub = &Subscription{
+			ID:            primitive.NewObjectID(),
+			UserID:        userID,
+			PlanID:        plan.ID,
+			Status:        SubscriptionPending,
+			Provider:      paymentProvider.Name(),
+			ProviderRef:   ev.SubscriptionID,
+			ProviderSubID: ev.SubscriptionID,
+			CreatedAt:     now,
+			UpdatedAt:     now,
+		}
+		if _, err := coll.InsertOne(ctx, sub); err != nil {
+			return "", err
+		}
+	} else if err != nil {
+		return "", err
+	}
+
+	if !ev.OccurredAt.IsZero() && !sub.LastEventAt.IsZero() && ev.OccurredAt.Before(sub.LastEventAt) {
+		return "ignored: stale event", nil
+	}
+
+	set := bson.M{"updated_at": now}
+	if ev.SubscriptionID != "" {
+		set["provider_subscription_id"] = ev.SubscriptionID
+	}
+	planID := sub.PlanID
+	if plan, ok := planByPriceID(ev.PriceID); ok {
+		planID = plan.ID
+		set["plan_id"] = plan.ID
+	}
+	if ev.Status != "" {
+		set["status"] = ev.Status
+	}
+	periodEnd := ev.PeriodEnd
+	if periodEnd.IsZero() && ev.Status == SubscriptionActive && sub.CurrentPeriodEnd.IsZero() {
+		plan, _ := findPlan(planID)
+		periodEnd = plan.period(now)
+	}
+	if !periodEnd.IsZero() {
+		set["current_period_end"] = periodEnd
+	}
+	if !ev.OccurredAt.IsZero() {
+		set["last_event_at"] = ev.OccurredAt
+	}
+	if _, err := coll.UpdateOne(ctx, bson.M{"_id": sub.ID}, bson.M{"$set": set}); err != nil {
+		return "", err
+	}
+	if ev.Status == SubscriptionActive && sub.Status != SubscriptionActive {
+		retireOtherSubscriptions(ctx, sub)
+	}
+
+	log.Printf("[webhooks] %s applied to subscription=%s user=%s status=%s", ev.Type, sub.ID.Hex(), sub.UserID.Hex(), ev.Status)
+	return "applied", nil
+}
+
+// handleSubscriptionWebhook ingests signed provider events. Every verified event is stored
+// in webhook_events before it is applied; redeliveries of a processed event are acknowledged
+// without touching the subscription, failed ones are retried.
+func handleSubscriptionWebhook(w http.ResponseWriter, r *http.Request) {
+	if paymentProvider == nil {
+		JSONError(w, http.StatusServiceUnavailable, "Payments are not configured")
+		return
+	}
+	if webhookSecret == "" {
+		JSONError(w, http.StatusServiceUnavailable, "Webhook secret is not configured")
+		return
+	}
+	body, err := io.ReadAll(io.LimitReader(r.Body, 1<<20))
+	if err != nil {
+		JSONError(w, http.StatusBadRequest, "Failed to read body")
+		return
+	}
+	if !verifyWebhookSignature(body, r.Header.Get("X-Signature"), webhookSecret) {
+		log.Printf("[webhooks] invalid signature from %s", r.RemoteAddr)
+		JSONError(w, http.StatusUnauthorized, "Invalid signature")
+		return
+	}
+
+	ev, err := paymentProvider.ParseWebhook(body)
+	if err != nil {
+		JSONErrorWithDetails(w, http.StatusBadRequest, "Invalid webhook payload", err.Error())
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(r.Context(), 5*time.Second)
+	defer cancel()
+	coll := database.Collection("webhook_events")
+	key := paymentProvider.Name() + ":" + ev.ID
+	res, err := coll.UpdateOne(ctx,
+		bson.M{"_id": key},
+		bson.M{
+			"$setOnInsert": bson.M{
+				"provider":    paymentProvider.Name(),
+				"event_id":    ev.ID,
+				"type":        ev.Type,
+				"payload":     string(body),
+				"received_at": time.Now(),
+			},
+			"$inc": bson.M{"deliveries": 1},
+		},
+		options.Update().SetUpsert(true),
+	)
+	if err != nil {
+		log.Printf("[webhooks] failed to store event %s: %v", key, err)
+		JSONError(w, http.StatusInternalServerError, "Failed to store event")
+		return
+	}
+	if res.UpsertedCount == 0 {
+		var rec WebhookEventRecord
+		if err := coll.FindOne(ctx, bson.M{"_id": key}).Decode(&rec); err == nil && rec.ProcessedAt != nil {
+			JSONSuccess(w, map[string]interface{}{"event_id": ev.ID, "duplicate": true, "result": rec.Result})
+			return
+		}
+	}
+
+	result, err := applyWebhookEvent(ev)
+	if err != nil {
+		log.Printf("[webhooks] event %s failed: %v", key, err)
+		coll.UpdateOne(context.Background(), bson.M{"_id": key}, bson.M{"$set": bson.M{"error": err.Error()}})
+		// Non-2xx makes the provider redeliver
+		JSONError(w, http.StatusInternalServerError, "Failed to process event")
+		return
+	}
+	coll.UpdateOne(context.Background(), bson.M{"_id": key}, bson.M{
+		"$set":   bson.M{"processed_at": time.Now(), "result": result},
+		"$unset": bson.M{"error": ""},
+	})
+	JSONSuccess(w, map[string]interface{}{"event_id": ev.ID, "duplicate": false, "result": result})
+}
@@ -0,0 +1,229 @@
+package main
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+)
+
+const testWebhookSecret = "webhook-secret"
+
+// webhookFixture reads testdata/webhooks/<name>.json
+func webhookFixture(t *testing.T, name string) []byte {
+	t.Helper()
+	b, err := os.ReadFile(filepath.Join("testdata", "webhooks", name+".json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return b
+}
+
+func signWebhook(body []byte, secret string) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write(body)
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// useTestWebhooks configures the fake provider, the secret and a plan for the
+// fixtures' variant 22222
+func useTestWebhooks(t *testing.T) {
+	t.Helper()
+	prevSecret, prevProvider, prevPlans := webhookSecret, paymentProvider, plans
+	webhookSecret = testWebhookSecret
+	paymentProvider = &FakePaymentProvider{}
+	plans = []Plan{{ID: "premium", Name: "Premium", Price: 19.99, Currency: "USD", Interval: "month", ProviderPriceID: "22222"}}
+	t.Cleanup(func() { webhookSecret, paymentProvider, plans = prevSecret, prevProvider, prevPlans })
+}
+
+// postWebhook calls handleSubscriptionWebhook with body and X-Signature
+func postWebhook(t *testing.T, body []byte, signature string) (int, map[string]interface{}) {
+	t.Helper()
+	r := httptest.NewRequest(http.MethodPost, "/api/subscription/webhook", bytes.NewReader(body))
+	if signature != "" {
+		r.Header.Set("X-Signature", signature)
+	}
+	w := httptest.NewRecorder()
+	handleSubscriptionWebhook(w, r)
+	var resp map[string]interface{}
+	json.Unmarshal(w.Body.Bytes(), &resp)
+	return w.Code, resp
+}
+
+// deliverFixture posts a correctly signed fixture and returns the result of applying it
+func deliverFixture(t *testing.T, name string) map[string]interface{} {
+	t.Helper()
+	body := webhookFixture(t, name)
+	code, resp := postWebhook(t, body, "sha256="+signWebhook(body, testWebhookSecret))
+	if code != http.StatusOK {
+		t.Fatalf("%s: status %d %v", name, code, resp)
+	}
+	return resp["data"].(map[string]interface{})
+}
+
+// fixtureSubscriptionID is the Lemon Squeezy subscription the fixtures refer to
+const fixtureSubscriptionID = "573182"
+
+// fixtureEventID is the ID a fixture's event is recorded under: Lemon Squeezy sends no
+// event ID, so it is the hash of the body
+func fixtureEventID(t *testing.T, name string) string {
+	t.Helper()
+	sum := sha256.Sum256(webhookFixture(t, name))
+	return "sha256:" + hex.EncodeToString(sum[:])
+}
+
+// fixtureSubscription loads the subscription the fixtures refer to
+func fixtureSubscription(t *testing.T) Subscription {
+	t.Helper()
+	var sub Subscription
+	if err := database.Collection("subscriptions").FindOne(t.Context(), bson.M{"provider_subscription_id": fixtureSubscriptionID}).Decode(&sub); err != nil {
+		t.Fatal(err)
+	}
+	return sub
+}
+
+func TestParseSubscriptionWebhookFixtures(t *testing.T) {
+	tests := []struct {
+		fixture    string
+		status     string
+		periodEnd  string
+		occurredAt string
+	}{
+		{"subscription_created", SubscriptionActive, "2026-11-16T00:00:00Z", "2026-10-16T12:00:00Z"},
+		{"subscription_updated", SubscriptionActive, "2026-12-16T00:00:00Z", "2026-11-16T00:05:00Z"},
+		{"subscription_cancelled", SubscriptionCanceled, "2026-12-16T00:00:00Z", "2026-11-20T09:30:00Z"},
+		{"subscription_expired", SubscriptionExpired, "2026-12-16T00:00:00Z", "2026-12-16T00:00:05Z"},
+	}
+	seen := map[string]bool{}
+	for _, tt := range tests {
+		ev, err := parseSubscriptionWebhook(webhookFixture(t, tt.fixture))
+		if err != nil {
+			t.Fatalf("%s: %v", tt.fixture, err)
+		}
+		if ev.Type != tt.fixture || ev.Status != tt.status || ev.PeriodEnd.Format(time.RFC3339) != tt.periodEnd || ev.OccurredAt.Format(time.RFC3339) != tt.occurredAt {
+			t.Errorf("%s: parsed %+v", tt.fixture, ev)
+		}
+		if ev.SubscriptionID != fixtureSubscriptionID || ev.PriceID != "22222" || ev.UserID != "66f1c0ffee0000000000a001" || ev.SessionID != "66f1c0ffee0000000000b001" {
+			t.Errorf("%s: parsed %+v", tt.fixture, ev)
+		}
+		if ev.ID != fixtureEventID(t, tt.fixture) || seen[ev.ID] {
+			t.Errorf("%s: event ID %q, want the body hash, unique per event", tt.fixture, ev.ID)
+		}
+		seen[ev.ID] = true
+	}
+
+	// An explicit event ID (the fake provider's payloads) wins over the hash
+	ev, err := parseSubscriptionWebhook([]byte(`{"meta":{"event_id":"evt_1","event_name":"subscription_created"},"data":{"id":"1","attributes":{"status":"active"}}}`))
+	if err != nil || ev.ID != "evt_1" {
+		t.Fatalf("event = %+v, %v, want ID evt_1", ev, err)
+	}
+}
+
+func TestSubscriptionWebhookRejectsBadSignature(t *testing.T) {
+	useTestWebhooks(t)
+	body := webhookFixture(t, "subscription_created")
+	tampered := bytes.Replace(body, []byte(`"variant_id": 22222`), []byte(`"variant_id": 33333`), 1)
+
+	for name, sig := range map[string]string{
+		"missing":        "",
+		"not hex":        "sha256=zzzz",
+		"other secret":   signWebhook(body, "someone-elses-secret"),
+		"tampered body":  signWebhook(body, testWebhookSecret),
+		"truncated hmac": signWebhook(body, testWebhookSecret)[:32],
+	} {
+		payload := body
+		if name == "tampered body" {
+			payload = tampered
+		}
+		// Rejected before the database is touched, so no MongoDB is needed
+		if code, resp := postWebhook(t, payload, sig); code != http.StatusUnauthorized {
+			t.Errorf("%s signature: status %d %v, want 401", name, code, resp)
+		}
+	}
+}
+
+func TestSubscriptionWebhookFixturesApplyInOrder(t *testing.T) {
+	useTestDatabase(t)
+	useTestWebhooks(t)
+
+	tests := []struct {
+		fixture   string
+		status    string
+		periodEnd time.Time
+	}{
+		{"subscription_created", SubscriptionActive, time.Date(2026, 11, 16, 0, 0, 0, 0, time.UTC)},
+		{"subscription_updated", SubscriptionActive, time.Date(2026, 12, 16, 0, 0, 0, 0, time.UTC)},
+		{"subscription_cancelled", SubscriptionCanceled, time.Date(2026, 12, 16, 0, 0, 0, 0, time.UTC)},
+		{"subscription_expired", SubscriptionExpired, time.Date(2026, 12, 16, 0, 0, 0, 0, time.UTC)},
+	}
+	for _, tt := range tests {
+		if res := deliverFixture(t, tt.fixture); res["result"] != "applied" || res["duplicate"] != false {
+			t.Fatalf("%s: %v", tt.fixture, res)
+		}
+		sub := fixtureSubscription(t)
+		if sub.Status != tt.status || !sub.CurrentPeriodEnd.Equal(tt.periodEnd) || sub.PlanID != "premium" {
+			t.Fatalf("after %s: status %s, period end %s, plan %s", tt.fixture, sub.Status, sub.CurrentPeriodEnd, sub.PlanID)
+		}
+	}
+	if n, _ := database.Collection("subscriptions").CountDocuments(t.Context(), bson.M{}); n != 1 {
+		t.Fatalf("subscriptions = %d, want 1", n)
+	}
+}
+
+func TestSubscriptionWebhookDuplicateIsNotAppliedTwice(t *testing.T) {
+	useTestDatabase(t)
+	useTestWebhooks(t)
+	ctx := t.Context()
+
+	deliverFixture(t, "subscription_created")
+	// Change the state behind the webhook's back: a second apply would overwrite it
+	sub := fixtureSubscription(t)
+	if _, err := database.Collection("subscriptions").UpdateOne(ctx, bson.M{"_id": sub.ID},
+		bson.M{"$set": bson.M{"status": SubscriptionCanceled}}); err != nil {
+		t.Fatal(err)
+	}
+
+	res := deliverFixture(t, "subscription_created")
+	if res["duplicate"] != true || res["result"] != "applied" {
+		t.Fatalf("redelivery = %v, want the recorded result of the first delivery", res)
+	}
+	if got := fixtureSubscription(t); got.Status != SubscriptionCanceled {
+		t.Fatalf("status = %s, the redelivery was applied again", got.Status)
+	}
+	var rec WebhookEventRecord
+	if err := database.Collection("webhook_events").FindOne(ctx, bson.M{"_id": "fake:" + fixtureEventID(t, "subscription_created")}).Decode(&rec); err != nil {
+		t.Fatal(err)
+	}
+	if rec.Deliveries != 2 || rec.ProcessedAt == nil {
+		t.Fatalf("event record = %+v, want 2 deliveries and processed", rec)
+	}
+}
+
+func TestSubscriptionWebhookSkipsStaleEvent(t *testing.T) {
+	useTestDatabase(t)
+	useTestWebhooks(t)
+
+	// The renewal arrives before the creation it follows
+	if res := deliverFixture(t, "subscription_updated"); res["result"] != "applied" {
+		t.Fatalf("updated: %v", res)
+	}
+	if res := deliverFixture(t, "subscription_created"); res["result"] != "ignored: stale event" {
+		t.Fatalf("created after updated: %v, want it skipped", res)
+	}
+	sub := fixtureSubscription(t)
+	if want := time.Date(2026, 12, 16, 0, 0, 0, 0, time.UTC); !sub.CurrentPeriodEnd.Equal(want) {
+		t.Fatalf("period end = %s, want %s from the newer event", sub.CurrentPeriodEnd, want)
+	}
+	if want := time.Date(2026, 11, 16, 0, 5, 0, 0, time.UTC); !sub.LastEventAt.Equal(want) {
+		t.Fatalf("last event = %s, want %s", sub.LastEventAt, want)
+	}
+}
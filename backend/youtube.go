@@ -0,0 +1,498 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// YouTube audio is fetched by an ordered chain of strategies (YOUTUBE_FETCHERS). Each
+// strategy's reliability is tracked, and the most reliable one is tried first.
+const (
+	defaultYouTubeFetchers = "web,web-simple,android,ios,tvhtml5,chrome-cookies,piped"
+	fetchAttemptTimeout    = 15 * time.Minute
+	fetchOutputTail        = 2000 // bytes of tool output kept per attempt
+	reliabilityWeight      = 0.2  // weight of the latest outcome in the moving average
+)
+
+// ytdlpBin is the yt-dlp executable (YTDLP_BIN, default yt-dlp from PATH)
+func ytdlpBin() string {
+	if b := os.Getenv("YTDLP_BIN"); b != "" {
+		return b
+	}
+	return "yt-dlp"
+}
+
+// AudioFetcher is one way of getting the audio track of a video
+type AudioFetcher interface {
+	Name() string
+	// Fetch saves the audio into dir and returns the file's path
+	Fetch(ctx context.Context, videoURL, dir string) (string, error)
+}
+
+// fetchError carries the output of the tool that failed, for diagnostics
+type fetchError struct {
+	Err    error
+	Output string
+}
+
+func (e *fetchError) Error() string { return e.Err.Error() }
+func (e *fetchError) Unwrap() error { return e.Err }
+
+// FetchAttempt is the diagnostic record of one strategy's try
+type FetchAttempt struct {
+	Strategy     string `bson:"strategy" json:"strategy"`
+	DurationMS   int64  `bson:"duration_ms" json:"duration_ms"`
+	Error        string `bson:"error" json:"error"`
+	Output       string `bson:"output,omitempty" json:"output,omitempty"`
+	AuthRequired bool   `bson:"auth_required,omitempty" json:"auth_required,omitempty"`
+}
+
+// ytDownloadError describes a failed YouTube download with every attempt's diagnostics
+type ytDownloadError struct {
+	AuthRequired bool
+	Details      string
+	Attempts     []FetchAttempt
+}
+
+func (e *ytDownloadError) Error() string {
+	if e.AuthRequired {
+		return "YouTube requires authentication. Please ensure cookies are properly configured."
+	}
+	return "Audio file not found after download"
+}
+
+func newYTDownloadError(attempts []FetchAttempt) *ytDownloadError {
+	e := &ytDownloadError{Attempts: attempts}
+	var lines []string
+	for i, a := range attempts {
+		lines = append(lines, fmt.Sprintf("attempt %d (%s, %dms) failed: %s", i+1, a.Strategy, a.DurationMS, a.Error))
+		if a.Output != "" {
+			lines = append(lines, a.Output)
+		}
+		e.AuthRequired = e.AuthRequired || a.AuthRequired
+	}
+	if len(attempts) == 0 {
+		lines = append(lines, "no download strategies are configured (YOUTUBE_FETCHERS)")
+	}
+	e.Details = strings.Join(lines, "\n")
+	if e.AuthRequired {
+		e.Details = "This video requires sign-in to access. The server needs valid YouTube cookies to download age-restricted or private content.\n\nDetails:\n" + e.Details
+	}
+	return e
+}
+
+// isYouTubeAuthError tells from yt-dlp output that YouTube wants a signed-in user
+func isYouTubeAuthError(output string) bool {
+	// Normalize quotes/case to catch messages like “you’re” vs "you're"
+	s := strings.ToLower(output)
+	s = strings.ReplaceAll(s, "’", "'")
+	return strings.Contains(s, "sign in to confirm you're not a bot") ||
+		strings.Contains(s, "sign in to confirm you") ||
+		strings.Contains(s, "this video is not available") ||
+		strings.Contains(s, "private video") ||
+		strings.Contains(s, "video unavailable") ||
+		strings.Contains(s, "cookies are no longer valid") ||
+		strings.Contains(s, "use --cookies-from-browser") ||
+		strings.Contains(s, "requires authentication")
+}
+
+// tail keeps the end of long tool output, where the error usually is
+func tail(s string, n int) string {
+	s = strings.TrimSpace(s)
+	if len(s) <= n {
+		return s
+	}
+	return "…" + s[len(s)-n:]
+}
+
+// ytdlpFetcher runs yt-dlp with one player client and format preference
+type ytdlpFetcher struct {
+	name           string
+	extractorArgs  string
+	format         string
+	userAgent      string // sent instead of the Accept-Language and Referer headers
+	browserCookies bool   // always use Chrome's cookies, ignoring YTDLP_COOKIES
+}
+
+func (f *ytdlpFetcher) Name() string { return f.name }
+
+func (f *ytdlpFetcher) Fetch(ctx context.Context, videoURL, dir string) (string, error) {
+	base := fmt.Sprintf("yt_%d", time.Now().UnixNano())
+	args := []string{"-R", "3", "--fragment-retries", "3", "--force-ipv4", "--geo-bypass", "--no-check-certificate"}
+	if f.userAgent != "" {
+		args = append(args, "--user-agent", f.userAgent)
+	} else {
+		args = append(args, "--add-header", "Accept-Language: en-US,en;q=0.9,ru;q=0.8", "--referer", "https://www.youtube.com/")
+	}
+	args = append(args,
+		"--extractor-args", f.extractorArgs,
+		"-f", f.format,
+		"-x",
+		"--audio-format", "mp3",
+		"-o", filepath.Join(dir, base+".%(ext)s"),
+	)
+	cookies := ytdlpCookieFileArgs()
+	if f.browserCookies || cookies == nil {
+		cookies = []string{"--cookies-from-browser", "chrome"}
+	}
+	// "--" keeps the URL from being read as an option
+	args = append(append(args, cookies...), "--", videoURL)
+
+	log.Printf("yt-dlp strategy=%s args=%v", f.name, args)
+	out, err := exec.CommandContext(ctx, ytdlpBin(), args...).CombinedOutput()
+	if err != nil {
+		return "", &fetchError{Err: fmt.Errorf("yt-dlp: %w", err), Output: tail(string(out), fetchOutputTail)}
+	}
+	if path := findFetchedFile(dir, base); path != "" {
+		return path, nil
+	}
+	return "", &fetchError{Err: errors.New("yt-dlp succeeded but produced no file"), Output: tail(string(out), fetchOutputTail)}
+}
+
+// findFetchedFile returns the file yt-dlp wrote for base, preferring the converted mp3
+func findFetchedFile(dir, base string) string {
+	if p := filepath.Join(dir, base+".mp3"); fileExists(p) {
+		return p
+	}
+	entries, _ := os.ReadDir(dir)
+	for _, e := range entries {
+		if strings.HasPrefix(e.Name(), base+".") && !strings.HasSuffix(e.Name(), ".part") {
+			return filepath.Join(dir, e.Name())
+		}
+	}
+	return ""
+}
+
+// pipedFetcher downloads through a Piped instance, an anonymous YouTube proxy that
+// needs no YouTube sign-in
+type pipedFetcher struct {
+	base   string
+	client *http.Client
+}
+
+func (f *pipedFetcher) Name() string { return "piped" }
+
+func (f *pipedFetcher) Fetch(ctx context.Context, videoURL, dir string) (string, error) {
+	vid := youTubeVideoID(videoURL)
+	if vid == "" {
+		return "", fmt.Errorf("cannot extract video ID from URL: %s", videoURL)
+	}
+	apiURL := fmt.Sprintf("%s/api/v1/streams/%s", strings.TrimRight(f.base, "/"), vid)
+	log.Printf("Piped fallback: GET %s", apiURL)
+	body, err := f.get(ctx, apiURL)
+	if err != nil {
+		return "", err
+	}
+	var piped struct {
+		AudioStreams []struct {
+			URL      string `json:"url"`
+			Bitrate  int    `json:"bitrate"`
+			MimeType string `json:"mimeType"`
+		} `json:"audioStreams"`
+	}
+	data, err := io.ReadAll(body)
+	body.Close()
+	if err != nil {
+		return "", err
+	}
+	if err := json.Unmarshal(data, &piped); err != nil {
+		return "", &fetchError{Err: fmt.Errorf("piped JSON parse error: %w", err), Output: tail(string(data), fetchOutputTail)}
+	}
+	if len(piped.AudioStreams) == 0 {
+		return "", errors.New("piped: no audioStreams found")
+	}
+	// pick highest bitrate
+	best := piped.AudioStreams[0]
+	for _, s := range piped.AudioStreams[1:] {
+		if s.Bitrate > best.Bitrate {
+			best = s
+		}
+	}
+	// decide extension by mime
+	ext := ".m4a"
+	if strings.Contains(strings.ToLower(best.MimeType), "webm") {
+		ext = ".webm"
+	}
+
+	stream, err := f.get(ctx, best.URL)
+	if err != nil {
+		return "", err
+	}
+	defer stream.Close()
+	out := filepath.Join(dir, fmt.Sprintf("yt_%d%s", time.Now().UnixNano(), ext))
+	file, err := os.Create(out)
+	if err != nil {
+		return "", err
+	}
+	if _, err := io.Copy(file, stream); err != nil {
+		file.Close()
+		os.Remove(out)
+		return "", fmt.Errorf("piped stream: %w", err)
+	}
+	if err := file.Close(); err != nil {
+		return "", err
+	}
+	return out, nil
+}
+
+// get returns the body of a 200 response
+func (f *pipedFetcher) get(ctx context.Context, u string) (io.ReadCloser, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, u, nil)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := f.client.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("piped: %w", err)
+	}
+	if resp.StatusCode != http.StatusOK {
+		msg, _ := io.ReadAll(io.LimitReader(resp.Body, fetchOutputTail))
+		resp.Body.Close()
+		return nil, &fetchError{Err: fmt.Errorf("piped: status %s", resp.Status), Output: string(msg)}
+	}
+	return resp.Body, nil
+}
+
+// youTubeVideoID extracts the ID from watch, youtu.be, /shorts/ and /embed/ URLs
+func youTubeVideoID(videoURL string) string {
+	u, err := url.Parse(videoURL)
+	if err != nil {
+		return ""
+	}
+	path := strings.Trim(u.Path, "/")
+	if strings.Contains(strings.ToLower(u.Host), "youtu.be") {
+		return path
+	}
+	if v := u.Query().Get("v"); v != "" {
+		return v
+	}
+	parts := strings.Split(path, "/")
+	return parts[len(parts)-1]
+}
+
+// youTubeHosts are the domains (and their subdomains) a video URL may point at
+var youTubeHosts = []string{"youtube.com", "youtu.be", "youtube-nocookie.com"}
+
+var errNotYouTubeURL = errors.New("not a YouTube video URL")
+
+// checkYouTubeURL accepts only http(s) URLs on YouTube hosts, so nothing a user sends
+// reaches yt-dlp as an option or makes it fetch another site
+func checkYouTubeURL(videoURL string) error {
+	u, err := url.Parse(videoURL)
+	if err != nil || (u.Scheme != "https" && u.Scheme != "http") || u.User != nil {
+		return errNotYouTubeURL
+	}
+	host := strings.ToLower(u.Hostname())
+	for _, h := range youTubeHosts {
+		if host == h || strings.HasSuffix(host, "."+h) {
+			return nil
+		}
+	}
+	return errNotYouTubeURL
+}
+
+// youTubeFetcherRegistry builds the strategies YOUTUBE_FETCHERS can name
+var youTubeFetcherRegistry = map[string]func() AudioFetcher{
+	"web": func() AudioFetcher {
+		// strict non-HLS preference avoids 403s on m3u8 fragments
+		return &ytdlpFetcher{name: "web", extractorArgs: "youtube:player_client=web", format: "bestaudio[ext=m4a]/bestaudio[protocol!=m3u8]/bestaudio/best"}
+	},
+	"web-simple": func() AudioFetcher {
+		return &ytdlpFetcher{name: "web-simple", extractorArgs: "youtube:player_client=web", format: "bestaudio/best"}
+	},
+	"android": func() AudioFetcher {
+		return &ytdlpFetcher{name: "android", extractorArgs: "youtube:player_client=android", format: "bestaudio[ext=m4a]/bestaudio/best"}
+	},
+	"ios": func() AudioFetcher {
+		return &ytdlpFetcher{name: "ios", extractorArgs: "youtube:player_client=ios", format: "bestaudio[ext=m4a]/bestaudio/best"}
+	},
+	"tvhtml5": func() AudioFetcher {
+		return &ytdlpFetcher{name: "tvhtml5", extractorArgs: "youtube:player_client=tvhtml5", format: "bestaudio[ext=m4a]/bestaudio/best"}
+	},
+	"chrome-cookies": func() AudioFetcher {
+		return &ytdlpFetcher{
+			name:           "chrome-cookies",
+			extractorArgs:  "youtube:player_client=web,youtube:skip=hls",
+			format:         "bestaudio[ext=m4a]/bestaudio/best",
+			userAgent:      "Mozilla/5.0 (Windows NT 10.0; Win64; x64) AppleWebKit/537.36 (KHTML, like Gecko) Chrome/120.0.0.0 Safari/537.36",
+			browserCookies: true,
+		}
+	},
+	"piped": func() AudioFetcher {
+		base := getEnvOrFile("PIPED_INSTANCE")
+		if base == "" {
+			base = "https://piped.video"
+		}
+		return &pipedFetcher{base: base, client: &http.Client{Timeout: 10 * time.Minute}}
+	},
+}
+
+// FetcherStats is the track record of one strategy on this instance
+type FetcherStats struct {
+	Strategy    string     `json:"strategy"`
+	Attempts    int        `json:"attempts"`
+	Successes   int        `json:"successes"`
+	Reliability float64    `json:"reliability"` // moving average of outcomes, 0..1
+	LastError   string     `json:"last_error,omitempty"`
+	LastUsedAt  *time.Time `json:"last_used_at,omitempty"`
+}
+
+// FetcherChain tries its strategies, most reliable first, until one produces a file
+type FetcherChain struct {
+	mu       sync.Mutex
+	fetchers []AudioFetcher // configured order, breaks ties
+	stats    map[string]*FetcherStats
+}
+
+// audioFetchers is the chain configured at startup
+var audioFetchers *FetcherChain
+
+func NewFetcherChain(fetchers ...AudioFetcher) *FetcherChain {
+	c := &FetcherChain{fetchers: fetchers, stats: map[string]*FetcherStats{}}
+	for _, f := range fetchers {
+		// Every strategy starts in the middle so a single failure does not bury it
+		c.stats[f.Name()] = &FetcherStats{Strategy: f.Name(), Reliability: 0.5}
+	}
+	return c
+}
+
+// newFetcherChainFromEnv builds the chain named by YOUTUBE_FETCHERS (comma-separated)
+func newFetcherChainFromEnv() (*FetcherChain, error) {
+	spec := getEnvOrFile("YOUTUBE_FETCHERS")
+	if spec == "" {
+		spec = defaultYouTubeFetchers
+	}
+	var fetchers []AudioFetcher
+	seen := map[string]bool{}
+	for _, name := range strings.Split(spec, ",") {
+		name = strings.TrimSpace(name)
+		if name == "" || seen[name] {
+			continue
+		}
+		build, ok := youTubeFetcherRegistry[name]
+		if !ok {
+			return nil, fmt.Errorf("unknown YouTube fetcher %q (expected %s)", name, defaultYouTubeFetchers)
+		}
+		seen[name] = true
+		fetchers = append(fetchers, build())
+	}
+	if len(fetchers) == 0 {
+		return nil, errors.New("YOUTUBE_FETCHERS names no strategies")
+	}
+	return NewFetcherChain(fetchers...), nil
+}
+
+// ordered returns the strategies by reliability, keeping the configured order on ties
+func (c *FetcherChain) ordered() []AudioFetcher {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	out := append([]AudioFetcher(nil), c.fetchers...)
+	sort.SliceStable(out, func(i, j int) bool {
+		return c.stats[out[i].Name()].Reliability > c.stats[out[j].Name()].Reliability
+	})
+	return out
+}
+
+func (c *FetcherChain) record(name string, err error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	s := c.stats[name]
+	now := time.Now()
+	s.Attempts++
+	s.LastUsedAt = &now
+	outcome := 0.0
+	if err == nil {
+		s.Successes++
+		outcome = 1
+	} else {
+		s.LastError = err.Error()
+	}
+	s.Reliability = s.Reliability*(1-reliabilityWeight) + outcome*reliabilityWeight
+}
+
+// Stats returns a snapshot of every strategy's record, in the order they are tried
+func (c *FetcherChain) Stats() []FetcherStats {
+	order := c.ordered()
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	out := make([]FetcherStats, 0, len(order))
+	for _, f := range order {
+		out = append(out, *c.stats[f.Name()])
+	}
+	return out
+}
+
+// Fetch runs the strategies until one succeeds. On failure the *ytDownloadError lists
+// every attempt with its output; it is marked AuthRequired when any attempt hit a sign-in wall.
+// URLs that checkYouTubeURL rejects are refused before any strategy runs.
+func (c *FetcherChain) Fetch(videoURL, dir string) (string, error) {
+	if err := checkYouTubeURL(videoURL); err != nil {
+		return "", err
+	}
+	var attempts []FetchAttempt
+	for _, f := range c.ordered() {
+		ctx, cancel := context.WithTimeout(context.Background(), fetchAttemptTimeout)
+		start := time.Now()
+		path, err := f.Fetch(ctx, videoURL, dir)
+		cancel()
+		c.record(f.Name(), err)
+		if err == nil {
+			log.Printf("YouTube fetch: strategy=%s succeeded in %s", f.Name(), time.Since(start).Round(time.Millisecond))
+			return path, nil
+		}
+
+		a := FetchAttempt{Strategy: f.Name(), DurationMS: time.Since(start).Milliseconds(), Error: err.Error()}
+		var fe *fetchError
+		if errors.As(err, &fe) {
+			a.Output = fe.Output
+		}
+		a.AuthRequired = isYouTubeAuthError(a.Output) || isYouTubeAuthError(a.Error)
+		log.Printf("YouTube fetch: strategy=%s failed: %v; output: %s", f.Name(), err, a.Output)
+		attempts = append(attempts, a)
+	}
+	return "", newYTDownloadError(attempts)
+}
+
+// handleAdminYouTubeFetchers shows the strategies' track record on this instance
+func handleAdminYouTubeFetchers(w http.ResponseWriter, r *http.Request) {
+	JSONSuccess(w, map[string]interface{}{"fetchers": audioFetchers.Stats()})
+}
+
+// ytdlpCookieFileArgs returns the yt-dlp flags for the cookies.txt in YTDLP_COOKIES
+// (a path or the file's contents), nil when none is configured
+func ytdlpCookieFileArgs() []string {
+	cp := getEnvOrFile("YTDLP_COOKIES")
+	if cp == "" {
+		return nil
+	}
+	if _, err := os.Stat(cp); err == nil {
+		// случай 1: YTDLP_COOKIES = путь к файлу
+		return []string{"--cookies", cp}
+	}
+	// случай 2: YTDLP_COOKIES = содержимое
+	tmp := "/tmp/yt-cookies.txt"
+	if err := os.WriteFile(tmp, []byte(cp), 0o600); err != nil {
+		log.Printf("ERROR: failed to write cookies from env to file: %v", err)
+		return nil
+	}
+	return []string{"--cookies", tmp}
+}
+
+// downloadYouTubeAudio downloads the audio track of videoURL into dir with the
+// configured strategy chain. Returns the path of the produced file or *ytDownloadError.
+func downloadYouTubeAudio(videoURL, dir string) (string, error) {
+	return audioFetchers.Fetch(videoURL, dir)
+}
@@ -0,0 +1,248 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"testing"
+
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// fakeYTDLP is a yt-dlp stand-in: it appends the player client of every run to
+// $FAKE_YTDLP_LOG, writes the mp3 for clients in $FAKE_YTDLP_OK, hits the sign-in wall
+// for clients in $FAKE_YTDLP_AUTH and fails with a 403 otherwise. It refuses to run
+// unless the URL comes after "--".
+const fakeYTDLP = `#!/bin/sh
+client=""; out=""; url=""
+while [ $# -gt 0 ]; do
+	case "$1" in
+	--extractor-args) client="${2#youtube:player_client=}"; shift ;;
+	-o) out="$2"; shift ;;
+	--) url="$2"; shift ;;
+	esac
+	shift
+done
+if [ -z "$url" ]; then
+	echo "ERROR: no URL after --" >&2
+	exit 2
+fi
+echo "$client" >> "$FAKE_YTDLP_LOG"
+echo "[youtube] extracting with the $client client"
+case " $FAKE_YTDLP_OK " in *" $client "*)
+	: > "$(echo "$out" | sed 's/%(ext)s/mp3/')"
+	exit 0 ;;
+esac
+case " $FAKE_YTDLP_AUTH " in *" $client "*)
+	echo "ERROR: [youtube] abc: Sign in to confirm you’re not a bot" >&2
+	exit 1 ;;
+esac
+echo "ERROR: unable to download video data: HTTP Error 403: Forbidden" >&2
+exit 1
+`
+
+// useFakeYTDLP installs fakeYTDLP as YTDLP_BIN for the chain named by fetchers and
+// returns a function listing the player clients it was run with, in order
+func useFakeYTDLP(t *testing.T, fetchers string) (*FetcherChain, func() []string) {
+	t.Helper()
+	if runtime.GOOS == "windows" {
+		t.Skip("the fake yt-dlp is a shell script")
+	}
+	dir := t.TempDir()
+	bin := filepath.Join(dir, "yt-dlp")
+	if err := os.WriteFile(bin, []byte(fakeYTDLP), 0o755); err != nil {
+		t.Fatal(err)
+	}
+	logPath := filepath.Join(dir, "runs.log")
+	t.Setenv("YTDLP_BIN", bin)
+	t.Setenv("YTDLP_COOKIES", "")
+	t.Setenv("YOUTUBE_FETCHERS", fetchers)
+	t.Setenv("FAKE_YTDLP_LOG", logPath)
+	t.Setenv("FAKE_YTDLP_OK", "")
+	t.Setenv("FAKE_YTDLP_AUTH", "")
+
+	chain, err := newFetcherChainFromEnv()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return chain, func() []string {
+		b, _ := os.ReadFile(logPath)
+		return strings.Fields(string(b))
+	}
+}
+
+func strategies(stats []FetcherStats) []string {
+	var out []string
+	for _, s := range stats {
+		out = append(out, s.Strategy)
+	}
+	return out
+}
+
+func TestFetcherChainRecordsEveryAttempt(t *testing.T) {
+	chain, runs := useFakeYTDLP(t, "web,android,ios")
+
+	_, err := chain.Fetch("https://youtu.be/abc", t.TempDir())
+	var ytErr *ytDownloadError
+	if !errors.As(err, &ytErr) {
+		t.Fatalf("error = %v, want *ytDownloadError", err)
+	}
+	if got := strings.Join(runs(), ","); got != "web,android,ios" {
+		t.Fatalf("runs = %s, want the configured order", got)
+	}
+	if len(ytErr.Attempts) != 3 {
+		t.Fatalf("attempts = %+v", ytErr.Attempts)
+	}
+	for i, want := range []string{"web", "android", "ios"} {
+		a := ytErr.Attempts[i]
+		if a.Strategy != want || a.AuthRequired || !strings.Contains(a.Error, "exit status 1") ||
+			!strings.Contains(a.Output, "the "+want+" client") || !strings.Contains(a.Output, "HTTP Error 403") {
+			t.Errorf("attempt %d = %+v", i+1, a)
+		}
+		if !strings.Contains(ytErr.Details, a.Output) {
+			t.Errorf("details miss the output of attempt %d", i+1)
+		}
+	}
+	if ytErr.AuthRequired {
+		t.Fatal("no attempt hit the sign-in wall")
+	}
+}
+
+func TestFetcherChainStopsAtFirstSuccess(t *testing.T) {
+	chain, runs := useFakeYTDLP(t, "web,android,ios")
+	t.Setenv("FAKE_YTDLP_OK", "android")
+
+	dir := t.TempDir()
+	path, err := chain.Fetch("https://youtu.be/abc", dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if filepath.Dir(path) != dir || filepath.Ext(path) != ".mp3" || !fileExists(path) {
+		t.Fatalf("path = %s", path)
+	}
+	if got := strings.Join(runs(), ","); got != "web,android" {
+		t.Fatalf("runs = %s, want web,android", got)
+	}
+}
+
+func TestFetcherChainAuthRequiredFromAnyAttempt(t *testing.T) {
+	chain, _ := useFakeYTDLP(t, "web,android,ios")
+	// Only the second strategy hits the sign-in wall
+	t.Setenv("FAKE_YTDLP_AUTH", "android")
+
+	_, err := chain.Fetch("https://youtu.be/abc", t.TempDir())
+	var ytErr *ytDownloadError
+	if !errors.As(err, &ytErr) {
+		t.Fatalf("error = %v, want *ytDownloadError", err)
+	}
+	if !ytErr.AuthRequired || !strings.Contains(ytErr.Error(), "authentication") {
+		t.Fatalf("error = %q, want it marked AuthRequired", ytErr.Error())
+	}
+	for i, want := range []bool{false, true, false} {
+		if ytErr.Attempts[i].AuthRequired != want {
+			t.Errorf("attempt %d (%s) AuthRequired = %v", i+1, ytErr.Attempts[i].Strategy, !want)
+		}
+	}
+}
+
+func TestFetcherChainPrefersReliableStrategies(t *testing.T) {
+	chain, runs := useFakeYTDLP(t, "web,android,ios")
+	dir := t.TempDir()
+
+	t.Setenv("FAKE_YTDLP_OK", "android")
+	if _, err := chain.Fetch("https://youtu.be/abc", dir); err != nil {
+		t.Fatal(err)
+	}
+	// web failed and sinks below the untried ios
+	if got := strings.Join(strategies(chain.Stats()), ","); got != "android,ios,web" {
+		t.Fatalf("order after the first fetch = %s", got)
+	}
+	if _, err := chain.Fetch("https://youtu.be/abc", dir); err != nil {
+		t.Fatal(err)
+	}
+
+	// android breaks: it is still tried first, then ios takes over the lead
+	t.Setenv("FAKE_YTDLP_OK", "ios")
+	if _, err := chain.Fetch("https://youtu.be/abc", dir); err != nil {
+		t.Fatal(err)
+	}
+	if got := strings.Join(runs(), ","); got != "web,android,android,android,ios" {
+		t.Fatalf("runs = %s", got)
+	}
+	stats := chain.Stats()
+	if got := strings.Join(strategies(stats), ","); got != "ios,android,web" {
+		t.Fatalf("order = %s, want ios,android,web", got)
+	}
+	want := map[string][2]int{"ios": {1, 1}, "android": {3, 2}, "web": {1, 0}}
+	for _, s := range stats {
+		if w := want[s.Strategy]; s.Attempts != w[0] || s.Successes != w[1] {
+			t.Errorf("%s: %d attempts, %d successes; want %d, %d", s.Strategy, s.Attempts, s.Successes, w[0], w[1])
+		}
+	}
+	if !strings.Contains(stats[1].LastError, "exit status 1") {
+		t.Errorf("android last error = %q", stats[1].LastError)
+	}
+}
+
+func TestCheckYouTubeURL(t *testing.T) {
+	tests := []struct {
+		url string
+		ok  bool
+	}{
+		{"https://www.youtube.com/watch?v=abc", true},
+		{"https://youtu.be/abc", true},
+		{"http://m.youtube.com/shorts/abc", true},
+		{"https://music.YouTube.com/watch?v=abc", true},
+		{"https://www.youtube-nocookie.com/embed/abc", true},
+		{"--exec=touch /tmp/pwned", false},
+		{"-o/etc/passwd", false},
+		{"file:///etc/passwd", false},
+		{"ftp://youtube.com/abc", false},
+		{"https://example.com/watch?v=abc", false},
+		{"https://youtube.com.example.com/watch?v=abc", false},
+		{"https://notyoutube.com/watch?v=abc", false},
+		{"https://user@youtube.com/watch?v=abc", false},
+		{"youtube.com/watch?v=abc", false},
+	}
+	for _, tt := range tests {
+		if err := checkYouTubeURL(tt.url); (err == nil) != tt.ok {
+			t.Errorf("checkYouTubeURL(%q) = %v, want ok = %v", tt.url, err, tt.ok)
+		}
+	}
+}
+
+func TestFetchYouTubeCaptionsRejectsOtherURLs(t *testing.T) {
+	// yt-dlp must not even be started
+	t.Setenv("YTDLP_BIN", filepath.Join(t.TempDir(), "missing"))
+	if _, err := fetchYouTubeCaptions("--exec=id", "", CaptionsAuto); !errors.Is(err, errNotYouTubeURL) {
+		t.Fatalf("error = %v, want errNotYouTubeURL", err)
+	}
+}
+
+func TestFetcherChainRejectsOtherURLs(t *testing.T) {
+	chain, runs := useFakeYTDLP(t, "web,android")
+	if _, err := chain.Fetch("--exec=id", t.TempDir()); !errors.Is(err, errNotYouTubeURL) {
+		t.Fatalf("error = %v, want errNotYouTubeURL", err)
+	}
+	if got := runs(); len(got) != 0 {
+		t.Fatalf("yt-dlp ran with %v", got)
+	}
+}
+
+func TestTranscribeYouTubeRejectsOtherURLs(t *testing.T) {
+	for _, u := range []string{"--exec=id", "https://example.com/video.mp4", "file:///etc/passwd"} {
+		body, _ := json.Marshal(map[string]string{"url": u})
+		r := withAuth(httptest.NewRequest(http.MethodPost, "/api/transcribe-youtube", bytes.NewReader(body)), primitive.NewObjectID())
+		w := httptest.NewRecorder()
+		handleTranscribeYouTube(w, r)
+		if w.Code != http.StatusBadRequest {
+			t.Errorf("url %q = %d, want 400", u, w.Code)
+		}
+	}
+}
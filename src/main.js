@@ -3,6 +3,9 @@ import App from './App.vue'
 import router from './router'
 import './style.css'
 import { initAllAnimations } from './animations.js'
+import { installSessionRefresh } from './session.js'
+
+installSessionRefresh()
 
 const app = createApp(App)
 app.use(router)
@@ -5,6 +5,10 @@ import SignIn from './SignIn.vue'
 import Dashboard from './Dashboard.vue'
 import NoteView from './NoteView.vue'
 import Settings from './Settings.vue'
+import Pricing from './Pricing.vue'
+import EmailAction from './EmailAction.vue'
+import OIDCCallback from './OIDCCallback.vue'
+import TwoFactor from './TwoFactor.vue'
 
 
 const routes = [
@@ -42,6 +46,40 @@ const routes = [
     component: Settings,
     meta: { requiresAuth: true }
   },
+  {
+    path: '/pricing',
+    name: 'Pricing',
+    component: Pricing,
+    meta: { requiresAuth: true }
+  },
+  {
+    path: '/verify-email',
+    name: 'VerifyEmail',
+    component: EmailAction,
+    props: { mode: 'verify' }
+  },
+  {
+    path: '/forgot-password',
+    name: 'ForgotPassword',
+    component: EmailAction,
+    props: { mode: 'forgot' }
+  },
+  {
+    path: '/reset-password',
+    name: 'ResetPassword',
+    component: EmailAction,
+    props: { mode: 'reset' }
+  },
+  {
+    path: '/auth/oidc/callback',
+    name: 'OIDCCallback',
+    component: OIDCCallback
+  },
+  {
+    path: '/two-factor',
+    name: 'TwoFactor',
+    component: TwoFactor
+  },
  
   // ,
   // {
@@ -0,0 +1,75 @@
+// Сессия: короткий access-токен (token) + одноразовый refresh-токен (refreshToken).
+// fetch к /api с истёкшим access-токеном один раз обновляет пару через /api/auth/refresh и повторяет запрос.
+
+export function saveSession(data) {
+  if (!data) return
+  if (data.token) localStorage.setItem('token', data.token)
+  if (data.refresh_token) localStorage.setItem('refreshToken', data.refresh_token)
+}
+
+// Вход с 2FA: вместо токенов сервер вернул challenge_token — переходим ко второму шагу
+export function startTwoFactor(router, data) {
+  if (!data || !data.two_factor_required) return false
+  sessionStorage.setItem('twoFactorChallenge', data.challenge_token)
+  router.push('/two-factor')
+  return true
+}
+
+export function clearSession() {
+  const refreshToken = localStorage.getItem('refreshToken')
+  const token = localStorage.getItem('token')
+  if (refreshToken || token) {
+    fetch('/api/auth/logout', {
+      method: 'POST',
+      headers: {
+        'Content-Type': 'application/json',
+        ...(token ? { 'Authorization': 'Bearer ' + token } : {})
+      },
+      body: JSON.stringify({ refresh_token: refreshToken || '' })
+    }).catch(() => {})
+  }
+  localStorage.removeItem('token')
+  localStorage.removeItem('refreshToken')
+  localStorage.removeItem('user')
+}
+
+let refreshing = null
+
+// Одновременные 401 ждут одного обновления: refresh-токен одноразовый
+function refreshSession(nativeFetch) {
+  if (!refreshing) {
+    const refreshToken = localStorage.getItem('refreshToken')
+    refreshing = (refreshToken
+      ? nativeFetch('/api/auth/refresh', {
+          method: 'POST',
+          headers: { 'Content-Type': 'application/json' },
+          body: JSON.stringify({ refresh_token: refreshToken })
+        }).then(async (resp) => {
+          if (!resp.ok) return false
+          saveSession(await resp.json())
+          return true
+        }).catch(() => false)
+      : Promise.resolve(false)
+    ).finally(() => { refreshing = null })
+  }
+  return refreshing
+}
+
+export function installSessionRefresh() {
+  const nativeFetch = window.fetch.bind(window)
+  window.fetch = async (input, init = {}) => {
+    const resp = await nativeFetch(input, init)
+    const url = typeof input === 'string' ? input : input.url
+    const headers = new Headers(init.headers || {})
+    if (resp.status !== 401 || !url.startsWith('/api/') || url.startsWith('/api/auth/') || !headers.has('Authorization')) {
+      return resp
+    }
+    if (!(await refreshSession(nativeFetch))) {
+      localStorage.removeItem('token')
+      localStorage.removeItem('refreshToken')
+      return resp
+    }
+    headers.set('Authorization', 'Bearer ' + localStorage.getItem('token'))
+    return nativeFetch(input, { ...init, headers })
+  }
+}
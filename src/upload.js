@@ -0,0 +1,92 @@
+// Возобновляемая загрузка записи по протоколу tus 1.0.0 (/api/uploads): файл уходит частями,
+// после обрыва связи загрузка продолжается с подтверждённого сервером смещения, а не с нуля.
+// Последняя часть превращает загрузку в задачу транскрипции (заголовок Upload-Job-Id).
+
+const TUS_VERSION = '1.0.0'
+const CHUNK_SIZE = 5 * 1024 * 1024
+const RETRY_DELAYS = [1000, 3000, 5000, 10000, 20000]
+
+function tusHeaders(extra = {}) {
+  const token = localStorage.getItem('token')
+  return {
+    'Tus-Resumable': TUS_VERSION,
+    ...(token ? { 'Authorization': 'Bearer ' + token } : {}),
+    ...extra
+  }
+}
+
+// Upload-Metadata: пары "ключ base64(значение)" через запятую
+function encodeMetadata(meta) {
+  return Object.entries(meta)
+    .filter(([, v]) => v)
+    .map(([k, v]) => k + ' ' + btoa(unescape(encodeURIComponent(v))))
+    .join(',')
+}
+
+// Ошибка с телом ответа сервера: message и details (например, upgrade_required)
+async function uploadError(resp, fallback) {
+  const err = new Error(fallback)
+  err.status = resp.status
+  try {
+    const body = await resp.json()
+    err.message = body.message || fallback
+    err.details = body.details
+  } catch (_) {}
+  // Конфликт смещения, занятая загрузка и сбои сервера лечатся повтором с актуального смещения
+  err.retryable = resp.status === 409 || resp.status === 423 || resp.status >= 500
+  return err
+}
+
+const sleep = (ms) => new Promise((resolve) => setTimeout(resolve, ms))
+
+// resumableUpload загружает blob и возвращает { jobId } созданной задачи.
+// onProgress(sent, total) вызывается после каждой подтверждённой части.
+export async function resumableUpload(blob, { filename, metadata = {}, onProgress } = {}) {
+  const create = await fetch('/api/uploads', {
+    method: 'POST',
+    headers: tusHeaders({
+      'Upload-Length': String(blob.size),
+      'Upload-Metadata': encodeMetadata({ filename, ...metadata })
+    })
+  })
+  if (create.status !== 201) throw await uploadError(create, 'Upload failed')
+  const location = create.headers.get('Location')
+
+  let offset = 0
+  let attempt = 0
+  for (;;) {
+    try {
+      const resp = await fetch(location, {
+        method: 'PATCH',
+        headers: tusHeaders({
+          'Content-Type': 'application/offset+octet-stream',
+          'Upload-Offset': String(offset)
+        }),
+        body: blob.slice(offset, Math.min(offset + CHUNK_SIZE, blob.size))
+      })
+      if (resp.status !== 204) throw await uploadError(resp, 'Upload failed')
+      offset = Number(resp.headers.get('Upload-Offset'))
+      attempt = 0
+      if (onProgress) onProgress(offset, blob.size)
+      if (offset >= blob.size) return { jobId: resp.headers.get('Upload-Job-Id') }
+    } catch (e) {
+      // TypeError — сетевой сбой fetch
+      if (!(e instanceof TypeError || e.retryable) || attempt >= RETRY_DELAYS.length) throw e
+      await sleep(RETRY_DELAYS[attempt++])
+      try {
+        const head = await fetch(location, { method: 'HEAD', headers: tusHeaders() })
+        if (head.ok) {
+          offset = Number(head.headers.get('Upload-Offset'))
+          const jobId = head.headers.get('Upload-Job-Id')
+          if (jobId) return { jobId }
+          if (offset >= blob.size) throw new Error('Upload failed')
+          if (onProgress) onProgress(offset, blob.size)
+        } else if (head.status === 404 || head.status === 410) {
+          throw await uploadError(head, 'Upload expired, please try again')
+        }
+      } catch (headErr) {
+        if (!(headErr instanceof TypeError)) throw headErr
+      }
+    }
+  }
+}